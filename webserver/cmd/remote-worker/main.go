@@ -0,0 +1,181 @@
+// remote-worker 是远程生成 worker 的参考实现：从服务端领取 image.generate 任务，调用本机的
+// 文生图后端生成后上传结果。GPU 主机只需能访问服务端即可（可以在 NAT 之后）。
+//
+// 用法：
+//
+//	REMOTE_WORKER_TOKEN=... go run ./cmd/remote-worker -server https://api.example.com -backend http://localhost:8000
+//
+// 其他 TextToImageProvider 实现只需替换 main 中的 provider。
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const workerVersion = "1.0.0"
+
+func main() {
+	hostname, _ := os.Hostname()
+
+	server := flag.String("server", getEnv("REMOTE_WORKER_SERVER", "http://localhost:8080"), "服务端地址")
+	token := flag.String("token", getEnv("REMOTE_WORKER_TOKEN", ""), "服务端的 REMOTE_WORKER_TOKEN")
+	id := flag.String("id", getEnv("REMOTE_WORKER_ID", hostname), "worker ID，同一服务端下唯一")
+	backend := flag.String("backend", getEnv("IMAGE_GEN_URL", "http://localhost:8000"), "文生图后端地址")
+	concurrency := flag.Int("concurrency", 1, "同时执行的任务数")
+	maxPixels := flag.Int("max-pixels", 0, "单张图片最大像素数（width × height），0 表示不限制")
+	maxSteps := flag.Int("max-steps", 0, "最大推理步数，0 表示不限制")
+	models := flag.String("models", "", "可用模型，逗号分隔；为空时只领取没有指定模型的任务")
+	model := flag.String("model", getEnv("IMAGE_GEN_MODEL", "qwen-image-gguf"), "后端的默认模型，任务没有指定模型时按此记录")
+	leaseWait := flag.Duration("lease-wait", defaultLeaseWait, "没有任务时的长轮询等待")
+	flag.Parse()
+
+	provider := newHTTPImageProvider(*backend, *model)
+	caps := Capabilities{MaxPixels: *maxPixels, MaxSteps: *maxSteps}
+	for _, name := range strings.Split(*models, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			caps.Models = append(caps.Models, name)
+		}
+	}
+
+	worker, err := NewWorker(Config{
+		ServerURL:    *server,
+		Token:        *token,
+		WorkerID:     *id,
+		Version:      workerVersion,
+		Capabilities: caps,
+		Concurrency:  *concurrency,
+		LeaseWait:    *leaseWait,
+	}, provider)
+	if err != nil {
+		log.Fatalf("Failed to create worker: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Remote worker %s pulling tasks from %s (backend %s, concurrency %d)", *id, *server, *backend, *concurrency)
+	worker.Run(ctx)
+	log.Println("Remote worker stopped")
+}
+
+func getEnv(key, defaultValue string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return defaultValue
+}
+
+// httpImageProvider 调用与 internal/qwen_image_gguf.go 相同协议的 Python 端点（/ping、/generate）
+type httpImageProvider struct {
+	baseURL string
+	model   string // 默认模型
+	client  *http.Client
+}
+
+func newHTTPImageProvider(baseURL, model string) *httpImageProvider {
+	// 生成耗时由租约截止时间控制，client 不设置整体超时
+	return &httpImageProvider{baseURL: strings.TrimRight(baseURL, "/"), model: model, client: &http.Client{}}
+}
+
+func (p *httpImageProvider) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/ping", nil)
+	if err != nil {
+		return fmt.Errorf("create ping request: %w", err)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("execute ping request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var payload struct {
+		Status string `json:"status"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ping failed: status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return fmt.Errorf("decode ping response: %w", err)
+	}
+	if !strings.EqualFold(payload.Status, "ready") {
+		return fmt.Errorf("model not ready: %s", payload.Status)
+	}
+	return nil
+}
+
+func (p *httpImageProvider) Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error) {
+	var empty TextToImageResponse
+	steps := req.Steps
+	if steps <= 0 {
+		steps = 20
+	}
+	payload := map[string]interface{}{
+		"prompt":              req.Prompt,
+		"negative_prompt":     req.NegativePrompt,
+		"num_inference_steps": steps,
+		"width":               req.Width,
+		"height":              req.Height,
+		"seed":                req.Seed,
+	}
+	// 只在任务指定模型时发送，单模型的端点不需要处理这个字段
+	if req.Model != "" {
+		payload["model"] = req.Model
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return empty, fmt.Errorf("marshal generate payload: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/generate", bytes.NewReader(body))
+	if err != nil {
+		return empty, fmt.Errorf("create generate request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return empty, fmt.Errorf("execute generate request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return empty, fmt.Errorf("generate failed: status %d, body: %s", resp.StatusCode, detail)
+	}
+	imageData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return empty, fmt.Errorf("read image payload: %w", err)
+	}
+	if len(imageData) == 0 {
+		return empty, errors.New("backend returned an empty image")
+	}
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = "image/jpeg"
+	}
+	return TextToImageResponse{ImageData: imageData, MimeType: mimeType}, nil
+}
+
+// InstanceName 返回后端地址，服务端记录为 remote:<worker>/<backend>
+func (p *httpImageProvider) InstanceName() string { return p.baseURL }
+
+// ModelName 返回后端的默认模型名称
+func (p *httpImageProvider) ModelName() string { return p.model }
+
+// 确保参考实现满足 worker 的可选接口
+var (
+	_ TextToImageProvider = (*httpImageProvider)(nil)
+	_ ProviderInfo        = (*httpImageProvider)(nil)
+)
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 远程 worker 客户端
+// ======================
+//
+// 按服务端 /api/v1/workers 协议（见 internal/remote_workers.go）循环：领取任务 → 调用
+// TextToImageProvider 生成 → 上传结果或报告失败，执行期间定期发送心跳。心跳返回 409 说明租约已被
+// 回收，立即取消生成。服务端只需要能被 worker 访问到，worker 可以在 NAT 之后。
+//
+
+const (
+	workerIDHeader       = "X-Worker-ID"
+	defaultLeaseWait     = 20 * time.Second // 长轮询等待，服务端会限制在自己的上限内
+	defaultErrorBackoff  = 5 * time.Second  // 领取或上报出错后的等待
+	defaultHeartbeatTick = 10 * time.Second
+	requestTimeout       = 30 * time.Second // 非长轮询请求的超时
+)
+
+// errLeaseLost 服务端已回收租约（409），结果不会再被接受
+var errLeaseLost = errors.New("lease lost")
+
+// TextToImageRequest 与服务端的文生图请求相同
+type TextToImageRequest struct {
+	Prompt         string `json:"prompt"`
+	Model          string `json:"model,omitempty"` // 任务要求的模型，为空时使用后端的默认模型
+	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	Steps          int    `json:"steps,omitempty"`
+	Seed           int64  `json:"seed,omitempty"`
+}
+
+// TextToImageResponse 与服务端的文生图响应相同
+type TextToImageResponse struct {
+	ImageData []byte
+	MimeType  string
+}
+
+// TextToImageProvider 与服务端 internal/endpoint_interface.go 中的接口相同，任何实现都可以包装为远程 worker
+type TextToImageProvider interface {
+	Ping(ctx context.Context) error
+	Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error)
+}
+
+// ProviderInfo 可选接口，上传结果时附带后端实例和模型；ModelName 为没有指定模型时使用的默认模型
+type ProviderInfo interface {
+	InstanceName() string
+	ModelName() string
+}
+
+// Capabilities 向服务端声明的能力，零值字段表示不限制
+type Capabilities struct {
+	Kinds     []string `json:"kinds,omitempty"`
+	Models    []string `json:"models,omitempty"`
+	MaxPixels int      `json:"max_pixels,omitempty"`
+	MaxSteps  int      `json:"max_steps,omitempty"`
+}
+
+// Lease 服务端分配的任务
+type Lease struct {
+	TaskID                   string          `json:"task_id"`
+	Kind                     string          `json:"kind"`
+	Attempt                  int             `json:"attempt"`
+	Input                    json.RawMessage `json:"input"`
+	Deadline                 time.Time       `json:"deadline"`
+	HeartbeatIntervalSeconds int             `json:"heartbeat_interval_seconds"`
+}
+
+// Config worker 配置
+type Config struct {
+	ServerURL    string // 服务端地址，如 https://api.example.com
+	Token        string // 服务端的 REMOTE_WORKER_TOKEN
+	WorkerID     string
+	Version      string
+	Capabilities Capabilities
+	Concurrency  int           // 同时执行的任务数，默认 1
+	LeaseWait    time.Duration // 长轮询等待
+	ErrorBackoff time.Duration
+	Client       *http.Client
+}
+
+// Worker 包装 TextToImageProvider 的远程 worker
+type Worker struct {
+	cfg      Config
+	provider TextToImageProvider
+	client   *http.Client
+}
+
+// NewWorker 创建远程 worker
+func NewWorker(cfg Config, provider TextToImageProvider) (*Worker, error) {
+	if cfg.ServerURL == "" || cfg.Token == "" || cfg.WorkerID == "" {
+		return nil, errors.New("server url, token and worker id are required")
+	}
+	if provider == nil {
+		return nil, errors.New("provider is required")
+	}
+	cfg.ServerURL = strings.TrimRight(cfg.ServerURL, "/")
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.LeaseWait <= 0 {
+		cfg.LeaseWait = defaultLeaseWait
+	}
+	if cfg.ErrorBackoff <= 0 {
+		cfg.ErrorBackoff = defaultErrorBackoff
+	}
+	if len(cfg.Capabilities.Kinds) == 0 {
+		cfg.Capabilities.Kinds = []string{"image.generate"}
+	}
+	client := cfg.Client
+	if client == nil {
+		// 超时由每个请求的 ctx 控制，长轮询需要比普通请求更长的时间
+		client = &http.Client{}
+	}
+	return &Worker{cfg: cfg, provider: provider, client: client}, nil
+}
+
+// Run 启动 Concurrency 个循环直到 ctx 结束；正在执行的任务会作为可重试失败交还服务端
+func (w *Worker) Run(ctx context.Context) error {
+	if err := w.provider.Ping(ctx); err != nil {
+		log.Printf("Warning: backend is not ready: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < w.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if _, err := w.RunOnce(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("Worker %s: %v", w.cfg.WorkerID, err)
+					select {
+					case <-ctx.Done():
+					case <-time.After(w.cfg.ErrorBackoff):
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// RunOnce 领取并执行一个任务，没有任务时返回 false
+func (w *Worker) RunOnce(ctx context.Context) (bool, error) {
+	lease, err := w.lease(ctx)
+	if err != nil || lease == nil {
+		return false, err
+	}
+	return true, w.execute(ctx, lease)
+}
+
+func (w *Worker) lease(ctx context.Context) (*Lease, error) {
+	body := map[string]interface{}{
+		"capabilities": w.cfg.Capabilities,
+		"wait_seconds": int(w.cfg.LeaseWait / time.Second),
+	}
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.LeaseWait+requestTimeout)
+	defer cancel()
+
+	resp, err := w.post(ctx, "/api/v1/workers/lease", body)
+	if err != nil {
+		return nil, fmt.Errorf("lease: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, nil
+	case http.StatusOK:
+		var lease Lease
+		if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+			return nil, fmt.Errorf("decode lease: %w", err)
+		}
+		return &lease, nil
+	default:
+		return nil, fmt.Errorf("lease: %w", responseError(resp))
+	}
+}
+
+// execute 执行领取到的任务并上报结果
+func (w *Worker) execute(ctx context.Context, lease *Lease) error {
+	if lease.Kind != "image.generate" {
+		return w.fail(ctx, lease, fmt.Sprintf("unsupported task kind %q", lease.Kind), false)
+	}
+	var req TextToImageRequest
+	if err := json.Unmarshal(lease.Input, &req); err != nil {
+		return w.fail(ctx, lease, fmt.Sprintf("invalid task input: %v", err), false)
+	}
+
+	taskCtx, cancel := context.WithDeadline(ctx, lease.Deadline)
+	defer cancel()
+
+	var lost bool
+	var mu sync.Mutex
+	stopHeartbeat := w.startHeartbeat(taskCtx, lease, func() {
+		mu.Lock()
+		lost = true
+		mu.Unlock()
+		cancel()
+	})
+
+	start := time.Now()
+	resp, err := w.provider.Generate(taskCtx, req)
+	duration := time.Since(start)
+	stopHeartbeat()
+
+	mu.Lock()
+	leaseLost := lost
+	mu.Unlock()
+	if leaseLost {
+		log.Printf("Worker %s: lease on task %s lost, dropping result", w.cfg.WorkerID, lease.TaskID)
+		return nil
+	}
+
+	if err != nil {
+		// 超过截止时间不再重试；worker 退出或后端故障时交给其他 worker
+		retryable := !errors.Is(taskCtx.Err(), context.DeadlineExceeded)
+		return w.fail(context.WithoutCancel(ctx), lease, err.Error(), retryable)
+	}
+
+	result := map[string]interface{}{
+		"attempt":     lease.Attempt,
+		"image":       resp.ImageData,
+		"mime_type":   resp.MimeType,
+		"duration_ms": duration.Milliseconds(),
+	}
+	// 记录实际使用的模型：任务指定的模型，否则为后端的默认模型
+	if req.Model != "" {
+		result["model"] = req.Model
+	}
+	if info, ok := w.provider.(ProviderInfo); ok {
+		result["backend"] = info.InstanceName()
+		if req.Model == "" {
+			result["model"] = info.ModelName()
+		}
+	}
+	if err := w.report(ctx, lease, "result", result); err != nil {
+		return fmt.Errorf("upload result of task %s: %w", lease.TaskID, err)
+	}
+	log.Printf("Worker %s: task %s completed in %.2fs", w.cfg.WorkerID, lease.TaskID, duration.Seconds())
+	return nil
+}
+
+// startHeartbeat 在任务执行期间定期发送心跳，租约丢失时调用 onLost；返回停止函数
+func (w *Worker) startHeartbeat(ctx context.Context, lease *Lease, onLost func()) func() {
+	interval := time.Duration(lease.HeartbeatIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultHeartbeatTick
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := w.report(ctx, lease, "heartbeat", map[string]int{"attempt": lease.Attempt})
+				if errors.Is(err, errLeaseLost) {
+					onLost()
+					return
+				}
+				if err != nil {
+					log.Printf("Worker %s: heartbeat for task %s: %v", w.cfg.WorkerID, lease.TaskID, err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (w *Worker) fail(ctx context.Context, lease *Lease, msg string, retryable bool) error {
+	log.Printf("Worker %s: task %s failed: %s", w.cfg.WorkerID, lease.TaskID, msg)
+	err := w.report(ctx, lease, "fail", map[string]interface{}{
+		"attempt":   lease.Attempt,
+		"error":     msg,
+		"retryable": retryable,
+	})
+	if err != nil && !errors.Is(err, errLeaseLost) {
+		return fmt.Errorf("report failure of task %s: %w", lease.TaskID, err)
+	}
+	return nil
+}
+
+// report 调用 /api/v1/workers/tasks/{id}/{action}，409 返回 errLeaseLost
+func (w *Worker) report(ctx context.Context, lease *Lease, action string, body interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+
+	resp, err := w.post(ctx, "/api/v1/workers/tasks/"+lease.TaskID+"/"+action, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errLeaseLost
+	default:
+		return responseError(resp)
+	}
+}
+
+func (w *Worker) post(ctx context.Context, path string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.ServerURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+w.cfg.Token)
+	req.Header.Set(workerIDHeader, w.cfg.WorkerID)
+	if w.cfg.Version != "" {
+		req.Header.Set("User-Agent", "remote-worker/"+w.cfg.Version)
+	}
+	return w.client.Do(req)
+}
+
+func responseError(resp *http.Response) error {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("server returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer 模拟服务端的 worker 接口，记录收到的上报
+type fakeServer struct {
+	mu      sync.Mutex
+	leases  []Lease
+	reports map[string]map[string]interface{} // action → 请求体
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get(workerIDHeader) != "gpu-1" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.URL.Path == "/api/v1/workers/lease" {
+		if len(s.leases) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		lease := s.leases[0]
+		s.leases = s.leases[1:]
+		json.NewEncoder(w).Encode(lease)
+		return
+	}
+	action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	s.reports[action] = body
+	w.WriteHeader(http.StatusOK)
+}
+
+// stubProvider 返回固定结果或错误
+type stubProvider struct {
+	err    error
+	prompt string
+	model  string
+}
+
+func (p *stubProvider) Ping(ctx context.Context) error { return nil }
+
+func (p *stubProvider) Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error) {
+	p.prompt = req.Prompt
+	p.model = req.Model
+	if p.err != nil {
+		return TextToImageResponse{}, p.err
+	}
+	return TextToImageResponse{ImageData: []byte("png"), MimeType: "image/png"}, nil
+}
+
+func (p *stubProvider) InstanceName() string { return "http://gpu-1:8000" }
+
+func (p *stubProvider) ModelName() string { return "qwen-image-gguf" }
+
+func newTestWorker(t *testing.T, provider TextToImageProvider, leases ...Lease) (*Worker, *fakeServer) {
+	t.Helper()
+	fake := &fakeServer{leases: leases, reports: map[string]map[string]interface{}{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	worker, err := NewWorker(Config{ServerURL: srv.URL, Token: "secret", WorkerID: "gpu-1", LeaseWait: time.Second}, provider)
+	if err != nil {
+		t.Fatalf("NewWorker: %v", err)
+	}
+	return worker, fake
+}
+
+func testLease(id string) Lease {
+	return Lease{
+		TaskID:   id,
+		Kind:     "image.generate",
+		Attempt:  1,
+		Input:    json.RawMessage(`{"prompt":"a cat","width":512,"height":512}`),
+		Deadline: time.Now().Add(time.Minute),
+	}
+}
+
+func TestWorkerUploadsResult(t *testing.T) {
+	provider := &stubProvider{}
+	worker, fake := newTestWorker(t, provider, testLease("task-1"))
+
+	leased, err := worker.RunOnce(context.Background())
+	if err != nil || !leased {
+		t.Fatalf("RunOnce: %v %v", leased, err)
+	}
+	if provider.prompt != "a cat" {
+		t.Fatalf("unexpected prompt: %q", provider.prompt)
+	}
+	result := fake.reports["result"]
+	// []byte 按 base64 编码："png" → "cG5n"
+	if result == nil || result["image"] != "cG5n" || result["mime_type"] != "image/png" || result["attempt"] != float64(1) {
+		t.Fatalf("unexpected result upload: %+v", result)
+	}
+
+	if leased, err := worker.RunOnce(context.Background()); leased || err != nil {
+		t.Fatalf("expected no task after 204, got %v %v", leased, err)
+	}
+}
+
+func TestWorkerForwardsRequestedModel(t *testing.T) {
+	provider := &stubProvider{}
+	sdxl := testLease("task-1")
+	sdxl.Input = json.RawMessage(`{"prompt":"a cat","model":"sdxl"}`)
+	worker, fake := newTestWorker(t, provider, sdxl, testLease("task-2"))
+
+	worker.RunOnce(context.Background())
+	if provider.model != "sdxl" || fake.reports["result"]["model"] != "sdxl" {
+		t.Fatalf("expected the requested model to reach the backend and the result, got %q, %+v", provider.model, fake.reports["result"])
+	}
+
+	// 没有指定模型时记录后端的默认模型
+	worker.RunOnce(context.Background())
+	if provider.model != "" || fake.reports["result"]["model"] != "qwen-image-gguf" || fake.reports["result"]["backend"] != "http://gpu-1:8000" {
+		t.Fatalf("expected the default model to be reported, got %+v", fake.reports["result"])
+	}
+}
+
+func TestWorkerReportsFailure(t *testing.T) {
+	worker, fake := newTestWorker(t, &stubProvider{err: errors.New("CUDA out of memory")},
+		testLease("task-1"), Lease{TaskID: "task-2", Kind: "video.render", Attempt: 3, Deadline: time.Now().Add(time.Minute)})
+
+	worker.RunOnce(context.Background())
+	fail := fake.reports["fail"]
+	if fail == nil || fail["error"] != "CUDA out of memory" || fail["retryable"] != true {
+		t.Fatalf("expected a retryable failure, got %+v", fail)
+	}
+
+	// 不支持的任务类型不应重试
+	worker.RunOnce(context.Background())
+	fail = fake.reports["fail"]
+	if fail["attempt"] != float64(3) || fail["retryable"] != false || !strings.Contains(fail["error"].(string), "unsupported") {
+		t.Fatalf("expected a permanent failure, got %+v", fail)
+	}
+}
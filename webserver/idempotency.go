@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Idempotency-Key =====
+//
+// 客户端在创建资源的 POST 请求上携带 Idempotency-Key 头：
+//   - 第一次请求正常执行，保存 key、请求指纹和响应
+//   - 窗口期内同一 key、同一请求的重试直接回放保存的响应（带 Idempotent-Replayed: true）
+//   - 同一 key 但请求内容不同返回 422
+//   - 第一次请求仍在处理时的重试返回 409
+//   - 5xx 响应不保存，客户端可以用同一 key 重试
+//   - 响应中只返回一次的密钥（如 callback_secret）不保存，回放的响应中没有这些字段
+
+const (
+	IdempotencyKeyHeader      = "Idempotency-Key"
+	IdempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	defaultIdempotencyWindow  = 24 * time.Hour
+	maxIdempotentRequestBytes = 32 << 20 // 超过该大小的请求体不参与指纹计算，直接返回 413
+)
+
+// idempotencyRedactedFields 保存响应前从 JSON 响应体顶层删除的字段，避免密钥明文留在 idempotency_keys 中
+var idempotencyRedactedFields = []string{"callback_secret"}
+
+// idempotencyWindow 保存响应的时长，可通过 IDEMPOTENCY_WINDOW（如 "24h"）配置
+var idempotencyWindow = parseIdempotencyWindow(getEnv("IDEMPOTENCY_WINDOW", ""))
+
+func parseIdempotencyWindow(raw string) time.Duration {
+	if d, err := time.ParseDuration(raw); err == nil && d > 0 {
+		return d
+	}
+	return defaultIdempotencyWindow
+}
+
+// storedResponse 保存的第一次请求的响应
+type storedResponse struct {
+	fingerprint string
+	statusCode  int
+	contentType string
+	body        []byte
+}
+
+// requestFingerprint 请求指纹：方法、路径、查询参数和请求体
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", r.Method, r.URL.Path, r.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// claimIdempotencyKey 尝试登记 key；已存在时返回之前保存的记录
+func claimIdempotencyKey(userID int64, key, fingerprint string) (*storedResponse, error) {
+	now := time.Now()
+
+	// 顺带清理过期的 key，使窗口外的 key 可以重新使用
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE expires_at <= ?", now); err != nil {
+		return nil, fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+
+	res, err := db.Exec(`
+		INSERT OR IGNORE INTO idempotency_keys (user_id, idem_key, fingerprint, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, userID, key, fingerprint, now, now.Add(idempotencyWindow))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil, nil
+	}
+
+	stored := &storedResponse{}
+	err = db.QueryRow(`
+		SELECT fingerprint, status_code, content_type, COALESCE(response_body, '')
+		FROM idempotency_keys WHERE user_id = ? AND idem_key = ?
+	`, userID, key).Scan(&stored.fingerprint, &stored.statusCode, &stored.contentType, &stored.body)
+	if errors.Is(err, sql.ErrNoRows) {
+		// 刚被并发清理，按新 key 处理
+		return claimIdempotencyKey(userID, key, fingerprint)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load idempotency key: %w", err)
+	}
+	return stored, nil
+}
+
+// saveIdempotentResponse 保存响应；5xx 时释放 key 以便重试
+func saveIdempotentResponse(userID int64, key string, rec *responseRecorder) {
+	var err error
+	if rec.status >= http.StatusInternalServerError {
+		_, err = db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND idem_key = ?", userID, key)
+	} else {
+		_, err = db.Exec(`
+			UPDATE idempotency_keys SET status_code = ?, content_type = ?, response_body = ?
+			WHERE user_id = ? AND idem_key = ?
+		`, rec.status, rec.Header().Get("Content-Type"), redactIdempotentBody(rec.body.Bytes()), userID, key)
+	}
+	if err != nil {
+		errorLog.Printf("Failed to save idempotent response for key %q: %v", key, err)
+	}
+}
+
+// redactIdempotentBody 删除响应体中的 idempotencyRedactedFields；不是 JSON 对象或没有这些字段时原样返回
+func redactIdempotentBody(body []byte) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return body
+	}
+	redacted := false
+	for _, name := range idempotencyRedactedFields {
+		if _, ok := fields[name]; ok {
+			delete(fields, name)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return body
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return body
+	}
+	return append(out, '\n')
+}
+
+// responseRecorder 转发响应的同时记录状态码和响应体
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// idempotencyMiddleware 为创建资源的 POST 接口提供 Idempotency-Key 支持，需放在 authMiddleware 之后
+func idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimSpace(r.Header.Get(IdempotencyKeyHeader))
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			errorResponse(w, http.StatusBadRequest, "idempotency key too long")
+			return
+		}
+
+		userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+		if err != nil {
+			errorResponse(w, http.StatusUnauthorized, "invalid user id")
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentRequestBytes+1))
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, "failed to read request body")
+			return
+		}
+		if len(body) > maxIdempotentRequestBytes {
+			errorResponse(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := requestFingerprint(r, body)
+		stored, err := claimIdempotencyKey(userID, key, fingerprint)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "database error")
+			return
+		}
+
+		if stored != nil {
+			switch {
+			case stored.fingerprint != fingerprint:
+				errorResponse(w, http.StatusUnprocessableEntity, "idempotency key reused with a different request")
+			case stored.statusCode == 0:
+				errorResponse(w, http.StatusConflict, "a request with this idempotency key is still in progress")
+			default:
+				if stored.contentType != "" {
+					w.Header().Set("Content-Type", stored.contentType)
+				}
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(stored.statusCode)
+				_, _ = w.Write(stored.body)
+			}
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				// handler panic 时释放 key，再交给 net/http 处理
+				rec.status = http.StatusInternalServerError
+				saveIdempotentResponse(userID, key, rec)
+				panic(p)
+			}
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			saveIdempotentResponse(userID, key, rec)
+		}()
+		next(rec, r)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postWithKey 以指定用户和 Idempotency-Key 发送 POST 请求
+func postWithKey(t *testing.T, handler http.HandlerFunc, user User, path, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", bearerFor(t, user))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	rr := httptest.NewRecorder()
+	authMiddleware(idempotencyMiddleware(handler))(rr, req)
+	return rr
+}
+
+func countTodos(t *testing.T, userID int64) int {
+	t.Helper()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM todos WHERE user_id = ?", userID).Scan(&count); err != nil {
+		t.Fatalf("failed to count todos: %v", err)
+	}
+	return count
+}
+
+func TestIdempotencyKeyReplaysResponse(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "dave")
+	body := fmt.Sprintf(`{"user_id":%d,"title":"Buy milk"}`, user.ID)
+
+	first := postWithKey(t, handleCreateTodo, user, "/todos", "key-1", body)
+	if first.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d", first.Code)
+	}
+
+	retry := postWithKey(t, handleCreateTodo, user, "/todos", "key-1", body)
+	if retry.Code != http.StatusCreated {
+		t.Fatalf("expected replayed status 201, got %d", retry.Code)
+	}
+	if retry.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Fatal("expected replayed response to be marked")
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Fatalf("replayed body differs:\n%s\n%s", first.Body.String(), retry.Body.String())
+	}
+	if n := countTodos(t, user.ID); n != 1 {
+		t.Fatalf("expected 1 todo after retry, got %d", n)
+	}
+
+	// 没有 key 的请求不受影响
+	postWithKey(t, handleCreateTodo, user, "/todos", "", body)
+	if n := countTodos(t, user.ID); n != 2 {
+		t.Fatalf("expected 2 todos without key, got %d", n)
+	}
+}
+
+func TestIdempotencyKeyDoesNotStoreSecrets(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "erin")
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"task_id": "t-1", "callback_secret": "s3cret"})
+	}
+
+	first := postWithKey(t, handler, user, "/api/v1/image/async", "key-secret", `{"prompt":"a fox"}`)
+	if !strings.Contains(first.Body.String(), "s3cret") {
+		t.Fatalf("expected the first response to carry the secret, got %s", first.Body.String())
+	}
+
+	var stored string
+	if err := db.QueryRow("SELECT response_body FROM idempotency_keys WHERE idem_key = ?", "key-secret").Scan(&stored); err != nil {
+		t.Fatalf("failed to load stored response: %v", err)
+	}
+	retry := postWithKey(t, handler, user, "/api/v1/image/async", "key-secret", `{"prompt":"a fox"}`)
+	if strings.Contains(stored, "s3cret") || strings.Contains(retry.Body.String(), "s3cret") {
+		t.Fatalf("expected the secret to be dropped from the stored response, got %s / %s", stored, retry.Body.String())
+	}
+	if retry.Code != http.StatusAccepted || !strings.Contains(retry.Body.String(), `"task_id":"t-1"`) {
+		t.Fatalf("expected the rest of the response to be replayed, got %d %s", retry.Code, retry.Body.String())
+	}
+}
+
+func TestIdempotencyKeyRejectsDifferentBody(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "erin")
+
+	postWithKey(t, handleCreateTodo, user, "/todos", "key-1", fmt.Sprintf(`{"user_id":%d,"title":"A"}`, user.ID))
+	rr := postWithKey(t, handleCreateTodo, user, "/todos", "key-1", fmt.Sprintf(`{"user_id":%d,"title":"B"}`, user.ID))
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status 422, got %d", rr.Code)
+	}
+	if n := countTodos(t, user.ID); n != 1 {
+		t.Fatalf("expected 1 todo, got %d", n)
+	}
+}
+
+func TestIdempotencyKeyScopedPerUser(t *testing.T) {
+	setupTestDB(t)
+	alice := createTestUser(t, "alice")
+	bob := createTestUser(t, "bob")
+
+	postWithKey(t, handleCreateTodo, alice, "/todos", "shared", fmt.Sprintf(`{"user_id":%d,"title":"A"}`, alice.ID))
+	rr := postWithKey(t, handleCreateTodo, bob, "/todos", "shared", fmt.Sprintf(`{"user_id":%d,"title":"B"}`, bob.ID))
+	if rr.Code != http.StatusCreated || rr.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Fatalf("expected a fresh response for another user, got %d", rr.Code)
+	}
+}
+
+func TestIdempotencyKeyReleasedOnServerError(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "frank")
+
+	calls := 0
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			errorResponse(w, http.StatusInternalServerError, "database error")
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]int{"call": calls})
+	}
+
+	if rr := postWithKey(t, handler, user, "/todos", "key-1", `{}`); rr.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status 500, got %d", rr.Code)
+	}
+	if rr := postWithKey(t, handler, user, "/todos", "key-1", `{}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected retry after 500 to run again, got %d", rr.Code)
+	}
+	if calls != 2 {
+		t.Fatalf("expected handler to run twice, ran %d times", calls)
+	}
+}
+
+func TestIdempotencyKeyInFlightAndExpiry(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "grace")
+	body := `{}`
+	req := httptest.NewRequest(http.MethodPost, "/todos", strings.NewReader(body))
+	fingerprint := requestFingerprint(req, []byte(body))
+
+	// 第一次请求尚未完成
+	if _, err := db.Exec(`
+		INSERT INTO idempotency_keys (user_id, idem_key, fingerprint, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`, user.ID, "key-1", fingerprint, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("failed to insert key: %v", err)
+	}
+	noop := func(w http.ResponseWriter, r *http.Request) { writeJSON(w, http.StatusCreated, nil) }
+	if rr := postWithKey(t, noop, user, "/todos", "key-1", body); rr.Code != http.StatusConflict {
+		t.Fatalf("expected status 409 while in flight, got %d", rr.Code)
+	}
+
+	// 窗口期过后 key 可以重新使用
+	if _, err := db.Exec("UPDATE idempotency_keys SET expires_at = ?", time.Now().Add(-time.Second)); err != nil {
+		t.Fatalf("failed to expire key: %v", err)
+	}
+	if rr := postWithKey(t, noop, user, "/todos", "key-1", body); rr.Code != http.StatusCreated {
+		t.Fatalf("expected expired key to be reusable, got %d", rr.Code)
+	}
+}
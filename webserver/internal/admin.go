@@ -0,0 +1,781 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// ======================
+// 管理员任务运维接口
+// ======================
+//
+// 管理员（users.is_admin = 1）可以跨用户查询任务、按条件批量重新排队 / 取消 / 删除任务，
+// 暂停和恢复 worker pool，并查看每个 worker 当前执行的任务。所有状态变化都写入 task_audit_log，
+// 并像普通状态变化一样发布事件和 webhook。
+//
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 500
+	bulkActionLimit      = 1000 // 单次按条件批量操作最多处理的任务数
+
+	AdminActionRequeue = "requeue"
+	AdminActionCancel  = "cancel"
+	AdminActionDelete  = "delete"
+)
+
+var (
+	// ErrInvalidTransition 任务当前状态不允许该操作
+	ErrInvalidTransition = errors.New("task status does not allow this operation")
+	ErrTaskNotFound      = errors.New("task not found")
+	ErrInvalidCursor     = errors.New("invalid cursor")
+)
+
+// adminActionStatuses 各操作允许的任务状态；按条件批量操作未指定 status 时使用
+var adminActionStatuses = map[string][]string{
+	AdminActionRequeue: {TaskFailed, TaskCancelled, TaskRunning},
+	AdminActionCancel:  {TaskScheduled, TaskQueued, TaskRunning},
+	AdminActionDelete:  {TaskDone, TaskFailed, TaskCancelled},
+}
+
+// TaskFilter 管理员查询任务的过滤条件，零值字段不参与过滤
+type TaskFilter struct {
+	Statuses      []string   `json:"status,omitempty"`
+	UserID        int64      `json:"user_id,omitempty"`
+	Kind          string     `json:"kind,omitempty"`
+	Backend       string     `json:"backend,omitempty"` // 生成图片的后端实例（images.backend_instance）或远程 worker ID
+	CreatedAfter  *time.Time `json:"created_after,omitempty"`
+	CreatedBefore *time.Time `json:"created_before,omitempty"`
+	ErrorContains string     `json:"error,omitempty"` // 错误信息包含的子串（不区分大小写）
+}
+
+// IsEmpty 是否没有任何过滤条件
+func (f TaskFilter) IsEmpty() bool {
+	return len(f.Statuses) == 0 && f.UserID == 0 && f.Kind == "" && f.Backend == "" &&
+		f.CreatedAfter == nil && f.CreatedBefore == nil && f.ErrorContains == ""
+}
+
+// where 生成 SQL 条件和参数
+func (f TaskFilter) where() (string, []interface{}) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if len(f.Statuses) > 0 {
+		conds = append(conds, "status IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(f.Statuses)), ", ")+")")
+		for _, s := range f.Statuses {
+			args = append(args, s)
+		}
+	}
+	if f.UserID != 0 {
+		conds = append(conds, "user_id = ?")
+		args = append(args, f.UserID)
+	}
+	if f.Kind != "" {
+		conds = append(conds, "kind = ?")
+		args = append(args, f.Kind)
+	}
+	if f.Backend != "" {
+		conds = append(conds, "(worker_id = ? OR image_id IN (SELECT id FROM images WHERE backend_instance = ?))")
+		args = append(args, f.Backend, f.Backend)
+	}
+	if f.CreatedAfter != nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, *f.CreatedAfter)
+	}
+	if f.CreatedBefore != nil {
+		conds = append(conds, "created_at < ?")
+		args = append(args, *f.CreatedBefore)
+	}
+	if f.ErrorContains != "" {
+		conds = append(conds, "instr(LOWER(COALESCE(error_msg, '')), LOWER(?)) > 0")
+		args = append(args, f.ErrorContains)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// parseTaskFilter 从查询参数读取过滤条件：status（逗号分隔）、user_id、kind、backend、
+// created_after / created_before（RFC 3339）、error
+func parseTaskFilter(q url.Values) (TaskFilter, error) {
+	var f TaskFilter
+	if s := q.Get("status"); s != "" {
+		for _, status := range strings.Split(s, ",") {
+			f.Statuses = append(f.Statuses, strings.ToUpper(strings.TrimSpace(status)))
+		}
+	}
+	if s := q.Get("user_id"); s != "" {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid user_id")
+		}
+		f.UserID = id
+	}
+	f.Kind = q.Get("kind")
+	f.Backend = q.Get("backend")
+	f.ErrorContains = q.Get("error")
+	for key, dst := range map[string]**time.Time{"created_after": &f.CreatedAfter, "created_before": &f.CreatedBefore} {
+		if s := q.Get(key); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				return f, fmt.Errorf("invalid %s, expected RFC 3339", key)
+			}
+			*dst = &t
+		}
+	}
+	return f, nil
+}
+
+// rowidScanner 先读取 rowid，其余列交给 scanTask
+type rowidScanner struct {
+	row   rowScanner
+	rowid *int64
+}
+
+func (s rowidScanner) Scan(dest ...interface{}) error {
+	return s.row.Scan(append([]interface{}{s.rowid}, dest...)...)
+}
+
+func encodeTaskCursor(rowid int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(rowid, 10)))
+}
+
+func decodeTaskCursor(cursor string) (int64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(raw), 10, 64)
+}
+
+// ListTasks 跨用户按条件查询任务，按创建顺序倒序；cursor 为上一页返回的 next_cursor，
+// 没有更多结果时 next_cursor 为空
+func (tm *TaskManager) ListTasks(filter TaskFilter, cursor string, limit int) ([]*ImageTask, string, error) {
+	if limit <= 0 {
+		limit = defaultAdminPageSize
+	}
+	where, args := filter.where()
+	if cursor != "" {
+		before, err := decodeTaskCursor(cursor)
+		if err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+		where += " AND rowid < ?"
+		args = append(args, before)
+	}
+
+	rows, err := tm.db.Query(`
+		SELECT rowid, `+taskColumns+`
+		FROM image_tasks
+		WHERE `+where+`
+		ORDER BY rowid DESC
+		LIMIT ?
+	`, append(args, limit+1)...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list tasks: %w", err)
+	}
+	defer rows.Close()
+
+	tasks := []*ImageTask{}
+	var rowids []int64
+	for rows.Next() {
+		var rowid int64
+		task, err := scanTask(rowidScanner{row: rows, rowid: &rowid})
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+		rowids = append(rowids, rowid)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to list tasks: %w", err)
+	}
+
+	next := ""
+	if len(tasks) > limit {
+		tasks = tasks[:limit]
+		next = encodeTaskCursor(rowids[limit-1])
+	}
+	return tasks, next, nil
+}
+
+// CancelTask 取消尚未结束的任务；执行中的任务租约失效，worker 的结果不再写入
+func (tm *TaskManager) CancelTask(task *ImageTask, reason string) error {
+	task.Status = TaskCancelled
+	task.ErrorMsg = reason
+	task.LeaseExpiresAt = nil
+	task.UpdatedAt = time.Now()
+	return tm.adminTransition(task, adminActionStatuses[AdminActionCancel], AuditActionCancelled, reason,
+		`error_msg = ?, lease_expires_at = NULL, updated_at = ?`, task.ErrorMsg, task.UpdatedAt)
+}
+
+// RequeueTask 把失败、已取消或执行中的任务交给调度器立即重新入队；跟随其他任务的任务改为独立执行
+func (tm *TaskManager) RequeueTask(task *ImageTask, reason string) error {
+	now := time.Now()
+	task.Status = TaskScheduled
+	task.RunAt = &now
+	task.ErrorMsg = ""
+	task.AttachedTo = ""
+	task.WorkerID = ""
+	task.LeaseExpiresAt = nil
+	task.UpdatedAt = now
+	return tm.adminTransition(task, adminActionStatuses[AdminActionRequeue], AuditActionRequeued, reason, `
+		run_at = ?, error_msg = '', attached_to = '', worker_id = '', lease_expires_at = NULL, updated_at = ?`,
+		task.RunAt, task.UpdatedAt)
+}
+
+// adminTransition 只在任务处于 from 中的状态时更新（set 同 updateTaskRow），并在同一事务中写入审计记录；
+// task 读取之后已被修改时返回 ErrVersionConflict
+func (tm *TaskManager) adminTransition(task *ImageTask, from []string, action, detail, set string, args ...interface{}) error {
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+
+	var previous string
+	if err := tx.QueryRow("SELECT status FROM image_tasks WHERE id = ?", task.ID).Scan(&previous); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrTaskNotFound
+		}
+		return fmt.Errorf("failed to load task: %w", err)
+	}
+
+	if !slices.Contains(from, previous) {
+		return ErrInvalidTransition
+	}
+	if err := tm.updateTask(tx, task, set, args...); err != nil {
+		return err
+	}
+
+	if err := insertAuditLog(tx, task.ID, action, detail, task.Attempts); err != nil {
+		return err
+	}
+
+	var attached []*ImageTask
+	if isTerminalStatus(task.Status) {
+		if err := enqueueTaskWebhooks(tx, task); err != nil {
+			return err
+		}
+		if attached, err = syncAttachedTasks(tx, task); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update task: %w", err)
+	}
+	snapshot.keep()
+
+	tm.storeAndPublish(append([]*ImageTask{task}, attached...)...)
+	if previous == TaskQueued || previous == TaskRunning {
+		tm.publishQueuePositions()
+	}
+	return nil
+}
+
+// DeleteTask 删除已结束的任务及其审计记录和二进制输入
+func (tm *TaskManager) DeleteTask(taskID string) error {
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM image_tasks WHERE id = ? AND status IN (?, ?, ?)`,
+		taskID, TaskDone, TaskFailed, TaskCancelled)
+	if err != nil {
+		return fmt.Errorf("failed to delete task: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var exists int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM image_tasks WHERE id = ?", taskID).Scan(&exists); err == nil && exists == 0 {
+			return ErrTaskNotFound
+		}
+		return ErrInvalidTransition
+	}
+	for _, query := range []string{
+		"DELETE FROM task_audit_log WHERE task_id = ?",
+		"DELETE FROM task_blobs WHERE task_id = ?",
+	} {
+		if _, err := tx.Exec(query, taskID); err != nil {
+			return fmt.Errorf("failed to delete task: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete task: %w", err)
+	}
+
+	tm.cache.remove(taskID)
+	return nil
+}
+
+// IsAdmin 用户是否为管理员
+func (tm *TaskManager) IsAdmin(userID int64) (bool, error) {
+	var isAdmin bool
+	err := tm.db.QueryRow("SELECT is_admin FROM users WHERE id = ?", userID).Scan(&isAdmin)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to load user: %w", err)
+	}
+	return isAdmin, nil
+}
+
+// remoteAssignments 返回远程 worker 正在执行的任务
+func (tm *TaskManager) remoteAssignments() ([]*ImageTask, error) {
+	rows, err := tm.db.Query(`
+		SELECT `+taskColumns+`
+		FROM image_tasks
+		WHERE status = ? AND worker_id != ''
+		ORDER BY worker_id, started_at
+	`, TaskRunning)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load remote assignments: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*ImageTask
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+//
+// ======================
+// AdminAPI
+// ======================
+//
+
+// WorkerAssignment worker 正在执行的任务
+type WorkerAssignment struct {
+	TaskID         string     `json:"task_id"`
+	Kind           string     `json:"kind"`
+	UserID         int64      `json:"user_id"`
+	Attempt        int        `json:"attempt"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+}
+
+// WorkerStatus 一个本地或远程 worker 及其当前任务
+type WorkerStatus struct {
+	ID           string              `json:"id"` // 本地 worker 为 local-<编号>
+	Remote       bool                `json:"remote"`
+	Capabilities *WorkerCapabilities `json:"capabilities,omitempty"`
+	LastSeenAt   *time.Time          `json:"last_seen_at,omitempty"`
+	Tasks        []WorkerAssignment  `json:"tasks"`
+}
+
+// WorkerPoolStatus worker pool 状态
+type WorkerPoolStatus struct {
+	Paused      bool           `json:"paused"`
+	QueueLength int            `json:"queue_length"`
+	Workers     []WorkerStatus `json:"workers"`
+}
+
+// AdminTaskList 任务列表的一页
+type AdminTaskList struct {
+	Tasks      []*ImageTask `json:"tasks"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// AdminTaskDetail 任务及其审计记录
+type AdminTaskDetail struct {
+	Task     *ImageTask       `json:"task"`
+	AuditLog []TaskAuditEntry `json:"audit_log"`
+}
+
+// AdminTaskActionRequest 批量操作：task_ids 和 filter 二选一；filter 未指定 status 时
+// 只匹配该操作允许的状态
+type AdminTaskActionRequest struct {
+	Action  string      `json:"action"` // requeue、cancel 或 delete
+	TaskIDs []string    `json:"task_ids,omitempty"`
+	Filter  *TaskFilter `json:"filter,omitempty"`
+}
+
+// AdminTaskActionResponse 批量操作结果
+type AdminTaskActionResponse struct {
+	Action   string            `json:"action"`
+	Matched  int               `json:"matched"`
+	Affected []string          `json:"affected"`
+	Errors   map[string]string `json:"errors,omitempty"` // 任务 ID → 失败原因
+}
+
+// AdminAPI 管理员接口
+type AdminAPI struct {
+	taskManager *TaskManager
+	workerPool  *WorkerPool
+	scheduler   *TaskScheduler
+	backends    *BackendRegistry // nil 时不提供 /api/v1/admin/backends
+}
+
+// NewAdminAPI 创建管理员接口；scheduler 用于重新排队后立即调度，可以为 nil
+func NewAdminAPI(tm *TaskManager, wp *WorkerPool, scheduler *TaskScheduler) *AdminAPI {
+	return &AdminAPI{taskManager: tm, workerPool: wp, scheduler: scheduler}
+}
+
+// RequireAdmin 只允许管理员访问，需放在 authMiddleware 之后
+func (a *AdminAPI) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+		if err != nil {
+			errorResponse(w, http.StatusUnauthorized, "invalid user id")
+			return
+		}
+		isAdmin, err := a.taskManager.IsAdmin(userID)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to check permissions")
+			return
+		}
+		if !isAdmin {
+			errorResponse(w, http.StatusForbidden, "admin access required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleTasks 处理 GET/POST /api/v1/admin/tasks
+//
+//	@Summary		List tasks or run a bulk action (admin)
+//	@Description	GET lists tasks across all users, newest first, filtered by status (comma-separated), user_id, kind, backend (image backend instance or remote worker ID), created_after / created_before (RFC 3339) and error substring; pass next_cursor as cursor for the next page. POST requeues, cancels or deletes the given task_ids or every task matching filter (at most 1000 per call).
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			status			query		string					false	"Statuses, comma-separated"
+//	@Param			user_id			query		int						false	"Owner"
+//	@Param			kind			query		string					false	"Task kind"
+//	@Param			backend			query		string					false	"Backend instance or remote worker ID"
+//	@Param			created_after	query		string					false	"RFC 3339"
+//	@Param			created_before	query		string					false	"RFC 3339"
+//	@Param			error			query		string					false	"Error message substring"
+//	@Param			limit			query		int						false	"Page size (max 500)"	default(50)
+//	@Param			cursor			query		string					false	"next_cursor of the previous page"
+//	@Param			request			body		AdminTaskActionRequest	false	"Bulk action (POST only)"
+//	@Success		200				{object}	AdminTaskList
+//	@Success		200				{object}	AdminTaskActionResponse
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string
+//	@Failure		403				{object}	map[string]string
+//	@Router			/api/v1/admin/tasks [get]
+//	@Router			/api/v1/admin/tasks [post]
+func (a *AdminAPI) HandleTasks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		filter, err := parseTaskFilter(q)
+		if err != nil {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		limit := defaultAdminPageSize
+		if l, err := strconv.Atoi(q.Get("limit")); err == nil && l > 0 {
+			limit = min(l, maxAdminPageSize)
+		}
+		tasks, next, err := a.taskManager.ListTasks(filter, q.Get("cursor"), limit)
+		if err != nil {
+			if errors.Is(err, ErrInvalidCursor) {
+				errorResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			errorResponse(w, http.StatusInternalServerError, "failed to list tasks")
+			return
+		}
+		writeJSON(w, http.StatusOK, AdminTaskList{Tasks: tasks, NextCursor: next})
+
+	case http.MethodPost:
+		var req AdminTaskActionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if _, ok := adminActionStatuses[req.Action]; !ok {
+			errorResponse(w, http.StatusBadRequest, "action must be requeue, cancel or delete")
+			return
+		}
+		if (len(req.TaskIDs) == 0) == (req.Filter == nil) {
+			errorResponse(w, http.StatusBadRequest, "exactly one of task_ids and filter is required")
+			return
+		}
+
+		ids := req.TaskIDs
+		if req.Filter != nil {
+			// 空条件会匹配所有任务，必须显式给出至少一个条件
+			if req.Filter.IsEmpty() {
+				errorResponse(w, http.StatusBadRequest, "filter must not be empty")
+				return
+			}
+			filter := *req.Filter
+			if len(filter.Statuses) == 0 {
+				filter.Statuses = adminActionStatuses[req.Action]
+			}
+			tasks, _, err := a.taskManager.ListTasks(filter, "", bulkActionLimit)
+			if err != nil {
+				errorResponse(w, http.StatusInternalServerError, "failed to list tasks")
+				return
+			}
+			ids = make([]string, 0, len(tasks))
+			for _, task := range tasks {
+				ids = append(ids, task.ID)
+			}
+		} else if len(ids) > bulkActionLimit {
+			errorResponse(w, http.StatusBadRequest, fmt.Sprintf("at most %d task_ids per request", bulkActionLimit))
+			return
+		}
+
+		resp := AdminTaskActionResponse{Action: req.Action, Matched: len(ids), Affected: []string{}}
+		for _, id := range ids {
+			if _, err := a.apply(r, req.Action, id); err != nil {
+				if resp.Errors == nil {
+					resp.Errors = map[string]string{}
+				}
+				resp.Errors[id] = err.Error()
+				continue
+			}
+			resp.Affected = append(resp.Affected, id)
+		}
+		log.Printf("Admin %s: %s %d/%d tasks", r.Header.Get("X-User-ID"), req.Action, len(resp.Affected), resp.Matched)
+		writeJSON(w, http.StatusOK, resp)
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// HandleTask 处理 /api/v1/admin/tasks/{id}[/requeue|/cancel]
+//
+//	@Summary		Inspect or operate on one task (admin)
+//	@Description	GET returns any user's task with its audit log, DELETE removes a finished task, POST /requeue puts a failed, cancelled or stuck running task back in the queue, POST /cancel cancels a scheduled, queued or running task. Returns 409 when the task's status does not allow the operation.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			task_id	path		string	true	"Task ID"
+//	@Success		200		{object}	AdminTaskDetail
+//	@Success		200		{object}	ImageTask
+//	@Failure		401		{object}	map[string]string
+//	@Failure		403		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		409		{object}	map[string]string
+//	@Router			/api/v1/admin/tasks/{task_id} [get]
+//	@Router			/api/v1/admin/tasks/{task_id} [delete]
+//	@Router			/api/v1/admin/tasks/{task_id}/requeue [post]
+//	@Router			/api/v1/admin/tasks/{task_id}/cancel [post]
+func (a *AdminAPI) HandleTask(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/tasks/")
+	taskID, op, _ := strings.Cut(rest, "/")
+	if taskID == "" || strings.Contains(op, "/") {
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	var action, allow string
+	switch op {
+	case "":
+		switch r.Method {
+		case http.MethodGet:
+			a.writeTaskDetail(w, taskID)
+			return
+		case http.MethodDelete:
+			action = AdminActionDelete
+		default:
+			allow = http.MethodGet + ", " + http.MethodDelete
+		}
+	case AdminActionRequeue, AdminActionCancel:
+		if r.Method == http.MethodPost {
+			action = op
+		} else {
+			allow = http.MethodPost
+		}
+	default:
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+	if action == "" {
+		w.Header().Set("Allow", allow)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	task, err := a.apply(r, action, taskID)
+	switch {
+	case errors.Is(err, ErrTaskNotFound):
+		errorResponse(w, http.StatusNotFound, "task not found")
+	case errors.Is(err, ErrInvalidTransition), errors.Is(err, ErrVersionConflict), errors.Is(err, ErrIllegalTransition):
+		errorResponse(w, http.StatusConflict, err.Error())
+	case err != nil:
+		errorResponse(w, http.StatusInternalServerError, fmt.Sprintf("failed to %s task", action))
+	case task == nil:
+		writeJSON(w, http.StatusOK, map[string]string{"task_id": taskID, "status": "deleted"})
+	default:
+		writeJSON(w, http.StatusOK, task)
+	}
+}
+
+func (a *AdminAPI) writeTaskDetail(w http.ResponseWriter, taskID string) {
+	task, err := a.taskManager.GetTask(taskID)
+	if err != nil {
+		errorResponse(w, http.StatusNotFound, "task not found")
+		return
+	}
+	entries, err := a.taskManager.GetTaskAuditLog(taskID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to load audit log")
+		return
+	}
+	writeJSON(w, http.StatusOK, AdminTaskDetail{Task: task, AuditLog: entries})
+}
+
+// apply 对单个任务执行操作，返回更新后的任务（删除时为 nil）
+func (a *AdminAPI) apply(r *http.Request, action, taskID string) (*ImageTask, error) {
+	if action == AdminActionDelete {
+		return nil, a.taskManager.DeleteTask(taskID)
+	}
+
+	current, err := a.taskManager.GetTask(taskID)
+	if err != nil {
+		return nil, ErrTaskNotFound
+	}
+	// GetTask 返回的是快照副本，修改失败不影响缓存
+	task := current
+	reason := fmt.Sprintf("%s by admin %s", map[string]string{
+		AdminActionRequeue: "requeued", AdminActionCancel: "cancelled",
+	}[action], r.Header.Get("X-User-ID"))
+
+	switch action {
+	case AdminActionCancel:
+		err = a.taskManager.CancelTask(task, reason)
+	case AdminActionRequeue:
+		err = a.taskManager.RequeueTask(task, reason)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// 本进程执行中的任务立即中止；远程 worker 在下一次心跳时收到 409
+	a.workerPool.CancelRunning(task.ID)
+	if action == AdminActionRequeue && a.scheduler != nil {
+		a.scheduler.Notify()
+	}
+	return task, nil
+}
+
+// HandleWorkers 处理 GET /api/v1/admin/workers 和 POST /api/v1/admin/workers/{pause|resume}
+//
+//	@Summary		Worker assignments and pause / resume (admin)
+//	@Description	GET lists in-process and remote workers with the tasks each one is executing. POST /pause stops workers (and remote leases) from taking new tasks; running tasks finish normally. POST /resume undoes it.
+//	@Tags			admin
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	WorkerPoolStatus
+//	@Failure		401	{object}	map[string]string
+//	@Failure		403	{object}	map[string]string
+//	@Router			/api/v1/admin/workers [get]
+//	@Router			/api/v1/admin/workers/pause [post]
+//	@Router			/api/v1/admin/workers/resume [post]
+func (a *AdminAPI) HandleWorkers(w http.ResponseWriter, r *http.Request) {
+	op := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/admin/workers"), "/")
+	switch op {
+	case "":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+	case "pause", "resume":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if op == "pause" {
+			a.workerPool.Pause()
+		} else {
+			a.workerPool.Resume()
+		}
+		log.Printf("Admin %s: worker pool %sd", r.Header.Get("X-User-ID"), op)
+	default:
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	status, err := a.workerStatus()
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to load workers")
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// workerStatus 汇总本地 worker 和最近活动或持有任务的远程 worker
+func (a *AdminAPI) workerStatus() (*WorkerPoolStatus, error) {
+	wp := a.workerPool
+	status := &WorkerPoolStatus{Paused: wp.Paused(), QueueLength: wp.GetQueueLength(), Workers: []WorkerStatus{}}
+
+	local := wp.LocalAssignments()
+	for _, i := range wp.WorkerIDs() {
+		ws := WorkerStatus{ID: fmt.Sprintf("local-%d", i), Tasks: []WorkerAssignment{}}
+		if assignment, ok := local[i]; ok {
+			ws.Tasks = append(ws.Tasks, assignment)
+		}
+		status.Workers = append(status.Workers, ws)
+	}
+
+	remote := map[string]*WorkerStatus{}
+	seen, err := a.taskManager.ListRemoteWorkers(time.Now().Add(-remoteWorkerActiveFor))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range seen {
+		caps, lastSeen := info.Capabilities, info.LastSeenAt
+		remote[info.ID] = &WorkerStatus{ID: info.ID, Remote: true, Capabilities: &caps, LastSeenAt: &lastSeen, Tasks: []WorkerAssignment{}}
+	}
+	running, err := a.taskManager.remoteAssignments()
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range running {
+		ws, ok := remote[task.WorkerID]
+		if !ok {
+			// 持有租约但最近没有活动的 worker，回收器会在租约过期后处理
+			ws = &WorkerStatus{ID: task.WorkerID, Remote: true, Tasks: []WorkerAssignment{}}
+			remote[task.WorkerID] = ws
+		}
+		ws.Tasks = append(ws.Tasks, WorkerAssignment{
+			TaskID:         task.ID,
+			Kind:           task.Kind,
+			UserID:         task.UserID,
+			Attempt:        task.Attempts,
+			StartedAt:      task.StartedAt,
+			LeaseExpiresAt: task.LeaseExpiresAt,
+		})
+	}
+
+	ids := make([]string, 0, len(remote))
+	for id := range remote {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		status.Workers = append(status.Workers, *remote[id])
+	}
+	return status, nil
+}
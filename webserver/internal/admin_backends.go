@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 实例状态操作：/api/v1/admin/backends/{id}/{enable|drain|disable}
+var backendStatusActions = map[string]string{
+	"enable":  BackendEnabled,
+	"drain":   BackendDrained,
+	"disable": BackendDisabled,
+}
+
+// AdminBackend 注册表中的实例及其实时统计（没有加载到负载均衡器时 live 为空）
+type AdminBackend struct {
+	*BackendRecord
+	Live *InstanceStats `json:"live,omitempty"`
+}
+
+// AdminBackendList 实例列表
+type AdminBackendList struct {
+	Types    []string       `json:"types"` // 可用的后端类型
+	Backends []AdminBackend `json:"backends"`
+}
+
+// SetBackendRegistry 启用 /api/v1/admin/backends
+func (a *AdminAPI) SetBackendRegistry(r *BackendRegistry) {
+	a.backends = r
+}
+
+func (a *AdminAPI) adminBackend(rec *BackendRecord) AdminBackend {
+	b := AdminBackend{BackendRecord: rec}
+	if stats, err := a.backends.Stats(rec); err == nil {
+		b.Live = &stats
+	}
+	return b
+}
+
+// writeBackendError 把注册表错误映射为 HTTP 状态码
+func writeBackendError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrBackendNotFound):
+		errorResponse(w, http.StatusNotFound, "backend not found")
+	case errors.Is(err, ErrBackendExists):
+		errorResponse(w, http.StatusConflict, "a backend with this url already exists")
+	case errors.Is(err, ErrInvalidBackend):
+		errorResponse(w, http.StatusBadRequest, err.Error())
+	default:
+		errorResponse(w, http.StatusInternalServerError, "failed to update backends")
+	}
+}
+
+// HandleBackends 处理 GET/POST /api/v1/admin/backends
+//
+//	@Summary		List or register image generation and speech-to-text backends (admin)
+//	@Description	GET lists every backend in the registry with live load balancer statistics. POST registers a backend (url required; type defaults to qwen-image-gguf, automatic1111, comfyui and openai-images are also image backends, use fast-whisper or openai-audio for speech-to-text; weight and capacity default to 1, status to enabled, models to the ones the backend declares) and starts routing to it immediately.
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request	body		BackendRecord	false	"Backend (POST only)"
+//	@Success		200		{object}	AdminBackendList
+//	@Success		201		{object}	AdminBackend
+//	@Failure		400		{object}	map[string]string
+//	@Failure		403		{object}	map[string]string
+//	@Failure		409		{object}	map[string]string
+//	@Router			/api/v1/admin/backends [get]
+//	@Router			/api/v1/admin/backends [post]
+func (a *AdminAPI) HandleBackends(w http.ResponseWriter, r *http.Request) {
+	if a.backends == nil {
+		errorResponse(w, http.StatusNotFound, "backend registry is not enabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		records, err := a.backends.List()
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to list backends")
+			return
+		}
+		list := AdminBackendList{Types: a.backends.Types(), Backends: make([]AdminBackend, 0, len(records))}
+		for _, rec := range records {
+			list.Backends = append(list.Backends, a.adminBackend(rec))
+		}
+		writeJSON(w, http.StatusOK, list)
+
+	case http.MethodPost:
+		var req BackendRecord
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		rec, err := a.backends.Add(BackendRecord{
+			URL: req.URL, Type: req.Type, Weight: req.Weight, Capacity: req.Capacity, Tags: req.Tags, Models: req.Models, Status: req.Status,
+		})
+		if err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		log.Printf("Admin %s: registered backend %d (%s)", r.Header.Get("X-User-ID"), rec.ID, rec.URL)
+		writeJSON(w, http.StatusCreated, a.adminBackend(rec))
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// HandleBackend 处理 /api/v1/admin/backends/{id}[/enable|/drain|/disable]
+//
+//	@Summary		Inspect, update, drain, disable or remove a backend (admin)
+//	@Description	GET returns the backend with live statistics. PATCH changes weight, capacity, tags, models or status. POST /drain stops new requests while in-flight ones finish, /disable also stops health checks, /enable resumes routing. DELETE removes the backend; requests already sent to it complete normally.
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		int				true	"Backend ID"
+//	@Param			request	body		BackendUpdate	false	"Fields to change (PATCH only)"
+//	@Success		200		{object}	AdminBackend
+//	@Failure		400		{object}	map[string]string
+//	@Failure		403		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Router			/api/v1/admin/backends/{id} [get]
+//	@Router			/api/v1/admin/backends/{id} [patch]
+//	@Router			/api/v1/admin/backends/{id} [delete]
+//	@Router			/api/v1/admin/backends/{id}/enable [post]
+//	@Router			/api/v1/admin/backends/{id}/drain [post]
+//	@Router			/api/v1/admin/backends/{id}/disable [post]
+func (a *AdminAPI) HandleBackend(w http.ResponseWriter, r *http.Request) {
+	if a.backends == nil {
+		errorResponse(w, http.StatusNotFound, "backend registry is not enabled")
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/admin/backends/")
+	rawID, op, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil || strings.Contains(op, "/") {
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	var rec *BackendRecord
+	switch {
+	case op == "" && r.Method == http.MethodGet:
+		rec, err = a.backends.Get(id)
+	case op == "" && r.Method == http.MethodPatch:
+		var u BackendUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		rec, err = a.backends.Update(id, u)
+	case op == "" && r.Method == http.MethodDelete:
+		if err := a.backends.Remove(id); err != nil {
+			writeBackendError(w, err)
+			return
+		}
+		log.Printf("Admin %s: removed backend %d", r.Header.Get("X-User-ID"), id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"id": id, "status": "removed"})
+		return
+	case op == "":
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPatch+", "+http.MethodDelete)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	default:
+		status, ok := backendStatusActions[op]
+		if !ok {
+			errorResponse(w, http.StatusNotFound, "not found")
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		rec, err = a.backends.Update(id, BackendUpdate{Status: &status})
+		if err == nil {
+			log.Printf("Admin %s: backend %d %s", r.Header.Get("X-User-ID"), id, status)
+		}
+	}
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, a.adminBackend(rec))
+}
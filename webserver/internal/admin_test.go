@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminCall 以 userID 身份经过 RequireAdmin 调用管理员接口
+func adminCall(a *AdminAPI, handler http.HandlerFunc, method, path string, userID int64, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+	rr := httptest.NewRecorder()
+	a.RequireAdmin(handler)(rr, req)
+	return rr
+}
+
+// setupAdmin 创建管理员账号，返回管理员 ID
+func setupAdmin(t *testing.T, tm *TaskManager) int64 {
+	t.Helper()
+	res, err := tm.db.Exec("INSERT INTO users (username, password, is_admin) VALUES ('ops', 'hash', 1)")
+	if err != nil {
+		t.Fatalf("failed to insert admin: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// failTask 把任务直接标记为失败
+func failTask(t *testing.T, tm *TaskManager, task *ImageTask, msg string) {
+	t.Helper()
+	task.Status = TaskFailed
+	task.ErrorMsg = msg
+	if err := tm.UpdateTask(task); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+}
+
+func TestAdminListTasksFiltersAndPaginates(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	adminID := setupAdmin(t, tm)
+	a := NewAdminAPI(tm, NewWorkerPool(1, 10, nil, tm), nil)
+
+	if rr := adminCall(a, a.HandleTasks, http.MethodGet, "/api/v1/admin/tasks", userID, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected regular users to be denied, got %d", rr.Code)
+	}
+
+	var oom []string
+	for i := 0; i < 5; i++ {
+		task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "p" + strconv.Itoa(i)}, TaskOptions{})
+		if i%2 == 0 {
+			failTask(t, tm, task, "backend: CUDA Out Of Memory")
+			oom = append(oom, task.ID)
+		}
+	}
+	tm.CreateTask(adminID, TextToImageRequest{Prompt: "admin's own"}, TaskOptions{})
+
+	list := func(query url.Values) AdminTaskList {
+		t.Helper()
+		rr := adminCall(a, a.HandleTasks, http.MethodGet, "/api/v1/admin/tasks?"+query.Encode(), adminID, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("list %v: got %d: %s", query, rr.Code, rr.Body.String())
+		}
+		var page AdminTaskList
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		return page
+	}
+
+	if all := list(url.Values{}); len(all.Tasks) != 6 || all.NextCursor != "" {
+		t.Fatalf("expected every user's tasks, got %d (cursor %q)", len(all.Tasks), all.NextCursor)
+	}
+
+	// 按状态、用户和错误子串过滤，每页 2 条，倒序
+	query := url.Values{"status": {"failed"}, "user_id": {strconv.FormatInt(userID, 10)}, "error": {"out of memory"}, "limit": {"2"}}
+	first := list(query)
+	if len(first.Tasks) != 2 || first.NextCursor == "" || first.Tasks[0].ID != oom[2] || first.Tasks[1].ID != oom[1] {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+	query.Set("cursor", first.NextCursor)
+	second := list(query)
+	if len(second.Tasks) != 1 || second.NextCursor != "" || second.Tasks[0].ID != oom[0] {
+		t.Fatalf("unexpected second page: %+v", second)
+	}
+
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	if empty := list(url.Values{"created_after": {future}}); len(empty.Tasks) != 0 {
+		t.Fatalf("expected no tasks created in the future, got %d", len(empty.Tasks))
+	}
+	if rr := adminCall(a, a.HandleTasks, http.MethodGet, "/api/v1/admin/tasks?cursor=%21", adminID, nil); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected invalid cursor to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestAdminTaskActions(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	adminID := setupAdmin(t, tm)
+	submitter := &recordingSubmitter{}
+	scheduler := NewTaskScheduler(tm, submitter, time.Hour)
+	a := NewAdminAPI(tm, NewWorkerPool(1, 10, nil, tm), scheduler)
+
+	queued, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "queued"}, TaskOptions{})
+	path := "/api/v1/admin/tasks/" + queued.ID
+	rr := adminCall(a, a.HandleTask, http.MethodPost, path+"/cancel", adminID, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("cancel: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := adminCall(a, a.HandleTask, http.MethodPost, path+"/cancel", adminID, nil); rr.Code != http.StatusConflict {
+		t.Fatalf("expected cancelling twice to conflict, got %d", rr.Code)
+	}
+	if stored, _ := NewTaskManager(testDB).GetTask(queued.ID); stored.Status != TaskCancelled {
+		t.Fatalf("expected task to be cancelled, got %s", stored.Status)
+	}
+
+	// 已取消的任务重新排队后由调度器提交
+	rr = adminCall(a, a.HandleTask, http.MethodPost, path+"/requeue", adminID, nil)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("requeue: got %d: %s", rr.Code, rr.Body.String())
+	}
+	scheduler.RunDue()
+	if submitter.count() != 1 || submitter.tasks[0].ID != queued.ID {
+		t.Fatalf("expected the requeued task to be submitted, got %d", submitter.count())
+	}
+
+	rr = adminCall(a, a.HandleTask, http.MethodGet, path, adminID, nil)
+	var detail AdminTaskDetail
+	json.Unmarshal(rr.Body.Bytes(), &detail)
+	if detail.Task.Status != TaskQueued || len(detail.AuditLog) != 2 ||
+		detail.AuditLog[0].Action != AuditActionCancelled || detail.AuditLog[1].Detail != "requeued by admin "+strconv.FormatInt(adminID, 10) {
+		t.Fatalf("unexpected detail: %+v", detail)
+	}
+
+	if rr := adminCall(a, a.HandleTask, http.MethodDelete, path, adminID, nil); rr.Code != http.StatusConflict {
+		t.Fatalf("expected deleting an unfinished task to conflict, got %d", rr.Code)
+	}
+
+	// 按条件批量操作：未指定 status 时只匹配该操作允许的状态
+	var failed []string
+	for i := 0; i < 3; i++ {
+		task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "flaky"}, TaskOptions{})
+		failTask(t, tm, task, "connection refused")
+		failed = append(failed, task.ID)
+	}
+	rr = adminCall(a, a.HandleTasks, http.MethodPost, "/api/v1/admin/tasks", adminID,
+		AdminTaskActionRequest{Action: AdminActionDelete, Filter: &TaskFilter{ErrorContains: "refused"}})
+	var resp AdminTaskActionResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if rr.Code != http.StatusOK || resp.Matched != 3 || len(resp.Affected) != 3 || len(resp.Errors) != 0 {
+		t.Fatalf("unexpected bulk delete: %d %+v", rr.Code, resp)
+	}
+	for _, id := range failed {
+		if rr := adminCall(a, a.HandleTask, http.MethodGet, "/api/v1/admin/tasks/"+id, adminID, nil); rr.Code != http.StatusNotFound {
+			t.Fatalf("expected task %s to be deleted, got %d", id, rr.Code)
+		}
+	}
+
+	rr = adminCall(a, a.HandleTasks, http.MethodPost, "/api/v1/admin/tasks", adminID,
+		AdminTaskActionRequest{Action: AdminActionCancel, TaskIDs: []string{queued.ID, "missing"}})
+	resp = AdminTaskActionResponse{}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if len(resp.Affected) != 1 || resp.Errors["missing"] == "" {
+		t.Fatalf("unexpected bulk cancel: %+v", resp)
+	}
+
+	if rr := adminCall(a, a.HandleTasks, http.MethodPost, "/api/v1/admin/tasks", adminID,
+		AdminTaskActionRequest{Action: AdminActionDelete, Filter: &TaskFilter{}}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected an empty filter to be rejected, got %d", rr.Code)
+	}
+}
+
+func TestAdminPauseResumeAndCancelRunning(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	adminID := setupAdmin(t, tm)
+	provider := newBlockingProvider()
+	wp := NewWorkerPool(1, 10, []TextToImageProvider{provider}, tm)
+	wp.Start()
+	defer wp.Stop()
+	a := NewAdminAPI(tm, wp, nil)
+
+	if rr := adminCall(a, a.HandleWorkers, http.MethodPost, "/api/v1/admin/workers/pause", adminID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("pause: got %d", rr.Code)
+	}
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "held"}, TaskOptions{})
+	wp.Submit(task)
+	select {
+	case <-provider.started:
+		t.Fatal("expected a paused pool not to start tasks")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	adminCall(a, a.HandleWorkers, http.MethodPost, "/api/v1/admin/workers/resume", adminID, nil)
+	<-provider.started
+
+	rr := adminCall(a, a.HandleWorkers, http.MethodGet, "/api/v1/admin/workers", adminID, nil)
+	var status WorkerPoolStatus
+	json.Unmarshal(rr.Body.Bytes(), &status)
+	if status.Paused || len(status.Workers) != 1 || len(status.Workers[0].Tasks) != 1 ||
+		status.Workers[0].ID != "local-0" || status.Workers[0].Tasks[0].TaskID != task.ID {
+		t.Fatalf("unexpected worker status: %+v", status)
+	}
+
+	// 取消执行中的任务会中止后端调用，worker 随后空闲
+	if rr := adminCall(a, a.HandleTask, http.MethodPost, "/api/v1/admin/tasks/"+task.ID+"/cancel", adminID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("cancel: got %d: %s", rr.Code, rr.Body.String())
+	}
+	waitFor(t, "worker to become idle", func() bool { return len(wp.LocalAssignments()) == 0 })
+	if stored, _ := NewTaskManager(testDB).GetTask(task.ID); stored.Status != TaskCancelled {
+		t.Fatalf("expected the running task to stay cancelled, got %s", stored.Status)
+	}
+}
+
+func TestAdminBackendRegistry(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	adminID := setupAdmin(t, tm)
+	wp := NewWorkerPool(1, 10, nil, tm)
+	defer wp.balancer.Close()
+	speech := NewLoadBalancer[SpeechToTextProvider](nil)
+	defer speech.Close()
+	newRegistry := func(lb *ImageBalancer) *BackendRegistry {
+		r := NewBackendRegistry(testDB, lb, nil)
+		r.RegisterType("fake", lb, func(string) (TextToImageProvider, error) { return newBlockingProvider(), nil })
+		r.RegisterSpeechType("fake-asr", speech, func(string) (SpeechToTextProvider, error) { return &fakeWhisper{}, nil })
+		return r
+	}
+	registry := newRegistry(wp.balancer)
+	a := NewAdminAPI(tm, wp, nil)
+	a.SetBackendRegistry(registry)
+
+	// 表中还没有同类实例时才写入初始实例
+	seed := []BackendRecord{{URL: "http://gpu-0:8000", Type: "fake"}}
+	if n, err := registry.Seed(seed); err != nil || n != 1 {
+		t.Fatalf("expected to seed 1 backend, got %d, %v", n, err)
+	}
+	seed = []BackendRecord{{URL: "http://other:8000", Type: "fake"}, {URL: "http://asr-0:8001", Type: "fake-asr"}}
+	if n, _ := registry.Seed(seed); n != 1 {
+		t.Fatalf("expected only the speech backend to be seeded, got %d", n)
+	}
+	if err := registry.Load(); err != nil || wp.balancer.Size() != 1 || speech.Size() != 1 {
+		t.Fatalf("expected the seeded backends to be loaded, got %d/%d (%v)", wp.balancer.Size(), speech.Size(), err)
+	}
+	asr := "/api/v1/admin/backends/2"
+	if rr := adminCall(a, a.HandleBackend, http.MethodPost, asr+"/drain", adminID, nil); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"live"`) {
+		t.Fatalf("expected the speech backend to be managed like image backends, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := adminCall(a, a.HandleBackend, http.MethodDelete, asr, adminID, nil); rr.Code != http.StatusOK || speech.Size() != 0 {
+		t.Fatalf("expected the speech backend to be removed, got %d (size %d)", rr.Code, speech.Size())
+	}
+
+	if rr := adminCall(a, a.HandleBackends, http.MethodGet, "/api/v1/admin/backends", userID, nil); rr.Code != http.StatusForbidden {
+		t.Fatalf("expected regular users to be denied, got %d", rr.Code)
+	}
+	var ids []int64
+	for _, u := range []string{"http://gpu-1:8000", "http://gpu-2:8000"} {
+		rr := adminCall(a, a.HandleBackends, http.MethodPost, "/api/v1/admin/backends", adminID,
+			map[string]interface{}{"url": u, "type": "fake", "capacity": 2, "tags": []string{"gpu"}})
+		var b AdminBackend
+		json.Unmarshal(rr.Body.Bytes(), &b)
+		if rr.Code != http.StatusCreated || b.Live == nil || b.Live.Capacity != 2 {
+			t.Fatalf("expected backend to be registered and routed, got %d %s", rr.Code, rr.Body.String())
+		}
+		ids = append(ids, b.ID)
+	}
+	for body, want := range map[string]int{
+		`{"url":"http://gpu-1:8000","type":"fake"}`: http.StatusConflict,
+		`{"url":"http://gpu-3:8000","type":"sdxl"}`: http.StatusBadRequest,
+		`{"url":"gpu-3","type":"fake"}`:             http.StatusBadRequest,
+	} {
+		if rr := adminCall(a, a.HandleBackends, http.MethodPost, "/api/v1/admin/backends", adminID, json.RawMessage(body)); rr.Code != want {
+			t.Fatalf("%s: expected %d, got %d", body, want, rr.Code)
+		}
+	}
+
+	// 注册时指定的模型直接生效，不需要再 PATCH
+	rr := adminCall(a, a.HandleBackends, http.MethodPost, "/api/v1/admin/backends", adminID,
+		map[string]interface{}{"url": "http://gpu-9:8000", "type": "fake", "models": []ModelCapability{{Name: "sdxl", MaxSteps: 30}}})
+	var withModels AdminBackend
+	json.Unmarshal(rr.Body.Bytes(), &withModels)
+	if rr.Code != http.StatusCreated || len(withModels.Models) != 1 || withModels.Live == nil || !slices.Equal(withModels.Live.Models, []string{"sdxl"}) {
+		t.Fatalf("expected the registered models to be stored and routed, got %d %s", rr.Code, rr.Body.String())
+	}
+	if rr := adminCall(a, a.HandleBackend, http.MethodDelete, "/api/v1/admin/backends/"+strconv.FormatInt(withModels.ID, 10), adminID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected delete to succeed, got %d", rr.Code)
+	}
+
+	// 加入 LoadBalancer 失败时不留下表中的行
+	taken := NewLoadBalancer[TextToImageProvider](nil)
+	defer taken.Close()
+	for id := int64(1); id <= 20; id++ {
+		taken.AddInstance(id, newBlockingProvider(), InstanceSettings{})
+	}
+	registry.RegisterType("taken", taken, func(string) (TextToImageProvider, error) { return newBlockingProvider(), nil })
+	if rr := adminCall(a, a.HandleBackends, http.MethodPost, "/api/v1/admin/backends", adminID,
+		map[string]interface{}{"url": "http://gpu-8:8000", "type": "taken"}); rr.Code == http.StatusCreated {
+		t.Fatalf("expected registration to fail when the instance cannot be routed, got %d", rr.Code)
+	}
+	var orphans int
+	testDB.QueryRow("SELECT COUNT(*) FROM backends WHERE url = ?", "http://gpu-8:8000").Scan(&orphans)
+	if orphans != 0 {
+		t.Fatalf("expected the failed registration to leave no row, got %d", orphans)
+	}
+
+	// 删除第一个实例后其他实例的 ID 不变
+	if rr := adminCall(a, a.HandleBackend, http.MethodDelete, "/api/v1/admin/backends/1", adminID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected delete to succeed, got %d", rr.Code)
+	}
+	if _, err := wp.balancer.Instance(1); err != ErrBackendNotFound || wp.balancer.Size() != 2 {
+		t.Fatalf("expected backend 1 to leave the balancer, got %v (size %d)", err, wp.balancer.Size())
+	}
+
+	// 排空：进行中的请求照常完成，新请求只去其他实例
+	inflight, _ := wp.balancer.Instance(ids[0])
+	inflight.outstanding.Add(1)
+	path := "/api/v1/admin/backends/" + strconv.FormatInt(ids[0], 10)
+	if rr := adminCall(a, a.HandleBackend, http.MethodPost, path+"/drain", adminID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected drain to succeed, got %d", rr.Code)
+	}
+	for i := 0; i < 2; i++ {
+		inst, err := wp.balancer.Acquire(context.Background())
+		if err != nil || inst.ID != ids[1] {
+			t.Fatalf("expected new requests to avoid the drained backend, got %v, %v", inst, err)
+		}
+	}
+	wp.balancer.Release(inflight, time.Second, nil)
+
+	other := "/api/v1/admin/backends/" + strconv.FormatInt(ids[1], 10)
+	if rr := adminCall(a, a.HandleBackend, http.MethodPost, other+"/disable", adminID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected disable to succeed, got %d", rr.Code)
+	}
+	if _, err := wp.balancer.tryAcquire(acquireOptions{}); err != ErrNoHealthyBackend {
+		t.Fatalf("expected no backend to accept requests, got %v", err)
+	}
+
+	rr = adminCall(a, a.HandleBackend, http.MethodPatch, path, adminID, map[string]interface{}{
+		"weight": 3, "status": "enabled", "models": []ModelCapability{{Name: "large", MaxSteps: 50}},
+	})
+	var b AdminBackend
+	json.Unmarshal(rr.Body.Bytes(), &b)
+	if rr.Code != http.StatusOK || b.Weight != 3 || b.Live.Weight != 3 || b.Live.Status != BackendEnabled || !slices.Equal(b.Live.Models, []string{"large"}) {
+		t.Fatalf("expected PATCH to update the live instance, got %d %s", rr.Code, rr.Body.String())
+	}
+	for _, body := range []map[string]interface{}{{"capacity": 0}, {"models": []ModelCapability{{MaxSteps: 10}}}} {
+		if rr := adminCall(a, a.HandleBackend, http.MethodPatch, path, adminID, body); rr.Code != http.StatusBadRequest {
+			t.Fatalf("%v: expected status 400, got %d", body, rr.Code)
+		}
+	}
+
+	// 重启后按表中的 ID 和状态重新加载
+	lb := NewLoadBalancer[TextToImageProvider](nil)
+	defer lb.Close()
+	if err := newRegistry(lb).Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	stats := lb.GetStats()["instances"].([]InstanceStats)
+	if len(stats) != 2 || stats[0].ID != ids[0] || stats[0].Weight != 3 || stats[1].Status != BackendDisabled || len(stats[0].Models) != 1 {
+		t.Fatalf("expected the registry to survive a restart, got %+v", stats)
+	}
+}
@@ -3,28 +3,55 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	defaultSSEHeartbeat = 15 * time.Second // 心跳间隔，需小于代理的空闲超时
+	sseRetryInterval    = 3 * time.Second  // 建议客户端的重连间隔
+	syncSpeechTimeout   = 30 * time.Second // 同步语音识别接口的截止时间
+)
+
 // AsyncAPIHandlers 异步 API 处理器集合
 type AsyncAPIHandlers struct {
-	workerPool  *WorkerPool
-	taskManager *TaskManager
-	whisperSvc  SpeechToTextProvider
+	workerPool        *WorkerPool
+	taskManager       *TaskManager
+	speech            *SpeechBalancer
+	speechHedger      *Hedger
+	webhooks          *WebhookStore
+	pipelines         *PipelineRunner
+	heartbeatInterval time.Duration
 }
 
 // NewAsyncAPIHandlers 创建异步 API 处理器
-func NewAsyncAPIHandlers(wp *WorkerPool, tm *TaskManager, ws SpeechToTextProvider) *AsyncAPIHandlers {
+func NewAsyncAPIHandlers(wp *WorkerPool, tm *TaskManager, speech *SpeechBalancer) *AsyncAPIHandlers {
 	return &AsyncAPIHandlers{
-		workerPool:  wp,
-		taskManager: tm,
-		whisperSvc:  ws,
+		workerPool:        wp,
+		taskManager:       tm,
+		speech:            speech,
+		speechHedger:      NewHedger(DefaultHedgePolicy()),
+		webhooks:          NewWebhookStore(tm.db),
+		heartbeatInterval: defaultSSEHeartbeat,
 	}
 }
 
+// SetSpeechHedging 设置同步语音识别接口的对冲和故障转移，见 hedging.go
+func (h *AsyncAPIHandlers) SetSpeechHedging(p HedgePolicy) {
+	h.speechHedger = NewHedger(p)
+}
+
+// SetPipelineRunner 启用流水线接口
+func (h *AsyncAPIHandlers) SetPipelineRunner(r *PipelineRunner) {
+	h.pipelines = r
+}
+
 //
 // ======================
 // 文生图异步接口
@@ -34,7 +61,15 @@ func NewAsyncAPIHandlers(wp *WorkerPool, tm *TaskManager, ws SpeechToTextProvide
 // SubmitImageTaskRequest 提交图片生成任务请求
 type SubmitImageTaskRequest struct {
 	Prompt         string `json:"prompt"`
+	Model          string `json:"model,omitempty"` // 见 GET /api/v1/models，为空时由任意后端生成
 	NegativePrompt string `json:"negative_prompt,omitempty"`
+	Steps          int    `json:"steps,omitempty"`
+	Seed           int64  `json:"seed,omitempty"`
+	Width          int    `json:"width,omitempty"`
+	Height         int    `json:"height,omitempty"`
+	CallbackURL    string `json:"callback_url,omitempty"` // 任务结束时 POST 签名事件到该地址
+	RunAt          string `json:"run_at,omitempty"`       // RFC 3339，到期后才进入队列
+	Cron           string `json:"cron,omitempty"`         // 5 段 cron 表达式，按计划重复生成
 }
 
 // SubmitImageTaskResponse 提交图片生成任务响应
@@ -42,21 +77,37 @@ type SubmitImageTaskResponse struct {
 	TaskID  string `json:"task_id"`
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// CallbackSecret callback_url 第一次使用时生成的签名密钥，之后不再返回（Idempotency-Key 回放的响应中也没有）
+	CallbackSecret string `json:"callback_secret,omitempty"`
+	// CacheHit 结果来自已有图片，任务已经完成
+	CacheHit  bool   `json:"cache_hit,omitempty"`
+	ResultURL string `json:"result_url,omitempty"`
+	// AttachedTo 跟随的相同参数任务，结果会同步到本任务
+	AttachedTo string `json:"attached_to,omitempty"`
+	// RunAt 计划任务的（下一次）执行时间
+	RunAt *time.Time `json:"run_at,omitempty"`
+	// QueuePosition 及预计开始、结束时间，仅排队中的任务返回
+	QueuePosition     int        `json:"queue_position,omitempty"`
+	EstimatedStartAt  *time.Time `json:"estimated_start_at,omitempty"`
+	EstimatedFinishAt *time.Time `json:"estimated_finish_at,omitempty"`
 }
 
 // HandleSubmitImageTask 处理提交图片生成任务
 //
 //	@Summary		Submit image generation task
-//	@Description	Submit an async image generation task and return task ID
+//	@Description	Submit an async image generation task and return task ID. Identical requests may complete immediately from the result cache (cache_hit) or follow an identical task in progress (attached_to). With run_at or cron the task is SCHEDULED and queued when due. A model (see GET /api/v1/models) routes the task to the backends serving it; an unknown model or one that does not support the requested size, steps or features is rejected with 400. When the queue is full or the predicted wait exceeds the admission limit the request is rejected with 503 and a Retry-After header.
 //	@Tags			async-tasks
 //	@Accept			json
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Param			request	body		SubmitImageTaskRequest	true	"Image generation request"
+//	@Param			Idempotency-Key	header		string	false	"Replays the original response when a retry reuses the key"
 //	@Success		202		{object}	SubmitImageTaskResponse
 //	@Failure		400		{object}	map[string]string
 //	@Failure		401		{object}	map[string]string
 //	@Failure		500		{object}	map[string]string
+//	@Failure		422		{object}	map[string]string	"Idempotency-Key reused with a different body"
+//	@Failure		503		{object}	map[string]string	"Queue full or predicted wait too long; see Retry-After"
 //	@Router			/api/v1/image/async [post]
 func (h *AsyncAPIHandlers) HandleSubmitImageTask(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -83,38 +134,174 @@ func (h *AsyncAPIHandlers) HandleSubmitImageTask(w http.ResponseWriter, r *http.
 		errorResponse(w, http.StatusBadRequest, "prompt is required")
 		return
 	}
+	if req.Steps < 0 || req.Width < 0 || req.Height < 0 {
+		errorResponse(w, http.StatusBadRequest, "steps, width and height must be non-negative")
+		return
+	}
+	runAt, err := parseScheduleTime(req.RunAt, req.Cron, time.Now())
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	params := TextToImageRequest{
+		Prompt:         req.Prompt,
+		Model:          req.Model,
+		NegativePrompt: req.NegativePrompt,
+		Steps:          req.Steps,
+		Seed:           req.Seed,
+		Width:          req.Width,
+		Height:         req.Height,
+	}
+	if err := h.checkModel(params); err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// 准入控制：立即执行的任务在队列满或预计等待过长时直接拒绝，
+	// 能由结果缓存完成的请求不占用后端，不受限制
+	if runAt.IsZero() {
+		if retryAfter, err := h.workerPool.Admit(); err != nil {
+			reusable, cacheErr := h.taskManager.ResultReusable(userID, params)
+			if cacheErr != nil {
+				log.Printf("Result cache check for user %d failed: %v", userID, cacheErr)
+			}
+			if !reusable {
+				writeOverloaded(w, retryAfter, err)
+				return
+			}
+		}
+	}
+
+	// callback_url 注册为该用户的非默认 endpoint，第一次使用时返回签名密钥
+	var callbackSecret string
+	if req.CallbackURL != "" {
+		ep, created, err := h.webhooks.EnsureCallbackEndpoint(userID, req.CallbackURL)
+		if errors.Is(err, ErrInvalidWebhookURL) {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to register callback")
+			return
+		}
+		if created {
+			callbackSecret = ep.Secret
+		}
+	}
 
 	// 创建任务
-	task, err := h.taskManager.CreateTask(userID, req.Prompt)
+	task, err := h.taskManager.CreateTask(userID, params, TaskOptions{CallbackURL: req.CallbackURL, RunAt: runAt, Cron: req.Cron})
 	if err != nil {
 		errorResponse(w, http.StatusInternalServerError, "failed to create task")
 		return
 	}
 
-	// 提交到 worker pool
-	if err := h.workerPool.Submit(task); err != nil {
-		errorResponse(w, http.StatusServiceUnavailable, "task queue is full, please try again later")
+	resp := SubmitImageTaskResponse{
+		TaskID:         task.ID,
+		Status:         task.Status,
+		Message:        "task submitted successfully",
+		CallbackSecret: callbackSecret,
+	}
+
+	// 计划任务由调度器到期后提交
+	if task.Status == TaskScheduled {
+		resp.Message = "task scheduled"
+		resp.RunAt = task.RunAt
+		writeJSON(w, http.StatusAccepted, resp)
 		return
 	}
 
+	// 相同参数的结果已存在或正在生成时不再提交到后端；缓存出错时按未命中处理
+	handled, err := h.taskManager.ApplyResultCache(task)
+	if err != nil {
+		log.Printf("Result cache lookup for task %s failed: %v", task.ID, err)
+	}
+	switch {
+	case handled && task.CacheHit:
+		resp.Message = "served from result cache"
+	case handled:
+		resp.Message = "attached to an identical task in progress"
+	default:
+		// 提交到 worker pool；准入检查之后队列仍可能被并发请求占满
+		if err := h.workerPool.Submit(task); err != nil {
+			task.Status = TaskFailed
+			task.ErrorMsg = err.Error()
+			task.UpdatedAt = time.Now()
+			if err := h.taskManager.UpdateTask(task); err != nil {
+				log.Printf("Failed to mark rejected task %s as failed: %v", task.ID, err)
+			}
+			writeOverloaded(w, h.workerPool.EstimateQueued(1).StartAt.Sub(time.Now()), err)
+			return
+		}
+	}
+
+	resp.Status = task.Status
+	resp.CacheHit = task.CacheHit
+	resp.ResultURL = task.ResultURL
+	resp.AttachedTo = task.AttachedTo
+	if position, eta, ok := h.taskETA(task); ok {
+		resp.QueuePosition = position
+		resp.EstimatedStartAt = &eta.StartAt
+		resp.EstimatedFinishAt = &eta.FinishAt
+	}
+
 	// 返回任务 ID
-	writeJSON(w, http.StatusAccepted, SubmitImageTaskResponse{
-		TaskID:  task.ID,
-		Status:  task.Status,
-		Message: "task submitted successfully",
-	})
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+// writeOverloaded 返回 503 和建议的 Retry-After（秒）
+func writeOverloaded(w http.ResponseWriter, retryAfter time.Duration, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	if errors.Is(err, ErrAdmissionRejected) {
+		errorResponse(w, http.StatusServiceUnavailable, "server is busy, predicted wait exceeds the limit, please try again later")
+		return
+	}
+	errorResponse(w, http.StatusServiceUnavailable, "task queue is full, please try again later")
+}
+
+// TaskStatusResponse 任务状态，排队或执行中的任务附带排队位置和预计开始、结束时间
+type TaskStatusResponse struct {
+	*ImageTask
+	QueuePosition     int        `json:"queue_position,omitempty"`
+	EstimatedStartAt  *time.Time `json:"estimated_start_at,omitempty"`
+	EstimatedFinishAt *time.Time `json:"estimated_finish_at,omitempty"`
+}
+
+// taskETA 计算排队位置和预计时间；跟随其他任务时按被跟随的任务计算，任务未在排队或执行时返回 false
+func (h *AsyncAPIHandlers) taskETA(task *ImageTask) (int, TaskEstimate, bool) {
+	if h.workerPool == nil {
+		return 0, TaskEstimate{}, false
+	}
+
+	id := task.AttachedTo
+	if id == "" {
+		id = task.ID
+	}
+	switch task.Status {
+	case TaskQueued:
+		position, err := h.taskManager.QueuePosition(id)
+		if err != nil || position == 0 {
+			return 0, TaskEstimate{}, false
+		}
+		return position, h.workerPool.EstimateQueued(position), true
+	case TaskRunning:
+		eta, ok := h.workerPool.EstimateRunning(id)
+		return 0, eta, ok
+	}
+	return 0, TaskEstimate{}, false
 }
 
 // HandleGetTaskStatus 查询任务状态
 //
 //	@Summary		Get task status
-//	@Description	Query the status of an async task by task ID
+//	@Description	Query the status of an async task by task ID. Queued and running tasks include queue_position and estimated_start_at / estimated_finish_at, derived from recent generation durations.
 //	@Tags			async-tasks
 //	@Accept			json
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Param			task_id	path		string	true	"Task ID"
-//	@Success		200		{object}	ImageTask
+//	@Success		200		{object}	TaskStatusResponse
 //	@Failure		401		{object}	map[string]string
 //	@Failure		404		{object}	map[string]string
 //	@Router			/api/v1/tasks/{task_id} [get]
@@ -152,7 +339,13 @@ func (h *AsyncAPIHandlers) HandleGetTaskStatus(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	writeJSON(w, http.StatusOK, task)
+	resp := TaskStatusResponse{ImageTask: task}
+	if position, eta, ok := h.taskETA(task); ok {
+		resp.QueuePosition = position
+		resp.EstimatedStartAt = &eta.StartAt
+		resp.EstimatedFinishAt = &eta.FinishAt
+	}
+	writeJSON(w, http.StatusOK, resp)
 }
 
 // HandleGetUserTasks 获取用户的所有任务
@@ -199,6 +392,226 @@ func (h *AsyncAPIHandlers) HandleGetUserTasks(w http.ResponseWriter, r *http.Req
 	writeJSON(w, http.StatusOK, tasks)
 }
 
+//
+// ======================
+// 任务事件推送（Server-Sent Events）
+// ======================
+//
+
+// HandleTaskEvents 推送单个任务的状态变化，任务结束后关闭连接
+//
+//	@Summary		Task events stream
+//	@Description	Server-Sent Events stream of status transitions, queue position and result_url for one task. Supports Last-Event-ID resume.
+//	@Tags			async-tasks
+//	@Produce		text/event-stream
+//	@Security		BearerAuth
+//	@Param			task_id			path		string	true	"Task ID"
+//	@Param			Last-Event-ID	header		string	false	"Resume after this event ID"
+//	@Success		200				{object}	TaskEvent
+//	@Failure		401				{object}	map[string]string
+//	@Failure		403				{object}	map[string]string
+//	@Failure		404				{object}	map[string]string
+//	@Router			/api/v1/tasks/{task_id}/events [get]
+func (h *AsyncAPIHandlers) HandleTaskEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	userIDStr := r.Header.Get("X-User-ID")
+	userID, err := strconv.ParseInt(userIDStr, 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	// 支持 /api/v1/tasks/{id}/events 和 ?task_id= 两种形式
+	taskID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/"), "/events")
+	if taskID == "" || strings.Contains(taskID, "/") {
+		taskID = r.URL.Query().Get("task_id")
+	}
+	if taskID == "" {
+		errorResponse(w, http.StatusBadRequest, "task_id is required")
+		return
+	}
+
+	task, err := h.taskManager.GetTask(taskID)
+	if err != nil {
+		errorResponse(w, http.StatusNotFound, "task not found")
+		return
+	}
+	if task.UserID != userID {
+		errorResponse(w, http.StatusForbidden, "access denied")
+		return
+	}
+
+	h.streamTaskEvents(w, r, EventFilter{UserID: userID, TaskID: taskID}, true)
+}
+
+// HandleUserTaskEvents 推送当前用户所有任务的状态变化
+//
+//	@Summary		User task events stream
+//	@Description	Server-Sent Events stream of every task of the authenticated user. Supports Last-Event-ID resume.
+//	@Tags			async-tasks
+//	@Produce		text/event-stream
+//	@Security		BearerAuth
+//	@Param			Last-Event-ID	header		string	false	"Resume after this event ID"
+//	@Success		200				{object}	TaskEvent
+//	@Failure		401				{object}	map[string]string
+//	@Router			/api/v1/tasks/events [get]
+func (h *AsyncAPIHandlers) HandleUserTaskEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	userIDStr := r.Header.Get("X-User-ID")
+	userID, err := strconv.ParseInt(userIDStr, 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	h.streamTaskEvents(w, r, EventFilter{UserID: userID}, false)
+}
+
+// streamTaskEvents 输出 SSE 事件流。
+// 无法从 Last-Event-ID 续传时先发送匹配任务的当前快照；singleTask 为 true 时任务结束即关闭流。
+func (h *AsyncAPIHandlers) streamTaskEvents(w http.ResponseWriter, r *http.Request, filter EventFilter, singleTask bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorResponse(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	lastID, _ := strconv.ParseUint(lastEventID, 10, 64)
+
+	// 先订阅再读取快照，避免两者之间的事件丢失
+	sub := h.taskManager.Events().SubscribeClient(filter, lastID)
+	defer sub.Cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // 关闭 nginx 缓冲
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryInterval.Milliseconds())
+
+	// 补发的历史事件 ID 都不大于 sub.LastID，之后收到的新事件都大于它，因此不会重复
+	send := func(e TaskEvent) bool {
+		if err := writeSSEEvent(w, e); err != nil {
+			return false
+		}
+		return !(singleTask && e.IsTerminal())
+	}
+
+	backlog := sub.Replay
+	if !sub.Resumed {
+		backlog = h.taskSnapshot(filter, sub.LastID)
+	}
+	for _, e := range backlog {
+		if !send(e) {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	// 续传时任务可能早已结束，终态事件客户端已经收到过
+	if singleTask && sub.Resumed {
+		if task, err := h.taskManager.GetTask(filter.TaskID); err == nil && isTerminalStatus(task.Status) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(h.heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// 注释行不会触发客户端事件，只用来防止代理断开空闲连接
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-sub.Events:
+			if !ok {
+				// 消费过慢，订阅已关闭：结束事件流，客户端按 retry 重连并带上 Last-Event-ID
+				return
+			}
+			ok = send(e)
+			flusher.Flush()
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// taskSnapshot 生成匹配任务的当前状态事件，事件 ID 使用订阅时刻的最新 ID
+func (h *AsyncAPIHandlers) taskSnapshot(filter EventFilter, lastID uint64) []TaskEvent {
+	var tasks []*ImageTask
+	if filter.TaskID != "" {
+		task, err := h.taskManager.GetTask(filter.TaskID)
+		if err != nil {
+			return nil
+		}
+		tasks = append(tasks, task)
+	} else {
+		userTasks, err := h.taskManager.GetUserTasks(filter.UserID, 50)
+		if err != nil {
+			return nil
+		}
+		// 只推送未结束的任务，已结束的任务可以通过 /api/v1/tasks 查询
+		for _, task := range userTasks {
+			if !isTerminalStatus(task.Status) {
+				tasks = append(tasks, task)
+			}
+		}
+	}
+
+	events := make([]TaskEvent, 0, len(tasks))
+	for _, task := range tasks {
+		event := TaskEvent{
+			ID:        lastID,
+			Type:      TaskEventStatus,
+			TaskID:    task.ID,
+			UserID:    task.UserID,
+			Status:    task.Status,
+			ResultURL: task.ResultURL,
+			ErrorMsg:  task.ErrorMsg,
+			Time:      task.UpdatedAt,
+		}
+		if task.Status == TaskQueued {
+			event.QueuePosition, _ = h.taskManager.QueuePosition(task.ID)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// writeSSEEvent 按 SSE 格式写出一个事件
+func writeSSEEvent(w io.Writer, e TaskEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.ID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", e.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+	return err
+}
+
 //
 // ======================
 // 语音转文字接口
@@ -208,7 +621,7 @@ func (h *AsyncAPIHandlers) HandleGetUserTasks(w http.ResponseWriter, r *http.Req
 // HandleSpeechToText 处理语音转文字（同步接口）
 //
 //	@Summary		Speech to text
-//	@Description	Convert audio file to text
+//	@Description	Convert a short audio file to text synchronously (30s limit). Requests that fail to connect are retried on another instance, and slow requests may be hedged to a second instance (SPEECH_HEDGE_PERCENTILE). Use POST /api/v1/speech/async for long recordings.
 //	@Tags			speech
 //	@Accept			multipart/form-data
 //	@Produce		json
@@ -217,6 +630,7 @@ func (h *AsyncAPIHandlers) HandleGetUserTasks(w http.ResponseWriter, r *http.Req
 //	@Success		200		{object}	SpeechToTextResponse
 //	@Failure		400		{object}	map[string]string
 //	@Failure		401		{object}	map[string]string
+//	@Failure		503		{object}	map[string]string
 //	@Router			/api/v1/speech/transcribe [post]
 func (h *AsyncAPIHandlers) HandleSpeechToText(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -244,11 +658,15 @@ func (h *AsyncAPIHandlers) HandleSpeechToText(w http.ResponseWriter, r *http.Req
 		return
 	}
 
-	// 调用语音识别服务
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// 调用语音识别服务：对冲和故障转移的所有请求都在截止时间内完成，客户端断开时一并取消
+	ctx, cancel := context.WithTimeout(r.Context(), syncSpeechTimeout)
 	defer cancel()
 
-	result, err := h.whisperSvc.TranscribeFile(ctx, audioData, header.Filename)
+	result, err := h.transcribe(ctx, audioData, "file", header.Filename)
+	if errors.Is(err, ErrNoBackend) || errors.Is(err, ErrNoHealthyBackend) {
+		errorResponse(w, http.StatusServiceUnavailable, "speech-to-text service unavailable")
+		return
+	}
 	if err != nil {
 		errorResponse(w, http.StatusInternalServerError, "transcription failed: "+err.Error())
 		return
@@ -260,7 +678,7 @@ func (h *AsyncAPIHandlers) HandleSpeechToText(w http.ResponseWriter, r *http.Req
 // HandleSpeechToTextPCM 处理 PCM 音频转文字（ESP32 专用）
 //
 //	@Summary		Speech to text (PCM)
-//	@Description	Convert PCM audio data to text (for ESP32)
+//	@Description	Convert PCM audio data to text (for ESP32). Failover and hedging work as for /api/v1/speech/transcribe, within the same 30s limit.
 //	@Tags			speech
 //	@Accept			application/octet-stream
 //	@Produce		json
@@ -269,6 +687,7 @@ func (h *AsyncAPIHandlers) HandleSpeechToText(w http.ResponseWriter, r *http.Req
 //	@Success		200		{object}	SpeechToTextResponse
 //	@Failure		400		{object}	map[string]string
 //	@Failure		401		{object}	map[string]string
+//	@Failure		503		{object}	map[string]string
 //	@Router			/api/v1/speech/pcm [post]
 func (h *AsyncAPIHandlers) HandleSpeechToTextPCM(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -283,11 +702,15 @@ func (h *AsyncAPIHandlers) HandleSpeechToTextPCM(w http.ResponseWriter, r *http.
 		return
 	}
 
-	// 调用语音识别服务
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// 调用语音识别服务：对冲和故障转移的所有请求都在截止时间内完成，客户端断开时一并取消
+	ctx, cancel := context.WithTimeout(r.Context(), syncSpeechTimeout)
 	defer cancel()
 
-	result, err := h.whisperSvc.TranscribePCM(ctx, pcmData)
+	result, err := h.transcribe(ctx, pcmData, "pcm", "")
+	if errors.Is(err, ErrNoBackend) || errors.Is(err, ErrNoHealthyBackend) {
+		errorResponse(w, http.StatusServiceUnavailable, "speech-to-text service unavailable")
+		return
+	}
 	if err != nil {
 		errorResponse(w, http.StatusInternalServerError, "transcription failed: "+err.Error())
 		return
@@ -296,6 +719,165 @@ func (h *AsyncAPIHandlers) HandleSpeechToTextPCM(w http.ResponseWriter, r *http.
 	writeJSON(w, http.StatusOK, result)
 }
 
+// transcribe 同步接口调用语音识别，按格式分别统计耗时用于对冲；没有配置语音识别服务时返回 ErrNoBackend
+func (h *AsyncAPIHandlers) transcribe(ctx context.Context, audio []byte, format, filename string) (SpeechToTextResponse, error) {
+	if h.speech == nil {
+		return SpeechToTextResponse{}, ErrNoBackend
+	}
+	return hedgedCall(ctx, h.speechHedger, h.speech, format, func(ctx context.Context, client SpeechToTextProvider) (SpeechToTextResponse, error) {
+		return transcribeWith(ctx, client, audio, format, filename)
+	})
+}
+
+// maxAsyncAudioSize 异步语音识别接受的最大上传大小
+const maxAsyncAudioSize = 200 << 20
+
+// SubmitTaskResponse 提交非文生图任务的响应
+type SubmitTaskResponse struct {
+	TaskID  string `json:"task_id"`
+	Kind    string `json:"kind"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// CallbackSecret callback_url 第一次使用时生成的签名密钥，之后不再返回（Idempotency-Key 回放的响应中也没有）
+	CallbackSecret    string     `json:"callback_secret,omitempty"`
+	QueuePosition     int        `json:"queue_position,omitempty"`
+	EstimatedStartAt  *time.Time `json:"estimated_start_at,omitempty"`
+	EstimatedFinishAt *time.Time `json:"estimated_finish_at,omitempty"`
+}
+
+// HandleSubmitSpeechTask 提交异步语音识别任务
+//
+//	@Summary		Submit speech-to-text task
+//	@Description	Upload an audio file and transcribe it asynchronously as a speech.transcribe task. Use this for long recordings that do not fit the synchronous endpoint's time limit. The transcription is returned in the task's output.
+//	@Tags			speech
+//	@Accept			multipart/form-data
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			file			formData	file	true	"Audio file"
+//	@Param			format			formData	string	false	"file (default) or pcm"
+//	@Param			callback_url	formData	string	false	"POST a signed event here when the task finishes"
+//	@Success		202				{object}	SubmitTaskResponse
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string
+//	@Failure		413				{object}	map[string]string
+//	@Failure		503				{object}	map[string]string	"Queue full or predicted wait too long; see Retry-After"
+//	@Router			/api/v1/speech/async [post]
+func (h *AsyncAPIHandlers) HandleSubmitSpeechTask(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	if !h.workerPool.Handles(TaskKindSpeechTranscribe) {
+		errorResponse(w, http.StatusServiceUnavailable, "speech-to-text service is not configured")
+		return
+	}
+
+	// 准入控制在读取上传之前进行，过载时不必接收整个音频文件
+	if retryAfter, err := h.workerPool.Admit(); err != nil {
+		writeOverloaded(w, retryAfter, err)
+		return
+	}
+
+	// 超过内存阈值的部分写入临时文件
+	r.Body = http.MaxBytesReader(w, r.Body, maxAsyncAudioSize)
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			errorResponse(w, http.StatusRequestEntityTooLarge, "audio file is too large")
+			return
+		}
+		errorResponse(w, http.StatusBadRequest, "failed to parse form")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	defer file.Close()
+
+	audioData, err := io.ReadAll(file)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to read file")
+		return
+	}
+	if len(audioData) == 0 {
+		errorResponse(w, http.StatusBadRequest, "file is empty")
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "file"
+	}
+	if format != "file" && format != "pcm" {
+		errorResponse(w, http.StatusBadRequest, "format must be file or pcm")
+		return
+	}
+
+	callbackURL := r.FormValue("callback_url")
+	var callbackSecret string
+	if callbackURL != "" {
+		ep, created, err := h.webhooks.EnsureCallbackEndpoint(userID, callbackURL)
+		if errors.Is(err, ErrInvalidWebhookURL) {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to register callback")
+			return
+		}
+		if created {
+			callbackSecret = ep.Secret
+		}
+	}
+
+	input, _ := json.Marshal(SpeechTranscribeInput{
+		Filename:  header.Filename,
+		Format:    format,
+		SizeBytes: len(audioData),
+	})
+	task, err := h.taskManager.CreateJob(userID, TaskKindSpeechTranscribe, input, audioData, TaskOptions{CallbackURL: callbackURL})
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to create task")
+		return
+	}
+
+	if err := h.workerPool.Submit(task); err != nil {
+		task.Status = TaskFailed
+		task.ErrorMsg = err.Error()
+		if err := h.taskManager.UpdateTask(task); err != nil {
+			log.Printf("Failed to mark rejected task %s as failed: %v", task.ID, err)
+		}
+		writeOverloaded(w, h.workerPool.EstimateQueued(1).StartAt.Sub(time.Now()), err)
+		return
+	}
+
+	resp := SubmitTaskResponse{
+		TaskID:         task.ID,
+		Kind:           task.Kind,
+		Status:         task.Status,
+		Message:        "task submitted successfully",
+		CallbackSecret: callbackSecret,
+	}
+	if position, eta, ok := h.taskETA(task); ok {
+		resp.QueuePosition = position
+		resp.EstimatedStartAt = &eta.StartAt
+		resp.EstimatedFinishAt = &eta.FinishAt
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
 //
 // ======================
 // 系统监控接口
@@ -305,17 +887,34 @@ func (h *AsyncAPIHandlers) HandleSpeechToTextPCM(w http.ResponseWriter, r *http.
 // HandleSystemStats 获取系统统计信息
 //
 //	@Summary		System statistics
-//	@Description	Get system statistics including queue length and worker status
+//	@Description	Get system statistics: queue length, live workers and recent scaling decisions, running tasks, whether the worker pool is paused, rolling per-backend generation durations, load balancing strategy with per-instance slot utilization, failures, latency EWMA and circuit breaker state for image generation and speech-to-text backends, hedging and failover counters of the synchronous speech endpoints, predicted wait for a new task, the admission limit and remote workers seen in the last minute
 //	@Tags			system
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Success		200	{object}	map[string]interface{}
 //	@Router			/api/v1/system/stats [get]
 func (h *AsyncAPIHandlers) HandleSystemStats(w http.ResponseWriter, r *http.Request) {
+	wp := h.workerPool
 	stats := map[string]interface{}{
-		"queue_length":   h.workerPool.GetQueueLength(),
-		"queue_capacity": h.workerPool.GetQueueCapacity(),
-		"queue_usage":    float64(h.workerPool.GetQueueLength()) / float64(h.workerPool.GetQueueCapacity()) * 100,
+		"queue_length":               wp.GetQueueLength(),
+		"queue_capacity":             wp.GetQueueCapacity(),
+		"queue_usage":                float64(wp.GetQueueLength()) / float64(wp.GetQueueCapacity()) * 100,
+		"workers":                    wp.WorkerCount(),
+		"scaling":                    wp.ScalingStats(),
+		"running":                    wp.RunningCount(),
+		"paused":                     wp.Paused(),
+		"avg_generation_seconds":     wp.Durations().Average().Seconds(),
+		"predicted_wait_seconds":     wp.PredictedWait().Seconds(),
+		"admission_max_wait_seconds": wp.AdmissionLimit().Seconds(),
+		"backends":                   wp.Durations().Stats(),
+		"load_balancer":              wp.balancer.GetStats(),
+	}
+	if h.speech != nil {
+		stats["speech_load_balancer"] = h.speech.GetStats()
+		stats["speech_hedging"] = h.speechHedger.Stats()
+	}
+	if workers, err := h.taskManager.ListRemoteWorkers(time.Now().Add(-remoteWorkerActiveFor)); err == nil {
+		stats["remote_workers"] = workers
 	}
 
 	writeJSON(w, http.StatusOK, stats)
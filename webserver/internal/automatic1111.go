@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Automatic1111 调用 stable-diffusion-webui 的 API（以 --api 启动）实现 TextToImageProvider。
+// 请求指定模型时作为 checkpoint 名（如 sd_xl_base_1.0.safetensors）通过 override_settings 切换，
+// 否则使用服务端当前加载的 checkpoint
+type Automatic1111 struct {
+	baseURL *url.URL
+	client  *http.Client
+}
+
+const (
+	a1111ModelName   = "automatic1111" // 不指定 checkpoint 时的模型名
+	defaultImageSize = 512             // 请求没有指定宽高时使用
+)
+
+// NewAutomatic1111 构造函数，允许自定义 http.Client。
+// 默认 client 不设置整体超时，生成耗时由调用方通过 ctx 的截止时间控制。
+func NewAutomatic1111(rawURL string, client *http.Client) (*Automatic1111, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parse base url: %w", err)
+	}
+
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &Automatic1111{baseURL: parsed, client: client}, nil
+}
+
+// Ping 通过 /internal/ping 检查服务是否启动
+func (a *Automatic1111) Ping(ctx context.Context) error {
+	if a == nil {
+		return errors.New("nil Automatic1111 receiver")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.resolvePath("/internal/ping"), nil)
+	if err != nil {
+		return fmt.Errorf("create ping request: %w", err)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("execute ping request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("ping failed: status %d, body: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
+
+func (a *Automatic1111) Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error) {
+	var empty TextToImageResponse
+	if a == nil {
+		return empty, errors.New("nil Automatic1111 receiver")
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultGenerateTimeout)
+		defer cancel()
+	}
+
+	payload := struct {
+		Prompt           string            `json:"prompt"`
+		NegativePrompt   string            `json:"negative_prompt,omitempty"`
+		Steps            int               `json:"steps"`
+		Width            int               `json:"width"`
+		Height           int               `json:"height"`
+		Seed             int64             `json:"seed"`
+		BatchSize        int               `json:"batch_size"`
+		OverrideSettings map[string]string `json:"override_settings,omitempty"`
+	}{
+		Prompt:         req.Prompt,
+		NegativePrompt: req.NegativePrompt,
+		Steps:          orDefault(req.Steps, defaultInferenceSteps),
+		Width:          orDefault(req.Width, defaultImageSize),
+		Height:         orDefault(req.Height, defaultImageSize),
+		Seed:           -1, // 随机
+		BatchSize:      1,
+	}
+	if req.Seed != 0 {
+		payload.Seed = req.Seed
+	}
+	if req.Model != "" && req.Model != a1111ModelName {
+		payload.OverrideSettings = map[string]string{"sd_model_checkpoint": req.Model}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return empty, fmt.Errorf("marshal txt2img payload: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, a.resolvePath("/sdapi/v1/txt2img"), bytes.NewReader(body))
+	if err != nil {
+		return empty, fmt.Errorf("create txt2img request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(httpReq)
+	if err != nil {
+		return empty, fmt.Errorf("execute txt2img request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return empty, fmt.Errorf("txt2img failed: status %d, body: %s", resp.StatusCode, detail)
+	}
+
+	var result struct {
+		Images []string `json:"images"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return empty, fmt.Errorf("decode txt2img response: %w", err)
+	}
+	if len(result.Images) == 0 {
+		return empty, errors.New("txt2img returned no images")
+	}
+	return decodeBase64Image(result.Images[0])
+}
+
+// InstanceName 返回实例的 base URL，用于记录生成来源
+func (a *Automatic1111) InstanceName() string {
+	return a.baseURL.String()
+}
+
+// ModelName 返回后端模型名称
+func (a *Automatic1111) ModelName() string {
+	return a1111ModelName
+}
+
+// Models 只声明当前加载的 checkpoint；服务端上的其他 checkpoint 需要在 backends 表的 models 中按名称配置
+func (a *Automatic1111) Models() []ModelCapability {
+	return []ModelCapability{{Name: a1111ModelName, Features: []string{FeatureNegativePrompt, FeatureSeed}}}
+}
+
+func (a *Automatic1111) resolvePath(path string) string {
+	u := *a.baseURL
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	return u.String()
+}
+
+// orDefault v 未设置（<= 0）时返回 def
+func orDefault(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// decodeBase64Image 解码 base64 图片，兼容 data URL 前缀，按内容识别 MIME 类型
+func decodeBase64Image(encoded string) (TextToImageResponse, error) {
+	if i := strings.Index(encoded, ";base64,"); i >= 0 {
+		encoded = encoded[i+len(";base64,"):]
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return TextToImageResponse{}, fmt.Errorf("decode base64 image: %w", err)
+	}
+	return TextToImageResponse{ImageData: data, MimeType: http.DetectContentType(data)}, nil
+}
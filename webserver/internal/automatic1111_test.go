@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// testPNG 编码一张 w x h 的空白 PNG
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestAutomatic1111Generate(t *testing.T) {
+	img := testPNG(t, 64, 32)
+	var got map[string]any
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /internal/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	})
+	mux.HandleFunc("POST /sdapi/v1/txt2img", func(w http.ResponseWriter, r *http.Request) {
+		got = nil
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(map[string]any{
+			"images":     []string{base64.StdEncoding.EncodeToString(img)},
+			"parameters": got,
+			"info":       "{}",
+		})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	a, err := NewAutomatic1111(srv.URL+"/", nil)
+	if err != nil {
+		t.Fatalf("NewAutomatic1111: %v", err)
+	}
+	if err := a.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	resp, err := a.Generate(context.Background(), TextToImageRequest{
+		Prompt: "a red fox", NegativePrompt: "blurry", Width: 64, Height: 32, Steps: 12, Seed: 42, Model: "sdxl.safetensors",
+	})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !bytes.Equal(resp.ImageData, img) || resp.MimeType != "image/png" {
+		t.Fatalf("unexpected image: %d bytes, %s", len(resp.ImageData), resp.MimeType)
+	}
+	override, _ := got["override_settings"].(map[string]any)
+	if got["prompt"] != "a red fox" || got["negative_prompt"] != "blurry" || got["seed"] != 42.0 ||
+		got["width"] != 64.0 || got["height"] != 32.0 || got["steps"] != 12.0 || override["sd_model_checkpoint"] != "sdxl.safetensors" {
+		t.Fatalf("unexpected txt2img payload: %v", got)
+	}
+
+	// 未指定的参数：随机种子、默认尺寸和步数，不切换 checkpoint
+	if _, err := a.Generate(context.Background(), TextToImageRequest{Prompt: "a red fox", Model: a1111ModelName}); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if got["seed"] != -1.0 || got["width"] != float64(defaultImageSize) || got["steps"] != float64(defaultInferenceSteps) || got["override_settings"] != nil {
+		t.Fatalf("unexpected defaults: %v", got)
+	}
+}
+
+func TestAutomatic1111Errors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sdapi/v1/txt2img" {
+			w.Write([]byte(`{"images": []}`))
+			return
+		}
+		http.Error(w, "loading", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	a, _ := NewAutomatic1111(srv.URL, nil)
+	if err := a.Ping(context.Background()); err == nil {
+		t.Fatal("expected ping to fail while the server is not ready")
+	}
+	if _, err := a.Generate(context.Background(), TextToImageRequest{Prompt: "a red fox"}); err == nil {
+		t.Fatal("expected an error when no images are returned")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+//
+// ======================
+// Worker 数量自动调整
+// ======================
+//
+// worker 数量在 ScalingPolicy.Min 和 Max 之间变化：目标值为排队与执行中的任务数，且不超过可用文生图后端
+// 能同时处理的请求数（多出来的 worker 只会在后端排队，还会让截止时间提前耗尽）。扩容立即生效；需求持续
+// 低于当前数量 ScaleDownDelay 之后才缩容，多出的 worker 完成手上的任务后退出，空闲的立即退出。
+//
+
+const (
+	defaultScaleInterval  = 5 * time.Second
+	defaultScaleDownDelay = time.Minute
+	scalingHistory        = 20 // 保留的调整记录条数
+)
+
+// ScalingPolicy worker 数量的上下限和调整节奏，Min == Max 时数量固定
+type ScalingPolicy struct {
+	Min            int           `json:"min"`
+	Max            int           `json:"max"`
+	Interval       time.Duration `json:"-"` // 检查间隔，提交任务时也会立即检查
+	ScaleDownDelay time.Duration `json:"-"` // 需求持续低于当前数量多久后缩容，避免抖动
+}
+
+// DefaultScalingPolicy 默认 2 到 8 个 worker
+func DefaultScalingPolicy() ScalingPolicy {
+	return ScalingPolicy{
+		Min:            2,
+		Max:            8,
+		Interval:       defaultScaleInterval,
+		ScaleDownDelay: defaultScaleDownDelay,
+	}
+}
+
+// dynamic 是否需要自动调整
+func (p ScalingPolicy) dynamic() bool {
+	return p.Max > p.Min
+}
+
+// ScalingDecision 一次 worker 目标数量的调整
+type ScalingDecision struct {
+	Time            time.Time `json:"time"`
+	From            int       `json:"from"`
+	To              int       `json:"to"`
+	QueueLength     int       `json:"queue_length"`
+	Running         int       `json:"running"`
+	HealthyCapacity int       `json:"healthy_capacity"` // 可用后端的并发槽位之和，-1 表示没有配置文生图和语音识别后端
+	Reason          string    `json:"reason"`
+}
+
+// ScalingStats worker 数量和最近的调整记录（新的在前）
+type ScalingStats struct {
+	ScalingPolicy
+	Workers   int               `json:"workers"` // 当前存活的 worker，缩容时可能暂时多于 Target
+	Target    int               `json:"target"`
+	Decisions []ScalingDecision `json:"decisions"`
+}
+
+// SetScalingPolicy 设置 worker 数量范围，需在 Start 之前调用；Min 至少为 1，Max 小于 Min 时按 Min 固定
+func (wp *WorkerPool) SetScalingPolicy(p ScalingPolicy) {
+	if p.Min < 1 {
+		p.Min = 1
+	}
+	if p.Max < p.Min {
+		p.Max = p.Min
+	}
+	if p.Interval <= 0 {
+		p.Interval = defaultScaleInterval
+	}
+	if p.ScaleDownDelay < 0 {
+		p.ScaleDownDelay = 0
+	}
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.scaling = p
+	wp.target = p.Min
+}
+
+// WorkerCount 当前存活的 worker 数
+func (wp *WorkerPool) WorkerCount() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return len(wp.workers)
+}
+
+// targetWorkers 当前目标 worker 数，用于排队时间预估
+func (wp *WorkerPool) targetWorkers() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.target
+}
+
+// WorkerIDs 存活 worker 的编号，升序
+func (wp *WorkerPool) WorkerIDs() []int {
+	wp.mu.Lock()
+	ids := make([]int, 0, len(wp.workers))
+	for id := range wp.workers {
+		ids = append(ids, id)
+	}
+	wp.mu.Unlock()
+	sort.Ints(ids)
+	return ids
+}
+
+// ScalingStats 返回 worker 数量和最近的调整记录
+func (wp *WorkerPool) ScalingStats() ScalingStats {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	stats := ScalingStats{
+		ScalingPolicy: wp.scaling,
+		Workers:       len(wp.workers),
+		Target:        wp.target,
+		Decisions:     make([]ScalingDecision, 0, len(wp.decisions)),
+	}
+	for i := len(wp.decisions) - 1; i >= 0; i-- {
+		stats.Decisions = append(stats.Decisions, wp.decisions[i])
+	}
+	return stats
+}
+
+// spawnWorkers 启动 worker 直到存活数达到目标，调用方持有 wp.mu；pool 已停止时不再启动
+func (wp *WorkerPool) spawnWorkers() {
+	if wp.ctx.Err() != nil {
+		return
+	}
+	for len(wp.workers) < wp.target {
+		id := wp.nextWorkerID
+		wp.nextWorkerID++
+		wp.workers[id] = struct{}{}
+		wp.wg.Add(1)
+		go wp.worker(id)
+	}
+}
+
+// retire 存活 worker 多于目标时让 id 退出，返回 true 表示 worker 应当退出
+func (wp *WorkerPool) retire(id int) bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if len(wp.workers) <= wp.target {
+		return false
+	}
+	delete(wp.workers, id)
+	return true
+}
+
+// workerExited 从存活列表中移除 worker
+func (wp *WorkerPool) workerExited(id int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	delete(wp.workers, id)
+}
+
+// resizedChan 目标数量下一次减少时关闭的 channel，空闲 worker 借此及时退出
+func (wp *WorkerPool) resizedChan() <-chan struct{} {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.resized
+}
+
+// nudgeScaler 提交任务后立即触发一次检查，不阻塞
+func (wp *WorkerPool) nudgeScaler() {
+	select {
+	case wp.nudge <- struct{}{}:
+	default:
+	}
+}
+
+// autoscale 定期或在提交任务后调整 worker 数量
+func (wp *WorkerPool) autoscale(interval time.Duration) {
+	defer wp.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wp.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wp.nudge:
+		}
+		wp.rescale(time.Now())
+	}
+}
+
+// healthyCapacity 返回文生图和语音识别后端的可用槽位之和，都没有配置时返回 -1
+func (wp *WorkerPool) healthyCapacity() int {
+	capacity, configured := 0, false
+	if wp.balancer.Size() > 0 {
+		capacity += wp.balancer.HealthyCapacity()
+		configured = true
+	}
+	if wp.speech != nil && wp.speech.Size() > 0 {
+		capacity += wp.speech.HealthyCapacity()
+		configured = true
+	}
+	if !configured {
+		return -1
+	}
+	return capacity
+}
+
+// rescale 按当前排队数、执行数和可用后端容量计算目标 worker 数并调整
+func (wp *WorkerPool) rescale(now time.Time) {
+	queued := len(wp.taskQueue)
+	running := wp.RunningCount()
+	capacity := wp.healthyCapacity()
+
+	desired := queued + running
+	reason := fmt.Sprintf("%d queued, %d running", queued, running)
+	if capacity >= 0 && desired > capacity {
+		desired = capacity
+		reason = fmt.Sprintf("%d queued, %d running, limited by %d healthy backend slots", queued, running, capacity)
+	}
+
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	p := wp.scaling
+	if desired < p.Min {
+		desired = p.Min
+	}
+	if desired > p.Max {
+		desired = p.Max
+	}
+
+	from := wp.target
+	switch {
+	case desired > from:
+		wp.target = desired
+		wp.lowSince = time.Time{}
+		wp.spawnWorkers()
+	case desired < from:
+		if wp.lowSince.IsZero() {
+			wp.lowSince = now
+		}
+		if now.Sub(wp.lowSince) < p.ScaleDownDelay {
+			return
+		}
+		wp.target = desired
+		wp.lowSince = time.Time{}
+		// 唤醒空闲的 worker 检查是否需要退出
+		close(wp.resized)
+		wp.resized = make(chan struct{})
+	default:
+		wp.lowSince = time.Time{}
+		return
+	}
+
+	decision := ScalingDecision{
+		Time: now, From: from, To: wp.target,
+		QueueLength: queued, Running: running, HealthyCapacity: capacity, Reason: reason,
+	}
+	wp.decisions = append(wp.decisions, decision)
+	if len(wp.decisions) > scalingHistory {
+		wp.decisions = wp.decisions[len(wp.decisions)-scalingHistory:]
+	}
+	log.Printf("Worker pool scaled from %d to %d workers (%s)", from, wp.target, reason)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// gateHandler 在 release 关闭前阻塞任务
+type gateHandler struct {
+	release chan struct{}
+}
+
+func (gateHandler) Deadline(task *ImageTask) time.Duration { return time.Minute }
+
+func (h gateHandler) Run(ctx context.Context, task *ImageTask) (TaskResult, error) {
+	select {
+	case <-h.release:
+		return TaskResult{Output: json.RawMessage(`{}`)}, nil
+	case <-ctx.Done():
+		return TaskResult{}, ctx.Err()
+	}
+}
+
+// slotProvider 声明并发槽位的后端，测试中不会被调用
+type slotProvider struct {
+	blockingProvider
+	slots int
+}
+
+func (p *slotProvider) MaxConcurrency() int { return p.slots }
+
+func TestWorkerPoolScalesWithQueueAndBackendCapacity(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	// 两个实例共 3 个槽位
+	backends := []TextToImageProvider{&slotProvider{slots: 2}, &slotProvider{slots: 1}}
+	wp := NewWorkerPool(1, 20, backends, tm)
+	wp.SetScalingPolicy(ScalingPolicy{Min: 1, Max: 5, Interval: time.Hour})
+	gate := gateHandler{release: make(chan struct{})}
+	release := sync.OnceFunc(func() { close(gate.release) })
+	wp.RegisterHandler("test.gate", gate)
+	wp.Start()
+	defer wp.Stop()
+	defer release()
+
+	if n := wp.WorkerCount(); n != 1 {
+		t.Fatalf("expected to start with the minimum of 1 worker, got %d", n)
+	}
+
+	// 提交后立即扩容：需求 6 个，但后端只有 3 个槽位
+	for i := 0; i < 6; i++ {
+		task, _ := tm.CreateJob(userID, "test.gate", json.RawMessage(`{}`), nil, TaskOptions{})
+		wp.Submit(task)
+	}
+	waitFor(t, "pool to grow to the backend capacity", func() bool { return wp.RunningCount() == 3 })
+	wp.rescale(time.Now())
+	if stats := wp.ScalingStats(); stats.Workers != 3 || stats.Target != 3 {
+		t.Fatalf("expected 3 workers, got %+v", stats)
+	}
+
+	release()
+	waitFor(t, "queue to drain", func() bool { return wp.GetQueueLength() == 0 && wp.RunningCount() == 0 })
+
+	wp.rescale(time.Now())
+	waitFor(t, "idle workers to retire", func() bool { return wp.WorkerCount() == 1 })
+
+	stats := wp.ScalingStats()
+	if len(stats.Decisions) < 2 || stats.Decisions[0].From != 3 || stats.Decisions[0].To != 1 {
+		t.Fatalf("unexpected scaling decisions: %+v", stats.Decisions)
+	}
+	for _, d := range stats.Decisions {
+		if d.To > 3 || d.HealthyCapacity != 3 {
+			t.Fatalf("expected the pool never to exceed the backend capacity: %+v", d)
+		}
+	}
+}
+
+func TestWorkerPoolScalesWithSpeechCapacity(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	// 文生图 1 个槽位，语音识别两个实例各 1 个槽位
+	wp := NewWorkerPool(1, 20, []TextToImageProvider{&slotProvider{slots: 1}}, tm)
+	speech := NewLoadBalancer([]SpeechToTextProvider{&fakeWhisper{}, &fakeWhisper{}})
+	defer speech.Close()
+	wp.SetSpeechBalancer(speech)
+	wp.SetScalingPolicy(ScalingPolicy{Min: 1, Max: 5, Interval: time.Hour})
+	gate := gateHandler{release: make(chan struct{})}
+	release := sync.OnceFunc(func() { close(gate.release) })
+	wp.RegisterHandler(TaskKindSpeechTranscribe, gate)
+	wp.Start()
+	defer wp.Stop()
+	defer release()
+
+	// 排队的都是语音识别任务：上限是两类后端的槽位之和，而不只是文生图的 1 个
+	for i := 0; i < 5; i++ {
+		task, _ := tm.CreateJob(userID, TaskKindSpeechTranscribe, json.RawMessage(`{}`), nil, TaskOptions{})
+		wp.Submit(task)
+	}
+	waitFor(t, "pool to grow to the combined capacity", func() bool { return wp.RunningCount() == 3 })
+	wp.rescale(time.Now())
+	stats := wp.ScalingStats()
+	if stats.Workers != 3 || stats.Target != 3 {
+		t.Fatalf("expected 3 workers, got %+v", stats)
+	}
+	if d := stats.Decisions[0]; d.HealthyCapacity != 3 {
+		t.Fatalf("expected speech slots to count as capacity, got %+v", d)
+	}
+}
+
+func TestWorkerPoolScaleDownWaitsForRunningTasks(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	backends := []TextToImageProvider{&slotProvider{slots: 2}, &slotProvider{slots: 1}}
+	wp := NewWorkerPool(1, 20, backends, tm)
+	wp.SetScalingPolicy(ScalingPolicy{Min: 1, Max: 4, Interval: time.Hour, ScaleDownDelay: time.Minute})
+	gate := gateHandler{release: make(chan struct{})}
+	release := sync.OnceFunc(func() { close(gate.release) })
+	wp.RegisterHandler("test.gate", gate)
+	wp.Start()
+	defer wp.Stop()
+	defer release()
+
+	for i := 0; i < 3; i++ {
+		task, _ := tm.CreateJob(userID, "test.gate", json.RawMessage(`{}`), nil, TaskOptions{})
+		wp.Submit(task)
+	}
+	now := time.Now()
+	wp.rescale(now)
+	waitFor(t, "three tasks to run", func() bool { return wp.RunningCount() == 3 })
+
+	// 两个槽位的实例变为不可用：延迟过后才缩容，且执行中的 worker 不被打断
+	wp.balancer.instances[0].available.Store(false)
+	wp.rescale(now)
+	if stats := wp.ScalingStats(); stats.Target != 3 {
+		t.Fatalf("expected scale-down to wait for the delay, got target %d", stats.Target)
+	}
+	wp.rescale(now.Add(2 * time.Minute))
+	if stats := wp.ScalingStats(); stats.Target != 1 || stats.Workers != 3 || wp.RunningCount() != 3 {
+		t.Fatalf("expected busy workers to keep running after scale-down, got %+v (running %d)", stats, wp.RunningCount())
+	}
+
+	release()
+	waitFor(t, "surplus workers to retire after their tasks", func() bool { return wp.WorkerCount() == 1 })
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 后端注册表
+// ======================
+//
+// backends 表是文生图和语音识别实例的唯一来源：启动时按类型加载到对应的 LoadBalancer，管理员接口的增删改
+// 先写表再同步到 LoadBalancer，不需要重启。某一类实例在表中还没有记录时（第一次启动）用环境变量初始化
+// （IMAGE_GEN_URL_<n>、WHISPER_URL_<n>），之后环境变量不再生效。
+//
+
+const (
+	BackendTypeQwenImageGGUF = "qwen-image-gguf"
+	BackendTypeAutomatic1111 = "automatic1111"
+	BackendTypeComfyUI       = "comfyui"
+	BackendTypeFastWhisper   = "fast-whisper"
+	// OpenAI 兼容后端需要 API key 等配置，由 initAsyncSystem 按环境变量注册
+	BackendTypeOpenAIImages = "openai-images"
+	BackendTypeOpenAIAudio  = "openai-audio"
+)
+
+var ErrInvalidBackend = errors.New("invalid backend")
+
+// BackendRecord backends 表中的一个实例
+type BackendRecord struct {
+	ID        int64             `json:"id"`
+	URL       string            `json:"url"`
+	Type      string            `json:"type"`
+	Weight    int               `json:"weight"`
+	Capacity  int               `json:"capacity"`
+	Tags      []string          `json:"tags"`
+	Models    []ModelCapability `json:"models"` // 覆盖后端声明的模型，为空时使用后端声明的模型
+	Status    string            `json:"status"` // enabled / drained / disabled
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// BackendUpdate 修改实例的字段，nil 表示不修改
+type BackendUpdate struct {
+	Weight   *int               `json:"weight,omitempty"`
+	Capacity *int               `json:"capacity,omitempty"`
+	Tags     *[]string          `json:"tags,omitempty"`
+	Models   *[]ModelCapability `json:"models,omitempty"`
+	Status   *string            `json:"status,omitempty"`
+}
+
+// BackendFactory 按地址创建某种类型的文生图后端
+type BackendFactory func(rawURL string) (TextToImageProvider, error)
+
+// SpeechBackendFactory 按地址创建某种类型的语音识别后端
+type SpeechBackendFactory func(rawURL string) (SpeechToTextProvider, error)
+
+// instancePool LoadBalancer 中与后端接口类型无关的操作，注册表通过它管理实例
+type instancePool interface {
+	SetWeight(id int64, weight int) error
+	SetCapacity(id int64, slots int) error
+	SetStatus(id int64, status string) error
+	SetModels(id int64, models []ModelCapability) error
+	RemoveInstance(id int64) error
+	Stats(id int64) (InstanceStats, error)
+}
+
+// backendType 一种后端类型：实例放进哪个 LoadBalancer，以及如何创建客户端
+type backendType struct {
+	pool instancePool
+	// open 创建客户端，返回按表中的 ID 和设置把它加入 pool 的函数
+	open func(rawURL string) (func(rec *BackendRecord) error, error)
+}
+
+// BackendRegistry 管理 backends 表并与 LoadBalancer 保持一致
+type BackendRegistry struct {
+	db *sql.DB
+
+	mu    sync.Mutex // 串行化修改，保证表和 LoadBalancer 一致
+	types map[string]backendType
+}
+
+// NewBackendRegistry 创建注册表，内置 qwen-image-gguf、automatic1111 和 comfyui 类型；speech 不为空时内置 fast-whisper 类型
+func NewBackendRegistry(db *sql.DB, image *ImageBalancer, speech *SpeechBalancer) *BackendRegistry {
+	r := &BackendRegistry{db: db, types: make(map[string]backendType)}
+	r.RegisterType(BackendTypeQwenImageGGUF, image, func(rawURL string) (TextToImageProvider, error) {
+		return NewQwenImageGGUF(rawURL, nil)
+	})
+	r.RegisterType(BackendTypeAutomatic1111, image, func(rawURL string) (TextToImageProvider, error) {
+		return NewAutomatic1111(rawURL, nil)
+	})
+	r.RegisterType(BackendTypeComfyUI, image, func(rawURL string) (TextToImageProvider, error) {
+		return NewComfyUI(rawURL, nil)
+	})
+	if speech != nil {
+		r.RegisterSpeechType(BackendTypeFastWhisper, speech, func(rawURL string) (SpeechToTextProvider, error) {
+			return NewFastWhisperService(rawURL, nil)
+		})
+	}
+	return r
+}
+
+// RegisterType 注册文生图后端类型，需在 Load 之前调用
+func (r *BackendRegistry) RegisterType(name string, lb *ImageBalancer, factory BackendFactory) {
+	registerBackendType(r, name, lb, factory)
+}
+
+// RegisterSpeechType 注册语音识别后端类型，需在 Load 之前调用
+func (r *BackendRegistry) RegisterSpeechType(name string, lb *SpeechBalancer, factory SpeechBackendFactory) {
+	registerBackendType(r, name, lb, factory)
+}
+
+func registerBackendType[P Pinger, F ~func(string) (P, error)](r *BackendRegistry, name string, lb *LoadBalancer[P], factory F) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.types[name] = backendType{
+		pool: lb,
+		open: func(rawURL string) (func(rec *BackendRecord) error, error) {
+			client, err := factory(rawURL)
+			if err != nil {
+				return nil, err
+			}
+			return func(rec *BackendRecord) error {
+				_, err := lb.AddInstance(rec.ID, client, rec.settings())
+				return err
+			}, nil
+		},
+	}
+}
+
+// Types 已注册的后端类型，升序
+func (r *BackendRegistry) Types() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	types := make([]string, 0, len(r.types))
+	for name := range r.types {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// Stats 实例的实时统计，没有加载到 LoadBalancer 时返回 ErrBackendNotFound
+func (r *BackendRegistry) Stats(rec *BackendRecord) (InstanceStats, error) {
+	r.mu.Lock()
+	t, ok := r.types[rec.Type]
+	r.mu.Unlock()
+	if !ok {
+		return InstanceStats{}, ErrBackendNotFound
+	}
+	return t.pool.Stats(rec.ID)
+}
+
+const backendColumns = `id, url, type, weight, capacity, tags, models, status, created_at, updated_at`
+
+func scanBackend(row rowScanner) (*BackendRecord, error) {
+	var rec BackendRecord
+	var tags, models string
+	if err := row.Scan(&rec.ID, &rec.URL, &rec.Type, &rec.Weight, &rec.Capacity, &tags, &models, &rec.Status, &rec.CreatedAt, &rec.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(tags), &rec.Tags); err != nil || rec.Tags == nil {
+		rec.Tags = []string{}
+	}
+	if err := json.Unmarshal([]byte(models), &rec.Models); err != nil || rec.Models == nil {
+		rec.Models = []ModelCapability{}
+	}
+	return &rec, nil
+}
+
+// normalize 校验并补全默认值
+func (r *BackendRegistry) normalize(rec *BackendRecord) error {
+	u, err := url.Parse(rec.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: url must be an absolute http or https url", ErrInvalidBackend)
+	}
+	if rec.Type == "" {
+		rec.Type = BackendTypeQwenImageGGUF
+	}
+	if _, ok := r.types[rec.Type]; !ok {
+		return fmt.Errorf("%w: unknown type %q", ErrInvalidBackend, rec.Type)
+	}
+	if rec.Weight == 0 {
+		rec.Weight = 1
+	}
+	if rec.Capacity == 0 {
+		rec.Capacity = 1
+	}
+	if rec.Weight < 1 || rec.Capacity < 1 {
+		return fmt.Errorf("%w: weight and capacity must be at least 1", ErrInvalidBackend)
+	}
+	if rec.Tags == nil {
+		rec.Tags = []string{}
+	}
+	if rec.Models == nil {
+		rec.Models = []ModelCapability{}
+	}
+	for _, m := range rec.Models {
+		if m.Name == "" || m.MaxWidth < 0 || m.MaxHeight < 0 || m.MaxSteps < 0 {
+			return fmt.Errorf("%w: models need a name and non-negative limits", ErrInvalidBackend)
+		}
+	}
+	if rec.Status == "" {
+		rec.Status = BackendEnabled
+	}
+	if !validBackendStatus(rec.Status) {
+		return fmt.Errorf("%w: status must be enabled, drained or disabled", ErrInvalidBackend)
+	}
+	return nil
+}
+
+func validBackendStatus(status string) bool {
+	return slices.Contains([]string{BackendEnabled, BackendDrained, BackendDisabled}, status)
+}
+
+// Seed 写入初始实例，返回写入的数量；表中已经有同一个 LoadBalancer 的实例时跳过该类实例
+func (r *BackendRegistry) Seed(records []BackendRecord) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rows, err := r.db.Query(`SELECT DISTINCT type FROM backends`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list backend types: %w", err)
+	}
+	seeded := make(map[instancePool]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan backend type: %w", err)
+		}
+		if t, ok := r.types[name]; ok {
+			seeded[t.pool] = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to list backend types: %w", err)
+	}
+
+	n := 0
+	for i := range records {
+		rec := &records[i]
+		if err := r.normalize(rec); err != nil {
+			return n, err
+		}
+		if seeded[r.types[rec.Type].pool] {
+			continue
+		}
+		if _, err := r.insert(rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Load 把表中的实例加入 LoadBalancer，无法创建客户端的实例记录警告后跳过
+func (r *BackendRegistry) Load() error {
+	records, err := r.List()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rec := range records {
+		if err := r.attach(rec); err != nil {
+			log.Printf("Warning: failed to load backend %d (%s): %v", rec.ID, rec.URL, err)
+		}
+	}
+	return nil
+}
+
+// List 所有实例，按 ID 升序
+func (r *BackendRegistry) List() ([]*BackendRecord, error) {
+	rows, err := r.db.Query(`SELECT ` + backendColumns + ` FROM backends ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backends: %w", err)
+	}
+	defer rows.Close()
+
+	records := []*BackendRecord{}
+	for rows.Next() {
+		rec, err := scanBackend(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan backend: %w", err)
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
+
+// Get 获取实例
+func (r *BackendRegistry) Get(id int64) (*BackendRecord, error) {
+	rec, err := scanBackend(r.db.QueryRow(`SELECT `+backendColumns+` FROM backends WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, ErrBackendNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get backend: %w", err)
+	}
+	return rec, nil
+}
+
+// Add 写入新实例并立即加入 LoadBalancer；同一 URL 已存在时返回 ErrBackendExists
+func (r *BackendRegistry) Add(rec BackendRecord) (*BackendRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.normalize(&rec); err != nil {
+		return nil, err
+	}
+	// 先创建客户端，地址不合法时不写表
+	t := r.types[rec.Type]
+	add, err := t.open(rec.URL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBackend, err)
+	}
+	saved, err := r.insert(&rec)
+	if err != nil {
+		return nil, err
+	}
+	if err := add(saved); err != nil {
+		// 加入 LoadBalancer 失败时删掉刚写入的行，否则表中留下不路由的实例，同一地址也无法重新注册
+		if _, derr := r.db.Exec(`DELETE FROM backends WHERE id = ?`, saved.ID); derr != nil {
+			log.Printf("Failed to delete backend %d after registration failed: %v", saved.ID, derr)
+		}
+		return nil, err
+	}
+
+	log.Printf("Registered backend %d (%s, %s)", saved.ID, saved.Type, saved.URL)
+	return saved, nil
+}
+
+// insert 写入一行，调用方持有 r.mu
+func (r *BackendRegistry) insert(rec *BackendRecord) (*BackendRecord, error) {
+	if err := r.normalize(rec); err != nil {
+		return nil, err
+	}
+	var n int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM backends WHERE url = ?`, rec.URL).Scan(&n); err != nil {
+		return nil, fmt.Errorf("failed to check backend: %w", err)
+	}
+	if n > 0 {
+		return nil, ErrBackendExists
+	}
+
+	tags, _ := json.Marshal(rec.Tags)
+	models, _ := json.Marshal(rec.Models)
+	now := time.Now()
+	res, err := r.db.Exec(`
+		INSERT INTO backends (url, type, weight, capacity, tags, models, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rec.URL, rec.Type, rec.Weight, rec.Capacity, string(tags), string(models), rec.Status, now, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backend: %w", err)
+	}
+	rec.ID, _ = res.LastInsertId()
+	rec.CreatedAt, rec.UpdatedAt = now, now
+	return rec, nil
+}
+
+// attach 为表中的实例创建客户端并加入 LoadBalancer，调用方持有 r.mu
+func (r *BackendRegistry) attach(rec *BackendRecord) error {
+	t, ok := r.types[rec.Type]
+	if !ok {
+		return fmt.Errorf("unknown backend type %q", rec.Type)
+	}
+	add, err := t.open(rec.URL)
+	if err != nil {
+		return err
+	}
+	return add(rec)
+}
+
+// settings 实例加入 LoadBalancer 时的初始设置
+func (rec *BackendRecord) settings() InstanceSettings {
+	return InstanceSettings{Weight: rec.Weight, Capacity: rec.Capacity, Status: rec.Status, Models: rec.Models}
+}
+
+// apply 把表中的权重、槽位、模型和状态同步到实例
+func (r *BackendRegistry) apply(pool instancePool, rec *BackendRecord) {
+	_ = pool.SetWeight(rec.ID, rec.Weight)
+	_ = pool.SetCapacity(rec.ID, rec.Capacity)
+	if len(rec.Models) > 0 {
+		_ = pool.SetModels(rec.ID, rec.Models)
+	} else {
+		_ = pool.SetModels(rec.ID, nil)
+	}
+	_ = pool.SetStatus(rec.ID, rec.Status)
+}
+
+// Update 修改实例的权重、槽位、标签、模型或状态，立即对新请求生效
+func (r *BackendRegistry) Update(id int64, u BackendUpdate) (*BackendRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, err := r.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.Weight != nil {
+		rec.Weight = *u.Weight
+	}
+	if u.Capacity != nil {
+		rec.Capacity = *u.Capacity
+	}
+	if u.Tags != nil {
+		rec.Tags = *u.Tags
+	}
+	if u.Models != nil {
+		rec.Models = *u.Models
+	}
+	if u.Status != nil {
+		rec.Status = *u.Status
+	}
+	// 显式传 0 或空状态不按默认值处理
+	if (u.Weight != nil && rec.Weight < 1) || (u.Capacity != nil && rec.Capacity < 1) {
+		return nil, fmt.Errorf("%w: weight and capacity must be at least 1", ErrInvalidBackend)
+	}
+	if u.Status != nil && !validBackendStatus(rec.Status) {
+		return nil, fmt.Errorf("%w: status must be enabled, drained or disabled", ErrInvalidBackend)
+	}
+	if err := r.normalize(rec); err != nil {
+		return nil, err
+	}
+
+	tags, _ := json.Marshal(rec.Tags)
+	models, _ := json.Marshal(rec.Models)
+	rec.UpdatedAt = time.Now()
+	if _, err := r.db.Exec(`
+		UPDATE backends SET weight = ?, capacity = ?, tags = ?, models = ?, status = ?, updated_at = ? WHERE id = ?
+	`, rec.Weight, rec.Capacity, string(tags), string(models), rec.Status, rec.UpdatedAt, id); err != nil {
+		return nil, fmt.Errorf("failed to update backend: %w", err)
+	}
+
+	if _, err := r.types[rec.Type].pool.Stats(id); err == nil {
+		r.apply(r.types[rec.Type].pool, rec)
+	} else if err := r.attach(rec); err != nil {
+		// 启动时没能加载的实例，修改后再试一次
+		log.Printf("Warning: backend %d is not loaded: %v", id, err)
+	}
+	return rec, nil
+}
+
+// Remove 删除实例：不再分配新请求，已经分配出去的请求照常完成
+func (r *BackendRegistry) Remove(id int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, err := r.Get(id)
+	if err != nil {
+		return err
+	}
+	res, err := r.db.Exec(`DELETE FROM backends WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete backend: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrBackendNotFound
+	}
+	if t, ok := r.types[rec.Type]; ok {
+		if err := t.pool.RemoveInstance(id); err != nil && !errors.Is(err, ErrBackendNotFound) {
+			return err
+		}
+	}
+	log.Printf("Removed backend %d", id)
+	return nil
+}
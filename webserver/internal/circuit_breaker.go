@@ -0,0 +1,178 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 熔断器
+// ======================
+//
+// 每个后端实例一个熔断器，由真实请求的结果驱动（健康检查的 Ping 成功不代表 Generate 可用）：
+//   closed     正常接收请求；连续失败达到 FailureThreshold 次后转为 open
+//   open       不接收请求；Cooldown 之后转为 half-open
+//   half-open  最多同时放行 HalfOpenProbes 个探测请求；探测失败立即回到 open，
+//              累计 HalfOpenProbes 个探测成功后恢复 closed
+// 被取消的请求（context.Canceled）不说明后端的状态，只释放探测名额。
+//
+
+// BreakerState 熔断器状态
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerPolicy 熔断阈值和冷却时间
+type BreakerPolicy struct {
+	FailureThreshold int           `json:"failure_threshold"` // 连续失败多少次后熔断
+	Cooldown         time.Duration `json:"-"`                 // 熔断后多久开始探测
+	HalfOpenProbes   int           `json:"half_open_probes"`  // 半开状态的探测请求数，也是恢复所需的成功次数
+}
+
+// DefaultBreakerPolicy 连续失败 5 次熔断，30 秒后用 1 个请求探测
+func DefaultBreakerPolicy() BreakerPolicy {
+	return BreakerPolicy{FailureThreshold: 5, Cooldown: 30 * time.Second, HalfOpenProbes: 1}
+}
+
+// normalized 把不合法的配置替换为默认值
+func (p BreakerPolicy) normalized() BreakerPolicy {
+	def := DefaultBreakerPolicy()
+	if p.FailureThreshold < 1 {
+		p.FailureThreshold = def.FailureThreshold
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = def.Cooldown
+	}
+	if p.HalfOpenProbes < 1 {
+		p.HalfOpenProbes = def.HalfOpenProbes
+	}
+	return p
+}
+
+// BreakerStats 熔断器当前状态
+type BreakerStats struct {
+	State               BreakerState `json:"state"`
+	ConsecutiveFailures int          `json:"consecutive_failures"`
+	OpenedAt            *time.Time   `json:"opened_at,omitempty"`
+	Trips               int64        `json:"trips"` // 累计熔断次数
+}
+
+// circuitBreaker 单个实例的熔断器，name 仅用于日志
+type circuitBreaker struct {
+	name string
+
+	mu        sync.Mutex
+	state     BreakerState
+	failures  int // closed 状态下的连续失败次数
+	openedAt  time.Time
+	probes    int // half-open 状态下进行中的探测请求
+	successes int // half-open 状态下成功的探测请求
+	trips     int64
+}
+
+func newCircuitBreaker(name string) *circuitBreaker {
+	return &circuitBreaker{name: name, state: BreakerClosed}
+}
+
+// ready 当前是否可能接收请求（不占用探测名额），用于筛选候选实例
+func (b *circuitBreaker) ready(now time.Time, p BreakerPolicy) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return now.Sub(b.openedAt) >= p.Cooldown
+	case BreakerHalfOpen:
+		return b.probes < p.HalfOpenProbes
+	default:
+		return true
+	}
+}
+
+// tryAcquire 为一个请求放行，open 状态冷却结束时转为 half-open；返回 false 表示不能发送请求
+func (b *circuitBreaker) tryAcquire(now time.Time, p BreakerPolicy) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerOpen {
+		if now.Sub(b.openedAt) < p.Cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probes, b.successes = 0, 0
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= p.HalfOpenProbes {
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record 记录 tryAcquire 放行的请求的结果；canceled 表示请求被调用方取消，不计入成败
+func (b *circuitBreaker) record(failed, canceled bool, now time.Time, p BreakerPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerClosed:
+		switch {
+		case canceled:
+		case failed:
+			b.failures++
+			if b.failures >= p.FailureThreshold {
+				b.trip(now)
+			}
+		default:
+			b.failures = 0
+		}
+	case BreakerHalfOpen:
+		if b.probes > 0 {
+			b.probes--
+		}
+		switch {
+		case canceled:
+		case failed:
+			b.trip(now)
+		default:
+			b.successes++
+			if b.successes >= p.HalfOpenProbes {
+				b.failures = 0
+				b.setState(BreakerClosed)
+			}
+		}
+	}
+	// open 状态下收到的是熔断前发出的请求的结果，忽略
+}
+
+// trip 转为 open，调用方持有 b.mu
+func (b *circuitBreaker) trip(now time.Time) {
+	b.openedAt = now
+	b.trips++
+	b.setState(BreakerOpen)
+}
+
+// setState 切换状态并记录日志，调用方持有 b.mu
+func (b *circuitBreaker) setState(s BreakerState) {
+	if b.state == s {
+		return
+	}
+	log.Printf("Circuit breaker for %s: %s -> %s", b.name, b.state, s)
+	b.state = s
+}
+
+// Stats 熔断器当前状态
+func (b *circuitBreaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := BreakerStats{State: b.state, ConsecutiveFailures: b.failures, Trips: b.trips}
+	if b.state != BreakerClosed {
+		openedAt := b.openedAt
+		stats.OpenedAt = &openedAt
+	}
+	return stats
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	p := BreakerPolicy{FailureThreshold: 3, Cooldown: time.Minute, HalfOpenProbes: 2}
+	b := newCircuitBreaker("test")
+	now := time.Now()
+
+	// 成功会清零连续失败，被取消的请求不计入
+	for _, failed := range []bool{true, true, false, true, true} {
+		b.tryAcquire(now, p)
+		b.record(failed, false, now, p)
+	}
+	b.tryAcquire(now, p)
+	b.record(true, true, now, p)
+	if s := b.Stats(); s.State != BreakerClosed || s.ConsecutiveFailures != 2 {
+		t.Fatalf("expected the breaker to stay closed with 2 failures, got %+v", s)
+	}
+
+	b.tryAcquire(now, p)
+	b.record(true, false, now, p)
+	if s := b.Stats(); s.State != BreakerOpen || s.Trips != 1 {
+		t.Fatalf("expected the third consecutive failure to open the breaker, got %+v", s)
+	}
+	if b.ready(now.Add(30*time.Second), p) || b.tryAcquire(now.Add(30*time.Second), p) {
+		t.Fatal("expected an open breaker to reject requests during the cooldown")
+	}
+
+	// 冷却后半开：最多 2 个探测，探测失败重新熔断
+	later := now.Add(time.Minute)
+	if !b.tryAcquire(later, p) || !b.tryAcquire(later, p) || b.tryAcquire(later, p) {
+		t.Fatal("expected exactly 2 probes in the half-open state")
+	}
+	b.record(false, false, later, p)
+	b.record(true, false, later, p)
+	if s := b.Stats(); s.State != BreakerOpen || s.Trips != 2 || !s.OpenedAt.Equal(later) {
+		t.Fatalf("expected a failed probe to reopen the breaker, got %+v", s)
+	}
+
+	// 两个探测都成功后恢复
+	later = later.Add(time.Minute)
+	b.tryAcquire(later, p)
+	b.tryAcquire(later, p)
+	b.record(false, false, later, p)
+	if s := b.Stats(); s.State != BreakerHalfOpen {
+		t.Fatalf("expected one successful probe not to be enough, got %+v", s)
+	}
+	b.record(false, false, later, p)
+	if s := b.Stats(); s.State != BreakerClosed || s.ConsecutiveFailures != 0 || s.OpenedAt != nil {
+		t.Fatalf("expected the breaker to close after the probes succeed, got %+v", s)
+	}
+}
+
+func TestLoadBalancerTripsFailingBackend(t *testing.T) {
+	lb := &ImageBalancer{strategy: &roundRobinStrategy[TextToImageProvider]{}, instances: newTestInstances(2)}
+	lb.SetBreakerPolicy(BreakerPolicy{FailureThreshold: 2, Cooldown: 50 * time.Millisecond, HalfOpenProbes: 1})
+	failing, healthy := lb.instances[0], lb.instances[1]
+	boom := errors.New("generate failed")
+
+	// instance-1 的 Ping 正常但每次生成都失败
+	for failing.breaker.Stats().State == BreakerClosed {
+		inst, err := lb.Acquire(context.Background())
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+		if inst == failing {
+			lb.Release(inst, time.Millisecond, boom)
+		} else {
+			lb.Release(inst, time.Millisecond, nil)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		inst, _ := lb.Acquire(context.Background())
+		if inst != healthy {
+			t.Fatalf("expected traffic to avoid the open instance, got %s", inst.Name)
+		}
+		lb.Release(inst, time.Millisecond, nil)
+	}
+	if lb.HealthyCapacity() != 1 {
+		t.Fatalf("expected the open instance not to count as capacity, got %d", lb.HealthyCapacity())
+	}
+
+	// 所有实例都不可用时返回错误，而不是退回第一个实例
+	healthy.available.Store(false)
+	if _, err := lb.Acquire(context.Background()); !errors.Is(err, ErrNoHealthyBackend) {
+		t.Fatalf("expected ErrNoHealthyBackend, got %v", err)
+	}
+	if lb.GetNext() != nil {
+		t.Fatal("expected GetNext not to fall back to an unhealthy instance")
+	}
+
+	// 冷却后只放行一个探测；被取消的探测不改变状态
+	time.Sleep(60 * time.Millisecond)
+	probe, err := lb.Acquire(context.Background())
+	if err != nil || probe != failing {
+		t.Fatalf("expected a probe to the cooled-down instance, got %v, %v", probe, err)
+	}
+	if _, err := lb.Acquire(context.Background()); !errors.Is(err, ErrNoHealthyBackend) {
+		t.Fatalf("expected the probe slot to be taken, got %v", err)
+	}
+	lb.Release(probe, time.Millisecond, context.Canceled)
+	if s := failing.breaker.Stats(); s.State != BreakerHalfOpen {
+		t.Fatalf("expected a canceled probe to leave the breaker half-open, got %+v", s)
+	}
+
+	probe, _ = lb.Acquire(context.Background())
+	lb.Release(probe, time.Millisecond, nil)
+	if s := failing.breaker.Stats(); s.State != BreakerClosed {
+		t.Fatalf("expected a successful probe to close the breaker, got %+v", s)
+	}
+}
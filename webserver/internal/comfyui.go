@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ComfyUI 调用 ComfyUI 服务实现 TextToImageProvider：提交内置的 txt2img 工作流（/prompt），
+// 轮询 /history/{prompt_id} 直到执行结束，再通过 /view 下载输出图片。
+// 请求指定模型时作为 checkpoint 名（ckpt_name），否则使用服务端的第一个 checkpoint
+type ComfyUI struct {
+	baseURL      *url.URL
+	client       *http.Client
+	clientID     string
+	pollInterval time.Duration
+
+	mu         sync.Mutex
+	checkpoint string // 缓存的默认 checkpoint
+}
+
+const (
+	comfyUIModelName    = "comfyui" // 不指定 checkpoint 时的模型名
+	comfyUIPollInterval = 500 * time.Millisecond
+	comfyUIOutputNode   = "9" // 工作流中 SaveImage 节点的 ID
+
+	comfyUICancelTimeout = 5 * time.Second // 放弃 prompt 时清理队列的超时
+)
+
+// NewComfyUI 构造函数，允许自定义 http.Client。
+// 默认 client 不设置整体超时，生成耗时由调用方通过 ctx 的截止时间控制。
+func NewComfyUI(rawURL string, client *http.Client) (*ComfyUI, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parse base url: %w", err)
+	}
+
+	if client == nil {
+		client = &http.Client{}
+	}
+
+	return &ComfyUI{
+		baseURL:      parsed,
+		client:       client,
+		clientID:     fmt.Sprintf("webserver-%d", rand.Int64()),
+		pollInterval: comfyUIPollInterval,
+	}, nil
+}
+
+// Ping 通过 /system_stats 检查服务是否启动
+func (c *ComfyUI) Ping(ctx context.Context) error {
+	if c == nil {
+		return errors.New("nil ComfyUI receiver")
+	}
+
+	var stats struct {
+		System map[string]any `json:"system"`
+	}
+	if err := c.getJSON(ctx, "/system_stats", &stats); err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+	if stats.System == nil {
+		return errors.New("ping failed: unexpected system_stats response")
+	}
+	return nil
+}
+
+func (c *ComfyUI) Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error) {
+	var empty TextToImageResponse
+	if c == nil {
+		return empty, errors.New("nil ComfyUI receiver")
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultGenerateTimeout)
+		defer cancel()
+	}
+
+	checkpoint := req.Model
+	if checkpoint == "" || checkpoint == comfyUIModelName {
+		var err error
+		if checkpoint, err = c.defaultCheckpoint(ctx); err != nil {
+			return empty, err
+		}
+	}
+
+	workflow, seed := comfyUIWorkflow(req, checkpoint)
+	promptID, err := c.queuePrompt(ctx, workflow)
+	if err != nil {
+		return empty, err
+	}
+	image, err := c.waitForOutput(ctx, promptID)
+	if err != nil {
+		return empty, err
+	}
+	resp, err := c.download(ctx, image)
+	if err != nil {
+		return empty, err
+	}
+	resp.Seed = seed
+	return resp, nil
+}
+
+// comfyUIWorkflow 按请求生成 API 格式的 txt2img 工作流，返回工作流和实际使用的种子
+func comfyUIWorkflow(req TextToImageRequest, checkpoint string) (map[string]any, int64) {
+	seed := req.Seed
+	if seed == 0 {
+		seed = rand.Int64N(1 << 48) // KSampler 要求非负种子
+	}
+	link := func(node string, output int) []any { return []any{node, output} }
+	return map[string]any{
+		"3": map[string]any{"class_type": "KSampler", "inputs": map[string]any{
+			"seed": seed, "steps": orDefault(req.Steps, defaultInferenceSteps), "cfg": 7.0,
+			"sampler_name": "euler", "scheduler": "normal", "denoise": 1.0,
+			"model": link("4", 0), "positive": link("6", 0), "negative": link("7", 0), "latent_image": link("5", 0),
+		}},
+		"4": map[string]any{"class_type": "CheckpointLoaderSimple", "inputs": map[string]any{"ckpt_name": checkpoint}},
+		"5": map[string]any{"class_type": "EmptyLatentImage", "inputs": map[string]any{
+			"width": orDefault(req.Width, defaultImageSize), "height": orDefault(req.Height, defaultImageSize), "batch_size": 1,
+		}},
+		"6": map[string]any{"class_type": "CLIPTextEncode", "inputs": map[string]any{"text": req.Prompt, "clip": link("4", 1)}},
+		"7": map[string]any{"class_type": "CLIPTextEncode", "inputs": map[string]any{"text": req.NegativePrompt, "clip": link("4", 1)}},
+		"8": map[string]any{"class_type": "VAEDecode", "inputs": map[string]any{"samples": link("3", 0), "vae": link("4", 2)}},
+		comfyUIOutputNode: map[string]any{"class_type": "SaveImage", "inputs": map[string]any{
+			"filename_prefix": "webserver", "images": link("8", 0),
+		}},
+	}, seed
+}
+
+// defaultCheckpoint 服务端的第一个 checkpoint，查询一次后缓存
+func (c *ComfyUI) defaultCheckpoint(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checkpoint != "" {
+		return c.checkpoint, nil
+	}
+
+	// {"CheckpointLoaderSimple": {"input": {"required": {"ckpt_name": [["a.safetensors", ...], {...}]}}}}
+	var info map[string]struct {
+		Input struct {
+			Required struct {
+				CkptName []json.RawMessage `json:"ckpt_name"`
+			} `json:"required"`
+		} `json:"input"`
+	}
+	if err := c.getJSON(ctx, "/object_info/CheckpointLoaderSimple", &info); err != nil {
+		return "", fmt.Errorf("list checkpoints: %w", err)
+	}
+	var names []string
+	if choices := info["CheckpointLoaderSimple"].Input.Required.CkptName; len(choices) > 0 {
+		_ = json.Unmarshal(choices[0], &names)
+	}
+	if len(names) == 0 {
+		return "", errors.New("comfyui has no checkpoints")
+	}
+	c.checkpoint = names[0]
+	return c.checkpoint, nil
+}
+
+// queuePrompt 提交工作流，返回 prompt_id
+func (c *ComfyUI) queuePrompt(ctx context.Context, workflow map[string]any) (string, error) {
+	body, err := json.Marshal(map[string]any{"prompt": workflow, "client_id": c.clientID})
+	if err != nil {
+		return "", fmt.Errorf("marshal prompt payload: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.resolvePath("/prompt"), bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("create prompt request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return "", fmt.Errorf("execute prompt request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// 工作流校验失败时返回 400 和 node_errors
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+		return "", fmt.Errorf("queue prompt failed: status %d, body: %s", resp.StatusCode, detail)
+	}
+
+	var result struct {
+		PromptID string `json:"prompt_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("decode prompt response: %w", err)
+	}
+	if result.PromptID == "" {
+		return "", errors.New("queue prompt returned no prompt_id")
+	}
+	return result.PromptID, nil
+}
+
+// comfyUIImage 工作流输出的一张图片
+type comfyUIImage struct {
+	Filename  string `json:"filename"`
+	Subfolder string `json:"subfolder"`
+	Type      string `json:"type"`
+}
+
+// waitForOutput 轮询执行历史，直到 SaveImage 节点有输出、执行失败或 ctx 结束；
+// ctx 结束时放弃 prompt，不让服务端继续为已取消的请求生成
+func (c *ComfyUI) waitForOutput(ctx context.Context, promptID string) (comfyUIImage, error) {
+	for {
+		// 执行结束前历史中没有该 prompt_id
+		var history map[string]struct {
+			Outputs map[string]struct {
+				Images []comfyUIImage `json:"images"`
+			} `json:"outputs"`
+			Status struct {
+				StatusStr string `json:"status_str"`
+				Completed bool   `json:"completed"`
+			} `json:"status"`
+		}
+		if err := c.getJSON(ctx, "/history/"+url.PathEscape(promptID), &history); err != nil {
+			if ctx.Err() != nil {
+				c.cancelPrompt(promptID)
+			}
+			return comfyUIImage{}, fmt.Errorf("poll history: %w", err)
+		}
+		if entry, ok := history[promptID]; ok {
+			if entry.Status.StatusStr == "error" {
+				return comfyUIImage{}, fmt.Errorf("comfyui prompt %s failed", promptID)
+			}
+			if images := entry.Outputs[comfyUIOutputNode].Images; len(images) > 0 {
+				return images[0], nil
+			}
+			if entry.Status.Completed {
+				return comfyUIImage{}, fmt.Errorf("comfyui prompt %s produced no images", promptID)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			c.cancelPrompt(promptID)
+			return comfyUIImage{}, ctx.Err()
+		case <-time.After(c.pollInterval):
+		}
+	}
+}
+
+// cancelPrompt 从等待队列中删除 prompt；已在执行时通过 /interrupt 中断，不影响其他客户端的 prompt
+func (c *ComfyUI) cancelPrompt(promptID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), comfyUICancelTimeout)
+	defer cancel()
+
+	if err := c.postJSON(ctx, "/queue", map[string]any{"delete": []string{promptID}}); err != nil {
+		log.Printf("Failed to remove ComfyUI prompt %s from the queue: %v", promptID, err)
+	}
+
+	// {"queue_running": [[number, prompt_id, prompt, extra_data, outputs_to_execute]], "queue_pending": [...]}
+	var queue struct {
+		Running [][]json.RawMessage `json:"queue_running"`
+	}
+	if err := c.getJSON(ctx, "/queue", &queue); err != nil {
+		log.Printf("Failed to check whether ComfyUI prompt %s is running: %v", promptID, err)
+		return
+	}
+	for _, item := range queue.Running {
+		var id string
+		if len(item) < 2 || json.Unmarshal(item[1], &id) != nil || id != promptID {
+			continue
+		}
+		if err := c.postJSON(ctx, "/interrupt", map[string]any{"prompt_id": promptID}); err != nil {
+			log.Printf("Failed to interrupt ComfyUI prompt %s: %v", promptID, err)
+		}
+	}
+}
+
+// download 通过 /view 下载输出图片
+func (c *ComfyUI) download(ctx context.Context, image comfyUIImage) (TextToImageResponse, error) {
+	var empty TextToImageResponse
+	query := url.Values{"filename": {image.Filename}, "subfolder": {image.Subfolder}, "type": {image.Type}}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, c.resolvePath("/view")+"?"+query.Encode(), nil)
+	if err != nil {
+		return empty, fmt.Errorf("create view request: %w", err)
+	}
+
+	resp, err := c.client.Do(httpReq)
+	if err != nil {
+		return empty, fmt.Errorf("execute view request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return empty, fmt.Errorf("view failed: status %d, body: %s", resp.StatusCode, detail)
+	}
+
+	imageData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return empty, fmt.Errorf("read image payload: %w", err)
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = http.DetectContentType(imageData)
+	}
+	return TextToImageResponse{ImageData: imageData, MimeType: mimeType}, nil
+}
+
+// getJSON GET path 并解析 JSON 响应
+func (c *ComfyUI) getJSON(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.resolvePath(path), nil)
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d, body: %s", resp.StatusCode, detail)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// postJSON POST JSON 请求体，忽略响应内容
+func (c *ComfyUI) postJSON(ctx context.Context, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.resolvePath(path), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("status %d, body: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
+
+// InstanceName 返回实例的 base URL，用于记录生成来源
+func (c *ComfyUI) InstanceName() string {
+	return c.baseURL.String()
+}
+
+// ModelName 返回后端模型名称
+func (c *ComfyUI) ModelName() string {
+	return comfyUIModelName
+}
+
+// Models 只声明默认 checkpoint；服务端上的其他 checkpoint 需要在 backends 表的 models 中按文件名配置
+func (c *ComfyUI) Models() []ModelCapability {
+	return []ModelCapability{{Name: comfyUIModelName, Features: []string{FeatureNegativePrompt, FeatureSeed}}}
+}
+
+func (c *ComfyUI) resolvePath(path string) string {
+	u := *c.baseURL
+	u.Path = strings.TrimRight(u.Path, "/") + path
+	return u.String()
+}
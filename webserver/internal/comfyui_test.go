@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeComfyUI 模拟 ComfyUI：提交的工作流在 polls 次查询历史后完成，fail 时以错误结束；
+// running 时 /queue 报告 prompt 正在执行
+type fakeComfyUI struct {
+	image   []byte
+	polls   int64
+	fail    bool
+	running bool
+
+	mu          sync.Mutex
+	workflow    map[string]map[string]any
+	history     atomic.Int64
+	deleted     atomic.Int64
+	interrupted atomic.Int64
+}
+
+func (f *fakeComfyUI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /system_stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"system": {"os": "posix"}, "devices": []}`))
+	})
+	mux.HandleFunc("GET /object_info/CheckpointLoaderSimple", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"CheckpointLoaderSimple": {"input": {"required": {"ckpt_name": [["base.safetensors", "sdxl.safetensors"], {}]}}}}`))
+	})
+	mux.HandleFunc("POST /prompt", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Prompt   map[string]map[string]any `json:"prompt"`
+			ClientID string                    `json:"client_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ClientID == "" {
+			http.Error(w, `{"error": "invalid prompt"}`, http.StatusBadRequest)
+			return
+		}
+		f.mu.Lock()
+		f.workflow = body.Prompt
+		f.mu.Unlock()
+		f.history.Store(0)
+		w.Write([]byte(`{"prompt_id": "p-1", "number": 0, "node_errors": {}}`))
+	})
+	mux.HandleFunc("GET /history/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "p-1" || f.history.Add(1) < f.polls {
+			w.Write([]byte(`{}`))
+			return
+		}
+		if f.fail {
+			w.Write([]byte(`{"p-1": {"outputs": {}, "status": {"status_str": "error", "completed": false}}}`))
+			return
+		}
+		w.Write([]byte(`{"p-1": {"outputs": {"9": {"images": [{"filename": "webserver_00001_.png", "subfolder": "", "type": "output"}]}},
+			"status": {"status_str": "success", "completed": true}}}`))
+	})
+	mux.HandleFunc("POST /queue", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Delete []string `json:"delete"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) == nil && len(body.Delete) == 1 && body.Delete[0] == "p-1" {
+			f.deleted.Add(1)
+		}
+	})
+	mux.HandleFunc("GET /queue", func(w http.ResponseWriter, r *http.Request) {
+		if f.running {
+			w.Write([]byte(`{"queue_running": [[0, "p-1", {}, {}, ["9"]]], "queue_pending": []}`))
+			return
+		}
+		w.Write([]byte(`{"queue_running": [], "queue_pending": []}`))
+	})
+	mux.HandleFunc("POST /interrupt", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			PromptID string `json:"prompt_id"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) == nil && body.PromptID == "p-1" {
+			f.interrupted.Add(1)
+		}
+	})
+	mux.HandleFunc("GET /view", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("filename") != "webserver_00001_.png" || r.URL.Query().Get("type") != "output" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(f.image)
+	})
+	return mux
+}
+
+// inputs 最近一次提交的工作流中节点的输入
+func (f *fakeComfyUI) inputs(node string) map[string]any {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	inputs, _ := f.workflow[node]["inputs"].(map[string]any)
+	return inputs
+}
+
+func TestComfyUIGenerate(t *testing.T) {
+	fake := &fakeComfyUI{image: testPNG(t, 64, 32), polls: 3}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, err := NewComfyUI(srv.URL, nil)
+	if err != nil {
+		t.Fatalf("NewComfyUI: %v", err)
+	}
+	c.pollInterval = time.Millisecond
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	resp, err := c.Generate(context.Background(), TextToImageRequest{
+		Prompt: "a red fox", NegativePrompt: "blurry", Width: 64, Height: 32, Steps: 12, Seed: 42,
+	})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !bytes.Equal(resp.ImageData, fake.image) || resp.MimeType != "image/png" || fake.history.Load() != 3 {
+		t.Fatalf("unexpected result: %d bytes, %s after %d polls", len(resp.ImageData), resp.MimeType, fake.history.Load())
+	}
+	sampler, latent := fake.inputs("3"), fake.inputs("5")
+	if sampler["seed"] != 42.0 || sampler["steps"] != 12.0 || latent["width"] != 64.0 || latent["height"] != 32.0 ||
+		fake.inputs("6")["text"] != "a red fox" || fake.inputs("7")["text"] != "blurry" {
+		t.Fatalf("unexpected workflow inputs: %v %v", sampler, latent)
+	}
+	// 没有指定模型时使用服务端的第一个 checkpoint
+	if ckpt := fake.inputs("4")["ckpt_name"]; ckpt != "base.safetensors" {
+		t.Fatalf("expected the default checkpoint, got %v", ckpt)
+	}
+
+	if resp.Seed != 42 {
+		t.Fatalf("expected the requested seed to be reported, got %d", resp.Seed)
+	}
+
+	resp, err = c.Generate(context.Background(), TextToImageRequest{Prompt: "a red fox", Model: "sdxl.safetensors"})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if ckpt := fake.inputs("4")["ckpt_name"]; ckpt != "sdxl.safetensors" {
+		t.Fatalf("expected the requested checkpoint, got %v", ckpt)
+	}
+	if seed, _ := fake.inputs("3")["seed"].(float64); seed < 0 || fake.inputs("5")["width"] != float64(defaultImageSize) {
+		t.Fatalf("unexpected defaults: %v %v", fake.inputs("3"), fake.inputs("5"))
+	}
+	// 随机选择的种子随结果返回，便于复现
+	if seed, _ := fake.inputs("3")["seed"].(float64); resp.Seed == 0 || float64(resp.Seed) != seed {
+		t.Fatalf("expected the random seed %v to be reported, got %d", seed, resp.Seed)
+	}
+}
+
+func TestComfyUIFailures(t *testing.T) {
+	fake := &fakeComfyUI{polls: 1, fail: true}
+	srv := httptest.NewServer(fake.handler())
+	defer srv.Close()
+
+	c, _ := NewComfyUI(srv.URL, nil)
+	c.pollInterval = time.Millisecond
+	if _, err := c.Generate(context.Background(), TextToImageRequest{Prompt: "a red fox"}); err == nil || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("expected the execution error, got %v", err)
+	}
+
+	// 一直没有结果时受 ctx 截止时间约束，并从服务端队列中删除 prompt；已在执行时中断它
+	for _, running := range []bool{false, true} {
+		stuck := &fakeComfyUI{polls: 1 << 40, running: running}
+		pending := httptest.NewServer(stuck.handler())
+		c, _ = NewComfyUI(pending.URL, nil)
+		c.pollInterval = time.Millisecond
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		if _, err := c.Generate(ctx, TextToImageRequest{Prompt: "a red fox"}); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the deadline to stop polling, got %v", err)
+		}
+		cancel()
+		pending.Close()
+
+		wantInterrupts := int64(0)
+		if running {
+			wantInterrupts = 1
+		}
+		if stuck.deleted.Load() != 1 || stuck.interrupted.Load() != wantInterrupts {
+			t.Fatalf("running=%v: expected the prompt to be abandoned, got %d deletes and %d interrupts",
+				running, stuck.deleted.Load(), stuck.interrupted.Load())
+		}
+	}
+}
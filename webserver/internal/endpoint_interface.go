@@ -10,12 +10,14 @@ type TextToImageRequest struct {
 	Height         int    `json:"height,omitempty"`
 	Steps          int    `json:"steps,omitempty"`
 	Seed           int64  `json:"seed,omitempty"`
+	Model          string `json:"model,omitempty"` // 模型目录中的模型名，为空时由任意实例生成
 }
 
 // 文生图响应结构体
 type TextToImageResponse struct {
 	ImageData []byte
 	MimeType  string
+	Seed      int64 // 后端实际使用的种子，请求未指定种子且后端自行选择时返回；0 表示未知
 }
 
 // 语音转文字请求结构体
@@ -51,3 +53,34 @@ type SpeechToTextProvider interface {
 	TranscribeFile(ctx context.Context, audioData []byte, filename string) (SpeechToTextResponse, error)
 	TranscribePCM(ctx context.Context, pcmData []byte) (SpeechToTextResponse, error)
 }
+
+// 后端描述接口（可选），用于记录生成结果来自哪个实例、哪个模型
+type ProviderInfo interface {
+	InstanceName() string
+	ModelName() string
+}
+
+// 文生图模型的可选能力
+const (
+	FeatureNegativePrompt = "negative_prompt"
+	FeatureSeed           = "seed"
+)
+
+// ModelCapability 后端提供的一个模型及其限制，0 表示不限制
+type ModelCapability struct {
+	Name      string   `json:"name"`
+	MaxWidth  int      `json:"max_width,omitempty"`
+	MaxHeight int      `json:"max_height,omitempty"`
+	MaxSteps  int      `json:"max_steps,omitempty"`
+	Features  []string `json:"features,omitempty"` // 支持的能力（FeatureNegativePrompt 等），为空表示不声明
+}
+
+// 后端模型能力接口（可选），用于模型目录和按模型路由；未实现时按 ProviderInfo.ModelName 声明一个不限制的模型
+type ProviderModels interface {
+	Models() []ModelCapability
+}
+
+// 后端并发能力接口（可选），返回实例能同时处理的生成请求数，作为负载均衡槽位数的默认值；未实现时按 1 计算
+type ProviderConcurrency interface {
+	MaxConcurrency() int
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 生成耗时统计与排队时间预估
+// ======================
+//
+
+const (
+	durationWindow            = 50               // 每个后端保留的最近耗时样本数
+	defaultGenerationEstimate = 60 * time.Second // 没有样本时假设的单次生成耗时
+	defaultAdmissionMaxWait   = 10 * time.Minute // 预计等待超过该值时拒绝新任务
+)
+
+var (
+	// ErrQueueFull 队列已满，任务未提交
+	ErrQueueFull = errors.New("task queue is full")
+	// ErrAdmissionRejected 预计等待时间超过准入上限
+	ErrAdmissionRejected = errors.New("predicted wait exceeds the admission limit")
+)
+
+// DurationTracker 按后端记录最近的生成耗时（滚动窗口）
+type DurationTracker struct {
+	mu       sync.RWMutex
+	window   int
+	fallback time.Duration
+	samples  map[string][]time.Duration // 后端 → 按时间顺序的最近样本
+}
+
+// BackendDurationStats 单个后端的耗时统计
+type BackendDurationStats struct {
+	Backend    string  `json:"backend"`
+	Samples    int     `json:"samples"`
+	AvgSeconds float64 `json:"avg_seconds"`
+	P50Seconds float64 `json:"p50_seconds"`
+	P90Seconds float64 `json:"p90_seconds"`
+	LastSecond float64 `json:"last_seconds"`
+}
+
+// NewDurationTracker 创建耗时统计，window 为每个后端保留的样本数，fallback 为没有样本时的预估耗时
+func NewDurationTracker(window int, fallback time.Duration) *DurationTracker {
+	if window <= 0 {
+		window = durationWindow
+	}
+	if fallback <= 0 {
+		fallback = defaultGenerationEstimate
+	}
+	return &DurationTracker{
+		window:   window,
+		fallback: fallback,
+		samples:  make(map[string][]time.Duration),
+	}
+}
+
+// Observe 记录一次成功生成的耗时
+func (t *DurationTracker) Observe(backend string, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s := append(t.samples[backend], d)
+	if len(s) > t.window {
+		s = s[len(s)-t.window:]
+	}
+	t.samples[backend] = s
+}
+
+// Average 预估单次生成耗时：各后端平均值再取平均（轮询时每个后端分到的任务数相同），没有样本时返回 fallback
+func (t *DurationTracker) Average() time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var sum time.Duration
+	n := 0
+	for _, s := range t.samples {
+		if len(s) == 0 {
+			continue
+		}
+		sum += meanDuration(s)
+		n++
+	}
+	if n == 0 {
+		return t.fallback
+	}
+	return sum / time.Duration(n)
+}
+
+// Stats 返回各后端的耗时统计，按后端名称排序
+func (t *DurationTracker) Stats() []BackendDurationStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := make([]BackendDurationStats, 0, len(t.samples))
+	for backend, s := range t.samples {
+		if len(s) == 0 {
+			continue
+		}
+		sorted := append([]time.Duration(nil), s...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		stats = append(stats, BackendDurationStats{
+			Backend:    backend,
+			Samples:    len(s),
+			AvgSeconds: meanDuration(s).Seconds(),
+			P50Seconds: percentileDuration(sorted, 0.5).Seconds(),
+			P90Seconds: percentileDuration(sorted, 0.9).Seconds(),
+			LastSecond: s[len(s)-1].Seconds(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Backend < stats[j].Backend })
+	return stats
+}
+
+// Percentile 后端最近耗时的分位数和样本数，没有样本时返回 0, 0
+func (t *DurationTracker) Percentile(backend string, p float64) (time.Duration, int) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	s := t.samples[backend]
+	if len(s) == 0 {
+		return 0, 0
+	}
+	sorted := append([]time.Duration(nil), s...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return percentileDuration(sorted, p), len(s)
+}
+
+// LoadFromDB 用最近生成的图片耗时预热统计，避免重启后预估回到默认值
+func (t *DurationTracker) LoadFromDB(db *sql.DB) error {
+	rows, err := db.Query(`
+		SELECT backend_instance, duration_ms FROM images
+		WHERE duration_ms > 0
+		ORDER BY id DESC LIMIT ?
+	`, t.window*10)
+	if err != nil {
+		return fmt.Errorf("failed to load generation durations: %w", err)
+	}
+	defer rows.Close()
+
+	// 查询结果从新到旧，先收集再按时间顺序写入
+	loaded := make(map[string][]time.Duration)
+	for rows.Next() {
+		var backend string
+		var ms int64
+		if err := rows.Scan(&backend, &ms); err != nil {
+			return fmt.Errorf("failed to scan generation duration: %w", err)
+		}
+		if len(loaded[backend]) < t.window {
+			loaded[backend] = append(loaded[backend], time.Duration(ms)*time.Millisecond)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for backend, s := range loaded {
+		for i := len(s) - 1; i >= 0; i-- {
+			t.Observe(backend, s[i])
+		}
+	}
+	return nil
+}
+
+func meanDuration(s []time.Duration) time.Duration {
+	var sum time.Duration
+	for _, d := range s {
+		sum += d
+	}
+	return sum / time.Duration(len(s))
+}
+
+// percentileDuration 取已排序样本的分位数（最近秩法）
+func percentileDuration(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// TaskEstimate 任务的预计开始、结束时间
+type TaskEstimate struct {
+	StartAt  time.Time
+	FinishAt time.Time
+}
+
+// estimateQueue 模拟 worker 依次领取任务：running 为正在执行的任务的开始时间，
+// 返回排在第 position 位（从 1 开始）的任务的预计开始、结束时间
+func estimateQueue(now time.Time, workers int, avg time.Duration, running []time.Time, position int) TaskEstimate {
+	if workers < 1 {
+		workers = 1
+	}
+
+	// 每个 worker 预计空闲的时刻；超时未完成的任务视为马上完成
+	free := make([]time.Time, workers)
+	for i := range free {
+		free[i] = now
+	}
+	for i, started := range running {
+		if i >= workers {
+			break
+		}
+		if end := started.Add(avg); end.After(now) {
+			free[i] = end
+		}
+	}
+
+	var start time.Time
+	for p := 0; p < position; p++ {
+		next := 0
+		for i := range free {
+			if free[i].Before(free[next]) {
+				next = i
+			}
+		}
+		start = free[next]
+		free[next] = start.Add(avg)
+	}
+	return TaskEstimate{StartAt: start, FinishAt: start.Add(avg)}
+}
+
+// retryAfterSeconds 把等待时长换算为 Retry-After 秒数（向上取整，至少 1 秒）
+func retryAfterSeconds(d time.Duration) int {
+	s := int(math.Ceil(d.Seconds()))
+	if s < 1 {
+		s = 1
+	}
+	return s
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDurationTrackerRollingWindow(t *testing.T) {
+	tracker := NewDurationTracker(3, time.Minute)
+	if got := tracker.Average(); got != time.Minute {
+		t.Fatalf("expected fallback without samples, got %s", got)
+	}
+
+	for _, s := range []int{100, 10, 20, 30} {
+		tracker.Observe("a", time.Duration(s)*time.Second)
+	}
+	tracker.Observe("b", 40*time.Second)
+
+	// a 只保留最近 3 个样本（平均 20s），再与 b 的 40s 取平均
+	if got := tracker.Average(); got != 30*time.Second {
+		t.Fatalf("expected 30s, got %s", got)
+	}
+
+	stats := tracker.Stats()
+	if len(stats) != 2 || stats[0].Backend != "a" || stats[0].Samples != 3 || stats[0].P90Seconds != 30 || stats[0].LastSecond != 30 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestEstimateQueue(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	avg := 10 * time.Second
+
+	// 两个 worker：一个已执行 4s，一个空闲
+	running := []time.Time{now.Add(-4 * time.Second)}
+	cases := []struct {
+		position int
+		start    time.Duration
+	}{
+		{1, 0},
+		{2, 6 * time.Second},
+		{3, 10 * time.Second},
+		{4, 16 * time.Second},
+	}
+	for _, c := range cases {
+		eta := estimateQueue(now, 2, avg, running, c.position)
+		if got := eta.StartAt.Sub(now); got != c.start {
+			t.Errorf("position %d: expected start after %s, got %s", c.position, c.start, got)
+		}
+		if eta.FinishAt.Sub(eta.StartAt) != avg {
+			t.Errorf("position %d: expected finish one average duration after start", c.position)
+		}
+	}
+
+	// 超时未完成的任务视为马上完成
+	overdue := estimateQueue(now, 1, avg, []time.Time{now.Add(-time.Minute)}, 1)
+	if !overdue.StartAt.Equal(now) {
+		t.Fatalf("expected overdue worker to be free now, got %s", overdue.StartAt)
+	}
+}
+
+func TestDurationTrackerLoadFromDB(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	for _, d := range []time.Duration{8 * time.Second, 12 * time.Second} {
+		task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "warm up " + d.String()}, TaskOptions{})
+		if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("x"), MimeType: "image/png", Backend: "http://gpu-1", Duration: d}); err != nil {
+			t.Fatalf("SaveGenerationResult: %v", err)
+		}
+	}
+
+	tracker := NewDurationTracker(durationWindow, time.Minute)
+	if err := tracker.LoadFromDB(testDB); err != nil {
+		t.Fatalf("LoadFromDB: %v", err)
+	}
+	stats := tracker.Stats()
+	if len(stats) != 1 || stats[0].Backend != "http://gpu-1" || stats[0].Samples != 2 || stats[0].LastSecond != 12 {
+		t.Fatalf("unexpected stats after warm up: %+v", stats)
+	}
+	if got := tracker.Average(); got != 10*time.Second {
+		t.Fatalf("expected 10s average, got %s", got)
+	}
+}
+
+func TestHandleSubmitImageTaskAdmissionControl(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(1, 10, nil, tm)
+	wp.Durations().Observe("gpu", 30*time.Second)
+	wp.SetAdmissionLimit(time.Minute)
+	h := NewAsyncAPIHandlers(wp, tm, nil)
+
+	submit := func(prompt string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(SubmitImageTaskRequest{Prompt: prompt, Seed: 1})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/image/async", bytes.NewReader(body))
+		req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		h.HandleSubmitImageTask(rr, req)
+		return rr
+	}
+
+	// 单个 worker、每次 30s：第 3 个任务预计等待 60s，仍在上限内
+	for i, want := range []int{1, 2, 3} {
+		rr := submit("queued " + strconv.Itoa(i))
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("submission %d: expected status 202, got %d: %s", i, rr.Code, rr.Body.String())
+		}
+		var resp SubmitImageTaskResponse
+		json.Unmarshal(rr.Body.Bytes(), &resp)
+		if resp.QueuePosition != want || resp.EstimatedStartAt == nil || resp.EstimatedFinishAt == nil {
+			t.Fatalf("submission %d: expected position %d with ETA, got %+v", i, want, resp)
+		}
+	}
+
+	// 第 4 个预计等待 90s，超过上限 30s
+	rr := submit("rejected")
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Retry-After"); got != "30" {
+		t.Fatalf("expected Retry-After 30, got %q", got)
+	}
+	var count int
+	testDB.QueryRow("SELECT COUNT(*) FROM image_tasks").Scan(&count)
+	if count != 3 || wp.GetQueueLength() != 3 {
+		t.Fatalf("expected rejected submission not to create a task, got %d tasks", count)
+	}
+
+	// 与排队中任务相同的请求直接跟随，不受准入限制
+	if rr := submit("queued 0"); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected identical request to be attached, got %d: %s", rr.Code, rr.Body.String())
+	}
+}
+
+func TestHandleSubmitImageTaskQueueFull(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(1, 1, nil, tm)
+	wp.SetAdmissionLimit(0)
+	h := NewAsyncAPIHandlers(wp, tm, nil)
+
+	var codes []int
+	for _, prompt := range []string{"first", "second"} {
+		body, _ := json.Marshal(SubmitImageTaskRequest{Prompt: prompt})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/image/async", bytes.NewReader(body))
+		req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		start := time.Now()
+		h.HandleSubmitImageTask(rr, req)
+		if time.Since(start) > time.Second {
+			t.Fatal("expected submission not to block")
+		}
+		codes = append(codes, rr.Code)
+		if rr.Code == http.StatusServiceUnavailable && rr.Header().Get("Retry-After") == "" {
+			t.Fatal("expected Retry-After on a full queue")
+		}
+	}
+	if codes[0] != http.StatusAccepted || codes[1] != http.StatusServiceUnavailable {
+		t.Fatalf("expected 202 then 503, got %v", codes)
+	}
+}
+
+// readTracker 记录请求体是否被读取过
+type readTracker struct {
+	r    io.Reader
+	read bool
+}
+
+func (t *readTracker) Read(p []byte) (int, error) {
+	t.read = true
+	return t.r.Read(p)
+}
+
+func TestHandleSubmitSpeechTaskAdmitsBeforeUpload(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(1, 1, nil, tm)
+	wp.SetAdmissionLimit(0)
+	speech := NewLoadBalancer([]SpeechToTextProvider{&fakeWhisper{got: make(chan []byte, 1)}})
+	defer speech.Close()
+	wp.RegisterHandler(TaskKindSpeechTranscribe, NewSpeechTranscribeHandler(speech, tm))
+	h := NewAsyncAPIHandlers(wp, tm, speech)
+
+	var codes []int
+	var bodies []*readTracker
+	for i := 0; i < 2; i++ {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "meeting.wav")
+		part.Write(bytes.Repeat([]byte{1, 2, 3, 4}, 1024))
+		mw.Close()
+
+		tracker := &readTracker{r: &body}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/speech/async", tracker)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		h.HandleSubmitSpeechTask(rr, req)
+		codes = append(codes, rr.Code)
+		bodies = append(bodies, tracker)
+	}
+	if codes[0] != http.StatusAccepted || codes[1] != http.StatusServiceUnavailable {
+		t.Fatalf("expected 202 then 503, got %v", codes)
+	}
+	// 队列已满时在读取上传之前拒绝
+	if bodies[1].read {
+		t.Fatal("expected the rejected upload not to be read")
+	}
+}
+
+func TestHandleGetTaskStatusIncludesETA(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(1, 10, nil, tm)
+	wp.Durations().Observe("gpu", 20*time.Second)
+	h := NewAsyncAPIHandlers(wp, tm, nil)
+
+	running, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "running"}, TaskOptions{})
+	running.Status = TaskRunning
+	tm.UpdateTask(running)
+	wp.markRunning(running.ID)
+	queued, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "queued"}, TaskOptions{})
+
+	get := func(id string) TaskStatusResponse {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/tasks?task_id="+id, nil)
+		req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		h.HandleGetTaskStatus(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp TaskStatusResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	r := get(running.ID)
+	if r.ImageTask == nil || r.ID != running.ID || r.EstimatedFinishAt == nil || r.QueuePosition != 0 {
+		t.Fatalf("expected running task with finish estimate, got %+v", r)
+	}
+
+	q := get(queued.ID)
+	if q.QueuePosition != 1 || q.EstimatedStartAt == nil {
+		t.Fatalf("expected queued task at position 1 with ETA, got %+v", q)
+	}
+	// 唯一的 worker 被占用，排队任务在运行任务结束后开始
+	if d := q.EstimatedStartAt.Sub(*r.EstimatedFinishAt); d < -time.Second || d > time.Second {
+		t.Fatalf("expected queued task to start when the running one finishes, got %s apart", d)
+	}
+}
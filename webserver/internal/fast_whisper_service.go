@@ -21,11 +21,12 @@ type FastWhisperService struct {
 }
 
 const (
-	defaultASRTimeout = 30 * time.Second
-	minPCMLength      = 16000 * 2 // 1 秒的 16kHz 16bit PCM 数据
+	defaultASRTimeout = 30 * time.Second // 调用方没有设置截止时间时使用
+	minPCMLength      = 16000 * 2        // 1 秒的 16kHz 16bit PCM 数据
 )
 
 // NewFastWhisperService 构造函数，允许自定义 http.Client。
+// 默认 client 不设置整体超时，长音频的识别时间由调用方通过 ctx 的截止时间控制。
 func NewFastWhisperService(rawURL string, client *http.Client) (*FastWhisperService, error) {
 	parsed, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
 	if err != nil {
@@ -33,7 +34,7 @@ func NewFastWhisperService(rawURL string, client *http.Client) (*FastWhisperServ
 	}
 
 	if client == nil {
-		client = &http.Client{Timeout: defaultASRTimeout}
+		client = &http.Client{}
 	}
 
 	return &FastWhisperService{baseURL: parsed, client: client}, nil
@@ -63,6 +64,12 @@ func (f *FastWhisperService) TranscribeFile(ctx context.Context, audioData []byt
 		return empty, errors.New("audio data is empty")
 	}
 
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultASRTimeout)
+		defer cancel()
+	}
+
 	// 创建 multipart form
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -128,6 +135,12 @@ func (f *FastWhisperService) TranscribePCM(ctx context.Context, pcmData []byte)
 		}, nil
 	}
 
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultASRTimeout)
+		defer cancel()
+	}
+
 	// 创建 HTTP 请求
 	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, f.resolvePath("/api/v1/asr/pcm"), bytes.NewReader(pcmData))
 	if err != nil {
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+//
+// ======================
+// 请求对冲与故障转移
+// ======================
+//
+// 同步接口的调用方（ESP32 语音指令）对尾延迟敏感。hedgedCall 先把请求发给一个实例：
+//   - 超过对冲延迟（最近成功请求耗时的 Percentile 分位数，不低于 MinDelay）还没有结果时，再发给另一个
+//     有空闲槽位的实例，取先成功的结果并取消其余请求；被取消的请求不计入熔断器和延迟统计
+//   - 请求因连接错误失败（连接被拒绝、被重置、响应中断）时换一个实例重试
+// 发出的请求总数不超过 MaxAttempts，全部受调用方 ctx 的截止时间约束。
+//
+
+const (
+	hedgeMinSamples     = 10 // 样本不足时不对冲，只做故障转移
+	hedgeLatencyWindow  = 200
+	defaultHedgeMinWait = 100 * time.Millisecond
+)
+
+// HedgePolicy 对冲和故障转移配置
+type HedgePolicy struct {
+	Percentile  float64       `json:"percentile"`   // 对冲延迟取最近成功请求耗时的分位数（如 0.95），0 表示不对冲
+	MinDelay    time.Duration `json:"-"`            // 对冲延迟下限
+	MaxAttempts int           `json:"max_attempts"` // 包括对冲和故障转移在内最多发出的请求数，1 表示都不做
+}
+
+// DefaultHedgePolicy 默认不对冲，连接错误时换一个实例重试一次
+func DefaultHedgePolicy() HedgePolicy {
+	return HedgePolicy{MinDelay: defaultHedgeMinWait, MaxAttempts: 2}
+}
+
+// normalized 补全非法取值
+func (p HedgePolicy) normalized() HedgePolicy {
+	if p.Percentile < 0 || p.Percentile >= 1 {
+		p.Percentile = 0
+	}
+	if p.MinDelay < 0 {
+		p.MinDelay = 0
+	}
+	if p.MaxAttempts < 1 {
+		p.MaxAttempts = 1
+	}
+	return p
+}
+
+// HedgeStats 对冲配置和累计次数
+type HedgeStats struct {
+	Policy    HedgePolicy `json:"policy"`
+	Requests  int64       `json:"requests"`
+	Hedges    int64       `json:"hedges"`     // 发出的对冲请求
+	HedgeWins int64       `json:"hedge_wins"` // 对冲请求先于原请求成功
+	Failovers int64       `json:"failovers"`  // 连接错误后换实例重试
+}
+
+// Hedger 按 HedgePolicy 调用负载均衡器中的实例，并按 key（如请求类型）记录成功请求的耗时
+type Hedger struct {
+	policy    HedgePolicy
+	latencies *DurationTracker
+
+	requests  atomic.Int64
+	hedges    atomic.Int64
+	hedgeWins atomic.Int64
+	failovers atomic.Int64
+}
+
+// NewHedger 创建对冲器
+func NewHedger(p HedgePolicy) *Hedger {
+	return &Hedger{policy: p.normalized(), latencies: NewDurationTracker(hedgeLatencyWindow, time.Second)}
+}
+
+// Delay key 的对冲延迟；未启用对冲或样本不足时返回 0, false
+func (h *Hedger) Delay(key string) (time.Duration, bool) {
+	if h.policy.Percentile == 0 || h.policy.MaxAttempts < 2 {
+		return 0, false
+	}
+	d, n := h.latencies.Percentile(key, h.policy.Percentile)
+	if n < hedgeMinSamples {
+		return 0, false
+	}
+	return max(d, h.policy.MinDelay), true
+}
+
+// Stats 配置和累计次数
+func (h *Hedger) Stats() HedgeStats {
+	return HedgeStats{
+		Policy:    h.policy,
+		Requests:  h.requests.Load(),
+		Hedges:    h.hedges.Load(),
+		HedgeWins: h.hedgeWins.Load(),
+		Failovers: h.failovers.Load(),
+	}
+}
+
+// isConnectionError 请求没有到达后端或连接中途断开，换一个实例重试是安全的
+func isConnectionError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// hedgedCall 按 h 的配置调用 lb 中的实例，返回第一个成功的结果；都失败时返回最后一个错误
+func hedgedCall[P Pinger, R any](ctx context.Context, h *Hedger, lb *LoadBalancer[P], key string,
+	call func(ctx context.Context, client P) (R, error)) (R, error) {
+	h.requests.Add(1)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // 取消还没有返回的请求
+
+	type attempt struct {
+		resp  R
+		err   error
+		hedge bool
+	}
+	results := make(chan attempt, h.policy.MaxAttempts)
+	tried := make(map[int64]bool)
+	launch := func(inst *BackendInstance[P], hedge bool) {
+		tried[inst.ID] = true
+		go func() {
+			start := time.Now()
+			resp, err := call(ctx, inst.Client)
+			lb.Release(inst, time.Since(start), err)
+			if err == nil {
+				h.latencies.Observe(key, time.Since(start))
+			}
+			results <- attempt{resp, err, hedge}
+		}()
+	}
+
+	var zero R
+	inst, err := lb.AcquireExcept(ctx, tried)
+	if err != nil {
+		return zero, err
+	}
+	launch(inst, false)
+	inflight := 1
+
+	var hedgeTimer <-chan time.Time
+	delay, hedging := h.Delay(key)
+	if hedging {
+		hedgeTimer = time.After(delay)
+	}
+
+	var lastErr error
+	for {
+		select {
+		case r := <-results:
+			inflight--
+			if r.err == nil {
+				if r.hedge {
+					h.hedgeWins.Add(1)
+				}
+				return r.resp, nil
+			}
+			lastErr = r.err
+			if isConnectionError(r.err) && len(tried) < h.policy.MaxAttempts {
+				// 还有请求在进行时不排队等槽位，以免错过它的结果
+				var inst *BackendInstance[P]
+				if inflight == 0 {
+					inst, _ = lb.AcquireExcept(ctx, tried)
+				} else {
+					inst, _ = lb.TryAcquireExcept(tried)
+				}
+				if inst != nil {
+					h.failovers.Add(1)
+					launch(inst, false)
+					inflight++
+				}
+			}
+			if inflight == 0 {
+				return zero, lastErr
+			}
+
+		case <-hedgeTimer:
+			// 只用有空闲槽位的实例对冲，不排队；没有空闲实例时不再对冲
+			hedgeTimer = nil
+			if len(tried) < h.policy.MaxAttempts {
+				if inst, _ := lb.TryAcquireExcept(tried); inst != nil {
+					h.hedges.Add(1)
+					launch(inst, true)
+					inflight++
+					if len(tried) < h.policy.MaxAttempts {
+						hedgeTimer = time.After(delay)
+					}
+				}
+			}
+
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
+}
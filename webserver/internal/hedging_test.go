@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedWhisper 按 fn 返回识别结果，记录调用次数
+type scriptedWhisper struct {
+	calls atomic.Int64
+	fn    func(ctx context.Context) (SpeechToTextResponse, error)
+}
+
+func (s *scriptedWhisper) Ping(ctx context.Context) error { return nil }
+
+func (s *scriptedWhisper) TranscribeFile(ctx context.Context, audioData []byte, filename string) (SpeechToTextResponse, error) {
+	s.calls.Add(1)
+	return s.fn(ctx)
+}
+
+func (s *scriptedWhisper) TranscribePCM(ctx context.Context, pcmData []byte) (SpeechToTextResponse, error) {
+	s.calls.Add(1)
+	return s.fn(ctx)
+}
+
+func newScriptedBalancer(whispers ...*scriptedWhisper) *SpeechBalancer {
+	lb := &SpeechBalancer{strategy: &roundRobinStrategy[SpeechToTextProvider]{}, breaker: DefaultBreakerPolicy()}
+	for i, w := range whispers {
+		lb.instances = append(lb.instances, newBackendInstance[SpeechToTextProvider](int64(i+1), w))
+	}
+	return lb
+}
+
+func transcribeFile(ctx context.Context, client SpeechToTextProvider) (SpeechToTextResponse, error) {
+	return client.TranscribeFile(ctx, []byte("audio"), "command.wav")
+}
+
+var (
+	answer     = SpeechToTextResponse{Language: "zh"}
+	refused    = fmt.Errorf("execute request: %w", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+	answerWith = func(resp SpeechToTextResponse, err error) func(context.Context) (SpeechToTextResponse, error) {
+		return func(context.Context) (SpeechToTextResponse, error) { return resp, err }
+	}
+	hang = func(ctx context.Context) (SpeechToTextResponse, error) {
+		<-ctx.Done()
+		return SpeechToTextResponse{}, ctx.Err()
+	}
+)
+
+func TestHedgedCallFailsOverOnConnectionErrors(t *testing.T) {
+	down := &scriptedWhisper{fn: answerWith(SpeechToTextResponse{}, refused)}
+	up := &scriptedWhisper{fn: answerWith(answer, nil)}
+	lb := newScriptedBalancer(down, up)
+	h := NewHedger(DefaultHedgePolicy())
+
+	resp, err := hedgedCall(context.Background(), h, lb, "file", transcribeFile)
+	if err != nil || resp.Language != "zh" {
+		t.Fatalf("expected failover to the healthy instance, got %+v, %v", resp, err)
+	}
+	if stats := h.Stats(); stats.Failovers != 1 || down.calls.Load() != 1 || up.calls.Load() != 1 {
+		t.Fatalf("unexpected attempts: %+v (%d/%d calls)", stats, down.calls.Load(), up.calls.Load())
+	}
+	if lb.instances[0].failures.Load() != 1 || lb.instances[0].Outstanding() != 0 || lb.instances[1].Outstanding() != 0 {
+		t.Fatal("expected both attempts to be released and the failure recorded")
+	}
+
+	// 其他错误不重试：请求已经到达后端，换实例多半得到同样的结果
+	bad := &scriptedWhisper{fn: answerWith(SpeechToTextResponse{}, errors.New("unexpected status 400"))}
+	other := &scriptedWhisper{fn: answerWith(answer, nil)}
+	if _, err := hedgedCall(context.Background(), h, newScriptedBalancer(bad, other), "file", transcribeFile); err == nil || other.calls.Load() != 0 {
+		t.Fatalf("expected no retry after a non-connection error, got %v (%d calls)", err, other.calls.Load())
+	}
+
+	// 所有实例都连不上时返回最后一个错误，请求数不超过 MaxAttempts
+	all := []*scriptedWhisper{{fn: down.fn}, {fn: down.fn}, {fn: down.fn}}
+	if _, err := hedgedCall(context.Background(), h, newScriptedBalancer(all...), "file", transcribeFile); !isConnectionError(err) {
+		t.Fatalf("expected the connection error, got %v", err)
+	}
+	if n := all[0].calls.Load() + all[1].calls.Load() + all[2].calls.Load(); n != 2 {
+		t.Fatalf("expected 2 attempts, got %d", n)
+	}
+}
+
+func TestHedgedCallHedgesSlowRequests(t *testing.T) {
+	h := NewHedger(HedgePolicy{Percentile: 0.9, MinDelay: 5 * time.Millisecond, MaxAttempts: 2})
+
+	// 样本不足时不对冲，只受截止时间约束
+	fast := &scriptedWhisper{fn: answerWith(answer, nil)}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := hedgedCall(ctx, h, newScriptedBalancer(&scriptedWhisper{fn: hang}, fast), "pcm", transcribeFile); !errors.Is(err, context.DeadlineExceeded) || fast.calls.Load() != 0 {
+		t.Fatalf("expected no hedge without samples, got %v (%d calls)", err, fast.calls.Load())
+	}
+
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.latencies.Observe("pcm", time.Millisecond)
+	}
+	if d, ok := h.Delay("pcm"); !ok || d != 5*time.Millisecond {
+		t.Fatalf("expected the delay to be floored at MinDelay, got %s (%v)", d, ok)
+	}
+
+	// 轮询先选中慢实例，超过对冲延迟后另一个实例先返回，慢请求被取消且不计为失败
+	lb := newScriptedBalancer(&scriptedWhisper{fn: hang}, fast)
+	start := time.Now()
+	resp, err := hedgedCall(context.Background(), h, lb, "pcm", transcribeFile)
+	if err != nil || resp.Language != "zh" || time.Since(start) > time.Second {
+		t.Fatalf("expected the hedge to answer, got %+v, %v", resp, err)
+	}
+	if stats := h.Stats(); stats.Hedges != 1 || stats.HedgeWins != 1 {
+		t.Fatalf("unexpected hedge stats: %+v", stats)
+	}
+	waitFor(t, "the slow request to be released", func() bool { return lb.instances[0].Outstanding() == 0 })
+	if lb.instances[0].failures.Load() != 0 || lb.instances[0].breaker.Stats().State != BreakerClosed {
+		t.Fatal("expected the cancelled request not to count against the slow instance")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//
+// ======================
+// 会话亲和（一致性哈希）
+// ======================
+//
+// 配置了亲和键时，带键的请求不经过 Strategy，而是用加权 rendezvous 哈希（HRW）给所有实例排序，优先选
+// 得分最高的实例：增删实例只会移动原本属于该实例的键，其他键仍落在原来的实例上，后端的缓存保持有效。
+// 为了避免热点键压垮单个实例，进行中请求超过平均值 × LoadFactor 的实例暂时跳过（bounded load），
+// 按排序顺延到下一个实例。
+//
+
+const (
+	AffinityUser        = "user"        // 用户 ID
+	AffinityFingerprint = "fingerprint" // 生成参数指纹（GenerationFingerprint），参数完全相同的生成落在同一实例上
+	AffinityModel       = "model"       // 任务指定的模型，同一模型的任务集中到少数实例上，减少切换模型的开销
+
+	defaultAffinityLoadFactor = 1.25
+)
+
+// affinityKeyParts 亲和键的组成部分
+var affinityKeyParts = map[string]func(task *ImageTask) string{
+	AffinityUser: func(task *ImageTask) string {
+		return strconv.FormatInt(task.UserID, 10)
+	},
+	AffinityFingerprint: func(task *ImageTask) string {
+		return task.Fingerprint
+	},
+	AffinityModel: func(task *ImageTask) string {
+		return task.Model
+	},
+}
+
+// AffinityPolicy 亲和键的组成和负载上限，Keys 为空表示不启用
+type AffinityPolicy struct {
+	Keys       []string `json:"keys"`
+	LoadFactor float64  `json:"load_factor"` // 单个实例进行中的请求不超过平均值的倍数，至少为 1
+}
+
+// ParseAffinityKeys 解析逗号分隔的亲和键（如 "user,fingerprint"、"model"），空字符串表示不启用
+func ParseAffinityKeys(s string) ([]string, error) {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		if _, ok := affinityKeyParts[k]; !ok {
+			return nil, fmt.Errorf("unknown affinity key %q", k)
+		}
+		if !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+// Key 任务的亲和键，未启用或各部分都为空时返回空字符串
+func (p AffinityPolicy) Key(task *ImageTask) string {
+	parts := make([]string, 0, len(p.Keys))
+	empty := true
+	for _, k := range p.Keys {
+		part := affinityKeyParts[k](task)
+		empty = empty && part == ""
+		parts = append(parts, part)
+	}
+	if empty {
+		return ""
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// rendezvousScore 键在实例上的加权 HRW 得分：-weight / ln(u)，u 为 (0, 1) 内的哈希值。
+// 只依赖键和实例 ID，多个进程对同一个键得到相同的排序
+func rendezvousScore[P Pinger](key string, inst *BackendInstance[P]) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.FormatInt(inst.ID, 10)))
+	// splitmix64 终混，改善 FNV 低位的分布
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	u := (float64(x>>11) + 0.5) / (1 << 53)
+	return -float64(inst.Weight()) / math.Log(u)
+}
+
+// rendezvousOrder 按键的得分从高到低排列实例
+func rendezvousOrder[P Pinger](key string, instances []*BackendInstance[P]) []*BackendInstance[P] {
+	type scored struct {
+		inst  *BackendInstance[P]
+		score float64
+	}
+	list := make([]scored, len(instances))
+	for i, inst := range instances {
+		list[i] = scored{inst, rendezvousScore(key, inst)}
+	}
+	slices.SortFunc(list, func(a, b scored) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.inst.ID, b.inst.ID)
+	})
+	ordered := make([]*BackendInstance[P], len(list))
+	for i, s := range list {
+		ordered[i] = s.inst
+	}
+	return ordered
+}
+
+// affinityOrder 带负载上限的亲和顺序：进行中请求未超过 ceil(平均值 × loadFactor) 的实例按得分在前，
+// 其余按得分在后。平均值按 healthy 中的全部实例计算（包括本次请求）
+func affinityOrder[P Pinger](key string, free, healthy []*BackendInstance[P], loadFactor float64) []*BackendInstance[P] {
+	total := 1
+	for _, inst := range healthy {
+		total += inst.Outstanding()
+	}
+	bound := int(math.Ceil(float64(total) * max(loadFactor, 1) / float64(len(healthy))))
+
+	ordered := rendezvousOrder(key, free)
+	within := make([]*BackendInstance[P], 0, len(ordered))
+	var over []*BackendInstance[P]
+	for _, inst := range ordered {
+		if inst.Outstanding()+1 <= bound {
+			within = append(within, inst)
+		} else {
+			over = append(over, inst)
+		}
+	}
+	return append(within, over...)
+}
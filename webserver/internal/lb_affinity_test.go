@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+)
+
+func TestRendezvousKeepsKeysOnScaling(t *testing.T) {
+	instances := newTestInstances(5)
+	owner := func(instances []*BackendInstance[TextToImageProvider], key string) int64 {
+		return rendezvousOrder(key, instances)[0].ID
+	}
+
+	const keys = 2000
+	before := make(map[string]int64, keys)
+	counts := map[int64]int{}
+	for i := 0; i < keys; i++ {
+		key := "user-" + strconv.Itoa(i)
+		before[key] = owner(instances[:4], key)
+		counts[before[key]]++
+	}
+	for id, n := range counts {
+		if n < keys/4*3/4 || n > keys/4*5/4 {
+			t.Fatalf("expected keys to spread evenly, instance %d got %d of %d", id, n, keys)
+		}
+	}
+
+	// 加入实例：只有移到新实例的键发生变化
+	moved := 0
+	for key, id := range before {
+		now := owner(instances, key)
+		if now != id {
+			if now != instances[4].ID {
+				t.Fatalf("key %s moved between existing instances (%d -> %d)", key, id, now)
+			}
+			moved++
+		}
+	}
+	if moved < keys/5/2 || moved > keys/5*2 {
+		t.Fatalf("expected about a fifth of the keys to move, got %d", moved)
+	}
+
+	// 移除实例：只有原本在该实例上的键发生变化
+	remaining := []*BackendInstance[TextToImageProvider]{instances[0], instances[2], instances[3]}
+	for key, id := range before {
+		if id != instances[1].ID && owner(remaining, key) != id {
+			t.Fatalf("key %s moved although its instance was not removed", key)
+		}
+	}
+}
+
+func TestAffinityBoundedLoadAndUserHash(t *testing.T) {
+	lb := &ImageBalancer{strategy: &roundRobinStrategy[TextToImageProvider]{}, breaker: DefaultBreakerPolicy(), instances: newTestInstances(3)}
+	for _, inst := range lb.instances {
+		inst.capacity.Store(10)
+	}
+	lb.SetAffinity(AffinityPolicy{Keys: []string{AffinityUser, AffinityFingerprint}, LoadFactor: 1.5})
+
+	generation := func(userID int64, req TextToImageRequest) *ImageTask {
+		return &ImageTask{UserID: userID, Prompt: req.Prompt, Seed: req.Seed, Fingerprint: GenerationFingerprint(req)}
+	}
+	lighthouse := TextToImageRequest{Prompt: "a lighthouse", Seed: 7}
+	task := generation(42, TextToImageRequest{Prompt: "  a lighthouse  ", Seed: 7})
+	key := lb.AffinityKey(task)
+	if key != lb.AffinityKey(generation(42, lighthouse)) || key == lb.AffinityKey(generation(7, lighthouse)) {
+		t.Fatal("expected the key to combine the user and the generation fingerprint")
+	}
+	// 提示词相同但参数不同的生成不是同一个可缓存单元
+	if key == lb.AffinityKey(generation(42, TextToImageRequest{Prompt: "a lighthouse", Seed: 8})) {
+		t.Fatal("expected a different seed to change the key")
+	}
+	order := rendezvousOrder(key, lb.instances)
+
+	// 负载均衡时总是落在同一个实例上
+	for i := 0; i < 3; i++ {
+		inst, _ := lb.AcquireFor(context.Background(), key)
+		if inst != order[0] {
+			t.Fatalf("expected affinity to pick %s, got %s", order[0].Name, inst.Name)
+		}
+		lb.Release(inst, 0, nil)
+	}
+
+	// 热点键：首选实例超过平均负载的 1.5 倍后顺延到下一个实例
+	var picked []*BackendInstance[TextToImageProvider]
+	for i := 0; i < 6; i++ {
+		inst, _ := lb.AcquireFor(context.Background(), key)
+		picked = append(picked, inst)
+	}
+	if order[0].Outstanding() != 3 || order[1].Outstanding() != 3 || order[2].Outstanding() != 0 {
+		t.Fatalf("expected load to spill over in hash order, got %d/%d/%d",
+			order[0].Outstanding(), order[1].Outstanding(), order[2].Outstanding())
+	}
+	for _, inst := range picked {
+		lb.Release(inst, 0, nil)
+	}
+
+	// user-hash：负数用户 ID 和没有实例时都不会 panic
+	if lb.GetByStrategy("user-hash", -7) != lb.GetByStrategy("user-hash", -7) {
+		t.Fatal("expected user-hash to be stable")
+	}
+	if (&ImageBalancer{strategy: &roundRobinStrategy[TextToImageProvider]{}}).GetByStrategy("user-hash", 3) != nil {
+		t.Fatal("expected no client without instances")
+	}
+
+	if _, err := ParseAffinityKeys("user, gpu"); err == nil {
+		t.Fatal("expected an unknown affinity key to be rejected")
+	}
+
+	// 按模型亲和：同一模型的任务落在同一实例上，不指定模型的任务不带亲和键
+	lb.SetAffinity(AffinityPolicy{Keys: []string{AffinityModel}})
+	sdxl := lb.AffinityKey(&ImageTask{UserID: 1, Prompt: "a fox", Model: "sdxl"})
+	if sdxl == "" || sdxl != lb.AffinityKey(&ImageTask{UserID: 2, Prompt: "a cat", Model: "sdxl"}) ||
+		sdxl == lb.AffinityKey(&ImageTask{UserID: 1, Prompt: "a fox", Model: "flux"}) {
+		t.Fatalf("expected the key to depend only on the model, got %q", sdxl)
+	}
+	if key := lb.AffinityKey(&ImageTask{UserID: 1, Prompt: "a fox"}); key != "" {
+		t.Fatalf("expected no affinity without a model, got %q", key)
+	}
+	if keys, err := ParseAffinityKeys("model,user"); err != nil || keys[0] != AffinityModel {
+		t.Fatalf("expected the model key to be accepted, got %v, %v", keys, err)
+	}
+	if keys, _ := ParseAffinityKeys(" fingerprint,user,fingerprint "); len(keys) != 2 || keys[0] != AffinityFingerprint {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// ======================
+// 负载均衡策略
+// ======================
+//
+// LoadBalancer 把可用实例交给 Strategy 选择，调用结束后通过 Release 把耗时和是否出错记录到实例上，
+// 策略据此做决策：
+//   round-robin           依次轮询
+//   weighted-round-robin  平滑加权轮询（权重见 BackendInstance.Weight）
+//   least-outstanding     进行中请求最少的实例
+//   peak-ewma             延迟 EWMA × (进行中请求 + 1) 最小的实例；延迟升高立即生效，降低时按时间衰减
+//   p2c                   随机取两个实例，选进行中请求较少的（相同时比较延迟）
+//
+
+const (
+	StrategyRoundRobin         = "round-robin"
+	StrategyWeightedRoundRobin = "weighted-round-robin"
+	StrategyLeastOutstanding   = "least-outstanding"
+	StrategyPeakEWMA           = "peak-ewma"
+	StrategyP2C                = "p2c"
+
+	ewmaDecay          = 10 * time.Second // 延迟 EWMA 的衰减时间常数
+	ewmaInitialLatency = time.Second      // 还没有样本的实例按该延迟估算
+	failurePenalty     = 2                // 失败请求按 max(耗时, 当前 EWMA, 1s) 的倍数计入延迟
+)
+
+// Strategy 从可用实例中选择一个，candidates 非空；实现需要并发安全
+type Strategy[P Pinger] interface {
+	Name() string
+	Pick(candidates []*BackendInstance[P]) *BackendInstance[P]
+}
+
+// NewStrategy 按名称创建策略，空字符串为 round-robin
+func NewStrategy[P Pinger](name string) (Strategy[P], error) {
+	switch name {
+	case "", StrategyRoundRobin:
+		return &roundRobinStrategy[P]{}, nil
+	case StrategyWeightedRoundRobin:
+		return &weightedRoundRobinStrategy[P]{current: make(map[*BackendInstance[P]]int)}, nil
+	case StrategyLeastOutstanding:
+		return &leastOutstandingStrategy[P]{}, nil
+	case StrategyPeakEWMA:
+		return &peakEWMAStrategy[P]{}, nil
+	case StrategyP2C:
+		return p2cStrategy[P]{}, nil
+	default:
+		return nil, fmt.Errorf("unknown load balancing strategy %q", name)
+	}
+}
+
+// Pinger 可以放进 LoadBalancer 的后端：只要求提供健康检查
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// BackendInstance 负载均衡中的一个后端实例及其运行统计
+type BackendInstance[P Pinger] struct {
+	ID     int64 // 稳定的实例 ID，来自 backends 表
+	Client P
+	Name   string // 后端实现了 ProviderInfo 时为 InstanceName，否则为 instance-<ID>
+
+	status      atomic.Value // BackendEnabled / BackendDrained / BackendDisabled
+	breaker     *circuitBreaker
+	weight      atomic.Int64
+	capacity    atomic.Int64 // 并发槽位数
+	available   atomic.Bool
+	outstanding atomic.Int64 // 进行中的请求，Acquire 时占用槽位
+	requests    atomic.Int64
+	failures    atomic.Int64
+	models      atomic.Pointer[[]ModelCapability] // 为空时使用后端声明的模型
+
+	mu         sync.Mutex
+	ewma       float64 // 延迟 EWMA（纳秒），0 表示还没有样本
+	lastSample time.Time
+}
+
+func newBackendInstance[P Pinger](id int64, client P) *BackendInstance[P] {
+	inst := &BackendInstance[P]{ID: id, Client: client, Name: fmt.Sprintf("instance-%d", id)}
+	if info, ok := any(client).(ProviderInfo); ok && info.InstanceName() != "" {
+		inst.Name = info.InstanceName()
+	}
+	inst.breaker = newCircuitBreaker(inst.Name)
+	inst.status.Store(BackendEnabled)
+	inst.weight.Store(1)
+	inst.capacity.Store(1)
+	if c, ok := any(client).(ProviderConcurrency); ok && c.MaxConcurrency() > 0 {
+		inst.capacity.Store(int64(c.MaxConcurrency()))
+	}
+	inst.available.Store(true)
+	return inst
+}
+
+// Status 实例状态：enabled 接收请求，drained 不接收新请求，disabled 不接收请求也不做健康检查
+func (inst *BackendInstance[P]) Status() string {
+	return inst.status.Load().(string)
+}
+
+// Weight 加权轮询的权重，至少为 1
+func (inst *BackendInstance[P]) Weight() int {
+	return int(inst.weight.Load())
+}
+
+// Capacity 同时处理的请求数上限，默认为后端声明的 MaxConcurrency，没有声明时为 1
+func (inst *BackendInstance[P]) Capacity() int {
+	return int(inst.capacity.Load())
+}
+
+// Models 实例提供的模型：backends 表中配置的优先，否则为后端声明的模型
+func (inst *BackendInstance[P]) Models() []ModelCapability {
+	if models := inst.models.Load(); models != nil {
+		return *models
+	}
+	return providerModels(inst.Client)
+}
+
+// Satisfies 实例能否处理对模型的要求，没有指定模型时总是可以
+func (inst *BackendInstance[P]) Satisfies(r ModelRequirement) bool {
+	if r.Model == "" {
+		return true
+	}
+	return slices.ContainsFunc(inst.Models(), func(c ModelCapability) bool { return c.Satisfies(r) })
+}
+
+// tryReserve 有空闲槽位时占用一个
+func (inst *BackendInstance[P]) tryReserve() bool {
+	for {
+		n := inst.outstanding.Load()
+		if n >= inst.capacity.Load() {
+			return false
+		}
+		if inst.outstanding.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// Outstanding 进行中的请求数
+func (inst *BackendInstance[P]) Outstanding() int {
+	return int(inst.outstanding.Load())
+}
+
+// observe 记录一次请求的耗时和结果，更新 peak EWMA
+func (inst *BackendInstance[P]) observe(latency time.Duration, failed bool, now time.Time) {
+	inst.requests.Add(1)
+	if failed {
+		inst.failures.Add(1)
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	sample := float64(latency)
+	if failed {
+		sample = math.Max(math.Max(sample, inst.ewma), float64(time.Second)) * failurePenalty
+	}
+	switch {
+	case inst.ewma == 0 || sample > inst.ewma:
+		// 延迟升高立即生效
+		inst.ewma = sample
+	default:
+		w := math.Exp(-float64(now.Sub(inst.lastSample)) / float64(ewmaDecay))
+		inst.ewma = inst.ewma*w + sample*(1-w)
+	}
+	inst.lastSample = now
+}
+
+// Latency 当前延迟 EWMA，没有样本时返回 0
+func (inst *BackendInstance[P]) Latency() time.Duration {
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	return time.Duration(inst.ewma)
+}
+
+// latencyEstimate 用于策略比较的延迟，没有样本时为 ewmaInitialLatency
+func (inst *BackendInstance[P]) latencyEstimate() float64 {
+	if l := inst.Latency(); l > 0 {
+		return float64(l)
+	}
+	return float64(ewmaInitialLatency)
+}
+
+// roundRobinStrategy 依次轮询
+type roundRobinStrategy[P Pinger] struct {
+	next atomic.Uint32
+}
+
+func (s *roundRobinStrategy[P]) Name() string { return StrategyRoundRobin }
+
+func (s *roundRobinStrategy[P]) Pick(candidates []*BackendInstance[P]) *BackendInstance[P] {
+	return candidates[int(s.next.Add(1)-1)%len(candidates)]
+}
+
+// weightedRoundRobinStrategy 平滑加权轮询：每次所有实例的当前值加上权重，选当前值最大的并减去权重总和，
+// 权重 3:1 时选择顺序为 A A B A 而不是 A A A B
+type weightedRoundRobinStrategy[P Pinger] struct {
+	mu      sync.Mutex
+	current map[*BackendInstance[P]]int
+}
+
+func (s *weightedRoundRobinStrategy[P]) Name() string { return StrategyWeightedRoundRobin }
+
+func (s *weightedRoundRobinStrategy[P]) Pick(candidates []*BackendInstance[P]) *BackendInstance[P] {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	total := 0
+	var best *BackendInstance[P]
+	for _, c := range candidates {
+		w := c.Weight()
+		total += w
+		s.current[c] += w
+		if best == nil || s.current[c] > s.current[best] {
+			best = c
+		}
+	}
+	s.current[best] -= total
+	return best
+}
+
+// leastOutstandingStrategy 选进行中请求最少的实例，相同时从轮换的起点开始取第一个
+type leastOutstandingStrategy[P Pinger] struct {
+	next atomic.Uint32
+}
+
+func (s *leastOutstandingStrategy[P]) Name() string { return StrategyLeastOutstanding }
+
+func (s *leastOutstandingStrategy[P]) Pick(candidates []*BackendInstance[P]) *BackendInstance[P] {
+	start := int(s.next.Add(1)-1) % len(candidates)
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		c := candidates[(start+i)%len(candidates)]
+		if c.Outstanding() < best.Outstanding() {
+			best = c
+		}
+	}
+	return best
+}
+
+// peakEWMAStrategy 选 延迟 EWMA × (进行中请求 + 1) 最小的实例
+type peakEWMAStrategy[P Pinger] struct {
+	next atomic.Uint32
+}
+
+func (s *peakEWMAStrategy[P]) Name() string { return StrategyPeakEWMA }
+
+func (s *peakEWMAStrategy[P]) Pick(candidates []*BackendInstance[P]) *BackendInstance[P] {
+	start := int(s.next.Add(1)-1) % len(candidates)
+	var best *BackendInstance[P]
+	bestCost := math.Inf(1)
+	for i := range candidates {
+		c := candidates[(start+i)%len(candidates)]
+		if cost := c.latencyEstimate() * float64(c.Outstanding()+1); cost < bestCost {
+			best, bestCost = c, cost
+		}
+	}
+	return best
+}
+
+// p2cStrategy 随机取两个不同的实例，选进行中请求较少的，相同时选延迟较低的
+type p2cStrategy[P Pinger] struct{}
+
+func (p2cStrategy[P]) Name() string { return StrategyP2C }
+
+func (p2cStrategy[P]) Pick(candidates []*BackendInstance[P]) *BackendInstance[P] {
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+	i := rand.IntN(len(candidates))
+	j := rand.IntN(len(candidates) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := candidates[i], candidates[j]
+	if a.Outstanding() != b.Outstanding() {
+		if a.Outstanding() < b.Outstanding() {
+			return a
+		}
+		return b
+	}
+	if b.latencyEstimate() < a.latencyEstimate() {
+		return b
+	}
+	return a
+}
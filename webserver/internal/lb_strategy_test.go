@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// newTestInstances 创建 n 个测试用实例
+func newTestInstances(n int) []*BackendInstance[TextToImageProvider] {
+	instances := make([]*BackendInstance[TextToImageProvider], n)
+	for i := range instances {
+		instances[i] = newBackendInstance[TextToImageProvider](int64(i+1), newBlockingProvider())
+	}
+	return instances
+}
+
+func TestWeightedRoundRobinInterleaves(t *testing.T) {
+	instances := newTestInstances(2)
+	instances[0].weight.Store(3)
+	s, _ := NewStrategy[TextToImageProvider](StrategyWeightedRoundRobin)
+
+	var got []string
+	for i := 0; i < 8; i++ {
+		got = append(got, s.Pick(instances).Name)
+	}
+	want := []string{"instance-1", "instance-1", "instance-2", "instance-1", "instance-1", "instance-1", "instance-2", "instance-1"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected smooth 3:1 order %v, got %v", want, got)
+		}
+	}
+
+	if _, err := NewStrategy[TextToImageProvider]("random"); err == nil {
+		t.Fatal("expected an unknown strategy name to be rejected")
+	}
+}
+
+func TestLoadAwareStrategiesAvoidBusyAndSlowInstances(t *testing.T) {
+	instances := newTestInstances(3)
+	instances[0].outstanding.Store(2)
+	instances[2].outstanding.Store(1)
+
+	least, _ := NewStrategy[TextToImageProvider](StrategyLeastOutstanding)
+	for i := 0; i < 3; i++ {
+		if got := least.Pick(instances); got != instances[1] {
+			t.Fatalf("expected least-outstanding to pick the idle instance, got %s", got.Name)
+		}
+	}
+
+	// instance-2 空闲但很慢，instance-3 有一个请求但很快
+	now := time.Now()
+	instances[1].observe(10*time.Second, false, now)
+	instances[2].observe(time.Second, false, now)
+	ewma, _ := NewStrategy[TextToImageProvider](StrategyPeakEWMA)
+	if got := ewma.Pick(instances); got != instances[2] {
+		t.Fatalf("expected peak-ewma to prefer the fast instance, got %s", got.Name)
+	}
+
+	// 失败按惩罚计入延迟，之后的快速请求随时间衰减
+	instances[2].observe(time.Second, true, now)
+	if l := instances[2].Latency(); l < 2*time.Second {
+		t.Fatalf("expected a failure to raise the latency estimate, got %v", l)
+	}
+	instances[2].observe(time.Second, false, now.Add(time.Minute))
+	if l := instances[2].Latency(); l > 1100*time.Millisecond {
+		t.Fatalf("expected the estimate to decay back, got %v", l)
+	}
+	if instances[2].requests.Load() != 3 || instances[2].failures.Load() != 1 {
+		t.Fatalf("unexpected counters: %d requests, %d failures", instances[2].requests.Load(), instances[2].failures.Load())
+	}
+
+	p2c, _ := NewStrategy[TextToImageProvider](StrategyP2C)
+	for i := 0; i < 50; i++ {
+		if got := p2c.Pick(instances); got == instances[0] {
+			t.Fatal("expected p2c never to pick the busiest instance")
+		}
+	}
+}
+
+func TestLoadBalancerAcquireSkipsUnavailableInstances(t *testing.T) {
+	lb := &ImageBalancer{strategy: &roundRobinStrategy[TextToImageProvider]{}, breaker: DefaultBreakerPolicy(), instances: newTestInstances(2)}
+	lb.SetStrategy(&leastOutstandingStrategy[TextToImageProvider]{})
+	lb.instances[0].available.Store(false)
+
+	inst, err := lb.Acquire(context.Background())
+	if err != nil || inst != lb.instances[1] {
+		t.Fatalf("expected the available instance, got %v, %v", inst, err)
+	}
+	if inst.Outstanding() != 1 {
+		t.Fatalf("expected Acquire to count the request, got %d", inst.Outstanding())
+	}
+	lb.Release(inst, time.Second, errors.New("boom"))
+	if inst.Outstanding() != 0 || inst.failures.Load() != 1 {
+		t.Fatalf("expected Release to record the failure, got %d outstanding, %d failures", inst.Outstanding(), inst.failures.Load())
+	}
+
+	stats := lb.GetStats()
+	if stats["strategy"] != StrategyLeastOutstanding || stats["available_instances"] != 1 {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+
+	if _, err := (&ImageBalancer{strategy: &roundRobinStrategy[TextToImageProvider]{}}).Acquire(context.Background()); !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("expected ErrNoBackend without instances, got %v", err)
+	}
+}
+
+func TestLoadBalancerAcquireWaitsForFreeSlot(t *testing.T) {
+	lb := &ImageBalancer{strategy: &roundRobinStrategy[TextToImageProvider]{}, breaker: DefaultBreakerPolicy(), instances: newTestInstances(2)}
+	lb.SetCapacity(1, 2)
+	a, b := lb.instances[0], lb.instances[1]
+
+	// 共 3 个槽位，不会有实例超过自己的容量
+	for i := 0; i < 3; i++ {
+		if _, err := lb.Acquire(context.Background()); err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+	}
+	if a.Outstanding() != 2 || b.Outstanding() != 1 {
+		t.Fatalf("expected slots to fill to capacity, got %d and %d", a.Outstanding(), b.Outstanding())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if _, err := lb.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Acquire to block until the context ends, got %v", err)
+	}
+
+	got := make(chan *BackendInstance[TextToImageProvider], 1)
+	go func() {
+		inst, _ := lb.Acquire(context.Background())
+		got <- inst
+	}()
+	waitFor(t, "Acquire to wait for a slot", func() bool { return lb.waiting.Load() == 1 })
+
+	stats := lb.GetStats()
+	if stats["slots"] != 3 || stats["slots_in_use"] != 3 {
+		t.Fatalf("unexpected slot stats: %v", stats)
+	}
+	if s := stats["instances"].([]InstanceStats)[0]; s.Capacity != 2 || s.Utilization != 1 {
+		t.Fatalf("unexpected instance stats: %+v", s)
+	}
+
+	lb.Release(b, time.Millisecond, nil)
+	select {
+	case inst := <-got:
+		if inst != b {
+			t.Fatalf("expected the waiter to get the released slot, got %s", inst.Name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the blocked Acquire")
+	}
+	lb.Release(a, time.Millisecond, nil)
+	lb.Release(a, time.Millisecond, nil)
+	lb.Release(b, time.Millisecond, nil)
+	if a.Outstanding() != 0 || b.Outstanding() != 0 {
+		t.Fatalf("expected all slots to be released, got %d and %d", a.Outstanding(), b.Outstanding())
+	}
+}
+
+func TestLoadBalancerAddInstanceAppliesSettings(t *testing.T) {
+	lb := NewLoadBalancer[TextToImageProvider](nil)
+	defer lb.Close()
+
+	// 停用的实例加入后立即不可分配，不会先以默认设置接收请求
+	if _, err := lb.AddInstance(1, newBlockingProvider(), InstanceSettings{Status: BackendDisabled}); err != nil {
+		t.Fatalf("AddInstance: %v", err)
+	}
+	if _, err := lb.tryAcquire(acquireOptions{}); !errors.Is(err, ErrNoHealthyBackend) {
+		t.Fatalf("expected the disabled instance not to accept requests, got %v", err)
+	}
+
+	inst, err := lb.AddInstance(2, newBlockingProvider(), InstanceSettings{Weight: 3, Capacity: 2, Models: []ModelCapability{{Name: "large"}}})
+	if err != nil {
+		t.Fatalf("AddInstance: %v", err)
+	}
+	if inst.Weight() != 3 || inst.Capacity() != 2 || inst.Status() != BackendEnabled || len(inst.Models()) != 1 || inst.Models()[0].Name != "large" {
+		t.Fatalf("expected the settings to be applied, got weight %d, capacity %d, %s, %v", inst.Weight(), inst.Capacity(), inst.Status(), inst.Models())
+	}
+	if _, err := lb.AddInstance(2, newBlockingProvider(), InstanceSettings{}); !errors.Is(err, ErrBackendExists) {
+		t.Fatalf("expected a duplicate id to be rejected, got %v", err)
+	}
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"slices"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,27 +17,57 @@ import (
 // ======================
 //
 
-// LoadBalancer 负载均衡器，使用轮询策略分配请求到不同的实例
-type LoadBalancer struct {
-	clients     []TextToImageProvider
-	nextIndex   uint32
-	healthCheck bool
+// 实例状态
+const (
+	BackendEnabled  = "enabled"  // 接收请求
+	BackendDrained  = "drained"  // 不接收新请求，进行中的请求正常完成
+	BackendDisabled = "disabled" // 不接收请求，也不做健康检查
+)
+
+var (
+	// ErrNoBackend 没有配置任何后端实例
+	ErrNoBackend = errors.New("no available backend service")
+	// ErrNoHealthyBackend 所有实例都不可用（健康检查失败、已熔断或未启用）
+	ErrNoHealthyBackend = errors.New("no healthy backend")
+	ErrBackendNotFound  = errors.New("backend not found")
+	ErrBackendExists    = errors.New("backend already exists")
+)
+
+// LoadBalancer 负载均衡器，按 Strategy（默认轮询）把请求分配到健康检查通过、未熔断且有空闲槽位的实例。
+// P 为后端接口类型，文生图和语音识别各用一个负载均衡器，实例 ID 都来自 backends 表
+type LoadBalancer[P Pinger] struct {
 	mu          sync.RWMutex
-	available   []bool // 记录每个实例是否可用
+	instances   []*BackendInstance[P] // 只整体替换，不原地修改，持有旧切片的调用方不受增删影响
+	strategy    Strategy[P]
+	breaker     BreakerPolicy
+	affinity    AffinityPolicy
+	healthCheck bool
+	stop        chan struct{}
+	closeOnce   sync.Once
+
+	freedMu sync.Mutex
+	freed   chan struct{} // 槽位释放或实例恢复时关闭并替换，唤醒等待的 Acquire
+	waiting atomic.Int64  // 正在等待槽位的 Acquire
 }
 
-// NewLoadBalancer 创建新的负载均衡器
-func NewLoadBalancer(clients []TextToImageProvider) *LoadBalancer {
-	lb := &LoadBalancer{
-		clients:     clients,
-		nextIndex:   0,
+type (
+	ImageBalancer  = LoadBalancer[TextToImageProvider]  // 文生图
+	SpeechBalancer = LoadBalancer[SpeechToTextProvider] // 语音识别
+)
+
+// NewLoadBalancer 创建新的负载均衡器，默认使用轮询策略；clients 的实例 ID 依次为 1..n，
+// 由 backends 表管理的实例通过 AddInstance 加入
+func NewLoadBalancer[P Pinger](clients []P) *LoadBalancer[P] {
+	lb := &LoadBalancer[P]{
+		strategy:    &roundRobinStrategy[P]{},
+		breaker:     DefaultBreakerPolicy(),
 		healthCheck: true,
-		available:   make([]bool, len(clients)),
+		stop:        make(chan struct{}),
 	}
 
 	// 初始化所有实例为可用
-	for i := range lb.available {
-		lb.available[i] = true
+	for i, client := range clients {
+		lb.instances = append(lb.instances, newBackendInstance(int64(i+1), client))
 	}
 
 	// 启动健康检查
@@ -45,128 +78,492 @@ func NewLoadBalancer(clients []TextToImageProvider) *LoadBalancer {
 	return lb
 }
 
-// GetNext 使用轮询算法获取下一个可用的客户端
-func (lb *LoadBalancer) GetNext() TextToImageProvider {
-	if len(lb.clients) == 0 {
-		return nil
+// SetStrategy 切换负载均衡策略
+func (lb *LoadBalancer[P]) SetStrategy(s Strategy[P]) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.strategy = s
+	log.Printf("Load balancing strategy: %s", s.Name())
+}
+
+// SetAffinity 设置会话亲和键，见 lb_affinity.go；Keys 为空时关闭
+func (lb *LoadBalancer[P]) SetAffinity(p AffinityPolicy) {
+	if p.LoadFactor < 1 {
+		p.LoadFactor = defaultAffinityLoadFactor
 	}
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.affinity = p
+}
+
+// AffinityKey 任务的亲和键，未启用亲和时为空
+func (lb *LoadBalancer[P]) AffinityKey(task *ImageTask) string {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.affinity.Key(task)
+}
 
-	// 简单的轮询算法
-	for i := 0; i < len(lb.clients); i++ {
-		index := atomic.AddUint32(&lb.nextIndex, 1) % uint32(len(lb.clients))
+// SetBreakerPolicy 设置各实例熔断器的阈值和冷却时间
+func (lb *LoadBalancer[P]) SetBreakerPolicy(p BreakerPolicy) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.breaker = p.normalized()
+}
 
-		lb.mu.RLock()
-		isAvailable := lb.available[index]
-		lb.mu.RUnlock()
+// Close 停止健康检查
+func (lb *LoadBalancer[P]) Close() {
+	lb.closeOnce.Do(func() {
+		if lb.stop != nil {
+			close(lb.stop)
+		}
+	})
+}
+
+// Instance 按 ID 查找实例
+func (lb *LoadBalancer[P]) Instance(id int64) (*BackendInstance[P], error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	for _, inst := range lb.instances {
+		if inst.ID == id {
+			return inst, nil
+		}
+	}
+	return nil, ErrBackendNotFound
+}
+
+// SetWeight 设置实例的权重（weighted-round-robin 使用），小于 1 时按 1 处理
+func (lb *LoadBalancer[P]) SetWeight(id int64, weight int) error {
+	if weight < 1 {
+		weight = 1
+	}
+	inst, err := lb.Instance(id)
+	if err != nil {
+		return err
+	}
+	inst.weight.Store(int64(weight))
+	return nil
+}
+
+// SetCapacity 设置实例的并发槽位数，小于 1 时按 1 处理；调小时进行中的请求不受影响
+func (lb *LoadBalancer[P]) SetCapacity(id int64, slots int) error {
+	if slots < 1 {
+		slots = 1
+	}
+	inst, err := lb.Instance(id)
+	if err != nil {
+		return err
+	}
+	inst.capacity.Store(int64(slots))
+	lb.notifyFreed()
+	return nil
+}
+
+// SetStatus 切换实例状态；重新启用时立即做一次健康检查
+func (lb *LoadBalancer[P]) SetStatus(id int64, status string) error {
+	inst, err := lb.Instance(id)
+	if err != nil {
+		return err
+	}
+	if previous := inst.status.Swap(status); previous != status {
+		log.Printf("Instance %s: %s -> %s", inst.Name, previous, status)
+		if status == BackendEnabled && lb.healthCheck {
+			go lb.checkInstance(inst)
+		}
+	}
+	// 等待槽位的请求重新检查：可能有实例恢复，也可能已经没有可用实例
+	lb.notifyFreed()
+	return nil
+}
+
+// SetModels 设置实例提供的模型，覆盖后端声明的模型；models 为 nil 时恢复为后端声明的模型
+func (lb *LoadBalancer[P]) SetModels(id int64, models []ModelCapability) error {
+	inst, err := lb.Instance(id)
+	if err != nil {
+		return err
+	}
+	if models == nil {
+		inst.models.Store(nil)
+	} else {
+		inst.models.Store(&models)
+	}
+	// 等待槽位的请求重新检查：可能已经没有实例提供它们需要的模型
+	lb.notifyFreed()
+	return nil
+}
+
+// freedChan 下一次有槽位释放时关闭的 channel
+func (lb *LoadBalancer[P]) freedChan() <-chan struct{} {
+	lb.freedMu.Lock()
+	defer lb.freedMu.Unlock()
+	if lb.freed == nil {
+		lb.freed = make(chan struct{})
+	}
+	return lb.freed
+}
 
-		if isAvailable {
-			return lb.clients[index]
+// notifyFreed 唤醒所有等待槽位的 Acquire
+func (lb *LoadBalancer[P]) notifyFreed() {
+	lb.freedMu.Lock()
+	defer lb.freedMu.Unlock()
+	if lb.freed != nil {
+		close(lb.freed)
+		lb.freed = nil
+	}
+}
+
+// candidates 已启用、健康检查通过且熔断器允许请求的实例，调用方持有 lb.mu
+func (lb *LoadBalancer[P]) candidates(now time.Time) []*BackendInstance[P] {
+	candidates := make([]*BackendInstance[P], 0, len(lb.instances))
+	for _, inst := range lb.instances {
+		if inst.Status() == BackendEnabled && inst.available.Load() && inst.breaker.ready(now, lb.breaker) {
+			candidates = append(candidates, inst)
 		}
 	}
+	return candidates
+}
+
+// Acquire 按策略选择有空闲槽位的实例并占用一个槽位，调用结束后必须调用 Release 上报结果。
+// 可用实例的槽位都被占满时阻塞到有槽位释放或 ctx 结束；没有配置实例时返回 ErrNoBackend，
+// 所有实例都不可用时返回 ErrNoHealthyBackend
+func (lb *LoadBalancer[P]) Acquire(ctx context.Context) (*BackendInstance[P], error) {
+	return lb.AcquireFor(ctx, "")
+}
+
+// AcquireFor 同 Acquire；key 非空时按一致性哈希优先选择该键对应的实例（见 lb_affinity.go）
+func (lb *LoadBalancer[P]) AcquireFor(ctx context.Context, key string) (*BackendInstance[P], error) {
+	return lb.acquire(ctx, acquireOptions{key: key})
+}
+
+// AcquireModel 同 AcquireFor，只选择满足模型要求的实例（见 models.go）；
+// 没有实例提供满足要求的模型时返回 ErrModelUnavailable
+func (lb *LoadBalancer[P]) AcquireModel(ctx context.Context, key string, model ModelRequirement) (*BackendInstance[P], error) {
+	return lb.acquire(ctx, acquireOptions{key: key, model: model})
+}
+
+// AcquireExcept 同 Acquire，但不选择 skip 中的实例（故障转移时换一个实例）；
+// 其余实例都不可用时返回 ErrNoHealthyBackend
+func (lb *LoadBalancer[P]) AcquireExcept(ctx context.Context, skip map[int64]bool) (*BackendInstance[P], error) {
+	return lb.acquire(ctx, acquireOptions{skip: skip})
+}
+
+// TryAcquireExcept 同 AcquireExcept 但不阻塞，其余实例都没有空闲槽位时返回 nil, nil
+func (lb *LoadBalancer[P]) TryAcquireExcept(skip map[int64]bool) (*BackendInstance[P], error) {
+	return lb.tryAcquire(acquireOptions{skip: skip})
+}
 
-	// 如果所有实例都不可用，返回第一个（降级处理）
-	log.Println("Warning: all instances are unavailable, using first one as fallback")
-	return lb.clients[0]
+// acquireOptions 选择实例的条件
+type acquireOptions struct {
+	key   string           // 亲和键
+	skip  map[int64]bool   // 不选择的实例
+	model ModelRequirement // 实例需要满足的模型要求
+}
+
+func (lb *LoadBalancer[P]) acquire(ctx context.Context, opts acquireOptions) (*BackendInstance[P], error) {
+	for {
+		// 先取 channel 再检查，避免错过检查之后的释放
+		freed := lb.freedChan()
+		inst, err := lb.tryAcquire(opts)
+		if inst != nil || err != nil {
+			return inst, err
+		}
+
+		lb.waiting.Add(1)
+		select {
+		case <-freed:
+			lb.waiting.Add(-1)
+		case <-ctx.Done():
+			lb.waiting.Add(-1)
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryAcquire 不阻塞地占用一个满足 opts 的槽位，可用实例都没有空闲槽位时返回 nil, nil
+func (lb *LoadBalancer[P]) tryAcquire(opts acquireOptions) (*BackendInstance[P], error) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if len(lb.instances) == 0 {
+		return nil, ErrNoBackend
+	}
+	if !slices.ContainsFunc(lb.instances, func(c *BackendInstance[P]) bool { return c.Satisfies(opts.model) }) {
+		return nil, ErrModelUnavailable
+	}
+
+	now := time.Now()
+	healthy := slices.DeleteFunc(lb.candidates(now), func(c *BackendInstance[P]) bool {
+		return opts.skip[c.ID] || !c.Satisfies(opts.model)
+	})
+	if len(healthy) == 0 {
+		return nil, ErrNoHealthyBackend
+	}
+	free := slices.DeleteFunc(slices.Clone(healthy), func(c *BackendInstance[P]) bool { return c.Outstanding() >= c.Capacity() })
+	if opts.key != "" {
+		// 亲和请求按固定顺序尝试，不经过策略
+		for _, inst := range affinityOrder(opts.key, free, healthy, lb.affinity.LoadFactor) {
+			if lb.reserve(inst, now) {
+				return inst, nil
+			}
+		}
+		return nil, nil
+	}
+	for len(free) > 0 {
+		inst := lb.strategy.Pick(free)
+		if lb.reserve(inst, now) {
+			return inst, nil
+		}
+		free = slices.DeleteFunc(free, func(c *BackendInstance[P]) bool { return c == inst })
+	}
+	return nil, nil
+}
+
+// reserve 占用实例的槽位和熔断器名额；槽位或半开状态的探测名额可能已被其他请求占用，
+// 此时返回 false，由调用方换一个实例
+func (lb *LoadBalancer[P]) reserve(inst *BackendInstance[P], now time.Time) bool {
+	if !inst.tryReserve() {
+		return false
+	}
+	if !inst.breaker.tryAcquire(now, lb.breaker) {
+		inst.outstanding.Add(-1)
+		return false
+	}
+	return true
+}
+
+// Release 结束 Acquire 得到的请求，记录耗时和是否出错供策略和熔断器使用；
+// 被调用方取消的请求不计入
+func (lb *LoadBalancer[P]) Release(inst *BackendInstance[P], latency time.Duration, err error) {
+	inst.outstanding.Add(-1)
+	defer lb.notifyFreed()
+
+	lb.mu.RLock()
+	policy := lb.breaker
+	lb.mu.RUnlock()
+
+	now := time.Now()
+	canceled := errors.Is(err, context.Canceled)
+	inst.breaker.record(err != nil, canceled, now, policy)
+	if !canceled {
+		inst.observe(latency, err != nil, now)
+	}
+}
+
+// GetNext 按当前策略获取下一个可用的客户端（不统计请求结果），没有可用实例时返回零值
+func (lb *LoadBalancer[P]) GetNext() (client P) {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	if candidates := lb.candidates(time.Now()); len(candidates) > 0 {
+		return lb.strategy.Pick(candidates).Client
+	}
+	return client
 }
 
 // GetByStrategy 使用指定策略获取客户端（预留接口，支持扩展）
-func (lb *LoadBalancer) GetByStrategy(strategy string, userID int64) TextToImageProvider {
+func (lb *LoadBalancer[P]) GetByStrategy(strategy string, userID int64) (client P) {
 	switch strategy {
-	case "round-robin":
-		return lb.GetNext()
 	case "user-hash":
-		// 根据用户 ID 哈希，保证同一用户总是使用同一实例（会话亲和性）
-		index := int(userID) % len(lb.clients)
+		// 按用户 ID 一致性哈希，同一用户总是使用同一实例（会话亲和性）；增删实例只影响该实例上的用户
 		lb.mu.RLock()
-		isAvailable := lb.available[index]
-		lb.mu.RUnlock()
-
-		if isAvailable {
-			return lb.clients[index]
+		defer lb.mu.RUnlock()
+		if candidates := lb.candidates(time.Now()); len(candidates) > 0 {
+			return rendezvousOrder(strconv.FormatInt(userID, 10), candidates)[0].Client
 		}
-		return lb.GetNext() // 降级到轮询
+		return client
 	default:
 		return lb.GetNext()
 	}
 }
 
-// startHealthCheck 定期检查所有实例的健康状态
-func (lb *LoadBalancer) startHealthCheck() {
+// startHealthCheck 定期检查所有实例的健康状态，Close 后退出；已移除和停用的实例不再检查
+func (lb *LoadBalancer[P]) startHealthCheck() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		for i, client := range lb.clients {
-			go lb.checkInstance(i, client)
+	for {
+		select {
+		case <-lb.stop:
+			return
+		case <-ticker.C:
+		}
+		lb.mu.RLock()
+		instances := lb.instances
+		lb.mu.RUnlock()
+		for _, inst := range instances {
+			if inst.Status() != BackendDisabled {
+				go lb.checkInstance(inst)
+			}
 		}
 	}
 }
 
 // checkInstance 检查单个实例的健康状态
-func (lb *LoadBalancer) checkInstance(index int, client TextToImageProvider) {
+func (lb *LoadBalancer[P]) checkInstance(inst *BackendInstance[P]) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := client.Ping(ctx)
-
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+	err := inst.Client.Ping(ctx)
 
 	if err != nil {
-		if lb.available[index] {
-			log.Printf("Instance %d became unavailable: %v", index, err)
-			lb.available[index] = false
+		if inst.available.Swap(false) {
+			log.Printf("Instance %s became unavailable: %v", inst.Name, err)
 		}
 	} else {
-		if !lb.available[index] {
-			log.Printf("Instance %d is now available", index)
-			lb.available[index] = true
+		if !inst.available.Swap(true) {
+			log.Printf("Instance %s is now available", inst.Name)
+			lb.notifyFreed()
 		}
 	}
 }
 
+// InstanceStats 单个实例的统计信息
+type InstanceStats struct {
+	ID            int64        `json:"id"`
+	Status        string       `json:"status"`
+	Name          string       `json:"name"`
+	Available     bool         `json:"available"`
+	Weight        int          `json:"weight"`
+	Capacity      int          `json:"capacity"`
+	Outstanding   int          `json:"outstanding"`
+	Utilization   float64      `json:"utilization"` // outstanding / capacity
+	Requests      int64        `json:"requests"`
+	Failures      int64        `json:"failures"`
+	LatencyEWMAMs float64      `json:"latency_ewma_ms"`
+	Breaker       BreakerStats `json:"breaker"`
+	Models        []string     `json:"models,omitempty"`
+}
+
+// instanceStats 单个实例的当前统计
+func instanceStats[P Pinger](inst *BackendInstance[P]) InstanceStats {
+	capacity, outstanding := inst.Capacity(), inst.Outstanding()
+	var models []string
+	for _, m := range inst.Models() {
+		models = append(models, m.Name)
+	}
+	return InstanceStats{
+		ID:            inst.ID,
+		Status:        inst.Status(),
+		Name:          inst.Name,
+		Available:     inst.available.Load(),
+		Weight:        inst.Weight(),
+		Capacity:      capacity,
+		Outstanding:   outstanding,
+		Utilization:   float64(outstanding) / float64(capacity),
+		Requests:      inst.requests.Load(),
+		Failures:      inst.failures.Load(),
+		LatencyEWMAMs: float64(inst.Latency()) / float64(time.Millisecond),
+		Breaker:       inst.breaker.Stats(),
+		Models:        models,
+	}
+}
+
+// Stats 按 ID 获取单个实例的统计
+func (lb *LoadBalancer[P]) Stats(id int64) (InstanceStats, error) {
+	inst, err := lb.Instance(id)
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	return instanceStats(inst), nil
+}
+
 // GetStats 获取负载均衡器统计信息
-func (lb *LoadBalancer) GetStats() map[string]interface{} {
+func (lb *LoadBalancer[P]) GetStats() map[string]interface{} {
 	lb.mu.RLock()
 	defer lb.mu.RUnlock()
 
-	availableCount := 0
-	for _, available := range lb.available {
-		if available {
-			availableCount++
-		}
+	slots, inUse := 0, 0
+	instances := make([]InstanceStats, 0, len(lb.instances))
+	for _, inst := range lb.instances {
+		stats := instanceStats(inst)
+		slots += stats.Capacity
+		inUse += stats.Outstanding
+		instances = append(instances, stats)
 	}
 
 	return map[string]interface{}{
-		"total_instances":     len(lb.clients),
-		"available_instances": availableCount,
-		"current_index":       atomic.LoadUint32(&lb.nextIndex),
+		"strategy":            lb.strategy.Name(),
+		"breaker_policy":      lb.breaker,
+		"affinity":            lb.affinity,
+		"total_instances":     len(lb.instances),
+		"available_instances": len(lb.candidates(time.Now())),
+		"slots":               slots,
+		"slots_in_use":        inUse,
+		"waiting":             lb.waiting.Load(),
+		"instances":           instances,
 	}
 }
 
-// AddInstance 动态添加新实例（热更新）
-func (lb *LoadBalancer) AddInstance(client TextToImageProvider) {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+// Size 返回实例总数
+func (lb *LoadBalancer[P]) Size() int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return len(lb.instances)
+}
+
+// HealthyCapacity 返回可用且未熔断的实例能同时处理的请求数之和
+func (lb *LoadBalancer[P]) HealthyCapacity() int {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	capacity := 0
+	for _, inst := range lb.candidates(time.Now()) {
+		capacity += inst.Capacity()
+	}
+	return capacity
+}
+
+// InstanceSettings 实例加入时的权重、槽位、状态和模型，零值表示使用默认值
+type InstanceSettings struct {
+	Weight   int               // 小于 1 时按 1 处理
+	Capacity int               // 小于 1 时使用后端声明的并发数
+	Status   string            // 为空时为 enabled
+	Models   []ModelCapability // 为空时使用后端声明的模型
+}
 
-	lb.clients = append(lb.clients, client)
-	lb.available = append(lb.available, true)
+// AddInstance 动态添加新实例（热更新），id 已存在时返回 ErrBackendExists。
+// 实例在加入前就按 settings 设置好，停用或排空的实例不会短暂接收请求
+func (lb *LoadBalancer[P]) AddInstance(id int64, client P, settings InstanceSettings) (*BackendInstance[P], error) {
+	inst := newBackendInstance(id, client)
+	if settings.Weight > 1 {
+		inst.weight.Store(int64(settings.Weight))
+	}
+	if settings.Capacity > 0 {
+		inst.capacity.Store(int64(settings.Capacity))
+	}
+	if settings.Status != "" {
+		inst.status.Store(settings.Status)
+	}
+	if len(settings.Models) > 0 {
+		inst.models.Store(&settings.Models)
+	}
 
-	log.Printf("Added new instance, total instances: %d", len(lb.clients))
+	lb.mu.Lock()
+	for _, existing := range lb.instances {
+		if existing.ID == id {
+			lb.mu.Unlock()
+			return nil, ErrBackendExists
+		}
+	}
+	lb.instances = append(slices.Clip(lb.instances), inst)
+	total := len(lb.instances)
+	lb.mu.Unlock()
+
+	log.Printf("Added instance %s (id %d, %s), total instances: %d", inst.Name, id, inst.Status(), total)
+	// 等待槽位的请求重新检查，新实例可能正好满足它们
+	lb.notifyFreed()
+	return inst, nil
 }
 
-// RemoveInstance 移除实例
-func (lb *LoadBalancer) RemoveInstance(index int) error {
+// RemoveInstance 移除实例，之后不再分配请求和做健康检查；已经分配出去的请求照常完成
+func (lb *LoadBalancer[P]) RemoveInstance(id int64) error {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 
-	if index < 0 || index >= len(lb.clients) {
-		return nil
+	i := slices.IndexFunc(lb.instances, func(inst *BackendInstance[P]) bool { return inst.ID == id })
+	if i < 0 {
+		return ErrBackendNotFound
 	}
+	name := lb.instances[i].Name
+	lb.instances = slices.Concat(lb.instances[:i], lb.instances[i+1:])
 
-	lb.clients = append(lb.clients[:index], lb.clients[index+1:]...)
-	lb.available = append(lb.available[:index], lb.available[index+1:]...)
-
-	log.Printf("Removed instance %d, total instances: %d", index, len(lb.clients))
+	log.Printf("Removed instance %s (id %d), total instances: %d", name, id, len(lb.instances))
 	return nil
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+//
+// ======================
+// 模型目录与按能力路由
+// ======================
+//
+// 每个实例声明自己提供的模型（后端实现 ProviderModels，或在 backends 表的 models 中配置），以及每个模型的
+// 最大分辨率、最大步数和支持的能力。指定了 model 的任务只分配给提供该模型且满足尺寸、步数和能力要求的实例；
+// 没有指定 model 的任务可以分配给任意实例。GET /api/v1/models 汇总所有未停用实例的模型。
+//
+
+// ErrModelUnavailable 没有实例提供满足要求的模型
+var ErrModelUnavailable = errors.New("no backend serves the requested model")
+
+// ModelRequirement 任务对模型的要求，Model 为空表示不限制
+type ModelRequirement struct {
+	Model    string
+	Width    int
+	Height   int
+	Steps    int
+	Features []string
+}
+
+// modelRequirement 生成请求对模型的要求
+func modelRequirement(req TextToImageRequest) ModelRequirement {
+	r := ModelRequirement{Model: req.Model, Width: req.Width, Height: req.Height, Steps: req.Steps}
+	if req.NegativePrompt != "" {
+		r.Features = append(r.Features, FeatureNegativePrompt)
+	}
+	if req.Seed != 0 {
+		r.Features = append(r.Features, FeatureSeed)
+	}
+	return r
+}
+
+// Satisfies 模型能否处理该要求；没有声明能力时不检查能力
+func (c ModelCapability) Satisfies(r ModelRequirement) bool {
+	if c.Name != r.Model {
+		return false
+	}
+	within := func(v, limit int) bool { return limit == 0 || v <= limit }
+	if !within(r.Width, c.MaxWidth) || !within(r.Height, c.MaxHeight) || !within(r.Steps, c.MaxSteps) {
+		return false
+	}
+	if len(c.Features) == 0 {
+		return true
+	}
+	for _, f := range r.Features {
+		if !slices.Contains(c.Features, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// providerModels 后端声明的模型：优先 ProviderModels，其次 ProviderInfo.ModelName
+func providerModels(client any) []ModelCapability {
+	if p, ok := client.(ProviderModels); ok {
+		return p.Models()
+	}
+	if info, ok := client.(ProviderInfo); ok && info.ModelName() != "" {
+		return []ModelCapability{{Name: info.ModelName()}}
+	}
+	return nil
+}
+
+// ModelInfo 模型目录中的一个模型：各实例限制中的最大值（有实例不限制时为 0）和能力的并集
+type ModelInfo struct {
+	ModelCapability
+	Backends  int `json:"backends"`  // 提供该模型的实例数（不含已停用的实例）
+	Available int `json:"available"` // 其中当前可以接收请求的实例数
+}
+
+// ModelList GET /api/v1/models 的响应
+type ModelList struct {
+	Models []ModelInfo `json:"models"`
+}
+
+// Models 汇总未停用实例的模型，按名称排序
+func (lb *LoadBalancer[P]) Models() []ModelInfo {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+
+	available := make(map[*BackendInstance[P]]bool)
+	for _, inst := range lb.candidates(time.Now()) {
+		available[inst] = true
+	}
+	byName := make(map[string]*ModelInfo)
+	for _, inst := range lb.instances {
+		if inst.Status() == BackendDisabled {
+			continue
+		}
+		for _, c := range inst.Models() {
+			m, ok := byName[c.Name]
+			if !ok {
+				m = &ModelInfo{ModelCapability: ModelCapability{Name: c.Name, MaxWidth: -1, MaxHeight: -1, MaxSteps: -1}}
+				byName[c.Name] = m
+			}
+			m.MaxWidth = widerLimit(m.MaxWidth, c.MaxWidth)
+			m.MaxHeight = widerLimit(m.MaxHeight, c.MaxHeight)
+			m.MaxSteps = widerLimit(m.MaxSteps, c.MaxSteps)
+			for _, f := range c.Features {
+				if !slices.Contains(m.Features, f) {
+					m.Features = append(m.Features, f)
+				}
+			}
+			m.Backends++
+			if available[inst] {
+				m.Available++
+			}
+		}
+	}
+
+	models := make([]ModelInfo, 0, len(byName))
+	for _, m := range byName {
+		sort.Strings(m.Features)
+		models = append(models, *m)
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i].Name < models[j].Name })
+	return models
+}
+
+// widerLimit 合并两个上限，-1 表示还没有值，0 表示不限制
+func widerLimit(a, b int) int {
+	if a == -1 {
+		return b
+	}
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
+
+// CheckModel 校验提交的生成请求：model 为空时不检查；没有未停用的实例提供满足要求的模型时返回说明原因的错误
+func (lb *LoadBalancer[P]) CheckModel(req TextToImageRequest) error {
+	if req.Model == "" {
+		return nil
+	}
+	r := modelRequirement(req)
+
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	known := false
+	for _, inst := range lb.instances {
+		if inst.Status() == BackendDisabled {
+			continue
+		}
+		for _, c := range inst.Models() {
+			if c.Name != req.Model {
+				continue
+			}
+			if c.Satisfies(r) {
+				return nil
+			}
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("%w: unknown model %q", ErrModelUnavailable, req.Model)
+	}
+	return fmt.Errorf("%w: %s does not support the requested size, steps or features, see GET /api/v1/models", ErrModelUnavailable, req.Model)
+}
+
+// checkModel 校验请求的模型：本进程的文生图实例或（启用远程 worker 时）最近在线的远程 worker 能处理即可；
+// 没有 worker 池时不校验
+func (h *AsyncAPIHandlers) checkModel(req TextToImageRequest) error {
+	if h.workerPool == nil {
+		return nil
+	}
+	err := h.workerPool.balancer.CheckModel(req)
+	if err == nil || !h.workerPool.remoteEnabled {
+		return err
+	}
+	workers, listErr := h.taskManager.ListRemoteWorkers(time.Now().Add(-remoteWorkerActiveFor))
+	if listErr != nil {
+		log.Printf("Failed to list remote workers for model check: %v", listErr)
+		return err
+	}
+	for _, w := range workers {
+		if w.Capabilities.serves(req) {
+			return nil
+		}
+	}
+	return err
+}
+
+// serves worker 能否领取该请求，与 leaseCandidates 的条件一致
+func (c WorkerCapabilities) serves(req TextToImageRequest) bool {
+	if len(c.Kinds) > 0 && !slices.Contains(c.Kinds, TaskKindImageGenerate) {
+		return false
+	}
+	if req.Model != "" && !slices.Contains(c.Models, req.Model) {
+		return false
+	}
+	pixels := referencePixels
+	if req.Width > 0 && req.Height > 0 {
+		pixels = req.Width * req.Height
+	}
+	return (c.MaxPixels == 0 || pixels <= c.MaxPixels) &&
+		(c.MaxSteps == 0 || orDefault(req.Steps, defaultInferenceSteps) <= c.MaxSteps)
+}
+
+// HandleListModels 处理 GET /api/v1/models
+//
+//	@Summary		List image generation models
+//	@Description	List the models served by the image generation backends with their maximum resolution, maximum steps and supported features (0 means unlimited), and how many backends serve each model. Pass a model name as "model" when submitting a task to route it to those backends.
+//	@Tags			async-tasks
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{object}	ModelList
+//	@Failure		401	{object}	map[string]string
+//	@Router			/api/v1/models [get]
+func (h *AsyncAPIHandlers) HandleListModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	list := ModelList{Models: []ModelInfo{}}
+	if h.workerPool != nil {
+		list.Models = h.workerPool.balancer.Models()
+	}
+	writeJSON(w, http.StatusOK, list)
+}
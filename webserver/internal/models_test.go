@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newModelBalancer 两个实例：1 只提供 small（最大 512x512，不支持 negative_prompt），2 提供 small 和 large
+func newModelBalancer(t *testing.T) *ImageBalancer {
+	t.Helper()
+	lb := &ImageBalancer{strategy: &roundRobinStrategy[TextToImageProvider]{}, breaker: DefaultBreakerPolicy(), instances: newTestInstances(2)}
+	if err := lb.SetModels(1, []ModelCapability{{Name: "small", MaxWidth: 512, MaxHeight: 512, Features: []string{FeatureSeed}}}); err != nil {
+		t.Fatalf("SetModels: %v", err)
+	}
+	if err := lb.SetModels(2, []ModelCapability{{Name: "small"}, {Name: "large", MaxWidth: 2048, MaxHeight: 2048, MaxSteps: 50}}); err != nil {
+		t.Fatalf("SetModels: %v", err)
+	}
+	return lb
+}
+
+func TestModelCatalogAndCheck(t *testing.T) {
+	lb := newModelBalancer(t)
+
+	models := lb.Models()
+	if len(models) != 2 || models[0].Name != "large" || models[1].Name != "small" {
+		t.Fatalf("unexpected catalog: %+v", models)
+	}
+	// 实例 2 的 small 不限制尺寸，合并后也不限制
+	if small := models[1]; small.Backends != 2 || small.Available != 2 || small.MaxWidth != 0 {
+		t.Fatalf("unexpected small entry: %+v", small)
+	}
+	if large := models[0]; large.Backends != 1 || large.MaxSteps != 50 || large.MaxWidth != 2048 {
+		t.Fatalf("unexpected large entry: %+v", large)
+	}
+
+	// 停用的实例不出现在目录中
+	lb.SetStatus(2, BackendDisabled)
+	if models := lb.Models(); len(models) != 1 || models[0].Name != "small" || models[0].MaxWidth != 512 {
+		t.Fatalf("expected only the small model of instance 1, got %+v", models)
+	}
+	if err := lb.CheckModel(TextToImageRequest{Model: "large"}); !errors.Is(err, ErrModelUnavailable) || !strings.Contains(err.Error(), "unknown model") {
+		t.Fatalf("expected unknown model, got %v", err)
+	}
+	if err := lb.CheckModel(TextToImageRequest{Model: "small", Width: 1024}); !errors.Is(err, ErrModelUnavailable) {
+		t.Fatalf("expected the size to be rejected, got %v", err)
+	}
+	if err := lb.CheckModel(TextToImageRequest{Model: "small", NegativePrompt: "blurry"}); !errors.Is(err, ErrModelUnavailable) {
+		t.Fatalf("expected negative_prompt to be rejected, got %v", err)
+	}
+	if err := lb.CheckModel(TextToImageRequest{Model: "small", Width: 512, Seed: 7}); err != nil {
+		t.Fatalf("expected small to accept the request, got %v", err)
+	}
+	if err := lb.CheckModel(TextToImageRequest{}); err != nil {
+		t.Fatalf("requests without a model must not be checked, got %v", err)
+	}
+}
+
+func TestAcquireModelRoutesToCapableInstances(t *testing.T) {
+	lb := newModelBalancer(t)
+	ctx := context.Background()
+
+	// 只有实例 2 能处理 1024x1024 的 small 和 large
+	for _, req := range []TextToImageRequest{{Model: "small", Width: 1024, Height: 1024}, {Model: "large"}} {
+		inst, err := lb.AcquireModel(ctx, "", modelRequirement(req))
+		if err != nil || inst.ID != 2 {
+			t.Fatalf("%+v: expected instance 2, got %v, %v", req, inst, err)
+		}
+		lb.Release(inst, 0, nil)
+	}
+
+	// 没有指定模型的请求仍然轮询所有实例
+	seen := map[int64]bool{}
+	for i := 0; i < 2; i++ {
+		inst, err := lb.AcquireModel(ctx, "", ModelRequirement{})
+		if err != nil {
+			t.Fatalf("AcquireModel: %v", err)
+		}
+		seen[inst.ID] = true
+		lb.Release(inst, 0, nil)
+	}
+	if len(seen) != 2 {
+		t.Fatalf("expected both instances, got %v", seen)
+	}
+
+	if _, err := lb.AcquireModel(ctx, "", ModelRequirement{Model: "huge"}); !errors.Is(err, ErrModelUnavailable) {
+		t.Fatalf("expected ErrModelUnavailable, got %v", err)
+	}
+	// 能处理的实例熔断或停用时按不健康处理，而不是模型不存在
+	lb.SetStatus(2, BackendDrained)
+	if _, err := lb.AcquireModel(ctx, "", ModelRequirement{Model: "large"}); !errors.Is(err, ErrNoHealthyBackend) {
+		t.Fatalf("expected ErrNoHealthyBackend, got %v", err)
+	}
+
+	// 清除覆盖后恢复为后端声明的模型（测试后端没有声明）
+	if err := lb.SetModels(1, nil); err != nil || len(lb.instances[0].Models()) != 0 {
+		t.Fatalf("expected the override to be cleared, got %v", err)
+	}
+}
+
+func TestModelAffectsFingerprint(t *testing.T) {
+	req := TextToImageRequest{Prompt: "a red fox", Seed: 42}
+	withModel := req
+	withModel.Model = "large"
+	if GenerationFingerprint(req) == GenerationFingerprint(withModel) {
+		t.Fatal("expected the model to change the fingerprint")
+	}
+}
+
+func TestHandleSubmitImageTaskChecksModel(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(1, 10, nil, tm)
+	wp.balancer = newModelBalancer(t)
+	h := NewAsyncAPIHandlers(wp, tm, nil)
+
+	submit := func(req SubmitImageTaskRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(req)
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/image/async", bytes.NewReader(body))
+		r.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		h.HandleSubmitImageTask(rr, r)
+		return rr
+	}
+
+	if rr := submit(SubmitImageTaskRequest{Prompt: "a red fox", Model: "huge"}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400, got %d: %s", rr.Code, rr.Body.String())
+	}
+	rr := submit(SubmitImageTaskRequest{Prompt: "a red fox", Model: "large"})
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp SubmitImageTaskResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	task, err := tm.GetTask(resp.TaskID)
+	if err != nil || task.Model != "large" || task.GenerationRequest().Model != "large" {
+		t.Fatalf("expected the model to be stored, got %+v, %v", task, err)
+	}
+
+	list := httptest.NewRecorder()
+	h.HandleListModels(list, httptest.NewRequest(http.MethodGet, "/api/v1/models", nil))
+	var models ModelList
+	json.Unmarshal(list.Body.Bytes(), &models)
+	if list.Code != http.StatusOK || len(models.Models) != 2 {
+		t.Fatalf("unexpected model list: %d %s", list.Code, list.Body.String())
+	}
+}
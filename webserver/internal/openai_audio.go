@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+)
+
+// OpenAIAudioProvider 调用 OpenAI 兼容的 /v1/audio/transcriptions 实现 SpeechToTextProvider，
+// 以 verbose_json 请求分段结果
+type OpenAIAudioProvider struct {
+	openAIClient
+}
+
+const (
+	defaultOpenAIASRModel = "whisper-1"
+	pcmSampleRate         = 16000 // TranscribePCM 的输入为 16kHz 16bit 单声道
+)
+
+// NewOpenAIAudioProvider 构造函数，允许自定义 http.Client。
+// 默认 client 不设置整体超时，长音频的识别时间由调用方通过 ctx 的截止时间控制。
+func NewOpenAIAudioProvider(rawURL string, cfg OpenAIConfig, client *http.Client) (*OpenAIAudioProvider, error) {
+	if cfg.Model == "" {
+		cfg.Model = defaultOpenAIASRModel
+	}
+	c, err := newOpenAIClient(rawURL, cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenAIAudioProvider{openAIClient: c}, nil
+}
+
+func (p *OpenAIAudioProvider) Ping(ctx context.Context) error {
+	if p == nil {
+		return errNilOpenAIProvider
+	}
+	return p.ping(ctx)
+}
+
+// TranscribeFile 上传音频文件进行识别
+func (p *OpenAIAudioProvider) TranscribeFile(ctx context.Context, audioData []byte, filename string) (SpeechToTextResponse, error) {
+	var empty SpeechToTextResponse
+	if p == nil {
+		return empty, errNilOpenAIProvider
+	}
+
+	if len(audioData) == 0 {
+		return empty, errors.New("audio data is empty")
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultASRTimeout)
+		defer cancel()
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", filename)
+	if err != nil {
+		return empty, fmt.Errorf("create form file: %w", err)
+	}
+	if _, err := part.Write(audioData); err != nil {
+		return empty, fmt.Errorf("write audio data: %w", err)
+	}
+	_ = writer.WriteField("model", p.config.Model)
+	_ = writer.WriteField("response_format", "verbose_json")
+	if err := writer.Close(); err != nil {
+		return empty, fmt.Errorf("close multipart writer: %w", err)
+	}
+
+	httpReq, err := p.newRequest(ctx, http.MethodPost, "/audio/transcriptions", body)
+	if err != nil {
+		return empty, fmt.Errorf("create request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", writer.FormDataContentType())
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return empty, fmt.Errorf("execute request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return empty, openAIError("transcribe", resp)
+	}
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return empty, fmt.Errorf("read response body: %w", err)
+	}
+
+	// verbose_json：{"language": "chinese", "duration": 1.5, "text": "...", "segments": [{"start", "end", "text", ...}]}；
+	// 不支持 verbose_json 的服务只返回 text
+	var result struct {
+		Language string  `json:"language"`
+		Duration float64 `json:"duration"`
+		Text     string  `json:"text"`
+		Segments []struct {
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+			Text  string  `json:"text"`
+		} `json:"segments"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return empty, fmt.Errorf("parse response json: %w, body: %s", err, respBody)
+	}
+
+	out := SpeechToTextResponse{Language: result.Language, Segments: []ASRSegment{}}
+	for _, s := range result.Segments {
+		out.Segments = append(out.Segments, ASRSegment{Start: s.Start, End: s.End, Text: s.Text})
+	}
+	if len(out.Segments) == 0 && result.Text != "" {
+		out.Segments = append(out.Segments, ASRSegment{End: result.Duration, Text: result.Text})
+	}
+	return out, nil
+}
+
+// TranscribePCM 把 PCM 数据（16kHz, 16bit, 单声道）封装为 WAV 后识别
+func (p *OpenAIAudioProvider) TranscribePCM(ctx context.Context, pcmData []byte) (SpeechToTextResponse, error) {
+	if p == nil {
+		return SpeechToTextResponse{}, errNilOpenAIProvider
+	}
+
+	if len(pcmData) < minPCMLength {
+		return SpeechToTextResponse{
+			Code:    1,
+			Message: "audio too short",
+		}, nil
+	}
+	return p.TranscribeFile(ctx, pcmToWAV(pcmData, pcmSampleRate), "audio.wav")
+}
+
+// InstanceName 返回实例的 base URL
+func (p *OpenAIAudioProvider) InstanceName() string {
+	return p.instanceName()
+}
+
+// ModelName 返回识别模型名称
+func (p *OpenAIAudioProvider) ModelName() string {
+	return p.config.Model
+}
+
+// pcmToWAV 为 16bit 单声道 PCM 数据加上 44 字节的 WAV 头
+func pcmToWAV(pcm []byte, sampleRate int) []byte {
+	const channels, bitsPerSample = 1, 16
+	blockAlign := channels * bitsPerSample / 8
+
+	var buf bytes.Buffer
+	buf.Grow(44 + len(pcm))
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+len(pcm)))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16)) // fmt 块大小
+	binary.Write(&buf, binary.LittleEndian, uint16(1))  // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(channels))
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate))
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate*blockAlign))
+	binary.Write(&buf, binary.LittleEndian, uint16(blockAlign))
+	binary.Write(&buf, binary.LittleEndian, uint16(bitsPerSample))
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(len(pcm)))
+	buf.Write(pcm)
+	return buf.Bytes()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//
+// ======================
+// OpenAI 兼容后端
+// ======================
+//
+// LocalAI、vLLM 等本地推理服务提供与 OpenAI 相同的 /v1/images/generations 和 /v1/audio/transcriptions 接口。
+// OpenAIImageProvider 和 OpenAIAudioProvider 分别实现 TextToImageProvider 和 SpeechToTextProvider；
+// 实例地址可以带或不带 /v1 后缀，健康检查使用 GET /v1/models。
+//
+
+// OpenAIConfig OpenAI 兼容后端的配置
+type OpenAIConfig struct {
+	APIKey string // 非空时以 Authorization: Bearer 发送
+	Model  string // 请求没有指定模型时使用的模型，为空时由服务端决定（语音识别默认 whisper-1）
+	// ResponseFormat 图片的返回方式：b64_json（默认）或 url
+	ResponseFormat string
+}
+
+const (
+	OpenAIResponseB64JSON = "b64_json"
+	OpenAIResponseURL     = "url"
+)
+
+// openAIClient 两种 OpenAI 兼容后端共用的地址、认证和健康检查
+type openAIClient struct {
+	baseURL *url.URL
+	client  *http.Client
+	config  OpenAIConfig
+}
+
+func newOpenAIClient(rawURL string, cfg OpenAIConfig, client *http.Client) (openAIClient, error) {
+	parsed, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
+	if err != nil {
+		return openAIClient{}, fmt.Errorf("parse base url: %w", err)
+	}
+	// 统一去掉 /v1，请求时再加上
+	parsed.Path = strings.TrimSuffix(strings.TrimRight(parsed.Path, "/"), "/v1")
+
+	if client == nil {
+		client = &http.Client{}
+	}
+	return openAIClient{baseURL: parsed, client: client, config: cfg}, nil
+}
+
+// newRequest 创建 /v1 下的请求并设置认证头
+func (o openAIClient) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	u := *o.baseURL
+	u.Path = strings.TrimRight(u.Path, "/") + "/v1" + path
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if o.config.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.config.APIKey)
+	}
+	return req, nil
+}
+
+// ping 通过 GET /v1/models 检查服务是否可用以及 API key 是否有效
+func (o openAIClient) ping(ctx context.Context) error {
+	req, err := o.newRequest(ctx, http.MethodGet, "/models", nil)
+	if err != nil {
+		return fmt.Errorf("create ping request: %w", err)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("execute ping request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("ping failed: status %d, body: %s", resp.StatusCode, detail)
+	}
+	return nil
+}
+
+// instanceName 实例的 base URL，用于记录生成来源
+func (o openAIClient) instanceName() string {
+	return o.baseURL.String()
+}
+
+// openAIError 读取 OpenAI 格式的错误响应 {"error": {"message": ...}}
+func openAIError(op string, resp *http.Response) error {
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 2048))
+	if len(detail) == 0 {
+		return fmt.Errorf("%s failed: status %d", op, resp.StatusCode)
+	}
+	return fmt.Errorf("%s failed: status %d, body: %s", op, resp.StatusCode, detail)
+}
+
+var errNilOpenAIProvider = errors.New("nil OpenAI provider receiver")
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// stubOpenAI 模拟 OpenAI 兼容服务，要求 Bearer sk-test，记录最近一次请求
+type stubOpenAI struct {
+	image []byte
+
+	mu       sync.Mutex
+	lastJSON map[string]any
+	lastForm map[string]string
+	lastFile []byte
+	verbose  bool // 是否按 verbose_json 返回分段
+}
+
+func (s *stubOpenAI) server(t *testing.T) *httptest.Server {
+	var srv *httptest.Server
+	mux := http.NewServeMux()
+	authorized := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer sk-test" {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte(`{"error": {"message": "invalid api key"}}`))
+				return
+			}
+			next(w, r)
+		}
+	}
+	mux.HandleFunc("GET /v1/models", authorized(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"object": "list", "data": [{"id": "stablediffusion"}, {"id": "whisper-1"}]}`))
+	}))
+	mux.HandleFunc("POST /v1/images/generations", authorized(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		s.mu.Lock()
+		s.lastJSON = body
+		s.mu.Unlock()
+		item := map[string]string{"b64_json": base64.StdEncoding.EncodeToString(s.image)}
+		if body["response_format"] == OpenAIResponseURL {
+			item = map[string]string{"url": srv.URL + "/generated/1.png"}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"created": 1, "data": []any{item}})
+	}))
+	mux.HandleFunc("GET /generated/1.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(s.image)
+	})
+	mux.HandleFunc("POST /v1/audio/transcriptions", authorized(func(w http.ResponseWriter, r *http.Request) {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, `{"error": {"message": "file is required"}}`, http.StatusBadRequest)
+			return
+		}
+		data, _ := io.ReadAll(file)
+		s.mu.Lock()
+		s.lastFile = data
+		s.lastForm = map[string]string{"model": r.FormValue("model"), "response_format": r.FormValue("response_format")}
+		verbose := s.verbose
+		s.mu.Unlock()
+		if !verbose {
+			w.Write([]byte(`{"text": "打开客厅的灯"}`))
+			return
+		}
+		w.Write([]byte(`{"task": "transcribe", "language": "chinese", "duration": 2.5, "text": "打开客厅的灯。关掉空调。",
+			"segments": [{"id": 0, "seek": 0, "start": 0.0, "end": 1.2, "text": "打开客厅的灯。", "avg_logprob": -0.2},
+			             {"id": 1, "seek": 0, "start": 1.2, "end": 2.5, "text": "关掉空调。", "avg_logprob": -0.3}]}`))
+	}))
+	srv = httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestOpenAIImageProvider(t *testing.T) {
+	stub := &stubOpenAI{image: testPNG(t, 64, 32)}
+	srv := stub.server(t)
+	ctx := context.Background()
+
+	// 地址带不带 /v1 都可以
+	p, err := NewOpenAIImageProvider(srv.URL+"/v1/", OpenAIConfig{APIKey: "sk-test", Model: "stablediffusion"}, nil)
+	if err != nil {
+		t.Fatalf("NewOpenAIImageProvider: %v", err)
+	}
+	if err := p.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+	resp, err := p.Generate(ctx, TextToImageRequest{Prompt: "a red fox", Width: 64, Height: 32, Seed: 42})
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if !bytes.Equal(resp.ImageData, stub.image) || resp.MimeType != "image/png" {
+		t.Fatalf("unexpected image: %d bytes, %s", len(resp.ImageData), resp.MimeType)
+	}
+	got := stub.lastJSON
+	if got["model"] != "stablediffusion" || got["prompt"] != "a red fox" || got["size"] != "64x32" ||
+		got["n"] != 1.0 || got["response_format"] != OpenAIResponseB64JSON || got["seed"] != nil {
+		t.Fatalf("unexpected generations payload: %v", got)
+	}
+	if p.ModelName() != "stablediffusion" || p.Models()[0].Name != "stablediffusion" {
+		t.Fatalf("expected the configured model to be declared, got %v", p.Models())
+	}
+
+	// url 模式下载返回的图片；请求指定的模型优先于默认模型
+	p, _ = NewOpenAIImageProvider(srv.URL, OpenAIConfig{APIKey: "sk-test", ResponseFormat: OpenAIResponseURL}, nil)
+	resp, err = p.Generate(ctx, TextToImageRequest{Prompt: "a red fox", Width: 256, Model: "dall-e-3"})
+	if err != nil || !bytes.Equal(resp.ImageData, stub.image) || resp.MimeType != "image/png" {
+		t.Fatalf("expected the image to be downloaded, got %d bytes, %v", len(resp.ImageData), err)
+	}
+	if got := stub.lastJSON; got["model"] != "dall-e-3" || got["size"] != "256x256" || got["response_format"] != OpenAIResponseURL {
+		t.Fatalf("unexpected generations payload: %v", got)
+	}
+
+	// API key 错误时返回服务端的错误信息
+	p, _ = NewOpenAIImageProvider(srv.URL, OpenAIConfig{APIKey: "sk-wrong"}, nil)
+	if err := p.Ping(ctx); err == nil {
+		t.Fatal("expected ping to fail with a wrong api key")
+	}
+	if _, err := p.Generate(ctx, TextToImageRequest{Prompt: "a red fox"}); err == nil || !strings.Contains(err.Error(), "invalid api key") {
+		t.Fatalf("expected the api error, got %v", err)
+	}
+	if _, err := NewOpenAIImageProvider(srv.URL, OpenAIConfig{ResponseFormat: "png"}, nil); err == nil {
+		t.Fatal("expected an unsupported response format to be rejected")
+	}
+}
+
+func TestOpenAIAudioProvider(t *testing.T) {
+	stub := &stubOpenAI{verbose: true}
+	srv := stub.server(t)
+	ctx := context.Background()
+
+	p, err := NewOpenAIAudioProvider(srv.URL, OpenAIConfig{APIKey: "sk-test"}, nil)
+	if err != nil {
+		t.Fatalf("NewOpenAIAudioProvider: %v", err)
+	}
+	if err := p.Ping(ctx); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	resp, err := p.TranscribeFile(ctx, []byte("RIFF audio"), "command.wav")
+	if err != nil {
+		t.Fatalf("TranscribeFile: %v", err)
+	}
+	want := []ASRSegment{{Start: 0, End: 1.2, Text: "打开客厅的灯。"}, {Start: 1.2, End: 2.5, Text: "关掉空调。"}}
+	if resp.Code != 0 || resp.Language != "chinese" || len(resp.Segments) != 2 || resp.Segments[0] != want[0] || resp.Segments[1] != want[1] {
+		t.Fatalf("unexpected transcription: %+v", resp)
+	}
+	if stub.lastForm["model"] != defaultOpenAIASRModel || stub.lastForm["response_format"] != "verbose_json" || string(stub.lastFile) != "RIFF audio" {
+		t.Fatalf("unexpected transcription request: %v %q", stub.lastForm, stub.lastFile)
+	}
+
+	// PCM 封装为 WAV 上传；只返回 text 的服务按一个分段处理
+	stub.mu.Lock()
+	stub.verbose = false
+	stub.mu.Unlock()
+	pcm := make([]byte, minPCMLength)
+	resp, err = p.TranscribePCM(ctx, pcm)
+	if err != nil || len(resp.Segments) != 1 || resp.Segments[0].Text != "打开客厅的灯" {
+		t.Fatalf("unexpected pcm transcription: %+v, %v", resp, err)
+	}
+	if wav := stub.lastFile; len(wav) != 44+len(pcm) || string(wav[:4]) != "RIFF" || string(wav[8:16]) != "WAVEfmt " {
+		t.Fatalf("expected a wav file, got %d bytes", len(wav))
+	}
+	if resp, _ := p.TranscribePCM(ctx, pcm[:100]); resp.Code != 1 {
+		t.Fatalf("expected short audio to be rejected, got %+v", resp)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// OpenAIImageProvider 调用 OpenAI 兼容的 /v1/images/generations 实现 TextToImageProvider。
+// 接口没有 negative_prompt、seed 和步数参数，这些字段不会发送；模型不声明能力，需要限制时在 backends 表中配置
+type OpenAIImageProvider struct {
+	openAIClient
+}
+
+const openAIImageModelName = "openai-images" // 没有配置模型时的模型名
+
+// NewOpenAIImageProvider 构造函数，允许自定义 http.Client。
+// 默认 client 不设置整体超时，生成耗时由调用方通过 ctx 的截止时间控制。
+func NewOpenAIImageProvider(rawURL string, cfg OpenAIConfig, client *http.Client) (*OpenAIImageProvider, error) {
+	switch cfg.ResponseFormat {
+	case "":
+		cfg.ResponseFormat = OpenAIResponseB64JSON
+	case OpenAIResponseB64JSON, OpenAIResponseURL:
+	default:
+		return nil, fmt.Errorf("unsupported response format %q", cfg.ResponseFormat)
+	}
+	c, err := newOpenAIClient(rawURL, cfg, client)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenAIImageProvider{openAIClient: c}, nil
+}
+
+func (p *OpenAIImageProvider) Ping(ctx context.Context) error {
+	if p == nil {
+		return errNilOpenAIProvider
+	}
+	return p.ping(ctx)
+}
+
+func (p *OpenAIImageProvider) Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error) {
+	var empty TextToImageResponse
+	if p == nil {
+		return empty, errNilOpenAIProvider
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultGenerateTimeout)
+		defer cancel()
+	}
+
+	payload := struct {
+		Model          string `json:"model,omitempty"`
+		Prompt         string `json:"prompt"`
+		N              int    `json:"n"`
+		Size           string `json:"size,omitempty"`
+		ResponseFormat string `json:"response_format"`
+	}{
+		Model:          p.config.Model,
+		Prompt:         req.Prompt,
+		N:              1,
+		ResponseFormat: p.config.ResponseFormat,
+	}
+	if req.Model != "" && req.Model != openAIImageModelName {
+		payload.Model = req.Model
+	}
+	// 只指定一边时按正方形处理，都不指定时使用服务端默认尺寸
+	if req.Width > 0 || req.Height > 0 {
+		w, h := orDefault(req.Width, req.Height), orDefault(req.Height, req.Width)
+		payload.Size = strconv.Itoa(w) + "x" + strconv.Itoa(h)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return empty, fmt.Errorf("marshal generations payload: %w", err)
+	}
+
+	httpReq, err := p.newRequest(ctx, http.MethodPost, "/images/generations", bytes.NewReader(body))
+	if err != nil {
+		return empty, fmt.Errorf("create generations request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return empty, fmt.Errorf("execute generations request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return empty, openAIError("generations", resp)
+	}
+
+	var result struct {
+		Data []struct {
+			B64JSON string `json:"b64_json"`
+			URL     string `json:"url"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return empty, fmt.Errorf("decode generations response: %w", err)
+	}
+	if len(result.Data) == 0 {
+		return empty, errors.New("generations returned no images")
+	}
+
+	// 按实际返回的字段解码，部分服务忽略 response_format
+	switch image := result.Data[0]; {
+	case image.B64JSON != "":
+		return decodeBase64Image(image.B64JSON)
+	case image.URL != "":
+		return p.download(ctx, image.URL)
+	default:
+		return empty, errors.New("generations returned neither b64_json nor url")
+	}
+}
+
+// download 下载 url 模式返回的图片；图片地址一般是服务端的静态文件或签名链接，不发送 API key
+func (p *OpenAIImageProvider) download(ctx context.Context, imageURL string) (TextToImageResponse, error) {
+	var empty TextToImageResponse
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return empty, fmt.Errorf("create image request: %w", err)
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return empty, fmt.Errorf("execute image request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return empty, fmt.Errorf("download image failed: status %d, body: %s", resp.StatusCode, detail)
+	}
+
+	imageData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return empty, fmt.Errorf("read image payload: %w", err)
+	}
+
+	mimeType := resp.Header.Get("Content-Type")
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = http.DetectContentType(imageData)
+	}
+	return TextToImageResponse{ImageData: imageData, MimeType: mimeType}, nil
+}
+
+// InstanceName 返回实例的 base URL，用于记录生成来源
+func (p *OpenAIImageProvider) InstanceName() string {
+	return p.instanceName()
+}
+
+// ModelName 返回配置的模型，没有配置时返回 openai-images
+func (p *OpenAIImageProvider) ModelName() string {
+	if p.config.Model != "" {
+		return p.config.Model
+	}
+	return openAIImageModelName
+}
+
+// Models 只声明默认模型；服务端上的其他模型需要在 backends 表的 models 中按名称配置
+func (p *OpenAIImageProvider) Models() []ModelCapability {
+	return []ModelCapability{{Name: p.ModelName()}}
+}
@@ -0,0 +1,970 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+//
+// ======================
+// 任务流水线
+// ======================
+//
+// 流水线是由若干步骤组成的 DAG，例如 transcribe（speech.transcribe）→ prompt（prompt.template）→
+// image（image.generate）。步骤在依赖全部 DONE 后才创建为普通任务，与单独提交的任务共用队列、
+// 重试和回收；步骤 input 的字符串中的 {{step.path}} 在创建任务时用依赖步骤的 output 替换。
+// 某个步骤失败或被取消时，依赖它的步骤标记为 SKIPPED，其余分支继续执行，全部结束后流水线给出
+// 一个汇总状态。PipelineRunner 在任务结束事件到达时推进流水线，状态都在数据库中，重启后继续。
+//
+
+const (
+	PipelineStepPending = "PENDING" // 等待依赖完成
+	PipelineStepSkipped = "SKIPPED" // 依赖失败或被取消，不再执行
+
+	maxPipelineSteps        = 20
+	defaultPipelineInterval = 30 * time.Second // 没有事件时兜底扫描的间隔
+	pipelineBatchSize       = 100              // 每轮最多推进的流水线数
+)
+
+var (
+	// ErrPipelineNotFound 流水线不存在
+	ErrPipelineNotFound = errors.New("pipeline not found")
+
+	pipelineStepIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	// placeholderPattern 匹配 {{step}} 或 {{step.field.0.sub}}
+	placeholderPattern = regexp.MustCompile(`\{\{\s*([A-Za-z0-9_-]+)((?:\.[A-Za-z0-9_-]+)*)\s*\}\}`)
+)
+
+// PipelineStepSpec 提交时的步骤定义
+type PipelineStepSpec struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	DependsOn []string        `json:"depends_on,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"` // JSON 对象，字符串中可以引用依赖步骤的输出
+}
+
+// PipelineDefinition 提交的流水线定义
+type PipelineDefinition struct {
+	Steps []PipelineStepSpec `json:"steps"`
+}
+
+// PipelineStep 步骤的当前状态
+type PipelineStep struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	DependsOn []string        `json:"depends_on"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	Status    string          `json:"status"` // PENDING、SKIPPED 或对应任务的状态
+	TaskID    string          `json:"task_id,omitempty"`
+	Output    json.RawMessage `json:"output,omitempty"`
+	ErrorMsg  string          `json:"error,omitempty"`
+}
+
+// Pipeline 流水线及其全部步骤（按拓扑顺序）
+type Pipeline struct {
+	ID        string          `json:"pipeline_id"`
+	UserID    int64           `json:"user_id"`
+	Status    string          `json:"status"` // RUNNING、DONE 或 FAILED
+	ErrorMsg  string          `json:"error,omitempty"`
+	Steps     []*PipelineStep `json:"steps"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// stepFinished 步骤是否已结束
+func stepFinished(status string) bool {
+	return status == PipelineStepSkipped || isTerminalStatus(status)
+}
+
+// validatePipeline 校验定义并返回按拓扑顺序排列的步骤。handles 判断任务类型是否可执行，
+// hasAudio 表示请求是否上传了音频（speech.transcribe 步骤需要）
+func validatePipeline(def PipelineDefinition, handles func(kind string) bool, hasAudio bool) ([]PipelineStepSpec, error) {
+	if len(def.Steps) == 0 {
+		return nil, errors.New("pipeline needs at least one step")
+	}
+	if len(def.Steps) > maxPipelineSteps {
+		return nil, fmt.Errorf("pipeline has more than %d steps", maxPipelineSteps)
+	}
+
+	index := make(map[string]int, len(def.Steps))
+	for i, step := range def.Steps {
+		if !pipelineStepIDPattern.MatchString(step.ID) {
+			return nil, fmt.Errorf("step id %q must be 1-64 letters, digits, '_' or '-'", step.ID)
+		}
+		if _, dup := index[step.ID]; dup {
+			return nil, fmt.Errorf("duplicate step id %q", step.ID)
+		}
+		index[step.ID] = i
+	}
+
+	for i := range def.Steps {
+		step := &def.Steps[i]
+		if !handles(step.Kind) {
+			return nil, fmt.Errorf("step %s: unsupported kind %q", step.ID, step.Kind)
+		}
+
+		deps := make(map[string]bool, len(step.DependsOn))
+		for _, dep := range step.DependsOn {
+			if _, ok := index[dep]; !ok {
+				return nil, fmt.Errorf("step %s depends on unknown step %q", step.ID, dep)
+			}
+			if dep == step.ID || deps[dep] {
+				return nil, fmt.Errorf("step %s has an invalid dependency on %q", step.ID, dep)
+			}
+			deps[dep] = true
+		}
+
+		if step.Kind == TaskKindSpeechTranscribe {
+			if len(step.DependsOn) > 0 {
+				return nil, fmt.Errorf("step %s: speech.transcribe steps read the uploaded audio and cannot have dependencies", step.ID)
+			}
+			if !hasAudio {
+				return nil, fmt.Errorf("step %s: speech.transcribe needs an uploaded audio file", step.ID)
+			}
+		}
+
+		if len(bytes.TrimSpace(step.Input)) == 0 {
+			step.Input = json.RawMessage(`{}`)
+		}
+		var input interface{}
+		if err := json.Unmarshal(step.Input, &input); err != nil {
+			return nil, fmt.Errorf("step %s: input must be a JSON object", step.ID)
+		}
+		if _, ok := input.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("step %s: input must be a JSON object", step.ID)
+		}
+		// 只能引用声明过的依赖，保证被引用的输出在创建任务时已经存在
+		_, err := walkStrings(input, func(s string) (interface{}, error) {
+			for _, m := range placeholderPattern.FindAllStringSubmatch(s, -1) {
+				if !deps[m[1]] {
+					return nil, fmt.Errorf("step %s references %q which is not in depends_on", step.ID, m[1])
+				}
+			}
+			return s, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Kahn 拓扑排序，同层保持定义中的顺序
+	indegree := make([]int, len(def.Steps))
+	dependents := make([][]int, len(def.Steps))
+	for i, step := range def.Steps {
+		indegree[i] = len(step.DependsOn)
+		for _, dep := range step.DependsOn {
+			dependents[index[dep]] = append(dependents[index[dep]], i)
+		}
+	}
+	ordered := make([]PipelineStepSpec, 0, len(def.Steps))
+	done := make([]bool, len(def.Steps))
+	for len(ordered) < len(def.Steps) {
+		progressed := false
+		for i := range def.Steps {
+			if done[i] || indegree[i] > 0 {
+				continue
+			}
+			done[i] = true
+			progressed = true
+			ordered = append(ordered, def.Steps[i])
+			for _, j := range dependents[i] {
+				indegree[j]--
+			}
+		}
+		if !progressed {
+			return nil, errors.New("pipeline steps contain a dependency cycle")
+		}
+	}
+	return ordered, nil
+}
+
+// walkStrings 递归遍历 JSON 值，用 fn 的返回值替换其中的每个字符串
+func walkStrings(v interface{}, fn func(string) (interface{}, error)) (interface{}, error) {
+	switch val := v.(type) {
+	case string:
+		return fn(val)
+	case map[string]interface{}:
+		for k, item := range val {
+			replaced, err := walkStrings(item, fn)
+			if err != nil {
+				return nil, err
+			}
+			val[k] = replaced
+		}
+	case []interface{}:
+		for i, item := range val {
+			replaced, err := walkStrings(item, fn)
+			if err != nil {
+				return nil, err
+			}
+			val[i] = replaced
+		}
+	}
+	return v, nil
+}
+
+// decodeJSON 解码 JSON，数字保留为 json.Number 以免大整数（如 seed）丢失精度
+func decodeJSON(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// lookupOutput 按 .field / .0 路径读取步骤输出中的值
+func lookupOutput(outputs map[string]json.RawMessage, stepID, path string) (interface{}, error) {
+	raw, ok := outputs[stepID]
+	if !ok || len(raw) == 0 {
+		return nil, fmt.Errorf("step %s has no output", stepID)
+	}
+	cur, err := decodeJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("step %s has invalid output: %w", stepID, err)
+	}
+
+	for _, key := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		if key == "" {
+			continue
+		}
+		switch node := cur.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return nil, fmt.Errorf("%s%s not found in step output", stepID, path)
+			}
+			cur = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, fmt.Errorf("%s%s not found in step output", stepID, path)
+			}
+			cur = node[i]
+		default:
+			return nil, fmt.Errorf("%s%s not found in step output", stepID, path)
+		}
+	}
+	return cur, nil
+}
+
+// resolveStepInput 用依赖步骤的输出替换 input 中的占位符。整个字符串只有一个占位符时保留被引用值的
+// JSON 类型（数字、对象等），否则把值转为文本拼接进字符串
+func resolveStepInput(input json.RawMessage, outputs map[string]json.RawMessage) (json.RawMessage, error) {
+	v, err := decodeJSON(input)
+	if err != nil {
+		return nil, fmt.Errorf("invalid step input: %w", err)
+	}
+
+	resolved, err := walkStrings(v, func(s string) (interface{}, error) {
+		matches := placeholderPattern.FindAllStringSubmatchIndex(s, -1)
+		if len(matches) == 0 {
+			return s, nil
+		}
+		if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) {
+			m := matches[0]
+			return lookupOutput(outputs, s[m[2]:m[3]], s[m[4]:m[5]])
+		}
+
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			value, err := lookupOutput(outputs, s[m[2]:m[3]], s[m[4]:m[5]])
+			if err != nil {
+				return nil, err
+			}
+			b.WriteString(s[last:m[0]])
+			if text, ok := value.(string); ok {
+				b.WriteString(text)
+			} else {
+				encoded, _ := json.Marshal(value)
+				b.Write(encoded)
+			}
+			last = m[1]
+		}
+		b.WriteString(s[last:])
+		return b.String(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(resolved)
+}
+
+//
+// ======================
+// 流水线持久化
+// ======================
+//
+
+// CreatePipeline 保存流水线，steps 须已按拓扑顺序排列；audio 供 speech.transcribe 步骤读取
+func (tm *TaskManager) CreatePipeline(userID int64, steps []PipelineStepSpec, audio []byte) (*Pipeline, error) {
+	now := time.Now()
+	p := &Pipeline{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Status:    TaskRunning,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO pipelines (id, user_id, status, audio, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, p.ID, p.UserID, p.Status, audio, p.CreatedAt, p.UpdatedAt); err != nil {
+		return nil, fmt.Errorf("failed to create pipeline: %w", err)
+	}
+
+	for i, spec := range steps {
+		step := &PipelineStep{
+			ID:        spec.ID,
+			Kind:      spec.Kind,
+			DependsOn: spec.DependsOn,
+			Input:     spec.Input,
+			Status:    PipelineStepPending,
+		}
+		if step.DependsOn == nil {
+			step.DependsOn = []string{}
+		}
+		deps, _ := json.Marshal(step.DependsOn)
+		if _, err := tx.Exec(`
+			INSERT INTO pipeline_steps (pipeline_id, step_id, position, kind, depends_on, input, status)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, p.ID, step.ID, i, step.Kind, string(deps), string(step.Input), step.Status); err != nil {
+			return nil, fmt.Errorf("failed to create pipeline step: %w", err)
+		}
+		p.Steps = append(p.Steps, step)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create pipeline: %w", err)
+	}
+
+	log.Printf("Created pipeline %s with %d steps for user %d", p.ID, len(p.Steps), userID)
+	return p, nil
+}
+
+// GetPipeline 读取流水线及其步骤
+func (tm *TaskManager) GetPipeline(id string) (*Pipeline, error) {
+	p := &Pipeline{}
+	err := tm.db.QueryRow(`
+		SELECT id, user_id, status, error_msg, created_at, updated_at
+		FROM pipelines WHERE id = ?
+	`, id).Scan(&p.ID, &p.UserID, &p.Status, &p.ErrorMsg, &p.CreatedAt, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrPipelineNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pipeline: %w", err)
+	}
+
+	if p.Steps, err = tm.loadPipelineSteps(p.ID); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// ListPipelines 返回用户最近的流水线，新的在前
+func (tm *TaskManager) ListPipelines(userID int64, limit int) ([]*Pipeline, error) {
+	rows, err := tm.db.Query(`
+		SELECT id FROM pipelines WHERE user_id = ? ORDER BY created_at DESC LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pipelines: %w", err)
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pipelines: %w", err)
+	}
+
+	pipelines := []*Pipeline{}
+	for _, id := range ids {
+		p, err := tm.GetPipeline(id)
+		if err != nil {
+			return nil, err
+		}
+		pipelines = append(pipelines, p)
+	}
+	return pipelines, nil
+}
+
+// activePipelineIDs 返回仍在执行的流水线
+func (tm *TaskManager) activePipelineIDs(limit int) ([]string, error) {
+	rows, err := tm.db.Query(`
+		SELECT id FROM pipelines WHERE status = ? ORDER BY updated_at LIMIT ?
+	`, TaskRunning, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load active pipelines: %w", err)
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load active pipelines: %w", err)
+	}
+	return ids, nil
+}
+
+// scanIDs 读取单列字符串结果并关闭 rows
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (tm *TaskManager) loadPipelineSteps(pipelineID string) ([]*PipelineStep, error) {
+	rows, err := tm.db.Query(`
+		SELECT step_id, kind, depends_on, input, task_id, status, output, error_msg
+		FROM pipeline_steps WHERE pipeline_id = ? ORDER BY position
+	`, pipelineID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pipeline steps: %w", err)
+	}
+	defer rows.Close()
+
+	var steps []*PipelineStep
+	for rows.Next() {
+		step := &PipelineStep{}
+		var deps, input, output string
+		if err := rows.Scan(&step.ID, &step.Kind, &deps, &input, &step.TaskID, &step.Status, &output, &step.ErrorMsg); err != nil {
+			return nil, fmt.Errorf("failed to scan pipeline step: %w", err)
+		}
+		if err := json.Unmarshal([]byte(deps), &step.DependsOn); err != nil {
+			return nil, fmt.Errorf("step %s has invalid dependencies: %w", step.ID, err)
+		}
+		if input != "" {
+			step.Input = json.RawMessage(input)
+		}
+		if output != "" {
+			step.Output = json.RawMessage(output)
+		}
+		steps = append(steps, step)
+	}
+	return steps, rows.Err()
+}
+
+// savePipelineStep 保存步骤的任务、状态和输出
+func (tm *TaskManager) savePipelineStep(pipelineID string, step *PipelineStep) error {
+	if _, err := tm.db.Exec(`
+		UPDATE pipeline_steps SET task_id = ?, status = ?, output = ?, error_msg = ?
+		WHERE pipeline_id = ? AND step_id = ?
+	`, step.TaskID, step.Status, string(step.Output), step.ErrorMsg, pipelineID, step.ID); err != nil {
+		return fmt.Errorf("failed to save pipeline step: %w", err)
+	}
+	return nil
+}
+
+// finishPipeline 记录流水线的最终状态，上传的音频不再需要，一并清除
+func (tm *TaskManager) finishPipeline(p *Pipeline) error {
+	p.UpdatedAt = time.Now()
+	if _, err := tm.db.Exec(`
+		UPDATE pipelines SET status = ?, error_msg = ?, audio = NULL, updated_at = ? WHERE id = ?
+	`, p.Status, p.ErrorMsg, p.UpdatedAt, p.ID); err != nil {
+		return fmt.Errorf("failed to finish pipeline: %w", err)
+	}
+	return nil
+}
+
+// loadPipelineAudio 读取流水线上传的音频
+func (tm *TaskManager) loadPipelineAudio(pipelineID string) ([]byte, error) {
+	var audio []byte
+	if err := tm.db.QueryRow("SELECT audio FROM pipelines WHERE id = ?", pipelineID).Scan(&audio); err != nil {
+		return nil, fmt.Errorf("failed to load pipeline audio: %w", err)
+	}
+	if len(audio) == 0 {
+		return nil, errors.New("pipeline has no uploaded audio")
+	}
+	return audio, nil
+}
+
+//
+// ======================
+// PipelineRunner - 推进流水线
+// ======================
+//
+
+// PipelineRunner 在任务结束后启动流水线中依赖已满足的步骤，并汇总流水线状态
+type PipelineRunner struct {
+	taskManager *TaskManager
+	submitter   TaskSubmitter
+	interval    time.Duration
+	retryDelay  time.Duration
+	mu          sync.Mutex // 串行推进，避免同一步骤被重复启动
+	kick        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// NewPipelineRunner 创建流水线执行器，interval <= 0 时使用默认扫描间隔
+func NewPipelineRunner(tm *TaskManager, submitter TaskSubmitter, interval time.Duration) *PipelineRunner {
+	if interval <= 0 {
+		interval = defaultPipelineInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PipelineRunner{
+		taskManager: tm,
+		submitter:   submitter,
+		interval:    interval,
+		retryDelay:  schedulerRetryDelay,
+		kick:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start 启动推进循环；任务结束事件会立即唤醒循环，启动时先处理重启前未完成的流水线
+func (r *PipelineRunner) Start(bus *TaskEventBus) {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		for {
+			r.RunOnce()
+
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+			case <-r.kick:
+			}
+		}
+	}()
+
+	if bus != nil {
+		sub := bus.Subscribe(EventFilter{}, 0)
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			defer sub.Cancel()
+			for {
+				select {
+				case <-r.ctx.Done():
+					return
+				case e := <-sub.Events:
+					if e.IsTerminal() {
+						r.Notify()
+					}
+				}
+			}
+		}()
+	}
+
+	log.Printf("Pipeline runner started (interval: %s)", r.interval)
+}
+
+// Stop 停止推进，未完成的流水线保留在数据库中
+func (r *PipelineRunner) Stop() {
+	r.cancel()
+	r.wg.Wait()
+	log.Println("Pipeline runner stopped")
+}
+
+// Notify 唤醒推进循环（非阻塞）
+func (r *PipelineRunner) Notify() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// RunOnce 推进所有执行中的流水线，返回处理的数量
+func (r *PipelineRunner) RunOnce() int {
+	ids, err := r.taskManager.activePipelineIDs(pipelineBatchSize)
+	if err != nil {
+		log.Printf("Pipeline runner: %v", err)
+		return 0
+	}
+
+	for _, id := range ids {
+		if r.ctx.Err() != nil {
+			break
+		}
+		if _, err := r.Advance(id); err != nil {
+			log.Printf("Pipeline runner: pipeline %s: %v", id, err)
+		}
+	}
+	return len(ids)
+}
+
+// Advance 同步步骤状态、启动依赖已满足的步骤并返回最新的流水线
+func (r *PipelineRunner) Advance(id string) (*Pipeline, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	p, err := r.taskManager.GetPipeline(id)
+	if err != nil {
+		return nil, err
+	}
+	if p.Status != TaskRunning {
+		return p, nil
+	}
+
+	byID := make(map[string]*PipelineStep, len(p.Steps))
+	outputs := make(map[string]json.RawMessage)
+	for _, step := range p.Steps {
+		byID[step.ID] = step
+
+		if step.TaskID != "" && !stepFinished(step.Status) {
+			r.syncStep(p, step)
+		}
+
+		if step.Status == PipelineStepPending {
+			// 步骤按拓扑顺序保存，依赖在本轮已经同步过
+			ready := true
+			for _, dep := range step.DependsOn {
+				switch status := byID[dep].Status; status {
+				case TaskDone:
+				case TaskFailed, TaskCancelled, PipelineStepSkipped:
+					step.Status = PipelineStepSkipped
+					step.ErrorMsg = fmt.Sprintf("dependency %s %s", dep, strings.ToLower(status))
+				default:
+					ready = false
+				}
+				if step.Status == PipelineStepSkipped {
+					break
+				}
+			}
+
+			switch {
+			case step.Status == PipelineStepSkipped:
+				if err := r.taskManager.savePipelineStep(p.ID, step); err != nil {
+					return nil, err
+				}
+			case ready:
+				if err := r.startStep(p, step, outputs); err != nil {
+					// 保持 PENDING，下一轮重试
+					log.Printf("Pipeline %s: failed to start step %s: %v", p.ID, step.ID, err)
+				}
+			}
+		}
+
+		if step.Status == TaskDone {
+			outputs[step.ID] = step.Output
+		}
+	}
+
+	status, errMsg := TaskDone, ""
+	for _, step := range p.Steps {
+		switch step.Status {
+		case TaskDone:
+		case TaskFailed, TaskCancelled, PipelineStepSkipped:
+			status = TaskFailed
+			if errMsg == "" && step.Status != PipelineStepSkipped {
+				errMsg = fmt.Sprintf("step %s %s: %s", step.ID, strings.ToLower(step.Status), step.ErrorMsg)
+			}
+		default:
+			return p, nil
+		}
+	}
+
+	p.Status = status
+	p.ErrorMsg = errMsg
+	if err := r.taskManager.finishPipeline(p); err != nil {
+		return nil, err
+	}
+	log.Printf("Pipeline %s finished: %s", p.ID, p.Status)
+	return p, nil
+}
+
+// syncStep 用步骤对应任务的当前状态更新步骤
+func (r *PipelineRunner) syncStep(p *Pipeline, step *PipelineStep) {
+	task, err := r.taskManager.GetTask(step.TaskID)
+	status, errMsg, output := "", "", step.Output
+	if err != nil {
+		status, errMsg = TaskFailed, "task no longer exists"
+	} else {
+		status, errMsg = task.Status, task.ErrorMsg
+		if task.Status == TaskDone {
+			output = task.Output
+		}
+	}
+	if status == step.Status && errMsg == step.ErrorMsg {
+		return
+	}
+
+	step.Status, step.ErrorMsg, step.Output = status, errMsg, output
+	if err := r.taskManager.savePipelineStep(p.ID, step); err != nil {
+		log.Printf("Pipeline %s: %v", p.ID, err)
+	}
+}
+
+// startStep 展开步骤输入，创建任务并提交到执行队列。输入无法展开时步骤直接失败
+func (r *PipelineRunner) startStep(p *Pipeline, step *PipelineStep, outputs map[string]json.RawMessage) error {
+	tm := r.taskManager
+
+	input, err := resolveStepInput(step.Input, outputs)
+	if err != nil {
+		step.Status, step.ErrorMsg = TaskFailed, err.Error()
+		return tm.savePipelineStep(p.ID, step)
+	}
+
+	var task *ImageTask
+	submit := true
+	switch step.Kind {
+	case TaskKindImageGenerate:
+		var params TextToImageRequest
+		if err := json.Unmarshal(input, &params); err != nil || strings.TrimSpace(params.Prompt) == "" {
+			step.Status, step.ErrorMsg = TaskFailed, "image.generate step needs a prompt"
+			return tm.savePipelineStep(p.ID, step)
+		}
+		if task, err = tm.CreateTask(p.UserID, params, TaskOptions{}); err != nil {
+			return err
+		}
+		// 与其他图片任务一样复用已有结果或跟随相同参数的任务
+		handled, err := tm.ApplyResultCache(task)
+		if err != nil {
+			log.Printf("Pipeline %s: result cache lookup failed for task %s: %v", p.ID, task.ID, err)
+		}
+		submit = !handled
+	case TaskKindSpeechTranscribe:
+		audio, err := tm.loadPipelineAudio(p.ID)
+		if err != nil {
+			step.Status, step.ErrorMsg = TaskFailed, err.Error()
+			return tm.savePipelineStep(p.ID, step)
+		}
+		if task, err = tm.CreateJob(p.UserID, step.Kind, input, audio, TaskOptions{}); err != nil {
+			return err
+		}
+	default:
+		if task, err = tm.CreateJob(p.UserID, step.Kind, input, nil, TaskOptions{}); err != nil {
+			return err
+		}
+	}
+
+	step.TaskID = task.ID
+	step.Status = task.Status
+	if task.Status == TaskDone {
+		step.Output = task.Output
+	}
+
+	if submit {
+		if err := r.submitter.Submit(task); err != nil {
+			// 队列已满：交给调度器稍后重新入队
+			if err := tm.RescheduleTask(task, time.Now().Add(r.retryDelay)); err != nil {
+				log.Printf("Pipeline %s: failed to reschedule task %s: %v", p.ID, task.ID, err)
+			}
+			step.Status = task.Status
+		}
+	}
+
+	return tm.savePipelineStep(p.ID, step)
+}
+
+//
+// ======================
+// 流水线接口
+// ======================
+//
+
+// HandlePipelines 处理 GET/POST /api/v1/pipelines
+//
+//	@Summary		Submit or list task pipelines
+//	@Description	POST submits a pipeline: a DAG of up to 20 steps (speech.transcribe, prompt.template, image.generate, ...). A step starts once all of its depends_on steps are DONE; {{step.field}} placeholders in its input are replaced with their outputs. A failed step skips its dependents and the pipeline reports one aggregate status. Send JSON, or multipart/form-data with the definition in `definition` and the audio for speech.transcribe steps in `audio`. GET lists the caller's recent pipelines.
+//	@Tags			async-tasks
+//	@Accept			json
+//	@Accept			multipart/form-data
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request			body		PipelineDefinition	false	"Pipeline definition (JSON requests)"
+//	@Param			definition		formData	string				false	"Pipeline definition (multipart requests)"
+//	@Param			audio			formData	file				false	"Audio for speech.transcribe steps"
+//	@Param			format			formData	string				false	"Audio format: file (default) or pcm"
+//	@Param			Idempotency-Key	header		string				false	"Replays the original response when a retry reuses the key"
+//	@Success		200				{array}		Pipeline
+//	@Success		202				{object}	Pipeline
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string
+//	@Failure		413				{object}	map[string]string
+//	@Failure		503				{object}	map[string]string	"Queue full or predicted wait too long; see Retry-After"
+//	@Router			/api/v1/pipelines [get]
+//	@Router			/api/v1/pipelines [post]
+func (h *AsyncAPIHandlers) HandlePipelines(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		pipelines, err := h.taskManager.ListPipelines(userID, 50)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to list pipelines")
+			return
+		}
+		writeJSON(w, http.StatusOK, pipelines)
+
+	case http.MethodPost:
+		h.createPipeline(w, r, userID)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (h *AsyncAPIHandlers) createPipeline(w http.ResponseWriter, r *http.Request, userID int64) {
+	if h.pipelines == nil {
+		errorResponse(w, http.StatusServiceUnavailable, "pipelines are not enabled")
+		return
+	}
+
+	var (
+		def      PipelineDefinition
+		audio    []byte
+		filename string
+		format   string
+	)
+	r.Body = http.MaxBytesReader(w, r.Body, maxAsyncAudioSize)
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(32 << 20); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				errorResponse(w, http.StatusRequestEntityTooLarge, "audio file is too large")
+				return
+			}
+			errorResponse(w, http.StatusBadRequest, "failed to parse form")
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+
+		if err := json.Unmarshal([]byte(r.FormValue("definition")), &def); err != nil {
+			errorResponse(w, http.StatusBadRequest, "definition must be a JSON pipeline definition")
+			return
+		}
+		if file, header, err := r.FormFile("audio"); err == nil {
+			audio, err = io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				errorResponse(w, http.StatusInternalServerError, "failed to read audio")
+				return
+			}
+			filename = header.Filename
+		}
+		format = r.FormValue("format")
+	} else if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			errorResponse(w, http.StatusRequestEntityTooLarge, "request body too large")
+			return
+		}
+		errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if format == "" {
+		format = "file"
+	}
+	if format != "file" && format != "pcm" {
+		errorResponse(w, http.StatusBadRequest, "format must be file or pcm")
+		return
+	}
+
+	steps, err := validatePipeline(def, h.workerPool.Handles, len(audio) > 0)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for i := range steps {
+		if steps[i].Kind == TaskKindSpeechTranscribe {
+			steps[i].Input, _ = json.Marshal(SpeechTranscribeInput{Filename: filename, Format: format, SizeBytes: len(audio)})
+		}
+	}
+
+	if retryAfter, err := h.workerPool.Admit(); err != nil {
+		writeOverloaded(w, retryAfter, err)
+		return
+	}
+
+	p, err := h.taskManager.CreatePipeline(userID, steps, audio)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to create pipeline")
+		return
+	}
+
+	// 立即启动没有依赖的步骤
+	if advanced, err := h.pipelines.Advance(p.ID); err != nil {
+		log.Printf("Failed to start pipeline %s: %v", p.ID, err)
+	} else {
+		p = advanced
+	}
+	writeJSON(w, http.StatusAccepted, p)
+}
+
+// HandlePipeline 处理 GET /api/v1/pipelines/{id}
+//
+//	@Summary		Get pipeline status
+//	@Description	Returns the aggregate status and each step's status, task ID, output and error
+//	@Tags			async-tasks
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id	path		string	true	"Pipeline ID"
+//	@Success		200	{object}	Pipeline
+//	@Failure		401	{object}	map[string]string
+//	@Failure		403	{object}	map[string]string
+//	@Failure		404	{object}	map[string]string
+//	@Router			/api/v1/pipelines/{id} [get]
+func (h *AsyncAPIHandlers) HandlePipeline(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/pipelines/")
+	if id == "" || strings.Contains(id, "/") {
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	p, err := h.taskManager.GetPipeline(id)
+	if errors.Is(err, ErrPipelineNotFound) {
+		errorResponse(w, http.StatusNotFound, "pipeline not found")
+		return
+	}
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to load pipeline")
+		return
+	}
+	if p.UserID != userID {
+		errorResponse(w, http.StatusForbidden, "access denied")
+		return
+	}
+	writeJSON(w, http.StatusOK, p)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// promptRecorder 记录收到的提示词并返回固定图片
+type promptRecorder struct {
+	prompts chan string
+}
+
+func (p *promptRecorder) Ping(ctx context.Context) error { return nil }
+
+func (p *promptRecorder) Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error) {
+	p.prompts <- req.Prompt
+	return TextToImageResponse{ImageData: []byte("png"), MimeType: "image/png"}, nil
+}
+
+// failHandler 总是失败
+type failHandler struct{}
+
+func (failHandler) Deadline(task *ImageTask) time.Duration { return time.Second }
+
+func (failHandler) Run(ctx context.Context, task *ImageTask) (TaskResult, error) {
+	return TaskResult{}, errors.New("boom")
+}
+
+func waitForPipeline(t *testing.T, tm *TaskManager, id string) *Pipeline {
+	t.Helper()
+	var p *Pipeline
+	waitFor(t, "pipeline to finish", func() bool {
+		p, _ = tm.GetPipeline(id)
+		return p != nil && p.Status != TaskRunning
+	})
+	return p
+}
+
+func TestValidatePipeline(t *testing.T) {
+	handles := func(kind string) bool {
+		return kind == TaskKindSpeechTranscribe || kind == TaskKindPromptTemplate || kind == TaskKindImageGenerate
+	}
+	step := func(id, kind, input string, deps ...string) PipelineStepSpec {
+		return PipelineStepSpec{ID: id, Kind: kind, DependsOn: deps, Input: json.RawMessage(input)}
+	}
+
+	// 定义顺序与依赖顺序不同，按拓扑顺序返回
+	ordered, err := validatePipeline(PipelineDefinition{Steps: []PipelineStepSpec{
+		step("image", TaskKindImageGenerate, `{"prompt":"{{prompt.text}}"}`, "prompt"),
+		step("prompt", TaskKindPromptTemplate, `{"template":"poster: {{asr.text}}"}`, "asr"),
+		step("asr", TaskKindSpeechTranscribe, ``),
+	}}, handles, true)
+	if err != nil {
+		t.Fatalf("validatePipeline: %v", err)
+	}
+	if ordered[0].ID != "asr" || ordered[1].ID != "prompt" || ordered[2].ID != "image" || string(ordered[0].Input) != `{}` {
+		t.Fatalf("unexpected order: %+v", ordered)
+	}
+
+	cases := []struct {
+		name  string
+		steps []PipelineStepSpec
+		audio bool
+		want  string
+	}{
+		{"empty", nil, false, "at least one step"},
+		{"bad id", []PipelineStepSpec{step("a b", TaskKindPromptTemplate, `{}`)}, false, "step id"},
+		{"duplicate", []PipelineStepSpec{step("a", TaskKindPromptTemplate, `{}`), step("a", TaskKindPromptTemplate, `{}`)}, false, "duplicate"},
+		{"unknown kind", []PipelineStepSpec{step("a", "video.render", `{}`)}, false, "unsupported kind"},
+		{"missing dep", []PipelineStepSpec{step("a", TaskKindPromptTemplate, `{}`, "b")}, false, "unknown step"},
+		{"cycle", []PipelineStepSpec{step("a", TaskKindPromptTemplate, `{}`, "b"), step("b", TaskKindPromptTemplate, `{}`, "a")}, false, "cycle"},
+		{"undeclared ref", []PipelineStepSpec{step("a", TaskKindPromptTemplate, `{}`), step("b", TaskKindPromptTemplate, `{"template":"{{a.text}}"}`)}, false, "not in depends_on"},
+		{"not object", []PipelineStepSpec{step("a", TaskKindPromptTemplate, `"text"`)}, false, "JSON object"},
+		{"no audio", []PipelineStepSpec{step("a", TaskKindSpeechTranscribe, `{}`)}, false, "audio"},
+		{"speech with deps", []PipelineStepSpec{step("a", TaskKindPromptTemplate, `{}`), step("b", TaskKindSpeechTranscribe, `{}`, "a")}, true, "cannot have dependencies"},
+	}
+	for _, c := range cases {
+		_, err := validatePipeline(PipelineDefinition{Steps: c.steps}, handles, c.audio)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.want, err)
+		}
+	}
+}
+
+func TestResolveStepInput(t *testing.T) {
+	outputs := map[string]json.RawMessage{
+		"asr":  json.RawMessage(`{"text":"你好","segments":[{"start":0,"text":"你好"}]}`),
+		"seed": json.RawMessage(`{"value":9007199254740993}`),
+	}
+
+	got, err := resolveStepInput(json.RawMessage(`{"prompt":"poster: {{ asr.text }} ({{asr.segments.0.start}})","seed":"{{seed.value}}","steps":20}`), outputs)
+	if err != nil {
+		t.Fatalf("resolveStepInput: %v", err)
+	}
+	var params TextToImageRequest
+	if err := json.Unmarshal(got, &params); err != nil {
+		t.Fatalf("resolved input is not a generation request: %s", got)
+	}
+	if params.Prompt != "poster: 你好 (0)" || params.Seed != 9007199254740993 || params.Steps != 20 {
+		t.Fatalf("unexpected resolved input: %s", got)
+	}
+
+	if _, err := resolveStepInput(json.RawMessage(`{"prompt":"{{asr.missing}}"}`), outputs); err == nil {
+		t.Fatal("expected a missing output field to fail")
+	}
+}
+
+func TestPipelineTranscribeTemplateGenerate(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	whisper := &fakeWhisper{got: make(chan []byte, 1)}
+	images := &promptRecorder{prompts: make(chan string, 1)}
+	wp := NewWorkerPool(1, 10, []TextToImageProvider{images}, tm)
+	speech := NewLoadBalancer([]SpeechToTextProvider{whisper})
+	defer speech.Close()
+	wp.RegisterHandler(TaskKindSpeechTranscribe, NewSpeechTranscribeHandler(speech, tm))
+	wp.Start()
+	defer wp.Stop()
+
+	runner := NewPipelineRunner(tm, wp, time.Hour)
+	runner.Start(tm.Events())
+	defer runner.Stop()
+	h := NewAsyncAPIHandlers(wp, tm, speech)
+	h.SetPipelineRunner(runner)
+
+	definition := `{"steps":[
+		{"id":"asr","kind":"speech.transcribe"},
+		{"id":"prompt","kind":"prompt.template","depends_on":["asr"],"input":{"template":"a watercolor poster of: {{asr.text}}"}},
+		{"id":"image","kind":"image.generate","depends_on":["prompt"],"input":{"prompt":"{{prompt.text}}","seed":7}}
+	]}`
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("definition", definition)
+	part, _ := mw.CreateFormFile("audio", "memo.wav")
+	part.Write([]byte("RIFF audio"))
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/pipelines", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+	rr := httptest.NewRecorder()
+	h.HandlePipelines(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var created Pipeline
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if created.Status != TaskRunning || len(created.Steps) != 3 || created.Steps[0].TaskID == "" || created.Steps[1].Status != PipelineStepPending {
+		t.Fatalf("expected only the transcription to start, got %+v", created)
+	}
+
+	if got := <-whisper.got; string(got) != "RIFF audio" {
+		t.Fatalf("unexpected audio: %q", got)
+	}
+	if prompt := <-images.prompts; prompt != "a watercolor poster of: 你好" {
+		t.Fatalf("unexpected prompt: %q", prompt)
+	}
+
+	done := waitForPipeline(t, tm, created.ID)
+	if done.Status != TaskDone {
+		t.Fatalf("expected pipeline to finish, got %+v", done)
+	}
+	var out struct {
+		ImageID   int64  `json:"image_id"`
+		ResultURL string `json:"result_url"`
+	}
+	if err := json.Unmarshal(done.Steps[2].Output, &out); err != nil || out.ImageID == 0 || out.ResultURL == "" {
+		t.Fatalf("expected image step output, got %s", done.Steps[2].Output)
+	}
+	var audio []byte
+	testDB.QueryRow("SELECT audio FROM pipelines WHERE id = ?", created.ID).Scan(&audio)
+	if audio != nil {
+		t.Fatal("expected the uploaded audio to be cleared")
+	}
+
+	get := httptest.NewRequest(http.MethodGet, "/api/v1/pipelines/"+created.ID, nil)
+	get.Header.Set("X-User-ID", strconv.FormatInt(userID+1, 10))
+	rr = httptest.NewRecorder()
+	h.HandlePipeline(rr, get)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected other users to be denied, got %d", rr.Code)
+	}
+}
+
+func TestPipelineFailureSkipsDependents(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(1, 10, nil, tm)
+	wp.RegisterHandler("test.fail", failHandler{})
+	wp.RegisterHandler("test.echo", echoHandler{})
+	wp.Start()
+	defer wp.Stop()
+
+	runner := NewPipelineRunner(tm, wp, time.Hour)
+	runner.Start(tm.Events())
+	defer runner.Stop()
+
+	steps, err := validatePipeline(PipelineDefinition{Steps: []PipelineStepSpec{
+		{ID: "broken", Kind: "test.fail"},
+		{ID: "after", Kind: "test.echo", DependsOn: []string{"broken"}},
+		{ID: "last", Kind: "test.echo", DependsOn: []string{"after"}},
+		{ID: "side", Kind: "test.echo", Input: json.RawMessage(`{"n":1}`)},
+	}}, wp.Handles, false)
+	if err != nil {
+		t.Fatalf("validatePipeline: %v", err)
+	}
+	p, err := tm.CreatePipeline(userID, steps, nil)
+	if err != nil {
+		t.Fatalf("CreatePipeline: %v", err)
+	}
+	runner.Notify()
+
+	done := waitForPipeline(t, tm, p.ID)
+	status := map[string]*PipelineStep{}
+	for _, step := range done.Steps {
+		status[step.ID] = step
+	}
+	if done.Status != TaskFailed || done.ErrorMsg != "step broken failed: boom" {
+		t.Fatalf("expected aggregate failure, got %s %q", done.Status, done.ErrorMsg)
+	}
+	if status["after"].Status != PipelineStepSkipped || status["last"].Status != PipelineStepSkipped || status["after"].TaskID != "" {
+		t.Fatalf("expected dependents to be skipped, got %+v %+v", status["after"], status["last"])
+	}
+	if status["side"].Status != TaskDone || string(status["side"].Output) != `{"n":1}` {
+		t.Fatalf("expected the independent branch to finish, got %+v", status["side"])
+	}
+}
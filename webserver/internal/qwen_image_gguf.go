@@ -20,11 +20,13 @@ type QwenImageGGUF struct {
 }
 
 const (
-	defaultGenerateTimeout = 60 * time.Second
+	defaultGenerateTimeout = 60 * time.Second // 调用方没有设置截止时间时使用
 	defaultInferenceSteps  = 20
+	qwenImageModelName     = "qwen-image-gguf"
 )
 
 // NewQwenImageGGUF 构造函数，允许自定义 http.Client。
+// 默认 client 不设置整体超时，生成耗时由调用方通过 ctx 的截止时间控制（worker 按任务参数计算）。
 func NewQwenImageGGUF(rawURL string, client *http.Client) (*QwenImageGGUF, error) {
 	parsed, err := url.Parse(strings.TrimSuffix(rawURL, "/"))
 	if err != nil {
@@ -32,7 +34,7 @@ func NewQwenImageGGUF(rawURL string, client *http.Client) (*QwenImageGGUF, error
 	}
 
 	if client == nil {
-		client = &http.Client{Timeout: defaultGenerateTimeout}
+		client = &http.Client{}
 	}
 
 	return &QwenImageGGUF{baseURL: parsed, client: client}, nil
@@ -80,6 +82,12 @@ func (q *QwenImageGGUF) Generate(ctx context.Context, req TextToImageRequest) (T
 		return empty, errors.New("nil QwenImageGGUF receiver")
 	}
 
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultGenerateTimeout)
+		defer cancel()
+	}
+
 	steps := req.Steps
 	if steps <= 0 {
 		steps = defaultInferenceSteps
@@ -89,10 +97,16 @@ func (q *QwenImageGGUF) Generate(ctx context.Context, req TextToImageRequest) (T
 		Prompt            string `json:"prompt"`
 		NegativePrompt    string `json:"negative_prompt,omitempty"`
 		NumInferenceSteps int    `json:"num_inference_steps"`
+		Width             int    `json:"width,omitempty"`
+		Height            int    `json:"height,omitempty"`
+		Seed              int64  `json:"seed,omitempty"`
 	}{
 		Prompt:            req.Prompt,
 		NegativePrompt:    req.NegativePrompt,
 		NumInferenceSteps: steps,
+		Width:             req.Width,
+		Height:            req.Height,
+		Seed:              req.Seed,
 	}
 
 	body, err := json.Marshal(payload)
@@ -130,6 +144,21 @@ func (q *QwenImageGGUF) Generate(ctx context.Context, req TextToImageRequest) (T
 	return TextToImageResponse{ImageData: imageData, MimeType: mimeType}, nil
 }
 
+// InstanceName 返回实例的 base URL，用于记录生成来源
+func (q *QwenImageGGUF) InstanceName() string {
+	return q.baseURL.String()
+}
+
+// ModelName 返回后端模型名称
+func (q *QwenImageGGUF) ModelName() string {
+	return qwenImageModelName
+}
+
+// Models 返回后端提供的模型；服务端不报告分辨率和步数上限，需要限制时在 backends 表中配置
+func (q *QwenImageGGUF) Models() []ModelCapability {
+	return []ModelCapability{{Name: qwenImageModelName, Features: []string{FeatureNegativePrompt, FeatureSeed}}}
+}
+
 func (q *QwenImageGGUF) resolvePath(path string) string {
 	u := *q.baseURL
 	u.Path = strings.TrimRight(u.Path, "/") + path
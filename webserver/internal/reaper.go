@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 执行截止时间、租约与卡死任务回收
+// ======================
+//
+// worker 开始执行任务时获取租约：attempts 加一，lease_expires_at = 开始时间 + 任务截止时间 + 宽限，
+// 执行期间定期刷新 heartbeat_at。TaskReaper 定期扫描 RUNNING 任务，租约过期（worker 卡死）或
+// 心跳停止（进程崩溃）的任务按重试策略重新排队或标记失败，每次处理都写入 task_audit_log。
+//
+
+const (
+	defaultReaperInterval   = 30 * time.Second
+	defaultHeartbeatTimeout = 45 * time.Second // 超过该时间没有心跳视为 worker 已退出
+	heartbeatInterval       = 10 * time.Second // worker 刷新心跳的间隔，需明显小于 HeartbeatTimeout
+	leaseGrace              = 15 * time.Second // 截止时间之外留给 worker 保存结果的时间
+	referencePixels         = 1024 * 1024      // PerStep 对应的图片尺寸；未指定尺寸时按该尺寸估算
+
+	AuditActionRequeued  = "requeued"
+	AuditActionFailed    = "failed"
+	AuditActionRecovered = "recovered"
+	AuditActionCancelled = "cancelled"
+)
+
+// ErrLeaseLost 任务已被回收、重新排队或不再处于预期状态，worker 不能再写入结果
+var ErrLeaseLost = errors.New("task lease lost")
+
+// DeadlinePolicy 按生成参数计算单个任务的执行截止时间
+type DeadlinePolicy struct {
+	Base    time.Duration // 固定开销（排队进入后端、编码图片等）
+	PerStep time.Duration // 1024x1024 图片每个推理步的耗时，按像素数线性缩放
+	Max     time.Duration // 截止时间上限
+}
+
+// DefaultDeadlinePolicy 默认策略：默认 20 步、1024x1024 约 130 秒
+func DefaultDeadlinePolicy() DeadlinePolicy {
+	return DeadlinePolicy{
+		Base:    30 * time.Second,
+		PerStep: 5 * time.Second,
+		Max:     15 * time.Minute,
+	}
+}
+
+// For 返回生成请求的截止时间
+func (p DeadlinePolicy) For(req TextToImageRequest) time.Duration {
+	steps := req.Steps
+	if steps <= 0 {
+		steps = defaultInferenceSteps
+	}
+	scale := 1.0
+	if req.Width > 0 && req.Height > 0 {
+		scale = float64(req.Width*req.Height) / referencePixels
+		// 小图也有固定的单步开销
+		if scale < 0.25 {
+			scale = 0.25
+		}
+	}
+
+	d := p.Base + time.Duration(float64(p.PerStep)*float64(steps)*scale)
+	if p.Max > 0 && d > p.Max {
+		d = p.Max
+	}
+	return d
+}
+
+// RetryPolicy 被回收的任务的重试策略
+type RetryPolicy struct {
+	MaxAttempts int           // 包括第一次执行在内的最多执行次数，达到后标记 FAILED
+	Backoff     time.Duration // 第 n 次重试在 n * Backoff 之后重新排队
+}
+
+// DefaultRetryPolicy 默认最多执行 3 次
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 3, Backoff: 30 * time.Second}
+}
+
+// ReaperConfig 回收器配置
+type ReaperConfig struct {
+	Interval         time.Duration
+	HeartbeatTimeout time.Duration
+	Retry            RetryPolicy
+}
+
+// DefaultReaperConfig 默认配置
+func DefaultReaperConfig() ReaperConfig {
+	return ReaperConfig{
+		Interval:         defaultReaperInterval,
+		HeartbeatTimeout: defaultHeartbeatTimeout,
+		Retry:            DefaultRetryPolicy(),
+	}
+}
+
+// StartLease 把 QUEUED 任务转为 RUNNING 并获取租约，任务已不在排队状态时返回 ErrLeaseLost
+func (tm *TaskManager) StartLease(task *ImageTask, deadline time.Duration) error {
+	return tm.startLease(task, deadline, "")
+}
+
+// startLease 获取租约，workerID 为持有租约的远程 worker（本进程执行时为空）
+func (tm *TaskManager) startLease(task *ImageTask, deadline time.Duration, workerID string) error {
+	now := time.Now()
+	expires := now.Add(deadline + leaseGrace)
+
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+
+	if task.Status != TaskQueued {
+		return ErrLeaseLost
+	}
+	task.Status = TaskRunning
+	err = tm.updateTask(tx, task, `
+		attempts = attempts + 1, started_at = ?, heartbeat_at = ?, lease_expires_at = ?, worker_id = ?,
+		error_msg = '', updated_at = ?`, now, now, expires, workerID, now)
+	if err != nil {
+		return leaseError(err)
+	}
+
+	task.Attempts++
+	task.StartedAt = &now
+	task.HeartbeatAt = &now
+	task.LeaseExpiresAt = &expires
+	task.WorkerID = workerID
+	task.ErrorMsg = ""
+	task.UpdatedAt = now
+
+	attached, err := syncAttachedTasks(tx, task)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to start task lease: %w", err)
+	}
+	snapshot.keep()
+
+	tm.storeAndPublish(append([]*ImageTask{task}, attached...)...)
+	// 任务出队后，后面排队的任务位置都前移了一位
+	tm.publishQueuePositions()
+	return nil
+}
+
+// Heartbeat 刷新任务心跳；任务已被回收或进入下一次执行时返回 ErrLeaseLost
+func (tm *TaskManager) Heartbeat(taskID string, attempt int) error {
+	now := time.Now()
+	res, err := tm.db.Exec(`
+		UPDATE image_tasks SET heartbeat_at = ?
+		WHERE id = ? AND status = ? AND attempts = ?
+	`, now, taskID, TaskRunning, attempt)
+	if err != nil {
+		return fmt.Errorf("failed to record heartbeat: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrLeaseLost
+	}
+
+	// 心跳不改变任务状态和版本，只刷新缓存中的快照
+	tm.cache.update(taskID, func(task *ImageTask) {
+		if task.Attempts == attempt {
+			task.HeartbeatAt = &now
+		}
+	})
+	return nil
+}
+
+// LeaseHeld 任务是否仍处于 worker 第 attempt 次执行中
+func (tm *TaskManager) LeaseHeld(taskID string, attempt int) bool {
+	var n int
+	err := tm.db.QueryRow(`
+		SELECT COUNT(*) FROM image_tasks WHERE id = ? AND status = ? AND attempts = ?
+	`, taskID, TaskRunning, attempt).Scan(&n)
+	return err == nil && n > 0
+}
+
+// ExpiredLeases 返回租约过期或心跳超时的 RUNNING 任务；跟随其他任务的任务随父任务变化，不在其中
+func (tm *TaskManager) ExpiredLeases(now time.Time, heartbeatTimeout time.Duration, limit int) ([]*ImageTask, error) {
+	rows, err := tm.db.Query(`
+		SELECT `+taskColumns+`
+		FROM image_tasks
+		WHERE status = ? AND attached_to = ''
+			AND (lease_expires_at < ? OR COALESCE(heartbeat_at, updated_at) < ?)
+		ORDER BY rowid
+		LIMIT ?
+	`, TaskRunning, now, now.Add(-heartbeatTimeout), limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load expired leases: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*ImageTask
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// RequeueExpiredTask 回收第 attempt 次执行：任务转为 SCHEDULED，runAt 后由调度器重新入队
+func (tm *TaskManager) RequeueExpiredTask(task *ImageTask, attempt int, runAt time.Time, reason string) error {
+	task.Status = TaskScheduled
+	task.RunAt = &runAt
+	task.ErrorMsg = reason
+	task.LeaseExpiresAt = nil
+	task.UpdatedAt = time.Now()
+	return tm.transitionRunning(task, attempt, AuditActionRequeued,
+		`run_at = ?, error_msg = ?, lease_expires_at = NULL, updated_at = ?`,
+		task.RunAt, task.ErrorMsg, task.UpdatedAt)
+}
+
+// FailExpiredTask 回收第 attempt 次执行并把任务标记为 FAILED，跟随的任务一起失败
+func (tm *TaskManager) FailExpiredTask(task *ImageTask, attempt int, reason string) error {
+	task.Status = TaskFailed
+	task.ErrorMsg = reason
+	task.LeaseExpiresAt = nil
+	task.UpdatedAt = time.Now()
+	return tm.transitionRunning(task, attempt, AuditActionFailed,
+		`error_msg = ?, lease_expires_at = NULL, updated_at = ?`,
+		task.ErrorMsg, task.UpdatedAt)
+}
+
+// transitionRunning 只在任务仍处于第 attempt 次执行时更新（set 同 updateTaskRow），并在同一事务中写入审计记录。
+// task 是该次执行期间读取的快照，版本相同即说明任务没有被回收或进入下一次执行
+func (tm *TaskManager) transitionRunning(task *ImageTask, attempt int, action, set string, args ...interface{}) error {
+	if task.Attempts != attempt {
+		return ErrLeaseLost
+	}
+
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+
+	if err := tm.updateTask(tx, task, set, args...); err != nil {
+		return leaseError(err)
+	}
+
+	if err := insertAuditLog(tx, task.ID, action, task.ErrorMsg, attempt); err != nil {
+		return err
+	}
+
+	// 重新排队时跟随的任务保持原状态，父任务再次开始执行时会同步
+	var attached []*ImageTask
+	if isTerminalStatus(task.Status) {
+		if err := enqueueTaskWebhooks(tx, task); err != nil {
+			return err
+		}
+		if attached, err = syncAttachedTasks(tx, task); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update running task: %w", err)
+	}
+	snapshot.keep()
+
+	tm.storeAndPublish(append([]*ImageTask{task}, attached...)...)
+	return nil
+}
+
+// leaseError 把被拒绝的更新转换为 ErrLeaseLost：任务已被其他写入方修改，本次执行不能再写入
+func leaseError(err error) error {
+	var te *TransitionError
+	if errors.As(err, &te) || errors.Is(err, ErrTaskNotFound) {
+		return fmt.Errorf("%w: %v", ErrLeaseLost, err)
+	}
+	return err
+}
+
+// RecoverQueuedTasks 服务启动时把上一个进程遗留在内存队列中的 QUEUED 任务交给调度器重新入队
+func (tm *TaskManager) RecoverQueuedTasks(now time.Time) (int, error) {
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id FROM image_tasks WHERE status = ? AND attached_to = ''
+	`, TaskQueued)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load queued tasks: %w", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan task: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to load queued tasks: %w", err)
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`
+			UPDATE image_tasks SET status = ?, run_at = ?, version = version + 1, updated_at = ? WHERE id = ? AND status = ?
+		`, TaskScheduled, now, now, id, TaskQueued); err != nil {
+			return 0, fmt.Errorf("failed to recover task: %w", err)
+		}
+		if err := insertAuditLog(tx, id, AuditActionRecovered, "queued task lost on restart", 0); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to recover queued tasks: %w", err)
+	}
+
+	// 内存缓存中的副本已过期
+	tm.cache.remove(ids...)
+	return len(ids), nil
+}
+
+// insertAuditLog 记录一次对任务的后台处理
+func insertAuditLog(tx *sql.Tx, taskID, action, detail string, attempt int) error {
+	if _, err := tx.Exec(`
+		INSERT INTO task_audit_log (task_id, action, detail, attempt, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, taskID, action, detail, attempt, time.Now()); err != nil {
+		return fmt.Errorf("failed to write task audit log: %w", err)
+	}
+	return nil
+}
+
+// TaskAuditEntry 一条任务审计记录
+type TaskAuditEntry struct {
+	ID        int64     `json:"id"`
+	TaskID    string    `json:"task_id"`
+	Action    string    `json:"action"`
+	Detail    string    `json:"detail,omitempty"`
+	Attempt   int       `json:"attempt,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// GetTaskAuditLog 返回任务的审计记录，按时间排序
+func (tm *TaskManager) GetTaskAuditLog(taskID string) ([]TaskAuditEntry, error) {
+	rows, err := tm.db.Query(`
+		SELECT id, task_id, action, detail, attempt, created_at
+		FROM task_audit_log WHERE task_id = ? ORDER BY id
+	`, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load task audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []TaskAuditEntry{}
+	for rows.Next() {
+		var e TaskAuditEntry
+		if err := rows.Scan(&e.ID, &e.TaskID, &e.Action, &e.Detail, &e.Attempt, &e.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan task audit log: %w", err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+//
+// ======================
+// TaskReaper - 卡死任务回收
+// ======================
+//
+
+// TaskReaper 定期回收租约过期或心跳停止的 RUNNING 任务
+type TaskReaper struct {
+	taskManager *TaskManager
+	scheduler   *TaskScheduler // 可为 nil；重新排队后唤醒调度器
+	cfg         ReaperConfig
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// NewTaskReaper 创建回收器，配置中的零值使用默认值
+func NewTaskReaper(tm *TaskManager, scheduler *TaskScheduler, cfg ReaperConfig) *TaskReaper {
+	def := DefaultReaperConfig()
+	if cfg.Interval <= 0 {
+		cfg.Interval = def.Interval
+	}
+	if cfg.HeartbeatTimeout <= 0 {
+		cfg.HeartbeatTimeout = def.HeartbeatTimeout
+	}
+	if cfg.Retry.MaxAttempts <= 0 {
+		cfg.Retry.MaxAttempts = def.Retry.MaxAttempts
+	}
+	if cfg.Retry.Backoff < 0 {
+		cfg.Retry.Backoff = 0
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TaskReaper{
+		taskManager: tm,
+		scheduler:   scheduler,
+		cfg:         cfg,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start 启动回收循环；启动时立即处理一次，回收上一个进程崩溃时遗留的任务
+func (r *TaskReaper) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+
+		ticker := time.NewTicker(r.cfg.Interval)
+		defer ticker.Stop()
+
+		for {
+			r.RunOnce()
+
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	log.Printf("Task reaper started (interval: %s, heartbeat timeout: %s, max attempts: %d)",
+		r.cfg.Interval, r.cfg.HeartbeatTimeout, r.cfg.Retry.MaxAttempts)
+}
+
+// Stop 停止回收
+func (r *TaskReaper) Stop() {
+	r.cancel()
+	r.wg.Wait()
+	log.Println("Task reaper stopped")
+}
+
+// RunOnce 回收一轮过期任务，返回处理的数量
+func (r *TaskReaper) RunOnce() int {
+	now := time.Now()
+	expired, err := r.taskManager.ExpiredLeases(now, r.cfg.HeartbeatTimeout, schedulerBatchSize)
+	if err != nil {
+		log.Printf("Reaper: %v", err)
+		return 0
+	}
+
+	reaped, requeued := 0, false
+	for _, task := range expired {
+		if r.ctx.Err() != nil {
+			break
+		}
+		if r.reap(task, now) {
+			reaped++
+			requeued = requeued || task.Status == TaskScheduled
+		}
+	}
+	if requeued && r.scheduler != nil {
+		r.scheduler.Notify()
+	}
+	return reaped
+}
+
+// reap 按重试策略处理一个过期任务
+func (r *TaskReaper) reap(task *ImageTask, now time.Time) bool {
+	attempt := task.Attempts
+	reason := "worker heartbeat lost"
+	if task.LeaseExpiresAt != nil && task.LeaseExpiresAt.Before(now) {
+		reason = "task exceeded its deadline"
+	}
+
+	var err error
+	if attempt < r.cfg.Retry.MaxAttempts {
+		runAt := now.Add(time.Duration(attempt) * r.cfg.Retry.Backoff)
+		err = r.taskManager.RequeueExpiredTask(task, attempt, runAt,
+			fmt.Sprintf("%s (attempt %d of %d), retrying", reason, attempt, r.cfg.Retry.MaxAttempts))
+		if err == nil {
+			log.Printf("Reaper: task %s %s on attempt %d, requeued for %s", task.ID, reason, attempt, runAt.Format(time.RFC3339))
+		}
+	} else {
+		err = r.taskManager.FailExpiredTask(task, attempt,
+			fmt.Sprintf("%s after %d attempts", reason, attempt))
+		if err == nil {
+			log.Printf("Reaper: task %s %s on attempt %d, giving up", task.ID, reason, attempt)
+		}
+	}
+
+	if err != nil {
+		// 任务在扫描之后已经结束或被其他回收器处理
+		if !errors.Is(err, ErrLeaseLost) {
+			log.Printf("Reaper: failed to reap task %s: %v", task.ID, err)
+		}
+		return false
+	}
+	return true
+}
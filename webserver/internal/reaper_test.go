@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingProvider 在 release 关闭或 ctx 结束前阻塞生成
+type blockingProvider struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingProvider() *blockingProvider {
+	return &blockingProvider{started: make(chan struct{}, 1), release: make(chan struct{})}
+}
+
+func (p *blockingProvider) Ping(ctx context.Context) error { return nil }
+
+func (p *blockingProvider) Generate(ctx context.Context, req TextToImageRequest) (TextToImageResponse, error) {
+	p.started <- struct{}{}
+	select {
+	case <-p.release:
+		return TextToImageResponse{ImageData: []byte("late"), MimeType: "image/png"}, nil
+	case <-ctx.Done():
+		return TextToImageResponse{}, ctx.Err()
+	}
+}
+
+// expireLease 把任务的租约拨到过去
+func expireLease(t *testing.T, tm *TaskManager, taskID string) {
+	t.Helper()
+	if _, err := tm.db.Exec("UPDATE image_tasks SET lease_expires_at = ? WHERE id = ?", time.Now().Add(-time.Second), taskID); err != nil {
+		t.Fatalf("failed to expire lease: %v", err)
+	}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDeadlinePolicyScalesWithStepsAndSize(t *testing.T) {
+	p := DeadlinePolicy{Base: 30 * time.Second, PerStep: 5 * time.Second, Max: 10 * time.Minute}
+
+	cases := []struct {
+		req  TextToImageRequest
+		want time.Duration
+	}{
+		{TextToImageRequest{}, 130 * time.Second},
+		{TextToImageRequest{Steps: 40, Width: 512, Height: 512}, 80 * time.Second},
+		{TextToImageRequest{Steps: 10, Width: 2048, Height: 1024}, 130 * time.Second},
+		{TextToImageRequest{Steps: 4, Width: 64, Height: 64}, 35 * time.Second},
+		{TextToImageRequest{Steps: 200, Width: 2048, Height: 2048}, 10 * time.Minute},
+	}
+	for _, c := range cases {
+		if got := p.For(c.req); got != c.want {
+			t.Errorf("%+v: expected %s, got %s", c.req, c.want, got)
+		}
+	}
+}
+
+func TestReaperRequeuesThenFailsExpiredTask(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	reaper := NewTaskReaper(tm, nil, ReaperConfig{
+		HeartbeatTimeout: time.Minute,
+		Retry:            RetryPolicy{MaxAttempts: 2, Backoff: time.Minute},
+	})
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "stuck", Seed: 3}, TaskOptions{})
+	follower, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "stuck", Seed: 3}, TaskOptions{})
+	if handled, _ := tm.ApplyResultCache(follower); !handled {
+		t.Fatal("expected follower to attach")
+	}
+
+	if err := tm.StartLease(task, time.Minute); err != nil {
+		t.Fatalf("StartLease: %v", err)
+	}
+	if n := reaper.RunOnce(); n != 0 {
+		t.Fatalf("expected healthy task not to be reaped, reaped %d", n)
+	}
+
+	// 第一次超时：重新排队，等待退避
+	expireLease(t, tm, task.ID)
+	if n := reaper.RunOnce(); n != 1 {
+		t.Fatalf("expected one task to be reaped, reaped %d", n)
+	}
+	stored, _ := NewTaskManager(testDB).GetTask(task.ID)
+	if stored.Status != TaskScheduled || stored.RunAt == nil || !stored.RunAt.After(time.Now()) || !strings.Contains(stored.ErrorMsg, "deadline") {
+		t.Fatalf("expected task to be requeued with backoff, got %+v", stored)
+	}
+	if tm.LeaseHeld(task.ID, 1) {
+		t.Fatal("expected the first attempt to lose its lease")
+	}
+
+	// 调度器重新入队后第二次执行再次超时：达到最大次数，任务和跟随者都失败
+	makeDue(t, tm, task.ID)
+	NewTaskScheduler(tm, &recordingSubmitter{}, time.Hour).RunDue()
+	stored, _ = tm.GetTask(task.ID)
+	if err := tm.StartLease(stored, time.Minute); err != nil {
+		t.Fatalf("StartLease: %v", err)
+	}
+	if stored.Attempts != 2 {
+		t.Fatalf("expected attempt 2, got %d", stored.Attempts)
+	}
+	expireLease(t, tm, task.ID)
+	reaper.RunOnce()
+
+	reloaded := NewTaskManager(testDB)
+	failed, _ := reloaded.GetTask(task.ID)
+	if failed.Status != TaskFailed || !strings.Contains(failed.ErrorMsg, "after 2 attempts") {
+		t.Fatalf("expected task to fail after 2 attempts, got %+v", failed)
+	}
+	if f, _ := reloaded.GetTask(follower.ID); f.Status != TaskFailed {
+		t.Fatalf("expected follower to fail with its parent, got %s", f.Status)
+	}
+
+	entries, err := tm.GetTaskAuditLog(task.ID)
+	if err != nil {
+		t.Fatalf("GetTaskAuditLog: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Action != AuditActionRequeued || entries[0].Attempt != 1 ||
+		entries[1].Action != AuditActionFailed || entries[1].Attempt != 2 {
+		t.Fatalf("unexpected audit log: %+v", entries)
+	}
+}
+
+func TestReaperDetectsLostHeartbeat(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	reaper := NewTaskReaper(tm, nil, ReaperConfig{HeartbeatTimeout: time.Minute, Retry: RetryPolicy{MaxAttempts: 1}})
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "crashed"}, TaskOptions{})
+	if err := tm.StartLease(task, time.Hour); err != nil {
+		t.Fatalf("StartLease: %v", err)
+	}
+	if err := tm.Heartbeat(task.ID, 1); err != nil {
+		t.Fatalf("Heartbeat: %v", err)
+	}
+	if err := tm.Heartbeat(task.ID, 2); err != ErrLeaseLost {
+		t.Fatalf("expected heartbeat for another attempt to be rejected, got %v", err)
+	}
+
+	// 进程崩溃：租约未到期但心跳停止
+	testDB.Exec("UPDATE image_tasks SET heartbeat_at = ? WHERE id = ?", time.Now().Add(-2*time.Minute), task.ID)
+	if n := reaper.RunOnce(); n != 1 {
+		t.Fatalf("expected task with stale heartbeat to be reaped, reaped %d", n)
+	}
+	stored, _ := NewTaskManager(testDB).GetTask(task.ID)
+	if stored.Status != TaskFailed || !strings.Contains(stored.ErrorMsg, "heartbeat") {
+		t.Fatalf("expected heartbeat failure, got %+v", stored)
+	}
+}
+
+func TestRecoverQueuedTasksAfterRestart(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "lost in memory"}, TaskOptions{})
+
+	restarted := NewTaskManager(testDB)
+	if n, err := restarted.RecoverQueuedTasks(time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one recovered task, got %d (%v)", n, err)
+	}
+
+	submitter := &recordingSubmitter{}
+	NewTaskScheduler(restarted, submitter, time.Hour).RunDue()
+	if submitter.count() != 1 || submitter.tasks[0].ID != task.ID {
+		t.Fatal("expected recovered task to be resubmitted by the scheduler")
+	}
+	if entries, _ := restarted.GetTaskAuditLog(task.ID); len(entries) != 1 || entries[0].Action != AuditActionRecovered {
+		t.Fatalf("unexpected audit log: %+v", entries)
+	}
+}
+
+func TestWorkerDiscardsResultAfterLeaseLost(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	provider := newBlockingProvider()
+	wp := NewWorkerPool(1, 10, []TextToImageProvider{provider}, tm)
+	wp.Start()
+	defer wp.Stop()
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "slow"}, TaskOptions{})
+	if err := wp.Submit(task); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	<-provider.started
+
+	expireLease(t, tm, task.ID)
+	NewTaskReaper(tm, nil, ReaperConfig{Retry: RetryPolicy{MaxAttempts: 3, Backoff: time.Minute}}).RunOnce()
+
+	close(provider.release)
+	waitFor(t, "worker to finish", func() bool { return wp.RunningCount() == 0 })
+
+	stored, _ := NewTaskManager(testDB).GetTask(task.ID)
+	if stored.Status != TaskScheduled || stored.ImageID != 0 {
+		t.Fatalf("expected late result to be discarded, got %+v", stored)
+	}
+}
+
+func TestWorkerCancelsGenerationAtDeadline(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	provider := newBlockingProvider()
+	wp := NewWorkerPool(1, 10, []TextToImageProvider{provider}, tm)
+	wp.SetDeadlinePolicy(DeadlinePolicy{Base: 50 * time.Millisecond})
+	wp.Start()
+	defer wp.Stop()
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "never finishes"}, TaskOptions{})
+	wp.Submit(task)
+	<-provider.started
+
+	waitFor(t, "task to fail", func() bool {
+		stored, err := NewTaskManager(testDB).GetTask(task.ID)
+		return err == nil && stored.Status == TaskFailed
+	})
+	stored, _ := NewTaskManager(testDB).GetTask(task.ID)
+	if !strings.Contains(stored.ErrorMsg, "deadline exceeded") || stored.LeaseExpiresAt == nil {
+		t.Fatalf("expected deadline failure with a lease, got %+v", stored)
+	}
+}
@@ -0,0 +1,599 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// ======================
+// 远程 worker 协议
+// ======================
+//
+// 远程 worker（如 NAT 后的 GPU 主机）主动拉取任务，而不是由服务端推送：
+//   POST /api/v1/workers/lease                 声明能力并领取一个 QUEUED 任务（可长轮询），没有任务时返回 204
+//   GET  /api/v1/workers/tasks/{id}/input      读取任务的二进制输入（如音频）
+//   POST /api/v1/workers/tasks/{id}/heartbeat  刷新心跳，租约已失效时返回 409，worker 应放弃执行
+//   POST /api/v1/workers/tasks/{id}/result     上传结果（图片或 JSON output）
+//   POST /api/v1/workers/tasks/{id}/fail       报告失败，retryable 时按重试策略重新排队
+// 请求携带 Authorization: Bearer <REMOTE_WORKER_TOKEN> 和 X-Worker-ID。队列状态仍保存在 image_tasks 中，
+// 租约与本进程 worker 相同（attempts、heartbeat_at、lease_expires_at），worker 消失后由回收器处理。
+//
+
+const (
+	WorkerIDHeader = "X-Worker-ID"
+
+	defaultLeaseWait      = 25 * time.Second // 长轮询的最长等待，需小于代理的空闲超时
+	leasePollInterval     = 2 * time.Second  // 长轮询期间没有事件时重新查询的间隔
+	leaseCandidates       = 10               // 每次查询的候选任务数，领取时可能被其他 worker 抢先
+	maxWorkerResultSize   = 64 << 20
+	remoteWorkerActiveFor = time.Minute // 最近这段时间内有请求的 worker 视为在线
+)
+
+var workerIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// WorkerCapabilities 远程 worker 声明的能力，零值字段表示不限制
+type WorkerCapabilities struct {
+	Kinds     []string `json:"kinds,omitempty"`      // 可执行的任务类型，默认 image.generate
+	Models    []string `json:"models,omitempty"`     // worker 上可用的模型，为空时只领取没有指定模型的任务
+	MaxPixels int      `json:"max_pixels,omitempty"` // 单张图片的最大像素数（width × height）
+	MaxSteps  int      `json:"max_steps,omitempty"`  // 最大推理步数
+}
+
+// WorkerLeaseRequest 领取任务请求
+type WorkerLeaseRequest struct {
+	Capabilities WorkerCapabilities `json:"capabilities"`
+	WaitSeconds  int                `json:"wait_seconds,omitempty"` // 没有任务时最多等待的秒数（长轮询）
+}
+
+// WorkerLease 领取到的任务
+type WorkerLease struct {
+	TaskID  string          `json:"task_id"`
+	Kind    string          `json:"kind"`
+	Attempt int             `json:"attempt"` // 之后的心跳、结果和失败报告都需带上
+	Input   json.RawMessage `json:"input"`   // image.generate 为 TextToImageRequest
+	// HasBlob 任务有二进制输入，需通过 input 接口读取
+	HasBlob bool `json:"has_blob,omitempty"`
+	// Deadline 超过后应停止执行，结果不再被接受
+	Deadline                 time.Time `json:"deadline"`
+	HeartbeatIntervalSeconds int       `json:"heartbeat_interval_seconds"`
+}
+
+// WorkerHeartbeatRequest 心跳请求
+type WorkerHeartbeatRequest struct {
+	Attempt int `json:"attempt"`
+}
+
+// WorkerResultRequest 上传结果：image.generate 上传 image，其他类型上传 output
+type WorkerResultRequest struct {
+	Attempt    int             `json:"attempt"`
+	Image      []byte          `json:"image,omitempty"` // base64 编码的图片
+	MimeType   string          `json:"mime_type,omitempty"`
+	Model      string          `json:"model,omitempty"`
+	Backend    string          `json:"backend,omitempty"` // worker 调用的后端实例
+	DurationMs int64           `json:"duration_ms,omitempty"`
+	Output     json.RawMessage `json:"output,omitempty"`
+}
+
+// WorkerFailRequest 报告失败
+type WorkerFailRequest struct {
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error"`
+	// Retryable 失败与任务本身无关（如后端暂时不可用、worker 退出），可以交给其他 worker 重试
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// RemoteWorkerInfo 远程 worker 最近一次上报的状态
+type RemoteWorkerInfo struct {
+	ID           string             `json:"id"`
+	Capabilities WorkerCapabilities `json:"capabilities"`
+	Version      string             `json:"version,omitempty"`
+	LastSeenAt   time.Time          `json:"last_seen_at"`
+}
+
+// RemoteWorkerConfig 远程 worker 接口配置
+type RemoteWorkerConfig struct {
+	Token     string        // worker 共享令牌
+	LeaseWait time.Duration // 长轮询的最长等待
+	Retry     RetryPolicy   // worker 报告可重试失败时的重试策略
+}
+
+//
+// ======================
+// 远程 worker 持久化
+// ======================
+//
+
+// touchRemoteWorker 记录 worker 的能力和最近活动时间
+func (tm *TaskManager) touchRemoteWorker(id string, caps WorkerCapabilities, version string) error {
+	data, err := json.Marshal(caps)
+	if err != nil {
+		return fmt.Errorf("failed to encode worker capabilities: %w", err)
+	}
+	now := time.Now()
+	if _, err := tm.db.Exec(`
+		INSERT INTO remote_workers (id, capabilities, version, last_seen_at, created_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(id) DO UPDATE SET
+			capabilities = excluded.capabilities, version = excluded.version, last_seen_at = excluded.last_seen_at
+	`, id, string(data), version, now, now); err != nil {
+		return fmt.Errorf("failed to record remote worker: %w", err)
+	}
+	return nil
+}
+
+// markRemoteWorkerSeen 只刷新 worker 的最近活动时间
+func (tm *TaskManager) markRemoteWorkerSeen(id string) {
+	if _, err := tm.db.Exec("UPDATE remote_workers SET last_seen_at = ? WHERE id = ?", time.Now(), id); err != nil {
+		log.Printf("Failed to update remote worker %s: %v", id, err)
+	}
+}
+
+// ListRemoteWorkers 返回 since 之后有活动的远程 worker
+func (tm *TaskManager) ListRemoteWorkers(since time.Time) ([]RemoteWorkerInfo, error) {
+	rows, err := tm.db.Query(`
+		SELECT id, capabilities, version, last_seen_at
+		FROM remote_workers WHERE last_seen_at >= ? ORDER BY id
+	`, since)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list remote workers: %w", err)
+	}
+	defer rows.Close()
+
+	workers := []RemoteWorkerInfo{}
+	for rows.Next() {
+		var info RemoteWorkerInfo
+		var caps string
+		if err := rows.Scan(&info.ID, &caps, &info.Version, &info.LastSeenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan remote worker: %w", err)
+		}
+		_ = json.Unmarshal([]byte(caps), &info.Capabilities)
+		workers = append(workers, info)
+	}
+	return workers, rows.Err()
+}
+
+// leaseCandidates 返回符合 worker 能力的排队任务，按入队顺序排列
+func (tm *TaskManager) leaseCandidates(caps WorkerCapabilities, limit int) ([]*ImageTask, error) {
+	if len(caps.Kinds) == 0 {
+		return nil, nil
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(caps.Kinds)), ", ")
+	args := []interface{}{TaskQueued}
+	for _, kind := range caps.Kinds {
+		args = append(args, kind)
+	}
+	// 未指定尺寸和步数时按后端默认值（1024x1024、默认步数）判断
+	args = append(args, TaskKindImageGenerate,
+		caps.MaxPixels, referencePixels, caps.MaxPixels,
+		caps.MaxSteps, defaultInferenceSteps, caps.MaxSteps)
+	// 指定了模型的任务只交给声明了该模型的 worker
+	models := "model = ''"
+	if len(caps.Models) > 0 {
+		models += " OR model IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(caps.Models)), ", ") + ")"
+		for _, m := range caps.Models {
+			args = append(args, m)
+		}
+	}
+	args = append(args, limit)
+
+	rows, err := tm.db.Query(`
+		SELECT `+taskColumns+`
+		FROM image_tasks
+		WHERE status = ? AND attached_to = '' AND kind IN (`+placeholders+`)
+			AND (kind != ? OR (
+				(? = 0 OR (CASE WHEN width > 0 AND height > 0 THEN width * height ELSE ? END) <= ?)
+				AND (? = 0 OR (CASE WHEN steps > 0 THEN steps ELSE ? END) <= ?)
+				AND (`+models+`)))
+		ORDER BY created_at, rowid
+		LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load queued tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*ImageTask
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// hasTaskBlob 任务是否有二进制输入
+func (tm *TaskManager) hasTaskBlob(taskID string) bool {
+	var n int
+	err := tm.db.QueryRow("SELECT COUNT(*) FROM task_blobs WHERE task_id = ?", taskID).Scan(&n)
+	return err == nil && n > 0
+}
+
+//
+// ======================
+// RemoteWorkerHub - 远程 worker 接口
+// ======================
+//
+
+// RemoteWorkerHub 处理远程 worker 的领取、心跳和结果上报
+type RemoteWorkerHub struct {
+	taskManager *TaskManager
+	workerPool  *WorkerPool
+	cfg         RemoteWorkerConfig
+}
+
+// NewRemoteWorkerHub 创建远程 worker 接口；cfg 中的零值使用默认配置
+func NewRemoteWorkerHub(tm *TaskManager, wp *WorkerPool, cfg RemoteWorkerConfig) *RemoteWorkerHub {
+	if cfg.LeaseWait <= 0 {
+		cfg.LeaseWait = defaultLeaseWait
+	}
+	if cfg.Retry.MaxAttempts <= 0 {
+		cfg.Retry = DefaultRetryPolicy()
+	}
+	return &RemoteWorkerHub{taskManager: tm, workerPool: wp, cfg: cfg}
+}
+
+// Authenticate 校验 worker 令牌和 X-Worker-ID，通过后交给 next 处理
+func (hub *RemoteWorkerHub) Authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if hub.cfg.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(hub.cfg.Token)) != 1 {
+			errorResponse(w, http.StatusUnauthorized, "invalid worker token")
+			return
+		}
+		if !workerIDPattern.MatchString(r.Header.Get(WorkerIDHeader)) {
+			errorResponse(w, http.StatusBadRequest, "X-Worker-ID must be 1-64 letters, digits, '.', '_' or '-'")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// HandleLease 处理 POST /api/v1/workers/lease
+//
+//	@Summary		Lease a task (remote worker)
+//	@Description	Remote workers authenticate with the shared worker token (Authorization: Bearer) and X-Worker-ID, declare their capabilities and lease the oldest matching QUEUED task. With wait_seconds the request long-polls until a task is queued. Returns 204 when there is nothing to do or the worker pool is paused.
+//	@Tags			workers
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			X-Worker-ID	header		string				true	"Worker identifier"
+//	@Param			request		body		WorkerLeaseRequest	true	"Capabilities"
+//	@Success		200			{object}	WorkerLease
+//	@Success		204			"No task available"
+//	@Failure		400			{object}	map[string]string
+//	@Failure		401			{object}	map[string]string
+//	@Router			/api/v1/workers/lease [post]
+func (hub *RemoteWorkerHub) HandleLease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	workerID := r.Header.Get(WorkerIDHeader)
+
+	var req WorkerLeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	caps := req.Capabilities
+	if len(caps.Kinds) == 0 {
+		caps.Kinds = []string{TaskKindImageGenerate}
+	}
+	wait := time.Duration(req.WaitSeconds) * time.Second
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > hub.cfg.LeaseWait {
+		wait = hub.cfg.LeaseWait
+	}
+
+	if err := hub.taskManager.touchRemoteWorker(workerID, caps, r.UserAgent()); err != nil {
+		log.Printf("Remote worker %s: %v", workerID, err)
+	}
+
+	// 先订阅再查询，避免错过两者之间入队的任务
+	sub := hub.taskManager.Events().Subscribe(EventFilter{}, 0)
+	defer sub.Cancel()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(leasePollInterval)
+	defer ticker.Stop()
+
+	for {
+		var lease *WorkerLease
+		var err error
+		// 暂停期间不分配任务，但仍按长轮询等待，避免 worker 空转
+		if !hub.workerPool.Paused() {
+			lease, err = hub.leaseOne(workerID, caps)
+		}
+		if err != nil {
+			log.Printf("Remote worker %s: lease failed: %v", workerID, err)
+			errorResponse(w, http.StatusInternalServerError, "failed to lease task")
+			return
+		}
+		if lease != nil {
+			writeJSON(w, http.StatusOK, lease)
+			return
+		}
+		if !waitForQueuedTask(r.Context(), sub, timer.C, ticker.C) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+}
+
+// waitForQueuedTask 等待有任务入队或轮询间隔到达；等待结束或请求取消时返回 false
+func waitForQueuedTask(ctx context.Context, sub *Subscription, done, poll <-chan time.Time) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-done:
+			return false
+		case <-poll:
+			return true
+		case e := <-sub.Events:
+			if e.Type == TaskEventStatus && e.Status == TaskQueued {
+				return true
+			}
+		}
+	}
+}
+
+// leaseOne 为 worker 领取一个任务，没有可领取的任务时返回 nil
+func (hub *RemoteWorkerHub) leaseOne(workerID string, caps WorkerCapabilities) (*WorkerLease, error) {
+	tm := hub.taskManager
+	tasks, err := tm.leaseCandidates(caps, leaseCandidates)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, task := range tasks {
+		deadline := hub.workerPool.TaskDeadline(task)
+		if err := tm.startLease(task, deadline, workerID); err != nil {
+			if errors.Is(err, ErrLeaseLost) {
+				continue // 被其他 worker 抢先
+			}
+			return nil, err
+		}
+
+		input := task.Input
+		if task.Kind == TaskKindImageGenerate {
+			input, _ = json.Marshal(task.GenerationRequest())
+		}
+		log.Printf("Remote worker %s leased %s task %s (attempt %d)", workerID, task.Kind, task.ID, task.Attempts)
+		return &WorkerLease{
+			TaskID:                   task.ID,
+			Kind:                     task.Kind,
+			Attempt:                  task.Attempts,
+			Input:                    input,
+			HasBlob:                  tm.hasTaskBlob(task.ID),
+			Deadline:                 task.StartedAt.Add(deadline),
+			HeartbeatIntervalSeconds: int(heartbeatInterval / time.Second),
+		}, nil
+	}
+	return nil, nil
+}
+
+// HandleTask 处理 /api/v1/workers/tasks/{id}/{input|heartbeat|result|fail}
+//
+//	@Summary		Report on a leased task (remote worker)
+//	@Description	GET input downloads the task's binary input. POST heartbeat keeps the lease alive, POST result uploads the image (base64) or JSON output, POST fail reports an error; retryable failures are requeued while attempts remain. Every call carries the lease attempt; 409 means the lease was lost and the worker must drop the task.
+//	@Tags			workers
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			X-Worker-ID	header		string				true	"Worker identifier"
+//	@Param			id			path		string				true	"Task ID"
+//	@Param			action		path		string				true	"input, heartbeat, result or fail"
+//	@Param			attempt		query		int					false	"Lease attempt (input only)"
+//	@Param			request		body		WorkerResultRequest	false	"Result (result), WorkerHeartbeatRequest (heartbeat) or WorkerFailRequest (fail)"
+//	@Success		200			{object}	map[string]string
+//	@Failure		400			{object}	map[string]string
+//	@Failure		401			{object}	map[string]string
+//	@Failure		404			{object}	map[string]string
+//	@Failure		409			{object}	map[string]string	"Lease lost"
+//	@Failure		413			{object}	map[string]string
+//	@Router			/api/v1/workers/tasks/{id}/{action} [get]
+//	@Router			/api/v1/workers/tasks/{id}/{action} [post]
+func (hub *RemoteWorkerHub) HandleTask(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/workers/tasks/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+	taskID, action := parts[0], parts[1]
+
+	method := http.MethodPost
+	if action == "input" {
+		method = http.MethodGet
+	}
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	switch action {
+	case "input":
+		hub.handleInput(w, r, taskID)
+	case "heartbeat":
+		hub.handleHeartbeat(w, r, taskID)
+	case "result":
+		hub.handleResult(w, r, taskID)
+	case "fail":
+		hub.handleFail(w, r, taskID)
+	default:
+		errorResponse(w, http.StatusNotFound, "not found")
+	}
+}
+
+// leasedTask 返回 worker 第 attempt 次执行中的任务；租约已不属于该 worker 时写入 409 并返回 nil
+func (hub *RemoteWorkerHub) leasedTask(w http.ResponseWriter, r *http.Request, taskID string, attempt int) *ImageTask {
+	workerID := r.Header.Get(WorkerIDHeader)
+	hub.taskManager.markRemoteWorkerSeen(workerID)
+
+	task, err := hub.taskManager.GetTask(taskID)
+	if err != nil {
+		errorResponse(w, http.StatusNotFound, "task not found")
+		return nil
+	}
+	if task.WorkerID != workerID || !hub.taskManager.LeaseHeld(taskID, attempt) {
+		errorResponse(w, http.StatusConflict, ErrLeaseLost.Error())
+		return nil
+	}
+	return task
+}
+
+func (hub *RemoteWorkerHub) handleInput(w http.ResponseWriter, r *http.Request, taskID string) {
+	attempt, _ := strconv.Atoi(r.URL.Query().Get("attempt"))
+	if hub.leasedTask(w, r, taskID, attempt) == nil {
+		return
+	}
+
+	data, err := hub.taskManager.LoadTaskBlob(taskID)
+	if err != nil {
+		errorResponse(w, http.StatusNotFound, "task has no binary input")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
+func (hub *RemoteWorkerHub) handleHeartbeat(w http.ResponseWriter, r *http.Request, taskID string) {
+	var req WorkerHeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if hub.leasedTask(w, r, taskID, req.Attempt) == nil {
+		return
+	}
+
+	if err := hub.taskManager.Heartbeat(taskID, req.Attempt); err != nil {
+		if errors.Is(err, ErrLeaseLost) {
+			errorResponse(w, http.StatusConflict, err.Error())
+			return
+		}
+		errorResponse(w, http.StatusInternalServerError, "failed to record heartbeat")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": TaskRunning})
+}
+
+func (hub *RemoteWorkerHub) handleResult(w http.ResponseWriter, r *http.Request, taskID string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxWorkerResultSize)
+	var req WorkerResultRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			errorResponse(w, http.StatusRequestEntityTooLarge, "result is too large")
+			return
+		}
+		errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	task := hub.leasedTask(w, r, taskID, req.Attempt)
+	if task == nil {
+		return
+	}
+	workerID := r.Header.Get(WorkerIDHeader)
+
+	var err error
+	if task.Kind == TaskKindImageGenerate {
+		if len(req.Image) == 0 {
+			errorResponse(w, http.StatusBadRequest, "image is required")
+			return
+		}
+		result := GenerationResult{
+			ImageData: req.Image,
+			MimeType:  req.MimeType,
+			Backend:   "remote:" + workerID,
+			Model:     req.Model,
+			Duration:  time.Duration(req.DurationMs) * time.Millisecond,
+		}
+		if req.Backend != "" {
+			result.Backend += "/" + req.Backend
+		}
+		if result.MimeType == "" {
+			result.MimeType = http.DetectContentType(req.Image)
+		}
+		result.Width, result.Height = imageSize(req.Image, task.Width, task.Height)
+
+		hub.workerPool.Durations().Observe(result.Backend, result.Duration)
+		_, err = hub.taskManager.SaveGenerationResult(task, result)
+	} else {
+		if len(req.Output) > 0 && !json.Valid(req.Output) {
+			errorResponse(w, http.StatusBadRequest, "output must be valid JSON")
+			return
+		}
+		err = hub.taskManager.CompleteTask(task, req.Output)
+	}
+	if err != nil {
+		log.Printf("Remote worker %s: failed to save result of task %s: %v", workerID, taskID, err)
+		task.Status = TaskFailed
+		task.ErrorMsg = fmt.Sprintf("failed to save result: %v", err)
+		if err := hub.taskManager.UpdateTask(task); err != nil {
+			log.Printf("Remote worker %s: failed to mark task %s as failed: %v", workerID, taskID, err)
+		}
+		errorResponse(w, http.StatusInternalServerError, "failed to save result")
+		return
+	}
+
+	log.Printf("Remote worker %s completed task %s (attempt %d)", workerID, taskID, req.Attempt)
+	writeJSON(w, http.StatusOK, map[string]string{"status": task.Status, "result_url": task.ResultURL})
+}
+
+func (hub *RemoteWorkerHub) handleFail(w http.ResponseWriter, r *http.Request, taskID string) {
+	var req WorkerFailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	task := hub.leasedTask(w, r, taskID, req.Attempt)
+	if task == nil {
+		return
+	}
+	workerID := r.Header.Get(WorkerIDHeader)
+
+	detail := strings.TrimSpace(req.Error)
+	if detail == "" {
+		detail = "worker reported a failure"
+	}
+	reason := fmt.Sprintf("worker %s: %s", workerID, detail)
+
+	var err error
+	if req.Retryable && req.Attempt < hub.cfg.Retry.MaxAttempts {
+		runAt := time.Now().Add(time.Duration(req.Attempt) * hub.cfg.Retry.Backoff)
+		err = hub.taskManager.RequeueExpiredTask(task, req.Attempt, runAt, reason)
+	} else {
+		err = hub.taskManager.FailExpiredTask(task, req.Attempt, reason)
+	}
+	if err != nil {
+		if errors.Is(err, ErrLeaseLost) {
+			errorResponse(w, http.StatusConflict, err.Error())
+			return
+		}
+		errorResponse(w, http.StatusInternalServerError, "failed to record failure")
+		return
+	}
+
+	log.Printf("Remote worker %s failed task %s (attempt %d): %s", workerID, taskID, req.Attempt, detail)
+	writeJSON(w, http.StatusOK, map[string]string{"status": task.Status})
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// workerCall 以远程 worker 身份调用接口
+func workerCall(hub *RemoteWorkerHub, method, path, workerID string, body interface{}) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set(WorkerIDHeader, workerID)
+	rr := httptest.NewRecorder()
+
+	handler := hub.HandleTask
+	if path == "/api/v1/workers/lease" {
+		handler = hub.HandleLease
+	}
+	hub.Authenticate(handler)(rr, req)
+	return rr
+}
+
+func setupRemoteWorkers(t *testing.T) (*TaskManager, *WorkerPool, *RemoteWorkerHub, int64) {
+	t.Helper()
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	// 本进程没有文生图后端，图片任务只能由远程 worker 执行
+	wp := NewWorkerPool(1, 10, nil, tm)
+	wp.EnableRemoteWorkers()
+	hub := NewRemoteWorkerHub(tm, wp, RemoteWorkerConfig{
+		Token: "secret",
+		Retry: RetryPolicy{MaxAttempts: 2, Backoff: time.Minute},
+	})
+	return tm, wp, hub, userID
+}
+
+func TestRemoteWorkerLeaseAndResult(t *testing.T) {
+	tm, wp, hub, userID := setupRemoteWorkers(t)
+
+	big, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "huge", Width: 2048, Height: 2048}, TaskOptions{})
+	small, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "small", Width: 512, Height: 512, Seed: 5}, TaskOptions{})
+	for _, task := range []*ImageTask{big, small} {
+		if err := wp.Submit(task); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+	}
+	if wp.GetQueueLength() != 0 {
+		t.Fatal("expected tasks to stay in the database for remote workers")
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/workers/lease", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer wrong")
+	req.Header.Set(WorkerIDHeader, "gpu-1")
+	rr := httptest.NewRecorder()
+	hub.Authenticate(hub.HandleLease)(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a bad token, got %d", rr.Code)
+	}
+
+	// 只能处理 1024x1024 以内的 worker 跳过大图
+	caps := WorkerCapabilities{Models: []string{"qwen-image"}, MaxPixels: 1024 * 1024}
+	rr = workerCall(hub, http.MethodPost, "/api/v1/workers/lease", "gpu-1", WorkerLeaseRequest{Capabilities: caps})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected a lease, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var lease WorkerLease
+	json.Unmarshal(rr.Body.Bytes(), &lease)
+	var params TextToImageRequest
+	json.Unmarshal(lease.Input, &params)
+	if lease.TaskID != small.ID || lease.Attempt != 1 || params.Prompt != "small" || params.Seed != 5 || !lease.Deadline.After(time.Now()) {
+		t.Fatalf("unexpected lease: %+v", lease)
+	}
+	if rr := workerCall(hub, http.MethodPost, "/api/v1/workers/lease", "gpu-1", WorkerLeaseRequest{Capabilities: caps}); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected no matching task, got %d", rr.Code)
+	}
+
+	path := "/api/v1/workers/tasks/" + lease.TaskID
+	if rr := workerCall(hub, http.MethodPost, path+"/heartbeat", "gpu-2", WorkerHeartbeatRequest{Attempt: 1}); rr.Code != http.StatusConflict {
+		t.Fatalf("expected another worker's heartbeat to be rejected, got %d", rr.Code)
+	}
+	if rr := workerCall(hub, http.MethodPost, path+"/heartbeat", "gpu-1", WorkerHeartbeatRequest{Attempt: 1}); rr.Code != http.StatusOK {
+		t.Fatalf("expected heartbeat to succeed, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	rr = workerCall(hub, http.MethodPost, path+"/result", "gpu-1", WorkerResultRequest{
+		Attempt: 1, Image: []byte("png bytes"), MimeType: "image/png", Model: "qwen-image", DurationMs: 12000,
+	})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected result to be accepted, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	done, _ := NewTaskManager(tm.db).GetTask(small.ID)
+	if done.Status != TaskDone || done.ImageID == 0 || done.WorkerID != "gpu-1" {
+		t.Fatalf("expected task to be completed by gpu-1, got %+v", done)
+	}
+	var backend, model string
+	tm.db.QueryRow("SELECT backend_instance, model_name FROM images WHERE id = ?", done.ImageID).Scan(&backend, &model)
+	if backend != "remote:gpu-1" || model != "qwen-image" {
+		t.Fatalf("unexpected provenance: %q %q", backend, model)
+	}
+	if stats := wp.Durations().Stats(); len(stats) != 1 || stats[0].Backend != "remote:gpu-1" {
+		t.Fatalf("expected remote duration to be tracked, got %+v", stats)
+	}
+
+	workers, err := tm.ListRemoteWorkers(time.Now().Add(-time.Minute))
+	if err != nil || len(workers) != 1 || workers[0].ID != "gpu-1" || workers[0].Capabilities.MaxPixels != 1024*1024 {
+		t.Fatalf("unexpected workers: %+v (%v)", workers, err)
+	}
+}
+
+func TestRemoteWorkerLeasesByModel(t *testing.T) {
+	tm, wp, hub, userID := setupRemoteWorkers(t)
+
+	var ids []string
+	for _, model := range []string{"sdxl", "qwen-image", ""} {
+		task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "a red fox " + model, Model: model}, TaskOptions{})
+		if err := wp.Submit(task); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		ids = append(ids, task.ID)
+	}
+
+	lease := func(worker string, models ...string) string {
+		rr := workerCall(hub, http.MethodPost, "/api/v1/workers/lease", worker, WorkerLeaseRequest{Capabilities: WorkerCapabilities{Models: models}})
+		if rr.Code == http.StatusNoContent {
+			return ""
+		}
+		var l WorkerLease
+		json.Unmarshal(rr.Body.Bytes(), &l)
+		return l.TaskID
+	}
+	// 没有声明模型的 worker 只领取没有指定模型的任务
+	if got := lease("plain"); got != ids[2] {
+		t.Fatalf("expected the task without a model, got %q", got)
+	}
+	if got := lease("plain"); got != "" {
+		t.Fatalf("expected tasks with a model to be skipped, got %q", got)
+	}
+	if got := lease("qwen", "qwen-image"); got != ids[1] {
+		t.Fatalf("expected the qwen-image task, got %q", got)
+	}
+	if got := lease("sdxl", "sdxl", "qwen-image"); got != ids[0] {
+		t.Fatalf("expected the sdxl task, got %q", got)
+	}
+}
+
+func TestSubmitRoutesModelsToRemoteWorkers(t *testing.T) {
+	tm, wp, hub, userID := setupRemoteWorkers(t)
+	wp.balancer = newModelBalancer(t) // 本进程提供 small 和 large
+	h := NewAsyncAPIHandlers(wp, tm, nil)
+
+	submit := func(model string) int {
+		body, _ := json.Marshal(SubmitImageTaskRequest{Prompt: "a red fox", Model: model})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/image/async", bytes.NewReader(body))
+		req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		h.HandleSubmitImageTask(rr, req)
+		return rr.Code
+	}
+
+	if code := submit("sdxl"); code != http.StatusBadRequest {
+		t.Fatalf("expected an unknown model to be rejected, got %d", code)
+	}
+	// 声明了 sdxl 的 worker 上线后接受该模型，任务留给远程 worker
+	if rr := workerCall(hub, http.MethodPost, "/api/v1/workers/lease", "gpu-1",
+		WorkerLeaseRequest{Capabilities: WorkerCapabilities{Models: []string{"sdxl"}}}); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected nothing to lease, got %d", rr.Code)
+	}
+	if code := submit("sdxl"); code != http.StatusAccepted || wp.GetQueueLength() != 0 {
+		t.Fatalf("expected the sdxl task to wait for remote workers, got %d (queue %d)", code, wp.GetQueueLength())
+	}
+	if code := submit("small"); code != http.StatusAccepted || wp.GetQueueLength() != 1 {
+		t.Fatalf("expected the small task to run locally, got %d (queue %d)", code, wp.GetQueueLength())
+	}
+}
+
+func TestRemoteWorkerFailureRetriesThenFails(t *testing.T) {
+	tm, _, hub, userID := setupRemoteWorkers(t)
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "flaky"}, TaskOptions{})
+
+	rr := workerCall(hub, http.MethodPost, "/api/v1/workers/lease", "gpu-1", WorkerLeaseRequest{})
+	var lease WorkerLease
+	json.Unmarshal(rr.Body.Bytes(), &lease)
+
+	path := "/api/v1/workers/tasks/" + task.ID + "/fail"
+	if rr := workerCall(hub, http.MethodPost, path, "gpu-1", WorkerFailRequest{Attempt: lease.Attempt, Error: "CUDA out of memory", Retryable: true}); rr.Code != http.StatusOK {
+		t.Fatalf("expected failure to be recorded, got %d: %s", rr.Code, rr.Body.String())
+	}
+	stored, _ := NewTaskManager(tm.db).GetTask(task.ID)
+	if stored.Status != TaskScheduled || !strings.Contains(stored.ErrorMsg, "CUDA out of memory") {
+		t.Fatalf("expected retryable failure to be requeued, got %+v", stored)
+	}
+	// 旧租约的结果不再被接受
+	if rr := workerCall(hub, http.MethodPost, "/api/v1/workers/tasks/"+task.ID+"/result", "gpu-1", WorkerResultRequest{Attempt: 1, Image: []byte("late")}); rr.Code != http.StatusConflict {
+		t.Fatalf("expected stale result to be rejected, got %d", rr.Code)
+	}
+
+	// 调度器重新入队后第二次执行失败：达到最大次数
+	makeDue(t, tm, task.ID)
+	NewTaskScheduler(tm, hub.workerPool, time.Hour).RunDue()
+	rr = workerCall(hub, http.MethodPost, "/api/v1/workers/lease", "gpu-2", WorkerLeaseRequest{})
+	json.Unmarshal(rr.Body.Bytes(), &lease)
+	if lease.TaskID != task.ID || lease.Attempt != 2 {
+		t.Fatalf("expected the task to be leased again, got %+v", lease)
+	}
+	workerCall(hub, http.MethodPost, path, "gpu-2", WorkerFailRequest{Attempt: 2, Error: "still broken", Retryable: true})
+
+	failed, _ := NewTaskManager(tm.db).GetTask(task.ID)
+	if failed.Status != TaskFailed || failed.ErrorMsg != "worker gpu-2: still broken" {
+		t.Fatalf("expected task to fail after max attempts, got %+v", failed)
+	}
+	if entries, _ := tm.GetTaskAuditLog(task.ID); len(entries) != 2 || entries[0].Action != AuditActionRequeued || entries[1].Action != AuditActionFailed {
+		t.Fatalf("unexpected audit log: %+v", entries)
+	}
+}
+
+func TestRemoteWorkerLeaseLongPoll(t *testing.T) {
+	tm, wp, hub, userID := setupRemoteWorkers(t)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "arrives later"}, TaskOptions{})
+		wp.Submit(task)
+	}()
+
+	start := time.Now()
+	rr := workerCall(hub, http.MethodPost, "/api/v1/workers/lease", "gpu-1", WorkerLeaseRequest{WaitSeconds: 5})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the long poll to return the new task, got %d", rr.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the lease to be woken by the queued event, took %s", elapsed)
+	}
+}
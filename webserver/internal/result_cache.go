@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// ======================
+// 生成结果缓存
+// ======================
+//
+// 相同生成参数（提示词、负面提示词、步数、尺寸、种子）得到相同的指纹：
+//   - 已有相同指纹的图片时，新任务直接完成并标记 cache_hit
+//   - 相同指纹的任务仍在排队或运行时，新任务跟随该任务（attached_to），不再提交到后端
+//   - 是否复用、复用谁的结果由用户的缓存策略决定
+//
+
+const (
+	// CacheModeOff 总是重新生成
+	CacheModeOff = "off"
+	// CacheModeOwn 只复用自己的结果
+	CacheModeOwn = "own"
+	// CacheModeShared 也复用其他 shared 用户的结果，自己的结果也会被他们复用
+	CacheModeShared = "shared"
+
+	fingerprintVersion = "v1" // 指纹算法变化时递增，旧指纹自然失效
+)
+
+// CachePolicy 用户的结果缓存策略
+type CachePolicy struct {
+	Mode string `json:"mode"`
+	// IncludeUnseeded seed 为 0 时后端随机选择种子，默认不复用这类请求的结果
+	IncludeUnseeded bool `json:"include_unseeded"`
+	// MaxAgeSeconds 只复用该时间内生成的图片，0 表示不限制
+	MaxAgeSeconds int64 `json:"max_age_seconds"`
+}
+
+// DefaultCachePolicy 没有设置过策略的用户使用的默认策略
+func DefaultCachePolicy() CachePolicy {
+	return CachePolicy{Mode: CacheModeOwn}
+}
+
+// Validate 检查策略取值
+func (p CachePolicy) Validate() error {
+	switch p.Mode {
+	case CacheModeOff, CacheModeOwn, CacheModeShared:
+	default:
+		return fmt.Errorf("mode must be one of %s, %s, %s", CacheModeOff, CacheModeOwn, CacheModeShared)
+	}
+	if p.MaxAgeSeconds < 0 {
+		return errors.New("max_age_seconds must be non-negative")
+	}
+	return nil
+}
+
+// appliesTo 策略是否允许复用该任务的结果
+func (p CachePolicy) appliesTo(task *ImageTask) bool {
+	if p.Mode == CacheModeOff || task.Fingerprint == "" {
+		return false
+	}
+	return task.Seed != 0 || p.IncludeUnseeded
+}
+
+// GenerationFingerprint 计算生成参数的确定性指纹；未指定的步数按后端默认值归一化。
+// 指定了模型时模型也参与指纹，未指定模型的请求指纹与之前相同
+func GenerationFingerprint(params TextToImageRequest) string {
+	steps := params.Steps
+	if steps <= 0 {
+		steps = defaultInferenceSteps
+	}
+
+	fields := []interface{}{
+		fingerprintVersion,
+		strings.TrimSpace(params.Prompt),
+		strings.TrimSpace(params.NegativePrompt),
+		steps,
+		params.Width,
+		params.Height,
+		params.Seed,
+	}
+	if params.Model != "" {
+		fields = append(fields, params.Model)
+	}
+	canonical, _ := json.Marshal(fields)
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// GetCachePolicy 读取用户的缓存策略，没有设置时返回默认策略
+func (tm *TaskManager) GetCachePolicy(userID int64) (CachePolicy, error) {
+	var p CachePolicy
+	err := tm.db.QueryRow(`
+		SELECT mode, include_unseeded, max_age_seconds
+		FROM result_cache_policies WHERE user_id = ?
+	`, userID).Scan(&p.Mode, &p.IncludeUnseeded, &p.MaxAgeSeconds)
+	if err == sql.ErrNoRows {
+		return DefaultCachePolicy(), nil
+	}
+	if err != nil {
+		return CachePolicy{}, fmt.Errorf("failed to get cache policy: %w", err)
+	}
+	return p, nil
+}
+
+// SetCachePolicy 保存用户的缓存策略
+func (tm *TaskManager) SetCachePolicy(userID int64, p CachePolicy) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	_, err := tm.db.Exec(`
+		INSERT INTO result_cache_policies (user_id, mode, include_unseeded, max_age_seconds, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET
+			mode = excluded.mode,
+			include_unseeded = excluded.include_unseeded,
+			max_age_seconds = excluded.max_age_seconds,
+			updated_at = excluded.updated_at
+	`, userID, p.Mode, p.IncludeUnseeded, p.MaxAgeSeconds, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to save cache policy: %w", err)
+	}
+	return nil
+}
+
+// cacheOwnerScope 按策略限定可复用结果的所有者
+func cacheOwnerScope(column string, p CachePolicy, userID int64) (string, []interface{}) {
+	if p.Mode == CacheModeShared {
+		return fmt.Sprintf(`(%s = ? OR %s IN (SELECT user_id FROM result_cache_policies WHERE mode = ?))`, column, column),
+			[]interface{}{userID, CacheModeShared}
+	}
+	return column + " = ?", []interface{}{userID}
+}
+
+// ApplyResultCache 在任务提交到 worker pool 之前检查结果缓存。
+// 返回 true 表示任务已经由缓存完成或跟随了相同参数的任务，调用方不应再提交它。
+func (tm *TaskManager) ApplyResultCache(task *ImageTask) (bool, error) {
+	policy, err := tm.GetCachePolicy(task.UserID)
+	if err != nil {
+		return false, err
+	}
+	if !policy.appliesTo(task) {
+		return false, nil
+	}
+
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+
+	// 1. 已生成的图片
+	imageID, err := findCachedImage(tx, task, policy)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	if err == nil {
+		if err := completeFromImage(tx, task, imageID); err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, fmt.Errorf("failed to commit cache hit: %w", err)
+		}
+		snapshot.keep()
+		tm.storeAndPublish(task)
+		log.Printf("Task %s served from cached image %d", task.ID, task.ImageID)
+		return true, nil
+	}
+
+	// 2. 相同参数、仍在进行中的任务
+	parentID, parentStatus, err := findInflightTask(tx, task, policy)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	task.AttachedTo = parentID
+	task.Status = parentStatus
+	task.UpdatedAt = time.Now()
+	if err := tm.updateTask(tx, task, `attached_to = ?, updated_at = ?`, task.AttachedTo, task.UpdatedAt); err != nil {
+		return false, fmt.Errorf("failed to attach task: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit attach: %w", err)
+	}
+	snapshot.keep()
+	tm.storeAndPublish(task)
+	log.Printf("Task %s attached to identical task %s", task.ID, parentID)
+	return true, nil
+}
+
+// ResultReusable 判断相同参数的请求能否由结果缓存完成（已有图片或可跟随的进行中任务），用于准入控制前的预判
+func (tm *TaskManager) ResultReusable(userID int64, params TextToImageRequest) (bool, error) {
+	policy, err := tm.GetCachePolicy(userID)
+	if err != nil {
+		return false, err
+	}
+	probe := &ImageTask{UserID: userID, Seed: params.Seed, Fingerprint: GenerationFingerprint(params)}
+	if !policy.appliesTo(probe) {
+		return false, nil
+	}
+
+	if _, err := findCachedImage(tm.db, probe, policy); err != sql.ErrNoRows {
+		return err == nil, err
+	}
+	if _, _, err := findInflightTask(tm.db, probe, policy); err != sql.ErrNoRows {
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// rowQuerier *sql.DB 和 *sql.Tx 共有的单行查询
+type rowQuerier interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// findCachedImage 查找可复用的图片，优先复用自己的图片（不需要复制）；没有时返回 sql.ErrNoRows
+func findCachedImage(q rowQuerier, task *ImageTask, policy CachePolicy) (int64, error) {
+	scope, args := cacheOwnerScope("user_id", policy, task.UserID)
+	query := `SELECT id FROM images WHERE fingerprint = ? AND ` + scope
+	args = append([]interface{}{task.Fingerprint}, args...)
+	if policy.MaxAgeSeconds > 0 {
+		query += ` AND created_at >= ?`
+		args = append(args, time.Now().Add(-time.Duration(policy.MaxAgeSeconds)*time.Second))
+	}
+	query += ` ORDER BY user_id = ? DESC, id DESC LIMIT 1`
+	args = append(args, task.UserID)
+
+	var imageID int64
+	err := q.QueryRow(query, args...).Scan(&imageID)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to look up cached image: %w", err)
+	}
+	return imageID, err
+}
+
+// findInflightTask 查找相同参数、仍在排队或执行的任务；没有时返回 sql.ErrNoRows
+func findInflightTask(q rowQuerier, task *ImageTask, policy CachePolicy) (string, string, error) {
+	scope, args := cacheOwnerScope("user_id", policy, task.UserID)
+	var parentID, parentStatus string
+	err := q.QueryRow(`
+		SELECT id, status FROM image_tasks
+		WHERE fingerprint = ? AND status IN (?, ?) AND attached_to = '' AND id != ? AND `+scope+`
+		ORDER BY rowid LIMIT 1
+	`, append([]interface{}{task.Fingerprint, TaskQueued, TaskRunning, task.ID}, args...)...).Scan(&parentID, &parentStatus)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", fmt.Errorf("failed to look up running task: %w", err)
+	}
+	return parentID, parentStatus, err
+}
+
+// completeFromImage 用已有图片完成任务：同一用户直接引用，其他用户的图片复制一份到任务所有者名下
+func completeFromImage(tx *sql.Tx, task *ImageTask, imageID int64) error {
+	var owner int64
+	if err := tx.QueryRow("SELECT user_id FROM images WHERE id = ?", imageID).Scan(&owner); err != nil {
+		return fmt.Errorf("failed to load cached image: %w", err)
+	}
+
+	now := time.Now()
+	if owner != task.UserID {
+		steps := task.Steps
+		if steps <= 0 {
+			steps = defaultInferenceSteps
+		}
+		res, err := tx.Exec(`
+			INSERT INTO prompts (user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, task.UserID, task.Prompt, task.NegativePrompt, steps, task.Seed, now)
+		if err != nil {
+			return fmt.Errorf("failed to create prompt: %w", err)
+		}
+		promptID, err := res.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("failed to get prompt id: %w", err)
+		}
+
+		res, err = tx.Exec(`
+			INSERT INTO images (user_id, prompt_id, image_data, image_path, image_format, width, height,
+				mime_type, backend_instance, model_name, duration_ms, fingerprint, created_at)
+			SELECT ?, ?, image_data, image_path, image_format, width, height,
+				mime_type, backend_instance, model_name, duration_ms, fingerprint, ?
+			FROM images WHERE id = ?
+		`, task.UserID, promptID, now, imageID)
+		if err != nil {
+			return fmt.Errorf("failed to copy cached image: %w", err)
+		}
+		if imageID, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("failed to get image id: %w", err)
+		}
+	}
+
+	task.Status = TaskDone
+	task.ResultURL = fmt.Sprintf("/api/images/%d", imageID)
+	task.ImageID = imageID
+	task.Output = imageTaskOutput(imageID, task.ResultURL)
+	task.ErrorMsg = ""
+	task.CacheHit = true
+	task.UpdatedAt = now
+
+	if err := updateTaskRow(tx, task, `result_url = ?, image_id = ?, output = ?, error_msg = '', cache_hit = 1, updated_at = ?`,
+		task.ResultURL, task.ImageID, string(task.Output), task.UpdatedAt); err != nil {
+		return err
+	}
+
+	return enqueueTaskWebhooks(tx, task)
+}
+
+// syncAttachedTasks 把 parent 的状态同步给跟随它的任务，返回被更新的任务。
+// 父任务被取消时不连带取消跟随任务（它们可能属于其他用户），而是像 RequeueTask 一样解除跟随、交给调度器立即重新入队。
+// 状态表不允许的同步（如父任务重新排队后再次入队，跟随任务仍为 RUNNING）跳过，等父任务下一次变化
+func syncAttachedTasks(tx *sql.Tx, parent *ImageTask) ([]*ImageTask, error) {
+	rows, err := tx.Query(`
+		SELECT `+taskColumns+`
+		FROM image_tasks
+		WHERE attached_to = ? AND status NOT IN (?, ?, ?)
+	`, parent.ID, TaskDone, TaskFailed, TaskCancelled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load attached tasks: %w", err)
+	}
+	var attached []*ImageTask
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan attached task: %w", err)
+		}
+		attached = append(attached, task)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to load attached tasks: %w", err)
+	}
+
+	var updated []*ImageTask
+	for _, task := range attached {
+		if parent.Status == TaskCancelled {
+			if err := detachTask(tx, task, parent); err != nil {
+				return nil, err
+			}
+			updated = append(updated, task)
+			continue
+		}
+		if !CanTransition(task.Status, parent.Status) {
+			continue
+		}
+		updated = append(updated, task)
+
+		switch {
+		case parent.Status == TaskDone && parent.ImageID != 0:
+			if err := completeFromImage(tx, task, parent.ImageID); err != nil {
+				return nil, err
+			}
+		case parent.Status == TaskFailed:
+			task.Status = TaskFailed
+			task.ErrorMsg = parent.ErrorMsg
+			task.UpdatedAt = time.Now()
+			if err := updateTaskRow(tx, task, `error_msg = ?, updated_at = ?`, task.ErrorMsg, task.UpdatedAt); err != nil {
+				return nil, fmt.Errorf("failed to update attached task: %w", err)
+			}
+			if err := enqueueTaskWebhooks(tx, task); err != nil {
+				return nil, err
+			}
+		default:
+			task.Status = parent.Status
+			task.ResultURL = parent.ResultURL
+			task.UpdatedAt = time.Now()
+			if err := updateTaskRow(tx, task, `result_url = ?, updated_at = ?`, task.ResultURL, task.UpdatedAt); err != nil {
+				return nil, fmt.Errorf("failed to update attached task: %w", err)
+			}
+			if isTerminalStatus(task.Status) {
+				if err := enqueueTaskWebhooks(tx, task); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	return updated, nil
+}
+
+// detachTask 解除 task 对已取消的 parent 的跟随，改为立即调度的独立任务，并写入审计记录
+func detachTask(tx *sql.Tx, task, parent *ImageTask) error {
+	now := time.Now()
+	task.Status = TaskScheduled
+	task.RunAt = &now
+	task.ErrorMsg = ""
+	task.AttachedTo = ""
+	task.ResultURL = ""
+	task.UpdatedAt = now
+	if err := updateTaskRow(tx, task, `run_at = ?, error_msg = '', attached_to = '', result_url = '', updated_at = ?`,
+		task.RunAt, task.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to detach attached task: %w", err)
+	}
+	return insertAuditLog(tx, task.ID, AuditActionRequeued, "leader task "+parent.ID+" was cancelled", task.Attempts)
+}
+
+//
+// ======================
+// 缓存策略接口
+// ======================
+//
+
+// HandleCachePolicy 处理 GET/PUT /api/v1/cache/policy
+//
+//	@Summary		Get or update result cache policy
+//	@Description	GET returns the caller's result cache policy; PUT replaces it. mode is off, own or shared.
+//	@Tags			async-tasks
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			policy	body		CachePolicy	false	"New policy (PUT only)"
+//	@Success		200		{object}	CachePolicy
+//	@Failure		400		{object}	map[string]string
+//	@Failure		401		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/api/v1/cache/policy [get]
+//	@Router			/api/v1/cache/policy [put]
+func (h *AsyncAPIHandlers) HandleCachePolicy(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		policy, err := h.taskManager.GetCachePolicy(userID)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to get cache policy")
+			return
+		}
+		writeJSON(w, http.StatusOK, policy)
+
+	case http.MethodPut:
+		var policy CachePolicy
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if err := policy.Validate(); err != nil {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.taskManager.SetCachePolicy(userID, policy); err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to save cache policy")
+			return
+		}
+		writeJSON(w, http.StatusOK, policy)
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
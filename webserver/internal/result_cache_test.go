@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func addTaskUser(t *testing.T, tm *TaskManager, name string) int64 {
+	t.Helper()
+	res, err := tm.db.Exec("INSERT INTO users (username, password) VALUES (?, ?)", name, "hash")
+	if err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// generate 创建任务、检查缓存，未命中时模拟后端生成
+func generate(t *testing.T, tm *TaskManager, userID int64, params TextToImageRequest) *ImageTask {
+	t.Helper()
+	task, err := tm.CreateTask(userID, params, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	handled, err := tm.ApplyResultCache(task)
+	if err != nil {
+		t.Fatalf("ApplyResultCache: %v", err)
+	}
+	if !handled {
+		if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte(task.ID), MimeType: "image/png"}); err != nil {
+			t.Fatalf("SaveGenerationResult: %v", err)
+		}
+	}
+	return task
+}
+
+func TestGenerationFingerprintNormalizesDefaults(t *testing.T) {
+	a := GenerationFingerprint(TextToImageRequest{Prompt: " a fox ", Seed: 1})
+	b := GenerationFingerprint(TextToImageRequest{Prompt: "a fox", Seed: 1, Steps: defaultInferenceSteps})
+	if a != b {
+		t.Fatal("expected default steps and surrounding whitespace to be normalized")
+	}
+	if a == GenerationFingerprint(TextToImageRequest{Prompt: "a fox", Seed: 2}) {
+		t.Fatal("expected different seeds to produce different fingerprints")
+	}
+}
+
+func TestResultCacheHitReusesOwnImage(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	params := TextToImageRequest{Prompt: "a red fox", Seed: 7, Width: 512, Height: 512}
+
+	first := generate(t, tm, userID, params)
+	if first.CacheHit {
+		t.Fatal("first generation must not be a cache hit")
+	}
+
+	second := generate(t, tm, userID, params)
+	if !second.CacheHit || second.Status != TaskDone || second.ImageID != first.ImageID {
+		t.Fatalf("expected cache hit on image %d, got %+v", first.ImageID, second)
+	}
+
+	tm.cache = newTaskCache(0, 0) // 强制从数据库读取
+	stored, err := tm.GetTask(second.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if !stored.CacheHit || stored.ResultURL != first.ResultURL {
+		t.Fatalf("cache hit not persisted: %+v", stored)
+	}
+
+	// 未指定种子的请求默认不复用
+	unseeded := TextToImageRequest{Prompt: "a red fox"}
+	generate(t, tm, userID, unseeded)
+	if again := generate(t, tm, userID, unseeded); again.CacheHit {
+		t.Fatal("expected unseeded request to be generated again")
+	}
+
+	if err := tm.SetCachePolicy(userID, CachePolicy{Mode: CacheModeOff}); err != nil {
+		t.Fatalf("SetCachePolicy: %v", err)
+	}
+	if off := generate(t, tm, userID, params); off.CacheHit {
+		t.Fatal("expected cache to be bypassed when policy is off")
+	}
+}
+
+func TestResultCacheSharedCopiesImage(t *testing.T) {
+	testDB, alice := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	bob := addTaskUser(t, tm, "bob")
+	params := TextToImageRequest{Prompt: "a castle", Seed: 3}
+
+	original := generate(t, tm, alice, params)
+
+	// alice 没有开启共享，bob 不能复用她的结果
+	if err := tm.SetCachePolicy(bob, CachePolicy{Mode: CacheModeShared}); err != nil {
+		t.Fatalf("SetCachePolicy: %v", err)
+	}
+	if miss := generate(t, tm, bob, params); miss.CacheHit {
+		t.Fatal("expected no reuse of a non-shared user's image")
+	}
+
+	if err := tm.SetCachePolicy(alice, CachePolicy{Mode: CacheModeShared}); err != nil {
+		t.Fatalf("SetCachePolicy: %v", err)
+	}
+	carol := addTaskUser(t, tm, "carol")
+	if err := tm.SetCachePolicy(carol, CachePolicy{Mode: CacheModeShared}); err != nil {
+		t.Fatalf("SetCachePolicy: %v", err)
+	}
+	hit := generate(t, tm, carol, params)
+	if !hit.CacheHit || hit.ImageID == original.ImageID {
+		t.Fatalf("expected a copied image for carol, got %+v", hit)
+	}
+
+	var owner int64
+	var data []byte
+	if err := testDB.QueryRow("SELECT user_id, image_data FROM images WHERE id = ?", hit.ImageID).Scan(&owner, &data); err != nil {
+		t.Fatalf("failed to load copied image: %v", err)
+	}
+	if owner != carol || len(data) == 0 {
+		t.Fatalf("unexpected copied image owner=%d len=%d", owner, len(data))
+	}
+}
+
+func TestResultCacheAttachesToRunningTask(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	params := TextToImageRequest{Prompt: "a waterfall", Seed: 11}
+
+	parent, err := tm.CreateTask(userID, params, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	parent.Status = TaskRunning
+	if err := tm.UpdateTask(parent); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+
+	follower, err := tm.CreateTask(userID, params, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	handled, err := tm.ApplyResultCache(follower)
+	if err != nil || !handled {
+		t.Fatalf("expected follower to be attached: handled=%v err=%v", handled, err)
+	}
+	if follower.AttachedTo != parent.ID || follower.Status != TaskRunning {
+		t.Fatalf("unexpected follower state: %+v", follower)
+	}
+	if pos, _ := tm.QueuePosition(follower.ID); pos != 0 {
+		t.Fatalf("attached task must not occupy a queue position, got %d", pos)
+	}
+
+	imageID, err := tm.SaveGenerationResult(parent, GenerationResult{ImageData: []byte("x"), MimeType: "image/png"})
+	if err != nil {
+		t.Fatalf("SaveGenerationResult: %v", err)
+	}
+
+	done, err := tm.GetTask(follower.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if done.Status != TaskDone || !done.CacheHit || done.ImageID != imageID {
+		t.Fatalf("expected follower to finish with image %d, got %+v", imageID, done)
+	}
+}
+
+func TestResultCacheFailurePropagatesToAttached(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	params := TextToImageRequest{Prompt: "a volcano", Seed: 5}
+
+	parent, _ := tm.CreateTask(userID, params, TaskOptions{})
+	follower, _ := tm.CreateTask(userID, params, TaskOptions{})
+	if handled, err := tm.ApplyResultCache(follower); err != nil || !handled {
+		t.Fatalf("expected follower to be attached: handled=%v err=%v", handled, err)
+	}
+
+	parent.Status = TaskFailed
+	parent.ErrorMsg = "backend unavailable"
+	if err := tm.UpdateTask(parent); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+
+	tm.cache = newTaskCache(0, 0)
+	failed, err := tm.GetTask(follower.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if failed.Status != TaskFailed || failed.ErrorMsg != "backend unavailable" {
+		t.Fatalf("expected follower to fail with parent, got %+v", failed)
+	}
+}
+
+func TestResultCacheCancelDetachesAttached(t *testing.T) {
+	testDB, alice := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	params := TextToImageRequest{Prompt: "a glacier", Seed: 13}
+
+	bob := addTaskUser(t, tm, "bob")
+	for _, userID := range []int64{alice, bob} {
+		if err := tm.SetCachePolicy(userID, CachePolicy{Mode: CacheModeShared}); err != nil {
+			t.Fatalf("SetCachePolicy: %v", err)
+		}
+	}
+	parent, _ := tm.CreateTask(alice, params, TaskOptions{})
+	follower, _ := tm.CreateTask(bob, params, TaskOptions{})
+	if handled, err := tm.ApplyResultCache(follower); err != nil || !handled || follower.AttachedTo != parent.ID {
+		t.Fatalf("expected bob's task to attach to alice's: handled=%v err=%v", handled, err)
+	}
+
+	if err := tm.CancelTask(parent, "cancelled by alice"); err != nil {
+		t.Fatalf("CancelTask: %v", err)
+	}
+
+	tm.cache = newTaskCache(0, 0)
+	detached, err := tm.GetTask(follower.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if detached.Status != TaskScheduled || detached.AttachedTo != "" || detached.ErrorMsg != "" || detached.RunAt == nil {
+		t.Fatalf("expected bob's task to be detached and rescheduled, got %+v", detached)
+	}
+	entries, err := tm.GetTaskAuditLog(follower.ID)
+	if err != nil || len(entries) != 1 || entries[0].Action != AuditActionRequeued {
+		t.Fatalf("expected a requeued audit entry, got %+v err=%v", entries, err)
+	}
+}
+
+func TestHandleSubmitImageTaskReportsCacheHit(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(0, 10, nil, tm)
+	h := NewAsyncAPIHandlers(wp, tm, nil)
+
+	submit := func() SubmitImageTaskResponse {
+		body, _ := json.Marshal(SubmitImageTaskRequest{Prompt: "a lighthouse", Seed: 9})
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/image/async", bytes.NewReader(body))
+		req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		h.HandleSubmitImageTask(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var resp SubmitImageTaskResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		return resp
+	}
+
+	first := submit()
+	if first.CacheHit || wp.GetQueueLength() != 1 {
+		t.Fatalf("expected first submission to be queued, got %+v", first)
+	}
+	queued := <-wp.taskQueue
+	if _, err := tm.SaveGenerationResult(queued, GenerationResult{ImageData: []byte("x"), MimeType: "image/png"}); err != nil {
+		t.Fatalf("SaveGenerationResult: %v", err)
+	}
+
+	second := submit()
+	if !second.CacheHit || second.Status != TaskDone || second.ResultURL == "" || wp.GetQueueLength() != 0 {
+		t.Fatalf("expected cache hit without queuing, got %+v", second)
+	}
+}
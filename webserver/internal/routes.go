@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// registerAsyncAPIRoutes 注册异步任务系统的路由，在 main() 中初始化 mux 之后调用
+func registerAsyncAPIRoutes(mux *http.ServeMux) {
+	// 文生图异步接口
+	mux.HandleFunc("/api/v1/image/async", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(idempotencyMiddleware(globalAsyncAPI.HandleSubmitImageTask))(w, r)
+	})
+
+	// 文生图模型目录
+	mux.HandleFunc("/api/v1/models", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleListModels)(w, r)
+	})
+
+	// 任务查询接口
+	mux.HandleFunc("/api/v1/tasks", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("task_id") != "" {
+				globalAsyncAPI.HandleGetTaskStatus(w, r)
+			} else {
+				globalAsyncAPI.HandleGetUserTasks(w, r)
+			}
+		})(w, r)
+	})
+
+	// /api/v1/tasks/events、/api/v1/tasks/{id}/events、/api/v1/tasks/{id}
+	mux.HandleFunc("/api/v1/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			rest := strings.TrimPrefix(r.URL.Path, "/api/v1/tasks/")
+			switch {
+			case rest == "events":
+				globalAsyncAPI.HandleUserTaskEvents(w, r)
+			case strings.HasSuffix(rest, "/events"):
+				globalAsyncAPI.HandleTaskEvents(w, r)
+			case rest != "" && !strings.Contains(rest, "/"):
+				setQueryParam(r, "task_id", rest)
+				globalAsyncAPI.HandleGetTaskStatus(w, r)
+			default:
+				errorResponse(w, http.StatusNotFound, "not found")
+			}
+		})(w, r)
+	})
+
+	// 计划任务
+	mux.HandleFunc("/api/v1/schedules", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleScheduledTasks)(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/schedules/", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleScheduledTask)(w, r)
+	})
+
+	// 任务流水线
+	mux.HandleFunc("/api/v1/pipelines", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(idempotencyMiddleware(globalAsyncAPI.HandlePipelines))(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/pipelines/", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandlePipeline)(w, r)
+	})
+
+	// 结果缓存策略
+	mux.HandleFunc("/api/v1/cache/policy", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleCachePolicy)(w, r)
+	})
+
+	// Webhook 管理接口
+	mux.HandleFunc("/api/v1/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleWebhooks)(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/webhooks/", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleWebhook)(w, r)
+	})
+
+	// 语音转文字接口
+	mux.HandleFunc("/api/v1/speech/transcribe", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleSpeechToText)(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/speech/pcm", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleSpeechToTextPCM)(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/speech/async", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleSubmitSpeechTask)(w, r)
+	})
+
+	// 远程 worker 接口：使用 worker 令牌认证，不经过用户登录
+	mux.HandleFunc("/api/v1/workers/lease", func(w http.ResponseWriter, r *http.Request) {
+		if globalRemoteWorkers == nil {
+			errorResponse(w, http.StatusNotFound, "remote workers are not enabled")
+			return
+		}
+		globalRemoteWorkers.Authenticate(globalRemoteWorkers.HandleLease)(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/workers/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		if globalRemoteWorkers == nil {
+			errorResponse(w, http.StatusNotFound, "remote workers are not enabled")
+			return
+		}
+		globalRemoteWorkers.Authenticate(globalRemoteWorkers.HandleTask)(w, r)
+	})
+
+	// 管理员接口：跨用户的任务运维和 worker 控制
+	mux.HandleFunc("/api/v1/admin/tasks", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAdminAPI.RequireAdmin(globalAdminAPI.HandleTasks))(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/admin/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAdminAPI.RequireAdmin(globalAdminAPI.HandleTask))(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/admin/workers", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAdminAPI.RequireAdmin(globalAdminAPI.HandleWorkers))(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/admin/workers/", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAdminAPI.RequireAdmin(globalAdminAPI.HandleWorkers))(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/admin/backends", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAdminAPI.RequireAdmin(globalAdminAPI.HandleBackends))(w, r)
+	})
+
+	mux.HandleFunc("/api/v1/admin/backends/", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAdminAPI.RequireAdmin(globalAdminAPI.HandleBackend))(w, r)
+	})
+
+	// 系统监控接口
+	mux.HandleFunc("/api/v1/system/stats", func(w http.ResponseWriter, r *http.Request) {
+		authMiddleware(globalAsyncAPI.HandleSystemStats)(w, r)
+	})
+}
+
+// setQueryParam 把路径参数写回查询字符串，复用按 query 取参数的 handler
+func setQueryParam(r *http.Request, key, value string) {
+	q := r.URL.Query()
+	q.Set(key, value)
+	r.URL.RawQuery = q.Encode()
+}
@@ -0,0 +1,558 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 计划任务
+// ======================
+//
+// 提交时带 run_at（RFC 3339）或 cron 的任务以 SCHEDULED 状态保存在 image_tasks 中：
+//   - 一次性任务到期后转为 QUEUED 并提交到 worker pool
+//   - 周期任务作为模板保持 SCHEDULED，每次触发时复制出一个新任务（schedule_id 指向模板）并推进 run_at
+// 所有状态都在数据库中，服务重启后调度器会继续处理到期的任务。
+//
+
+const (
+	defaultSchedulerInterval = 15 * time.Second // 扫描到期任务的间隔
+	schedulerBatchSize       = 100              // 每轮最多处理的到期任务数
+	schedulerRetryDelay      = 30 * time.Second // 队列已满时重新调度的延迟
+)
+
+// ErrTaskNotScheduled 任务已经入队、执行或被取消，不能再修改计划
+var ErrTaskNotScheduled = errors.New("task is no longer scheduled")
+
+// TaskSubmitter 接收到期任务的执行队列，由 WorkerPool 实现
+type TaskSubmitter interface {
+	Submit(task *ImageTask) error
+}
+
+// parseScheduleTime 解析 run_at；cron 非空时校验表达式。两者都为空返回零值表示立即执行
+func parseScheduleTime(runAt, cron string, now time.Time) (time.Time, error) {
+	if runAt != "" && cron != "" {
+		return time.Time{}, errors.New("run_at and cron are mutually exclusive")
+	}
+	if cron != "" {
+		schedule, err := ParseCron(cron)
+		if err != nil {
+			return time.Time{}, err
+		}
+		next := schedule.Next(now)
+		if next.IsZero() {
+			return time.Time{}, fmt.Errorf("cron expression %q never fires", cron)
+		}
+		return next, nil
+	}
+	if runAt == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, runAt)
+	if err != nil {
+		return time.Time{}, errors.New("run_at must be an RFC 3339 timestamp")
+	}
+	if !t.After(now) {
+		return time.Time{}, errors.New("run_at must be in the future")
+	}
+	return t, nil
+}
+
+// DueScheduledTasks 返回 run_at 已到期的计划任务，按到期时间排序
+func (tm *TaskManager) DueScheduledTasks(now time.Time, limit int) ([]*ImageTask, error) {
+	rows, err := tm.db.Query(`
+		SELECT `+taskColumns+`
+		FROM image_tasks
+		WHERE status = ? AND run_at <= ?
+		ORDER BY run_at
+		LIMIT ?
+	`, TaskScheduled, now, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scheduled tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []*ImageTask
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// ListScheduledTasks 返回用户所有仍在等待的计划任务和周期任务
+func (tm *TaskManager) ListScheduledTasks(userID int64) ([]*ImageTask, error) {
+	rows, err := tm.db.Query(`
+		SELECT `+taskColumns+`
+		FROM image_tasks
+		WHERE user_id = ? AND status = ?
+		ORDER BY run_at
+	`, userID, TaskScheduled)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scheduled tasks: %w", err)
+	}
+	defer rows.Close()
+
+	tasks := []*ImageTask{}
+	for rows.Next() {
+		task, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, rows.Err()
+}
+
+// transitionScheduled 只在任务仍为读取时的 SCHEDULED 快照时更新（set 同 updateTaskRow），避免和调度器或其他请求竞争；
+// 任务已不是 SCHEDULED 时返回 ErrTaskNotScheduled，仍为 SCHEDULED 但已被修改时返回 ErrVersionConflict
+func (tm *TaskManager) transitionScheduled(task *ImageTask, set string, args ...interface{}) error {
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+
+	if err := tm.updateTask(tx, task, set, args...); err != nil {
+		var te *TransitionError
+		if (errors.As(err, &te) && te.From != TaskScheduled) || errors.Is(err, ErrTaskNotFound) {
+			return ErrTaskNotScheduled
+		}
+		return err
+	}
+
+	if isTerminalStatus(task.Status) {
+		if err := enqueueTaskWebhooks(tx, task); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update scheduled task: %w", err)
+	}
+	snapshot.keep()
+
+	tm.storeAndPublish(task)
+	if task.Status == TaskQueued {
+		tm.publishQueuePositions()
+	}
+	return nil
+}
+
+// ActivateScheduledTask 把到期的一次性任务转为 QUEUED
+func (tm *TaskManager) ActivateScheduledTask(task *ImageTask) error {
+	task.Status = TaskQueued
+	task.UpdatedAt = time.Now()
+	return tm.transitionScheduled(task, `updated_at = ?`, task.UpdatedAt)
+}
+
+// RescheduleTask 把已入队但提交失败的任务放回 SCHEDULED，runAt 后重试
+func (tm *TaskManager) RescheduleTask(task *ImageTask, runAt time.Time) error {
+	if task.Status != TaskQueued {
+		return fmt.Errorf("%w: task %s is %s", ErrIllegalTransition, task.ID, task.Status)
+	}
+	task.Status = TaskScheduled
+	task.RunAt = &runAt
+	task.UpdatedAt = time.Now()
+
+	if err := tm.updateTask(tm.db, task, `run_at = ?, updated_at = ?`, task.RunAt, task.UpdatedAt); err != nil {
+		return fmt.Errorf("failed to reschedule task: %w", err)
+	}
+	tm.storeAndPublish(task)
+	return nil
+}
+
+// AdvanceSchedule 周期任务触发后推进到下一次触发时间
+func (tm *TaskManager) AdvanceSchedule(task *ImageTask, next time.Time) error {
+	task.RunAt = &next
+	task.UpdatedAt = time.Now()
+	return tm.transitionScheduled(task, `run_at = ?, updated_at = ?`, task.RunAt, task.UpdatedAt)
+}
+
+// UpdateScheduledTask 保存修改后的计划任务（生成参数、run_at、cron）
+func (tm *TaskManager) UpdateScheduledTask(task *ImageTask) error {
+	task.Fingerprint = GenerationFingerprint(task.GenerationRequest())
+	task.UpdatedAt = time.Now()
+	return tm.transitionScheduled(task, `
+		prompt = ?, model = ?, negative_prompt = ?, steps = ?, seed = ?, width = ?, height = ?,
+		fingerprint = ?, run_at = ?, cron_expr = ?, updated_at = ?`,
+		task.Prompt, task.Model, task.NegativePrompt, task.Steps, task.Seed, task.Width, task.Height,
+		task.Fingerprint, task.RunAt, task.Cron, task.UpdatedAt)
+}
+
+// CancelScheduledTask 取消计划任务；周期任务取消后不再产生新任务
+func (tm *TaskManager) CancelScheduledTask(task *ImageTask, reason string) error {
+	task.Status = TaskCancelled
+	task.ErrorMsg = reason
+	task.UpdatedAt = time.Now()
+	return tm.transitionScheduled(task, `error_msg = ?, updated_at = ?`, task.ErrorMsg, task.UpdatedAt)
+}
+
+//
+// ======================
+// TaskScheduler - 到期任务调度
+// ======================
+//
+
+// TaskScheduler 定期把到期的计划任务提交到执行队列
+type TaskScheduler struct {
+	taskManager *TaskManager
+	submitter   TaskSubmitter
+	interval    time.Duration
+	retryDelay  time.Duration
+	kick        chan struct{}
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+}
+
+// NewTaskScheduler 创建调度器，interval <= 0 时使用默认扫描间隔
+func NewTaskScheduler(tm *TaskManager, submitter TaskSubmitter, interval time.Duration) *TaskScheduler {
+	if interval <= 0 {
+		interval = defaultSchedulerInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TaskScheduler{
+		taskManager: tm,
+		submitter:   submitter,
+		interval:    interval,
+		retryDelay:  schedulerRetryDelay,
+		kick:        make(chan struct{}, 1),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// Start 启动调度循环；启动时立即处理停机期间到期的任务
+func (s *TaskScheduler) Start() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.RunDue()
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			case <-s.kick:
+			}
+		}
+	}()
+
+	log.Printf("Task scheduler started (interval: %s)", s.interval)
+}
+
+// Stop 停止调度，未到期的任务保留在数据库中
+func (s *TaskScheduler) Stop() {
+	s.cancel()
+	s.wg.Wait()
+	log.Println("Task scheduler stopped")
+}
+
+// Notify 唤醒调度循环（非阻塞）
+func (s *TaskScheduler) Notify() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// RunDue 处理所有到期的计划任务，返回处理的数量
+func (s *TaskScheduler) RunDue() int {
+	now := time.Now()
+	due, err := s.taskManager.DueScheduledTasks(now, schedulerBatchSize)
+	if err != nil {
+		log.Printf("Scheduler: %v", err)
+		return 0
+	}
+
+	for _, task := range due {
+		if s.ctx.Err() != nil {
+			break
+		}
+		if task.Cron != "" {
+			s.fireRecurring(task, now)
+		} else {
+			s.fireOnce(task)
+		}
+	}
+	return len(due)
+}
+
+// fireOnce 一次性任务到期：转为 QUEUED 并提交
+func (s *TaskScheduler) fireOnce(task *ImageTask) {
+	if err := s.taskManager.ActivateScheduledTask(task); err != nil {
+		if !errors.Is(err, ErrTaskNotScheduled) {
+			log.Printf("Scheduler: failed to activate task %s: %v", task.ID, err)
+		}
+		return
+	}
+	s.dispatch(task)
+}
+
+// fireRecurring 周期任务到期：复制出一个新任务提交，并推进到下一次触发时间。
+// 停机期间错过的多次触发只补一次。
+func (s *TaskScheduler) fireRecurring(tmpl *ImageTask, now time.Time) {
+	schedule, err := ParseCron(tmpl.Cron)
+	if err != nil {
+		log.Printf("Scheduler: task %s has invalid cron %q: %v", tmpl.ID, tmpl.Cron, err)
+		_ = s.taskManager.CancelScheduledTask(tmpl, fmt.Sprintf("invalid cron expression: %v", err))
+		return
+	}
+
+	next := schedule.Next(now)
+	if next.IsZero() {
+		_ = s.taskManager.CancelScheduledTask(tmpl, "cron expression never fires again")
+		return
+	}
+	// 先推进模板，避免重复触发
+	if err := s.taskManager.AdvanceSchedule(tmpl, next); err != nil {
+		if !errors.Is(err, ErrTaskNotScheduled) {
+			log.Printf("Scheduler: failed to advance schedule %s: %v", tmpl.ID, err)
+		}
+		return
+	}
+
+	run, err := s.taskManager.CreateTask(tmpl.UserID, tmpl.GenerationRequest(), TaskOptions{
+		CallbackURL: tmpl.CallbackURL,
+		ScheduleID:  tmpl.ID,
+	})
+	if err != nil {
+		log.Printf("Scheduler: failed to create run for schedule %s: %v", tmpl.ID, err)
+		return
+	}
+	s.dispatch(run)
+}
+
+// dispatch 提交一个 QUEUED 任务；结果缓存命中时不占用后端，队列已满时稍后重试
+func (s *TaskScheduler) dispatch(task *ImageTask) {
+	handled, err := s.taskManager.ApplyResultCache(task)
+	if err != nil {
+		log.Printf("Scheduler: result cache lookup for task %s failed: %v", task.ID, err)
+	}
+	if handled {
+		return
+	}
+
+	if err := s.submitter.Submit(task); err != nil {
+		retryAt := time.Now().Add(s.retryDelay)
+		log.Printf("Scheduler: failed to submit task %s, retrying at %s: %v", task.ID, retryAt.Format(time.RFC3339), err)
+		if err := s.taskManager.RescheduleTask(task, retryAt); err != nil {
+			log.Printf("Scheduler: %v", err)
+		}
+	}
+}
+
+//
+// ======================
+// 计划任务管理接口
+// ======================
+//
+
+// UpdateScheduledTaskRequest 修改计划任务请求，只修改出现的字段
+type UpdateScheduledTaskRequest struct {
+	Prompt         *string `json:"prompt,omitempty"`
+	Model          *string `json:"model,omitempty"` // 空字符串表示不再指定模型
+	NegativePrompt *string `json:"negative_prompt,omitempty"`
+	Steps          *int    `json:"steps,omitempty"`
+	Seed           *int64  `json:"seed,omitempty"`
+	Width          *int    `json:"width,omitempty"`
+	Height         *int    `json:"height,omitempty"`
+	RunAt          *string `json:"run_at,omitempty"` // RFC 3339，设置后任务变为一次性任务
+	Cron           *string `json:"cron,omitempty"`   // 设置后任务变为周期任务
+}
+
+// HandleScheduledTasks 处理 GET /api/v1/schedules
+//
+//	@Summary		List scheduled tasks
+//	@Description	List the caller's tasks that are still waiting for run_at or a cron firing
+//	@Tags			async-tasks
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Success		200	{array}		ImageTask
+//	@Failure		401	{object}	map[string]string
+//	@Failure		500	{object}	map[string]string
+//	@Router			/api/v1/schedules [get]
+func (h *AsyncAPIHandlers) HandleScheduledTasks(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	tasks, err := h.taskManager.ListScheduledTasks(userID)
+	if err != nil {
+		errorResponse(w, http.StatusInternalServerError, "failed to list scheduled tasks")
+		return
+	}
+	writeJSON(w, http.StatusOK, tasks)
+}
+
+// HandleScheduledTask 处理 GET/PUT/DELETE /api/v1/schedules/{id}
+//
+//	@Summary		Get, edit or cancel a scheduled task
+//	@Description	GET returns the task, PUT edits generation parameters, run_at or cron, DELETE cancels it. Only SCHEDULED tasks can be edited or cancelled.
+//	@Tags			async-tasks
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		string						true	"Task ID"
+//	@Param			request	body		UpdateScheduledTaskRequest	false	"Fields to change (PUT only)"
+//	@Success		200		{object}	ImageTask
+//	@Failure		400		{object}	map[string]string
+//	@Failure		401		{object}	map[string]string
+//	@Failure		403		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		409		{object}	map[string]string
+//	@Router			/api/v1/schedules/{id} [get]
+//	@Router			/api/v1/schedules/{id} [put]
+//	@Router			/api/v1/schedules/{id} [delete]
+func (h *AsyncAPIHandlers) HandleScheduledTask(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	taskID := strings.TrimPrefix(r.URL.Path, "/api/v1/schedules/")
+	if taskID == "" || strings.Contains(taskID, "/") {
+		errorResponse(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	task, err := h.taskManager.GetTask(taskID)
+	if err != nil {
+		errorResponse(w, http.StatusNotFound, "task not found")
+		return
+	}
+	if task.UserID != userID {
+		errorResponse(w, http.StatusForbidden, "access denied")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, task)
+
+	case http.MethodPut:
+		var req UpdateScheduledTaskRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+
+		// task 是快照副本，修改失败不会影响缓存
+		if err := applyScheduleUpdate(task, req, time.Now()); err != nil {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.checkModel(task.GenerationRequest()); err != nil {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := h.taskManager.UpdateScheduledTask(task); err != nil {
+			if errors.Is(err, ErrTaskNotScheduled) || errors.Is(err, ErrVersionConflict) {
+				errorResponse(w, http.StatusConflict, err.Error())
+				return
+			}
+			errorResponse(w, http.StatusInternalServerError, "failed to update scheduled task")
+			return
+		}
+		writeJSON(w, http.StatusOK, task)
+
+	case http.MethodDelete:
+		if err := h.taskManager.CancelScheduledTask(task, "cancelled by user"); err != nil {
+			if errors.Is(err, ErrTaskNotScheduled) || errors.Is(err, ErrVersionConflict) {
+				errorResponse(w, http.StatusConflict, err.Error())
+				return
+			}
+			errorResponse(w, http.StatusInternalServerError, "failed to cancel scheduled task")
+			return
+		}
+		writeJSON(w, http.StatusOK, task)
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPut+", "+http.MethodDelete)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// applyScheduleUpdate 把修改请求合并到任务上并校验
+func applyScheduleUpdate(task *ImageTask, req UpdateScheduledTaskRequest, now time.Time) error {
+	if task.Status != TaskScheduled {
+		return ErrTaskNotScheduled
+	}
+
+	if req.Prompt != nil {
+		task.Prompt = *req.Prompt
+	}
+	if req.Model != nil {
+		task.Model = *req.Model
+	}
+	if req.NegativePrompt != nil {
+		task.NegativePrompt = *req.NegativePrompt
+	}
+	if req.Steps != nil {
+		task.Steps = *req.Steps
+	}
+	if req.Seed != nil {
+		task.Seed = *req.Seed
+	}
+	if req.Width != nil {
+		task.Width = *req.Width
+	}
+	if req.Height != nil {
+		task.Height = *req.Height
+	}
+	if task.Prompt == "" {
+		return errors.New("prompt is required")
+	}
+	if task.Steps < 0 || task.Width < 0 || task.Height < 0 {
+		return errors.New("steps, width and height must be non-negative")
+	}
+
+	if req.RunAt != nil || req.Cron != nil {
+		var runAt, cron string
+		if req.RunAt != nil {
+			runAt = *req.RunAt
+		}
+		if req.Cron != nil {
+			cron = *req.Cron
+		}
+		next, err := parseScheduleTime(runAt, cron, now)
+		if err != nil {
+			return err
+		}
+		if next.IsZero() {
+			return errors.New("run_at or cron is required")
+		}
+		task.RunAt = &next
+		task.Cron = cron
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSubmitter 记录提交的任务，full 为 true 时模拟队列已满
+type recordingSubmitter struct {
+	mu    sync.Mutex
+	full  bool
+	tasks []*ImageTask
+}
+
+func (s *recordingSubmitter) Submit(task *ImageTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.full {
+		return errors.New("task queue is full")
+	}
+	s.tasks = append(s.tasks, task)
+	return nil
+}
+
+func (s *recordingSubmitter) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tasks)
+}
+
+// makeDue 把计划任务的 run_at 拨到过去
+func makeDue(t *testing.T, tm *TaskManager, taskID string) {
+	t.Helper()
+	if _, err := tm.db.Exec("UPDATE image_tasks SET run_at = ? WHERE id = ?", time.Now().Add(-time.Minute), taskID); err != nil {
+		t.Fatalf("failed to move run_at: %v", err)
+	}
+}
+
+func TestSchedulerQueuesOneShotTaskWhenDue(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	submitter := &recordingSubmitter{}
+	s := NewTaskScheduler(tm, submitter, time.Hour)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "night sky"}, TaskOptions{RunAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if task.Status != TaskScheduled || task.RunAt == nil {
+		t.Fatalf("expected SCHEDULED task with run_at, got %+v", task)
+	}
+	if pos, _ := tm.QueuePosition(task.ID); pos != 0 {
+		t.Fatalf("scheduled task must not be in the queue, got position %d", pos)
+	}
+
+	if n := s.RunDue(); n != 0 || submitter.count() != 0 {
+		t.Fatalf("expected nothing due yet, ran %d", n)
+	}
+
+	makeDue(t, tm, task.ID)
+	if n := s.RunDue(); n != 1 || submitter.count() != 1 {
+		t.Fatalf("expected the task to be submitted once, ran %d submitted %d", n, submitter.count())
+	}
+
+	// 模拟重启：新的 TaskManager 从数据库读取
+	restarted := NewTaskManager(testDB)
+	stored, err := restarted.GetTask(task.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if stored.Status != TaskQueued {
+		t.Fatalf("expected QUEUED after firing, got %s", stored.Status)
+	}
+	if n := NewTaskScheduler(restarted, submitter, time.Hour).RunDue(); n != 0 {
+		t.Fatalf("expected fired task not to run again, ran %d", n)
+	}
+}
+
+func TestSchedulerSurvivesRestart(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "dawn"}, TaskOptions{RunAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	makeDue(t, tm, task.ID)
+
+	// 停机期间到期，新进程启动时立即处理
+	submitter := &recordingSubmitter{}
+	s := NewTaskScheduler(NewTaskManager(testDB), submitter, time.Hour)
+	s.Start()
+	defer s.Stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for submitter.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if submitter.count() != 1 {
+		t.Fatal("expected overdue task to be submitted on startup")
+	}
+}
+
+func TestSchedulerRecurringTaskSpawnsRuns(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	submitter := &recordingSubmitter{}
+	s := NewTaskScheduler(tm, submitter, time.Hour)
+
+	tmpl, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "daily fox", Seed: 1}, TaskOptions{Cron: "0 3 * * *"})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if tmpl.Status != TaskScheduled || tmpl.RunAt == nil || tmpl.RunAt.Hour() != 3 {
+		t.Fatalf("expected template scheduled for 03:00, got %+v", tmpl)
+	}
+
+	makeDue(t, tm, tmpl.ID)
+	s.RunDue()
+	if submitter.count() != 1 {
+		t.Fatalf("expected one run to be submitted, got %d", submitter.count())
+	}
+	run := submitter.tasks[0]
+	if run.ScheduleID != tmpl.ID || run.Status != TaskQueued || run.Prompt != "daily fox" {
+		t.Fatalf("unexpected run: %+v", run)
+	}
+
+	stored, err := NewTaskManager(testDB).GetTask(tmpl.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if stored.Status != TaskScheduled || stored.RunAt == nil || !stored.RunAt.After(time.Now()) {
+		t.Fatalf("expected template to advance to a future run_at, got %+v", stored)
+	}
+
+	// 取消后不再触发
+	if err := tm.CancelScheduledTask(stored, "cancelled by user"); err != nil {
+		t.Fatalf("CancelScheduledTask: %v", err)
+	}
+	makeDue(t, tm, tmpl.ID)
+	if n := s.RunDue(); n != 0 {
+		t.Fatalf("expected cancelled schedule not to fire, ran %d", n)
+	}
+}
+
+func TestSchedulerReschedulesWhenQueueFull(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	submitter := &recordingSubmitter{full: true}
+	s := NewTaskScheduler(tm, submitter, time.Hour)
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "busy"}, TaskOptions{RunAt: time.Now().Add(time.Hour)})
+	makeDue(t, tm, task.ID)
+	s.RunDue()
+
+	stored, err := NewTaskManager(testDB).GetTask(task.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if stored.Status != TaskScheduled || stored.RunAt == nil || !stored.RunAt.After(time.Now()) {
+		t.Fatalf("expected task to be rescheduled, got %+v", stored)
+	}
+}
+
+func TestHandleScheduledTaskEditAndCancel(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	h := NewAsyncAPIHandlers(nil, tm, nil)
+
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		if body != nil {
+			json.NewEncoder(&buf).Encode(body)
+		}
+		req := httptest.NewRequest(method, path, &buf)
+		req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		rr := httptest.NewRecorder()
+		if path == "/api/v1/schedules" {
+			h.HandleScheduledTasks(rr, req)
+		} else {
+			h.HandleScheduledTask(rr, req)
+		}
+		return rr
+	}
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "old"}, TaskOptions{RunAt: time.Now().Add(time.Hour)})
+
+	rr := do(http.MethodGet, "/api/v1/schedules", nil)
+	var listed []ImageTask
+	if err := json.Unmarshal(rr.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0].ID != task.ID {
+		t.Fatalf("unexpected list: %s", rr.Body.String())
+	}
+
+	prompt, cron := "new", "0 4 * * *"
+	rr = do(http.MethodPut, "/api/v1/schedules/"+task.ID, UpdateScheduledTaskRequest{Prompt: &prompt, Cron: &cron})
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var edited ImageTask
+	json.Unmarshal(rr.Body.Bytes(), &edited)
+	if edited.Prompt != "new" || edited.Cron != cron || edited.RunAt == nil || edited.RunAt.Hour() != 4 {
+		t.Fatalf("unexpected edited task: %+v", edited)
+	}
+
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	if rr := do(http.MethodPut, "/api/v1/schedules/"+task.ID, UpdateScheduledTaskRequest{RunAt: &past}); rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected past run_at to be rejected, got %d", rr.Code)
+	}
+
+	if rr := do(http.MethodDelete, "/api/v1/schedules/"+task.ID, nil); rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+	if rr := do(http.MethodDelete, "/api/v1/schedules/"+task.ID, nil); rr.Code != http.StatusConflict {
+		t.Fatalf("expected cancelling twice to conflict, got %d", rr.Code)
+	}
+	stored, _ := NewTaskManager(testDB).GetTask(task.ID)
+	if stored.Status != TaskCancelled {
+		t.Fatalf("expected CANCELLED, got %s", stored.Status)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -13,6 +15,14 @@ var (
 	globalTaskManager *TaskManager
 	globalWorkerPool  *WorkerPool
 	globalAsyncAPI    *AsyncAPIHandlers
+	globalWebhooks    *WebhookDispatcher
+	globalScheduler   *TaskScheduler
+	globalReaper      *TaskReaper
+	globalPipelines   *PipelineRunner
+	globalAdminAPI    *AdminAPI
+	globalSpeechLB    *SpeechBalancer
+
+	globalRemoteWorkers *RemoteWorkerHub
 )
 
 // initAsyncSystem 初始化异步任务系统
@@ -21,60 +31,252 @@ func initAsyncSystem() error {
 
 	// 1. 初始化 TaskManager
 	globalTaskManager = NewTaskManager(db)
+	globalTaskManager.SetCacheLimits(getEnvInt("TASK_CACHE_SIZE", defaultTaskCacheSize),
+		getEnvDuration("TASK_CACHE_TTL", defaultTaskCacheTTL))
 
-	// 2. 初始化文生图客户端实例
-	imageBaseURLs := []string{
-		getEnv("IMAGE_GEN_URL_1", "http://localhost:8000"), // 第一个实例
-		// 后续可以添加更多实例
-		// getEnv("IMAGE_GEN_URL_2", "http://localhost:8001"),
-		// getEnv("IMAGE_GEN_URL_3", "http://localhost:8002"),
+	// 上一个进程内存队列中的任务已丢失，交给调度器重新入队
+	if n, err := globalTaskManager.RecoverQueuedTasks(time.Now()); err != nil {
+		log.Printf("Warning: %v", err)
+	} else if n > 0 {
+		log.Printf("Recovered %d queued tasks from the previous run", n)
 	}
 
-	var imageClients []TextToImageProvider
-	for i, baseURL := range imageBaseURLs {
-		client, err := NewQwenImageGGUF(baseURL, nil)
-		if err != nil {
-			log.Printf("Warning: failed to create image client %d (%s): %v", i, baseURL, err)
-			continue
+	// 2. 文生图实例的初始配置：IMAGE_GEN_URL_<n>（从 1 开始连续编号）及对应的
+	// IMAGE_GEN_WEIGHT_<n>（weighted-round-robin 权重）、IMAGE_GEN_SLOTS_<n>（并发槽位，本地 GGUF 服务一般为 1）和
+	// IMAGE_GEN_TYPE_<n>（后端类型：qwen-image-gguf（默认）、automatic1111 或 comfyui）。
+	// 只在 backends 表为空时写入，之后通过 /api/v1/admin/backends 管理
+	var imageSeeds []BackendRecord
+	for n := 1; ; n++ {
+		defaultURL := ""
+		if n == 1 {
+			defaultURL = "http://localhost:8000"
 		}
-		imageClients = append(imageClients, client)
-		log.Printf("Initialized image generation client %d: %s", i, baseURL)
-	}
-
-	if len(imageClients) == 0 {
-		log.Println("Warning: no image generation clients available")
+		baseURL := getEnv(fmt.Sprintf("IMAGE_GEN_URL_%d", n), defaultURL)
+		if baseURL == "" {
+			break
+		}
+		imageSeeds = append(imageSeeds, BackendRecord{
+			URL:      baseURL,
+			Type:     getEnv(fmt.Sprintf("IMAGE_GEN_TYPE_%d", n), BackendTypeQwenImageGGUF),
+			Weight:   getEnvInt(fmt.Sprintf("IMAGE_GEN_WEIGHT_%d", n), 1),
+			Capacity: getEnvInt(fmt.Sprintf("IMAGE_GEN_SLOTS_%d", n), 1),
+		})
 	}
 
-	// 3. 初始化语音转文字客户端
-	whisperURL := getEnv("WHISPER_URL", "http://localhost:8001")
-	whisperClient, err := NewFastWhisperService(whisperURL, nil)
-	if err != nil {
-		log.Printf("Warning: failed to create whisper client: %v", err)
-	} else {
-		log.Printf("Initialized speech-to-text client: %s", whisperURL)
+	// 3. 语音识别实例的初始配置：WHISPER_URL_<n> 及对应的 WHISPER_WEIGHT_<n>、WHISPER_SLOTS_<n> 和
+	// WHISPER_TYPE_<n>（fast-whisper（默认）或 openai-audio），含义同上；第 1 个实例兼容旧的 WHISPER_URL。同样只在 backends 表中还没有语音识别实例时写入
+	var speechSeeds []BackendRecord
+	for n := 1; ; n++ {
+		defaultURL := ""
+		if n == 1 {
+			defaultURL = getEnv("WHISPER_URL", "http://localhost:8001")
+		}
+		baseURL := getEnv(fmt.Sprintf("WHISPER_URL_%d", n), defaultURL)
+		if baseURL == "" {
+			break
+		}
+		speechSeeds = append(speechSeeds, BackendRecord{
+			URL:      baseURL,
+			Type:     getEnv(fmt.Sprintf("WHISPER_TYPE_%d", n), BackendTypeFastWhisper),
+			Weight:   getEnvInt(fmt.Sprintf("WHISPER_WEIGHT_%d", n), 1),
+			Capacity: getEnvInt(fmt.Sprintf("WHISPER_SLOTS_%d", n), 1),
+		})
 	}
+	globalSpeechLB = NewLoadBalancer[SpeechToTextProvider](nil)
 
 	// 4. 初始化 WorkerPool
-	workerCount := 2 // 并发 worker 数量
 	queueSize := 100 // 队列容量
-	globalWorkerPool = NewWorkerPool(workerCount, queueSize, imageClients, globalTaskManager)
+	// worker 数量在 WORKER_MIN 和 WORKER_MAX 之间随排队任务数和可用后端容量调整
+	scaling := DefaultScalingPolicy()
+	scaling.Min = getEnvInt("WORKER_MIN", scaling.Min)
+	scaling.Max = getEnvInt("WORKER_MAX", scaling.Max)
+	scaling.Interval = getEnvDuration("WORKER_SCALE_INTERVAL", scaling.Interval)
+	scaling.ScaleDownDelay = getEnvDuration("WORKER_SCALE_DOWN_DELAY", scaling.ScaleDownDelay)
+	globalWorkerPool = NewWorkerPool(scaling.Min, queueSize, nil, globalTaskManager)
+	globalWorkerPool.SetScalingPolicy(scaling)
+	// 负载均衡配置对文生图和语音识别的负载均衡器同样生效
+	// LB_STRATEGY：round-robin（默认）、weighted-round-robin、least-outstanding、peak-ewma、p2c
+	strategy := getEnv("LB_STRATEGY", StrategyRoundRobin)
+	if imageStrategy, err := NewStrategy[TextToImageProvider](strategy); err != nil {
+		log.Printf("Warning: %v, using %s", err, StrategyRoundRobin)
+	} else {
+		speechStrategy, _ := NewStrategy[SpeechToTextProvider](strategy)
+		globalWorkerPool.balancer.SetStrategy(imageStrategy)
+		globalSpeechLB.SetStrategy(speechStrategy)
+	}
+	// LB_AFFINITY：会话亲和键，逗号分隔的 user、fingerprint、model，为空（默认）时不启用；
+	// 单个实例进行中的请求不超过平均值的 LB_AFFINITY_LOAD_FACTOR 倍（默认 1.25）
+	if keys, err := ParseAffinityKeys(getEnv("LB_AFFINITY", "")); err != nil {
+		log.Printf("Warning: %v, session affinity disabled", err)
+	} else if len(keys) > 0 {
+		loadFactor, _ := strconv.ParseFloat(getEnv("LB_AFFINITY_LOAD_FACTOR", ""), 64)
+		affinity := AffinityPolicy{Keys: keys, LoadFactor: loadFactor}
+		globalWorkerPool.balancer.SetAffinity(affinity)
+		globalSpeechLB.SetAffinity(affinity)
+		log.Printf("Session affinity on %v", keys)
+	}
+	// 实例连续失败 CB_FAILURE_THRESHOLD 次后熔断，CB_COOLDOWN 后放行 CB_HALF_OPEN_PROBES 个探测请求
+	breaker := DefaultBreakerPolicy()
+	breaker.FailureThreshold = getEnvInt("CB_FAILURE_THRESHOLD", breaker.FailureThreshold)
+	breaker.Cooldown = getEnvDuration("CB_COOLDOWN", breaker.Cooldown)
+	breaker.HalfOpenProbes = getEnvInt("CB_HALF_OPEN_PROBES", breaker.HalfOpenProbes)
+	globalWorkerPool.balancer.SetBreakerPolicy(breaker)
+	globalSpeechLB.SetBreakerPolicy(breaker)
+	// 从 backends 表加载文生图和语音识别实例
+	backends := NewBackendRegistry(db, globalWorkerPool.balancer, globalSpeechLB)
+	// OpenAI 兼容后端（LocalAI 等）：OPENAI_API_KEY 对两种类型都生效，OPENAI_IMAGE_MODEL / OPENAI_ASR_MODEL 为默认模型，
+	// OPENAI_IMAGE_RESPONSE_FORMAT 为 b64_json（默认）或 url
+	imageConfig := OpenAIConfig{
+		APIKey:         getEnv("OPENAI_API_KEY", ""),
+		Model:          getEnv("OPENAI_IMAGE_MODEL", ""),
+		ResponseFormat: getEnv("OPENAI_IMAGE_RESPONSE_FORMAT", OpenAIResponseB64JSON),
+	}
+	audioConfig := OpenAIConfig{APIKey: imageConfig.APIKey, Model: getEnv("OPENAI_ASR_MODEL", defaultOpenAIASRModel)}
+	backends.RegisterType(BackendTypeOpenAIImages, globalWorkerPool.balancer, func(rawURL string) (TextToImageProvider, error) {
+		return NewOpenAIImageProvider(rawURL, imageConfig, nil)
+	})
+	backends.RegisterSpeechType(BackendTypeOpenAIAudio, globalSpeechLB, func(rawURL string) (SpeechToTextProvider, error) {
+		return NewOpenAIAudioProvider(rawURL, audioConfig, nil)
+	})
+	if n, err := backends.Seed(append(imageSeeds, speechSeeds...)); err != nil {
+		log.Printf("Warning: failed to seed backends: %v", err)
+	} else if n > 0 {
+		log.Printf("Seeded %d backends from the environment", n)
+	}
+	if err := backends.Load(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if globalWorkerPool.balancer.Size() == 0 {
+		log.Println("Warning: no image generation clients available")
+	}
+	if globalSpeechLB.Size() == 0 {
+		log.Println("Warning: no speech-to-text clients available")
+	}
+	// 任务截止时间 = TASK_DEADLINE_BASE + 步数 × TASK_DEADLINE_PER_STEP（按 1024x1024 像素数缩放），不超过 TASK_DEADLINE_MAX
+	deadlines := DefaultDeadlinePolicy()
+	deadlines.Base = getEnvDuration("TASK_DEADLINE_BASE", deadlines.Base)
+	deadlines.PerStep = getEnvDuration("TASK_DEADLINE_PER_STEP", deadlines.PerStep)
+	deadlines.Max = getEnvDuration("TASK_DEADLINE_MAX", deadlines.Max)
+	globalWorkerPool.SetDeadlinePolicy(deadlines)
+	// 设置 REMOTE_WORKER_TOKEN 后，本进程无法执行的任务（如没有配置文生图后端）留给远程 worker 领取
+	remoteWorkerToken := getEnv("REMOTE_WORKER_TOKEN", "")
+	if remoteWorkerToken != "" {
+		globalWorkerPool.EnableRemoteWorkers()
+	}
+	// 语音识别作为 speech.transcribe 任务与文生图共用队列、重试和回收
+	globalWorkerPool.RegisterHandler(TaskKindSpeechTranscribe, NewSpeechTranscribeHandler(globalSpeechLB, globalTaskManager))
+	globalWorkerPool.SetSpeechBalancer(globalSpeechLB)
+	// 预计等待超过上限时拒绝新任务（503 + Retry-After），0 表示只在队列满时拒绝
+	globalWorkerPool.SetAdmissionLimit(getEnvDuration("ADMISSION_MAX_WAIT", defaultAdmissionMaxWait))
+	// 用历史耗时预热排队时间预估
+	if err := globalWorkerPool.Durations().LoadFromDB(db); err != nil {
+		log.Printf("Warning: %v", err)
+	}
 	globalWorkerPool.Start()
 
 	// 5. 初始化异步 API 处理器
-	globalAsyncAPI = NewAsyncAPIHandlers(globalWorkerPool, globalTaskManager, whisperClient)
+	globalAsyncAPI = NewAsyncAPIHandlers(globalWorkerPool, globalTaskManager, globalSpeechLB)
+
+	// 同步语音识别：SPEECH_HEDGE_PERCENTILE（如 0.95，默认 0 不对冲）分位数的耗时后仍未返回时向另一个实例发出对冲请求，
+	// 不短于 SPEECH_HEDGE_MIN_DELAY；连接错误时换实例重试；包括原请求最多 SPEECH_MAX_ATTEMPTS 个请求
+	hedge := DefaultHedgePolicy()
+	hedge.Percentile, _ = strconv.ParseFloat(getEnv("SPEECH_HEDGE_PERCENTILE", "0"), 64)
+	hedge.MinDelay = getEnvDuration("SPEECH_HEDGE_MIN_DELAY", hedge.MinDelay)
+	hedge.MaxAttempts = getEnvInt("SPEECH_MAX_ATTEMPTS", hedge.MaxAttempts)
+	globalAsyncAPI.SetSpeechHedging(hedge)
+
+	// 6. 启动 webhook 投递（任务结束时的回调）
+	webhookCfg := DefaultWebhookConfig()
+	webhookCfg.MaxAttempts = getEnvInt("WEBHOOK_MAX_ATTEMPTS", webhookCfg.MaxAttempts)
+	webhookCfg.Timeout = getEnvDuration("WEBHOOK_TIMEOUT", webhookCfg.Timeout)
+	webhookCfg.BaseBackoff = getEnvDuration("WEBHOOK_BASE_BACKOFF", webhookCfg.BaseBackoff)
+	webhookCfg.MaxBackoff = getEnvDuration("WEBHOOK_MAX_BACKOFF", webhookCfg.MaxBackoff)
+	globalWebhooks = NewWebhookDispatcher(db, nil, webhookCfg)
+	globalWebhooks.Start(globalTaskManager.Events())
+
+	// 7. 启动计划任务调度（重启后会立即处理停机期间到期的任务）
+	globalScheduler = NewTaskScheduler(globalTaskManager, globalWorkerPool,
+		getEnvDuration("SCHEDULER_INTERVAL", defaultSchedulerInterval))
+	globalScheduler.Start()
+
+	// 8. 启动卡死任务回收（租约过期或心跳停止的任务按重试策略重新排队或失败）
+	reaperCfg := DefaultReaperConfig()
+	reaperCfg.Interval = getEnvDuration("REAPER_INTERVAL", reaperCfg.Interval)
+	reaperCfg.HeartbeatTimeout = getEnvDuration("TASK_HEARTBEAT_TIMEOUT", reaperCfg.HeartbeatTimeout)
+	reaperCfg.Retry.MaxAttempts = getEnvInt("TASK_MAX_ATTEMPTS", reaperCfg.Retry.MaxAttempts)
+	reaperCfg.Retry.Backoff = getEnvDuration("TASK_RETRY_BACKOFF", reaperCfg.Retry.Backoff)
+	globalReaper = NewTaskReaper(globalTaskManager, globalScheduler, reaperCfg)
+	globalReaper.Start()
+
+	// 9. 启动流水线推进（步骤的任务结束后启动依赖它的步骤）
+	globalPipelines = NewPipelineRunner(globalTaskManager, globalWorkerPool,
+		getEnvDuration("PIPELINE_INTERVAL", defaultPipelineInterval))
+	globalPipelines.Start(globalTaskManager.Events())
+	globalAsyncAPI.SetPipelineRunner(globalPipelines)
+
+	// 10. 远程 worker 接口（GPU 主机主动拉取任务，租约由回收器统一处理）
+	if remoteWorkerToken != "" {
+		globalRemoteWorkers = NewRemoteWorkerHub(globalTaskManager, globalWorkerPool, RemoteWorkerConfig{
+			Token:     remoteWorkerToken,
+			LeaseWait: getEnvDuration("REMOTE_WORKER_LEASE_WAIT", defaultLeaseWait),
+			Retry:     reaperCfg.Retry,
+		})
+		log.Println("Remote worker API enabled")
+	}
+
+	// 11. 管理员运维接口（跨用户查询和修复任务、暂停 / 恢复 worker、管理文生图和语音识别实例）
+	globalAdminAPI = NewAdminAPI(globalTaskManager, globalWorkerPool, globalScheduler)
+	globalAdminAPI.SetBackendRegistry(backends)
 
 	log.Println("Async task system initialized successfully")
 	return nil
 }
 
+// getEnvInt 读取整数环境变量，缺失或非法时返回默认值
+func getEnvInt(key string, defaultValue int) int {
+	if v, err := strconv.Atoi(getEnv(key, "")); err == nil {
+		return v
+	}
+	return defaultValue
+}
+
+// getEnvDuration 读取时长环境变量（如 "30s"、"5m"），缺失或非法时返回默认值
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if d, err := time.ParseDuration(getEnv(key, "")); err == nil {
+		return d
+	}
+	return defaultValue
+}
+
 // shutdownAsyncSystem 优雅关闭异步任务系统
 func shutdownAsyncSystem() {
 	log.Println("Shutting down async task system...")
 
+	// 先停止流水线、回收和调度，避免向已关闭的队列提交任务
+	if globalPipelines != nil {
+		globalPipelines.Stop()
+	}
+
+	if globalReaper != nil {
+		globalReaper.Stop()
+	}
+
+	if globalScheduler != nil {
+		globalScheduler.Stop()
+	}
+
 	if globalWorkerPool != nil {
 		globalWorkerPool.Stop()
 	}
 
+	if globalSpeechLB != nil {
+		globalSpeechLB.Close()
+	}
+
+	if globalWebhooks != nil {
+		globalWebhooks.Stop()
+	}
+
 	log.Println("Async task system shutdown complete")
 }
 
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// ======================
+// TaskEventBus - 任务事件发布/订阅
+// ======================
+//
+
+const (
+	// TaskEventStatus 任务状态变化（SCHEDULED → QUEUED → RUNNING → DONE/FAILED，或 CANCELLED）
+	TaskEventStatus = "status"
+	// TaskEventPosition 排队位置变化
+	TaskEventPosition = "position"
+
+	defaultEventHistory = 1024 // 为 Last-Event-ID 续传保留的事件数
+	subscriberBuffer    = 64   // 每个订阅者的缓冲区大小
+)
+
+// TaskEvent 推送给订阅者的任务事件
+type TaskEvent struct {
+	ID            uint64    `json:"id"`
+	Type          string    `json:"type"`
+	TaskID        string    `json:"task_id"`
+	Kind          string    `json:"kind,omitempty"`
+	UserID        int64     `json:"user_id"`
+	Status        string    `json:"status"`
+	QueuePosition int       `json:"queue_position,omitempty"`
+	ResultURL     string    `json:"result_url,omitempty"`
+	ErrorMsg      string    `json:"error,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// IsTerminal 事件是否表示任务已结束
+func (e TaskEvent) IsTerminal() bool {
+	return e.Type == TaskEventStatus && isTerminalStatus(e.Status)
+}
+
+// isTerminalStatus 任务是否处于终态
+func isTerminalStatus(status string) bool {
+	return status == TaskDone || status == TaskFailed || status == TaskCancelled
+}
+
+// EventFilter 订阅过滤条件，零值字段表示不过滤
+type EventFilter struct {
+	UserID int64
+	TaskID string
+}
+
+func (f EventFilter) match(e TaskEvent) bool {
+	if f.UserID != 0 && e.UserID != f.UserID {
+		return false
+	}
+	if f.TaskID != "" && e.TaskID != f.TaskID {
+		return false
+	}
+	return true
+}
+
+type subscriber struct {
+	filter     EventFilter
+	ch         chan TaskEvent
+	closeOnLag bool        // 缓冲区满时关闭 ch 而不是丢弃事件
+	lagged     atomic.Bool // 因缓冲区满被关闭
+}
+
+// TaskEventBus 进程内的任务事件总线，保留最近的事件用于断线续传
+type TaskEventBus struct {
+	mu      sync.Mutex
+	nextID  uint64
+	history []TaskEvent // 环形缓冲区中按 ID 递增排列的最近事件
+	limit   int
+	subs    map[*subscriber]struct{}
+}
+
+// NewTaskEventBus 创建事件总线，history 为保留的历史事件数
+func NewTaskEventBus(history int) *TaskEventBus {
+	if history <= 0 {
+		history = defaultEventHistory
+	}
+	return &TaskEventBus{
+		limit: history,
+		subs:  make(map[*subscriber]struct{}),
+	}
+}
+
+// Publish 发布事件并返回分配的事件 ID，不会被慢订阅者阻塞：缓冲区已满时丢弃事件，
+// SubscribeClient 的订阅则被关闭
+func (b *TaskEventBus) Publish(e TaskEvent) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	e.ID = b.nextID
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.history = append(b.history, e)
+	if len(b.history) > b.limit {
+		b.history = b.history[len(b.history)-b.limit:]
+	}
+
+	for sub := range b.subs {
+		if !sub.filter.match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			if sub.closeOnLag {
+				sub.lagged.Store(true)
+				delete(b.subs, sub)
+				close(sub.ch)
+			}
+		}
+	}
+
+	return e.ID
+}
+
+// Subscription 一次订阅：Events 接收新事件，Replay 为需要补发的历史事件
+type Subscription struct {
+	Events <-chan TaskEvent
+	Replay []TaskEvent
+	// Resumed 为 false 表示无法从 Last-Event-ID 完整续传，调用方应先发送当前快照
+	Resumed bool
+	// LastID 订阅时刻最新的事件 ID，可作为快照事件的 ID
+	LastID uint64
+	Cancel func()
+	// Lagged 为 true 表示 SubscribeClient 的订阅因消费过慢被关闭（Events 已关闭）
+	Lagged func() bool
+}
+
+// Subscribe 订阅匹配 filter 的事件，lastID > 0 时补发 ID 大于 lastID 的历史事件。
+// 消费过慢时事件会被丢弃，只适合把事件当作唤醒信号、另有轮询兜底的调用方
+func (b *TaskEventBus) Subscribe(filter EventFilter, lastID uint64) *Subscription {
+	return b.subscribe(filter, lastID, false)
+}
+
+// SubscribeClient 同 Subscribe，但缓冲区满时关闭 Events 而不是丢弃事件（包括终态事件），
+// 调用方应结束事件流，让客户端带 Last-Event-ID 重连后补发或重新获取快照
+func (b *TaskEventBus) SubscribeClient(filter EventFilter, lastID uint64) *Subscription {
+	return b.subscribe(filter, lastID, true)
+}
+
+func (b *TaskEventBus) subscribe(filter EventFilter, lastID uint64, closeOnLag bool) *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub := &subscriber{filter: filter, ch: make(chan TaskEvent, subscriberBuffer), closeOnLag: closeOnLag}
+	b.subs[sub] = struct{}{}
+
+	subscription := &Subscription{
+		Events: sub.ch,
+		LastID: b.nextID,
+		Lagged: sub.lagged.Load,
+		Cancel: func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			delete(b.subs, sub)
+		},
+	}
+
+	// lastID 大于当前 ID 说明服务重启过，历史已丢失
+	if lastID > 0 && lastID <= b.nextID {
+		subscription.Resumed = len(b.history) == 0 || b.history[0].ID <= lastID+1
+		for _, e := range b.history {
+			if e.ID > lastID && filter.match(e) {
+				subscription.Replay = append(subscription.Replay, e)
+			}
+		}
+	}
+
+	return subscription
+}
+
+// LastID 返回最近一次发布的事件 ID
+func (b *TaskEventBus) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.nextID
+}
+
+// SubscriberCount 当前订阅者数量
+func (b *TaskEventBus) SubscriberCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subs)
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskEventBusReplaysAfterLastEventID(t *testing.T) {
+	bus := NewTaskEventBus(3)
+	for i := 0; i < 5; i++ {
+		bus.Publish(TaskEvent{Type: TaskEventStatus, TaskID: "t1", UserID: 1, Status: TaskQueued})
+	}
+
+	sub := bus.Subscribe(EventFilter{TaskID: "t1"}, 3)
+	defer sub.Cancel()
+	if !sub.Resumed || len(sub.Replay) != 2 || sub.Replay[0].ID != 4 || sub.Replay[1].ID != 5 {
+		t.Fatalf("expected replay of events 4 and 5, got resumed=%v %+v", sub.Resumed, sub.Replay)
+	}
+
+	// 历史只保留 3 条（3、4、5），从 1 续传会丢事件
+	lost := bus.Subscribe(EventFilter{TaskID: "t1"}, 1)
+	defer lost.Cancel()
+	if lost.Resumed {
+		t.Fatal("expected resume from evicted event to be rejected")
+	}
+
+	// 服务重启后客户端带来的 ID 比当前大
+	restarted := bus.Subscribe(EventFilter{TaskID: "t1"}, 99)
+	defer restarted.Cancel()
+	if restarted.Resumed || len(restarted.Replay) != 0 {
+		t.Fatal("expected unknown event id to fall back to snapshot")
+	}
+}
+
+func TestTaskEventBusFiltersByUser(t *testing.T) {
+	bus := NewTaskEventBus(0)
+	sub := bus.Subscribe(EventFilter{UserID: 2}, 0)
+	defer sub.Cancel()
+
+	bus.Publish(TaskEvent{Type: TaskEventStatus, TaskID: "a", UserID: 1, Status: TaskQueued})
+	bus.Publish(TaskEvent{Type: TaskEventStatus, TaskID: "b", UserID: 2, Status: TaskQueued})
+
+	select {
+	case e := <-sub.Events:
+		if e.TaskID != "b" {
+			t.Fatalf("expected event for task b, got %s", e.TaskID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected an event")
+	}
+	select {
+	case e := <-sub.Events:
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+}
+
+func TestTaskEventBusClosesLaggingClients(t *testing.T) {
+	bus := NewTaskEventBus(0)
+	client := bus.SubscribeClient(EventFilter{TaskID: "t1"}, 0)
+	defer client.Cancel()
+	hint := bus.Subscribe(EventFilter{TaskID: "t1"}, 0)
+	defer hint.Cancel()
+
+	// 客户端一直不读，排队位置事件填满缓冲区后终态事件无处可放
+	for i := 0; i < subscriberBuffer; i++ {
+		bus.Publish(TaskEvent{Type: TaskEventPosition, TaskID: "t1", UserID: 1, Status: TaskQueued})
+	}
+	done := bus.Publish(TaskEvent{Type: TaskEventStatus, TaskID: "t1", UserID: 1, Status: TaskDone, ResultURL: "/images/1"})
+
+	var last uint64
+	for e := range client.Events {
+		last = e.ID
+	}
+	if !client.Lagged() || last != done-1 || bus.SubscriberCount() != 1 {
+		t.Fatalf("expected the client subscription to be closed after event %d, got lagged=%v last=%d subs=%d",
+			done-1, client.Lagged(), last, bus.SubscriberCount())
+	}
+	// 普通订阅丢弃事件但保持订阅
+	if hint.Lagged() || len(hint.Events) != subscriberBuffer {
+		t.Fatalf("expected the hint subscription to stay open, got %d buffered", len(hint.Events))
+	}
+
+	// 带 Last-Event-ID 重连后补发终态事件
+	resumed := bus.SubscribeClient(EventFilter{TaskID: "t1"}, last)
+	defer resumed.Cancel()
+	if !resumed.Resumed || len(resumed.Replay) != 1 || resumed.Replay[0].Status != TaskDone || resumed.Replay[0].ResultURL != "/images/1" {
+		t.Fatalf("expected the DONE event to be replayed, got %+v", resumed.Replay)
+	}
+}
+
+// sseEvent 测试中解析出的一个 SSE 事件
+type sseEvent struct {
+	id    string
+	event TaskEvent
+}
+
+// readSSE 从响应体中读取事件直到流关闭
+func readSSE(t *testing.T, body *bufio.Scanner, events chan<- sseEvent) {
+	t.Helper()
+	defer close(events)
+
+	var current sseEvent
+	for body.Scan() {
+		line := body.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			current.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &current.event); err != nil {
+				t.Errorf("bad event data %q: %v", line, err)
+			}
+		case line == "" && current.event.TaskID != "":
+			events <- current
+			current = sseEvent{}
+		}
+	}
+}
+
+func newEventsServer(t *testing.T, h *AsyncAPIHandlers, userID int64) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/tasks/", func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+		if strings.HasSuffix(r.URL.Path, "/tasks/events") {
+			h.HandleUserTaskEvents(w, r)
+			return
+		}
+		h.HandleTaskEvents(w, r)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) sseEvent {
+	t.Helper()
+	select {
+	case e, ok := <-events:
+		if !ok {
+			t.Fatal("stream closed unexpectedly")
+		}
+		return e
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+	return sseEvent{}
+}
+
+func TestHandleTaskEventsStreamsUntilDone(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	h := NewAsyncAPIHandlers(nil, tm, nil)
+	server := newEventsServer(t, h, userID)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a boat"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/tasks/" + task.ID + "/events")
+	if err != nil {
+		t.Fatalf("GET events: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+
+	events := make(chan sseEvent, 16)
+	go readSSE(t, bufio.NewScanner(resp.Body), events)
+
+	snapshot := nextEvent(t, events)
+	if snapshot.event.Status != TaskQueued || snapshot.event.QueuePosition != 1 {
+		t.Fatalf("expected queued snapshot at position 1, got %+v", snapshot.event)
+	}
+
+	task.Status = TaskRunning
+	if err := tm.UpdateTask(task); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+	if e := nextEvent(t, events); e.event.Status != TaskRunning {
+		t.Fatalf("expected RUNNING, got %+v", e.event)
+	}
+
+	if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("x"), MimeType: "image/png"}); err != nil {
+		t.Fatalf("SaveGenerationResult: %v", err)
+	}
+	done := nextEvent(t, events)
+	if done.event.Status != TaskDone || done.event.ResultURL == "" {
+		t.Fatalf("expected DONE with result_url, got %+v", done.event)
+	}
+
+	// 任务结束后服务端关闭连接
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("expected stream to close after terminal event")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream was not closed")
+	}
+}
+
+func TestHandleUserTaskEventsResumesFromLastEventID(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	h := NewAsyncAPIHandlers(nil, tm, nil)
+	server := newEventsServer(t, h, userID)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a tree"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	lastSeen := tm.Events().LastID()
+
+	// 客户端断线期间任务开始运行
+	task.Status = TaskRunning
+	if err := tm.UpdateTask(task); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/tasks/events", nil)
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(lastSeen, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	events := make(chan sseEvent, 16)
+	go readSSE(t, bufio.NewScanner(resp.Body), events)
+
+	missed := nextEvent(t, events)
+	if missed.event.Status != TaskRunning || missed.id != strconv.FormatUint(lastSeen+1, 10) {
+		t.Fatalf("expected replay of RUNNING event %d, got id=%s %+v", lastSeen+1, missed.id, missed.event)
+	}
+}
+
+func TestHandleTaskEventsSendsHeartbeats(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	h := NewAsyncAPIHandlers(nil, tm, nil)
+	h.heartbeatInterval = 20 * time.Millisecond
+	server := newEventsServer(t, h, userID)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a hill"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+
+	resp, err := http.Get(server.URL + "/api/v1/tasks/" + task.ID + "/events")
+	if err != nil {
+		t.Fatalf("GET events: %v", err)
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	deadline := time.After(2 * time.Second)
+	found := make(chan struct{})
+	go func() {
+		for scanner.Scan() {
+			if scanner.Text() == ": heartbeat" {
+				close(found)
+				return
+			}
+		}
+	}()
+	select {
+	case <-found:
+	case <-deadline:
+		t.Fatal("no heartbeat received")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 任务类型与处理器注册
+// ======================
+//
+// 每种任务类型（kind）注册一个 TaskHandler。WorkerPool 按任务的 kind 查找处理器执行，
+// 排队、租约、重试、回收、SSE、webhook 和清理对所有类型通用。新增任务类型只需实现
+// TaskHandler 并调用 WorkerPool.RegisterHandler。
+//
+
+const (
+	TaskKindImageGenerate    = "image.generate"
+	TaskKindSpeechTranscribe = "speech.transcribe"
+	TaskKindPromptTemplate   = "prompt.template"
+
+	speechDeadlineBase  = 60 * time.Second // 语音识别的固定开销
+	speechDeadlinePerMB = 30 * time.Second // 每 MB 音频的识别时间
+	speechDeadlineMax   = 30 * time.Minute
+
+	promptTemplateDeadline = 5 * time.Second
+	maxPromptLength        = 4000 // 模板展开后的最大字符数
+)
+
+// ErrUnknownTaskKind 没有为任务类型注册处理器
+var ErrUnknownTaskKind = errors.New("unknown task kind")
+
+// TaskResult 处理器的执行结果
+type TaskResult struct {
+	Output json.RawMessage   // 写入任务 output 的 JSON 结果
+	Image  *GenerationResult // 非空时按生成图片保存（prompts / images），任务通过 result_url 返回图片
+}
+
+// TaskHandler 一种任务类型的执行逻辑
+type TaskHandler interface {
+	// Deadline 返回任务的执行截止时间，超过后取消执行并由回收器按重试策略处理
+	Deadline(task *ImageTask) time.Duration
+	// Run 执行任务；返回错误时任务标记为 FAILED
+	Run(ctx context.Context, task *ImageTask) (TaskResult, error)
+}
+
+// LocalAvailability 可选接口：处理器当前能否在本进程执行（例如没有配置任何后端时不能）
+type LocalAvailability interface {
+	Available() bool
+}
+
+// TaskRegistry 任务类型到处理器的映射
+type TaskRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]TaskHandler
+}
+
+// NewTaskRegistry 创建空的处理器注册表
+func NewTaskRegistry() *TaskRegistry {
+	return &TaskRegistry{handlers: make(map[string]TaskHandler)}
+}
+
+// Register 注册或替换 kind 的处理器
+func (r *TaskRegistry) Register(kind string, h TaskHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[kind] = h
+}
+
+// Lookup 查找 kind 的处理器
+func (r *TaskRegistry) Lookup(kind string) (TaskHandler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	h, ok := r.handlers[kind]
+	return h, ok
+}
+
+// Kinds 返回已注册的任务类型，按名称排序
+func (r *TaskRegistry) Kinds() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	kinds := make([]string, 0, len(r.handlers))
+	for kind := range r.handlers {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// imageGenerateHandler image.generate：通过负载均衡选择文生图后端生成图片
+type imageGenerateHandler struct {
+	wp *WorkerPool
+}
+
+func (h *imageGenerateHandler) Deadline(task *ImageTask) time.Duration {
+	return h.wp.deadlines.For(task.GenerationRequest())
+}
+
+// Available 本进程配置了文生图后端时才在本地执行
+func (h *imageGenerateHandler) Available() bool {
+	return h.wp.balancer.Size() > 0
+}
+
+func (h *imageGenerateHandler) Run(ctx context.Context, task *ImageTask) (TaskResult, error) {
+	inst, err := h.wp.balancer.AcquireModel(ctx, h.wp.balancer.AffinityKey(task), modelRequirement(task.GenerationRequest()))
+	if err != nil {
+		return TaskResult{}, err
+	}
+
+	startTime := time.Now()
+	resp, err := inst.Client.Generate(ctx, task.GenerationRequest())
+	// 把耗时和结果反馈给负载均衡策略
+	h.wp.balancer.Release(inst, time.Since(startTime), err)
+	if err != nil {
+		return TaskResult{}, err
+	}
+
+	result := newGenerationResult(task, inst.Client, resp, time.Since(startTime))
+	return TaskResult{Image: &result}, nil
+}
+
+// SpeechTranscribeInput speech.transcribe 的输入，音频本身保存在 task_blobs
+type SpeechTranscribeInput struct {
+	Filename  string `json:"filename,omitempty"`
+	Format    string `json:"format"` // file（带容器格式的音频文件）或 pcm（16kHz 16bit 单声道）
+	SizeBytes int    `json:"size_bytes"`
+}
+
+// SpeechTranscribeOutput speech.transcribe 的输出：识别结果加上拼接好的全文，便于后续步骤引用
+type SpeechTranscribeOutput struct {
+	Text string `json:"text"`
+	SpeechToTextResponse
+}
+
+// speechTranscribeHandler speech.transcribe：读取上传的音频，通过负载均衡选择语音识别实例转写
+type speechTranscribeHandler struct {
+	balancer *SpeechBalancer
+	tm       *TaskManager
+}
+
+// NewSpeechTranscribeHandler 创建语音识别任务处理器
+func NewSpeechTranscribeHandler(balancer *SpeechBalancer, tm *TaskManager) TaskHandler {
+	return &speechTranscribeHandler{balancer: balancer, tm: tm}
+}
+
+// Available 本进程配置了语音识别后端时才在本地执行
+func (h *speechTranscribeHandler) Available() bool {
+	return h.balancer != nil && h.balancer.Size() > 0
+}
+
+func (h *speechTranscribeHandler) Deadline(task *ImageTask) time.Duration {
+	var in SpeechTranscribeInput
+	_ = json.Unmarshal(task.Input, &in)
+
+	d := speechDeadlineBase + time.Duration(float64(speechDeadlinePerMB)*float64(in.SizeBytes)/(1<<20))
+	if d > speechDeadlineMax {
+		d = speechDeadlineMax
+	}
+	return d
+}
+
+func (h *speechTranscribeHandler) Run(ctx context.Context, task *ImageTask) (TaskResult, error) {
+	if h.balancer == nil {
+		return TaskResult{}, errors.New("no available speech-to-text service")
+	}
+
+	var in SpeechTranscribeInput
+	if err := json.Unmarshal(task.Input, &in); err != nil {
+		return TaskResult{}, fmt.Errorf("invalid task input: %w", err)
+	}
+	audio, err := h.tm.LoadTaskBlob(task.ID)
+	if err != nil {
+		return TaskResult{}, err
+	}
+
+	resp, err := transcribe(ctx, h.balancer, h.balancer.AffinityKey(task), audio, in.Format, in.Filename)
+	if err != nil {
+		return TaskResult{}, err
+	}
+
+	texts := make([]string, 0, len(resp.Segments))
+	for _, seg := range resp.Segments {
+		if t := strings.TrimSpace(seg.Text); t != "" {
+			texts = append(texts, t)
+		}
+	}
+	output, err := json.Marshal(SpeechTranscribeOutput{Text: strings.Join(texts, " "), SpeechToTextResponse: resp})
+	if err != nil {
+		return TaskResult{}, fmt.Errorf("failed to encode transcription: %w", err)
+	}
+	return TaskResult{Output: output}, nil
+}
+
+// PromptTemplateInput prompt.template 的输入。流水线在创建任务前已把 {{step.field}} 替换为上游输出
+type PromptTemplateInput struct {
+	Template string `json:"template"`
+}
+
+// PromptTemplateOutput prompt.template 的输出
+type PromptTemplateOutput struct {
+	Text string `json:"text"`
+}
+
+// promptTemplateHandler prompt.template：整理展开后的模板文本，作为后续步骤的提示词
+type promptTemplateHandler struct{}
+
+func (promptTemplateHandler) Deadline(task *ImageTask) time.Duration {
+	return promptTemplateDeadline
+}
+
+func (promptTemplateHandler) Run(ctx context.Context, task *ImageTask) (TaskResult, error) {
+	var in PromptTemplateInput
+	if err := json.Unmarshal(task.Input, &in); err != nil {
+		return TaskResult{}, fmt.Errorf("invalid task input: %w", err)
+	}
+
+	text := strings.Join(strings.Fields(in.Template), " ")
+	if text == "" {
+		return TaskResult{}, errors.New("template expands to an empty prompt")
+	}
+	if r := []rune(text); len(r) > maxPromptLength {
+		text = string(r[:maxPromptLength])
+	}
+
+	output, err := json.Marshal(PromptTemplateOutput{Text: text})
+	if err != nil {
+		return TaskResult{}, fmt.Errorf("failed to encode prompt: %w", err)
+	}
+	return TaskResult{Output: output}, nil
+}
+
+// transcribe 通过负载均衡选择语音识别实例转写音频，format 为 pcm 时按 16kHz 16bit 单声道处理
+func transcribe(ctx context.Context, lb *SpeechBalancer, key string, audio []byte, format, filename string) (SpeechToTextResponse, error) {
+	inst, err := lb.AcquireFor(ctx, key)
+	if err != nil {
+		return SpeechToTextResponse{}, err
+	}
+
+	startTime := time.Now()
+	resp, err := transcribeWith(ctx, inst.Client, audio, format, filename)
+	lb.Release(inst, time.Since(startTime), err)
+	return resp, err
+}
+
+// transcribeWith 用指定实例转写音频
+func transcribeWith(ctx context.Context, client SpeechToTextProvider, audio []byte, format, filename string) (SpeechToTextResponse, error) {
+	if format == "pcm" {
+		return client.TranscribePCM(ctx, audio)
+	}
+	return client.TranscribeFile(ctx, audio, filename)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoHandler 把输入原样作为输出，用于验证通用任务流程
+type echoHandler struct{}
+
+func (echoHandler) Deadline(task *ImageTask) time.Duration { return time.Second }
+
+func (echoHandler) Run(ctx context.Context, task *ImageTask) (TaskResult, error) {
+	return TaskResult{Output: task.Input}, nil
+}
+
+// fakeWhisper 记录收到的音频并返回固定识别结果
+type fakeWhisper struct {
+	got chan []byte
+}
+
+func (f *fakeWhisper) Ping(ctx context.Context) error { return nil }
+
+func (f *fakeWhisper) TranscribeFile(ctx context.Context, audioData []byte, filename string) (SpeechToTextResponse, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return SpeechToTextResponse{}, errors.New("expected a task deadline")
+	}
+	f.got <- audioData
+	return SpeechToTextResponse{Language: "zh", Segments: []ASRSegment{{Start: 0, End: 1.5, Text: "你好"}}}, nil
+}
+
+func (f *fakeWhisper) TranscribePCM(ctx context.Context, pcmData []byte) (SpeechToTextResponse, error) {
+	return SpeechToTextResponse{}, errors.New("unexpected pcm request")
+}
+
+func waitForStatus(t *testing.T, tm *TaskManager, taskID, status string) *ImageTask {
+	t.Helper()
+	var task *ImageTask
+	waitFor(t, "task "+status, func() bool {
+		task, _ = NewTaskManager(tm.db).GetTask(taskID)
+		return task != nil && task.Status == status
+	})
+	return task
+}
+
+func TestWorkerPoolRunsRegisteredKinds(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	wp := NewWorkerPool(1, 10, nil, tm)
+	wp.RegisterHandler("test.echo", echoHandler{})
+	wp.Start()
+	defer wp.Stop()
+
+	echo, err := tm.CreateJob(userID, "test.echo", json.RawMessage(`{"n":1}`), nil, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateJob: %v", err)
+	}
+	unknown, _ := tm.CreateJob(userID, "video.render", json.RawMessage(`{}`), nil, TaskOptions{})
+	wp.Submit(echo)
+	wp.Submit(unknown)
+
+	done := waitForStatus(t, tm, echo.ID, TaskDone)
+	if done.Kind != "test.echo" || string(done.Output) != `{"n":1}` {
+		t.Fatalf("unexpected completed task: %+v", done)
+	}
+	failed := waitForStatus(t, tm, unknown.ID, TaskFailed)
+	if failed.ErrorMsg != "unknown task kind: video.render" {
+		t.Fatalf("unexpected error: %q", failed.ErrorMsg)
+	}
+
+	if _, err := tm.CreateJob(userID, "test.echo", nil, nil, TaskOptions{Cron: "* * * * *"}); err != ErrCronNotSupported {
+		t.Fatalf("expected cron to be rejected for other kinds, got %v", err)
+	}
+}
+
+func TestHandleSubmitSpeechTaskTranscribesAsync(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	whisper := &fakeWhisper{got: make(chan []byte, 1)}
+	wp := NewWorkerPool(1, 10, nil, tm)
+	speech := NewLoadBalancer([]SpeechToTextProvider{whisper})
+	defer speech.Close()
+	wp.RegisterHandler(TaskKindSpeechTranscribe, NewSpeechTranscribeHandler(speech, tm))
+	h := NewAsyncAPIHandlers(wp, tm, speech)
+
+	audio := bytes.Repeat([]byte{1, 2, 3, 4}, 1024)
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "meeting.wav")
+	part.Write(audio)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/speech/async", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("X-User-ID", strconv.FormatInt(userID, 10))
+	rr := httptest.NewRecorder()
+	h.HandleSubmitSpeechTask(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	var resp SubmitTaskResponse
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	if resp.Kind != TaskKindSpeechTranscribe || resp.Status != TaskQueued {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+
+	wp.Start()
+	defer wp.Stop()
+
+	if got := <-whisper.got; !bytes.Equal(got, audio) {
+		t.Fatal("expected the uploaded audio to reach the speech service")
+	}
+	done := waitForStatus(t, tm, resp.TaskID, TaskDone)
+
+	var out SpeechToTextResponse
+	if err := json.Unmarshal(done.Output, &out); err != nil || len(out.Segments) != 1 || out.Segments[0].Text != "你好" {
+		t.Fatalf("unexpected output: %s", done.Output)
+	}
+	var in SpeechTranscribeInput
+	json.Unmarshal(done.Input, &in)
+	if in.Filename != "meeting.wav" || in.SizeBytes != len(audio) || in.Format != "file" {
+		t.Fatalf("unexpected input: %s", done.Input)
+	}
+	if _, err := tm.LoadTaskBlob(resp.TaskID); err == nil {
+		t.Fatal("expected the audio to be deleted after completion")
+	}
+}
+
+func TestSpeechToTextBalancesInstances(t *testing.T) {
+	testDB, _ := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	whispers := []*fakeWhisper{{got: make(chan []byte, 1)}, {got: make(chan []byte, 1)}}
+	speech := NewLoadBalancer([]SpeechToTextProvider{whispers[0], whispers[1]})
+	defer speech.Close()
+	h := NewAsyncAPIHandlers(nil, tm, speech)
+
+	transcribe := func(h *AsyncAPIHandlers) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		part, _ := mw.CreateFormFile("file", "command.wav")
+		part.Write([]byte("audio"))
+		mw.Close()
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/speech/transcribe", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		rr := httptest.NewRecorder()
+		h.HandleSpeechToText(rr, req)
+		return rr
+	}
+
+	// 轮询：两个请求分别落在两个实例上
+	for i := 0; i < 2; i++ {
+		if rr := transcribe(h); rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+	for i, w := range whispers {
+		if len(w.got) != 1 {
+			t.Fatalf("expected instance %d to serve one request, got %d", i+1, len(w.got))
+		}
+	}
+	if stats := speech.GetStats(); stats["total_instances"] != 2 {
+		t.Fatalf("unexpected speech stats: %v", stats)
+	}
+
+	// 所有实例都不可用或没有配置语音识别时返回 503
+	for _, inst := range speech.instances {
+		inst.available.Store(false)
+	}
+	if rr := transcribe(h); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 without healthy instances, got %d", rr.Code)
+	}
+	if rr := transcribe(NewAsyncAPIHandlers(nil, tm, nil)); rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 without speech backends, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"container/list"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// 任务状态机、乐观版本与任务快照缓存
+// ======================
+//
+// 任务状态只能按 taskTransitions 变化，每次更新都写成
+//
+//	UPDATE image_tasks SET status = ?, version = version + 1, ... WHERE id = ? AND version = ? AND status IN (...)
+//
+// 持有过期快照的写入方（worker、回收器、调度器、管理员接口）会得到 ErrVersionConflict，而不是覆盖
+// 更新的状态；DONE → RUNNING 这类非法转换在写入数据库之前就被拒绝。
+//
+// TaskManager 缓存和 GetTask 返回的都是副本：调用方可以随意修改自己的 *ImageTask，
+// 只有写入成功后的新状态才会替换缓存中的快照。缓存按 LRU 限制条数，并在 TTL 后重新从数据库加载。
+//
+
+const (
+	defaultTaskCacheSize = 10000
+	defaultTaskCacheTTL  = 10 * time.Minute
+)
+
+var (
+	// ErrIllegalTransition 状态表不允许从任务当前状态转换到目标状态
+	ErrIllegalTransition = errors.New("illegal task status transition")
+	// ErrVersionConflict 任务在读取之后已被其他写入方修改
+	ErrVersionConflict = errors.New("task was modified concurrently")
+)
+
+// taskTransitions 每个状态允许转换到的状态。同状态转换用于修改字段（计划任务改参数、跟随任务同步），
+// DONE 是最终状态；FAILED 和 CANCELLED 只能由管理员重新排队
+var taskTransitions = map[string][]string{
+	TaskScheduled: {TaskScheduled, TaskQueued, TaskCancelled},
+	TaskQueued:    {TaskQueued, TaskRunning, TaskScheduled, TaskDone, TaskFailed, TaskCancelled},
+	TaskRunning:   {TaskRunning, TaskScheduled, TaskDone, TaskFailed, TaskCancelled},
+	TaskDone:      {},
+	TaskFailed:    {TaskScheduled},
+	TaskCancelled: {TaskScheduled},
+}
+
+// CanTransition 任务能否从 from 转换到 to
+func CanTransition(from, to string) bool {
+	for _, s := range taskTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transitionSources 返回可以转换到 to 的所有状态，按固定顺序
+func transitionSources(to string) []string {
+	var sources []string
+	for _, from := range []string{TaskScheduled, TaskQueued, TaskRunning, TaskDone, TaskFailed, TaskCancelled} {
+		if CanTransition(from, to) {
+			sources = append(sources, from)
+		}
+	}
+	return sources
+}
+
+// TransitionError 任务更新被拒绝，记录数据库中的当前状态；
+// 版本不一致时匹配 ErrVersionConflict，否则匹配 ErrIllegalTransition
+type TransitionError struct {
+	TaskID  string
+	From    string // 数据库中的当前状态
+	To      string
+	Version int64 // 数据库中的当前版本
+	Stale   int64 // 写入方持有的版本
+}
+
+func (e *TransitionError) Error() string {
+	if e.Version != e.Stale {
+		return fmt.Sprintf("%v: task %s is at version %d (%s), update was based on version %d",
+			ErrVersionConflict, e.TaskID, e.Version, e.From, e.Stale)
+	}
+	return fmt.Sprintf("%v: task %s %s -> %s", ErrIllegalTransition, e.TaskID, e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error {
+	if e.Version != e.Stale {
+		return ErrVersionConflict
+	}
+	return ErrIllegalTransition
+}
+
+// taskExecer 兼容 *sql.DB 和 *sql.Tx
+type taskExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// updateTaskRow 把 task 写成 task.Status：set 为除 status、version 之外要更新的列（如 "error_msg = ?"），
+// 只有数据库中的版本仍为 task.Version 且状态表允许这次转换时才会写入，成功后 task.Version 加一；
+// 在事务中调用时，调用方用 taskSnapshot 在事务没有提交时恢复任务
+func updateTaskRow(q taskExecer, task *ImageTask, set string, args ...interface{}) error {
+	sources := transitionSources(task.Status)
+	if len(sources) == 0 {
+		return &TransitionError{TaskID: task.ID, From: "", To: task.Status, Version: task.Version, Stale: task.Version}
+	}
+
+	query := `UPDATE image_tasks SET status = ?, version = version + 1`
+	if set != "" {
+		query += ", " + set
+	}
+	query += ` WHERE id = ? AND version = ? AND status IN (?` + strings.Repeat(", ?", len(sources)-1) + `)`
+
+	params := make([]interface{}, 0, len(args)+len(sources)+3)
+	params = append(params, task.Status)
+	params = append(params, args...)
+	params = append(params, task.ID, task.Version)
+	for _, s := range sources {
+		params = append(params, s)
+	}
+
+	res, err := q.Exec(query, params...)
+	if err != nil {
+		return fmt.Errorf("failed to update task: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return rejectedUpdate(q, task)
+	}
+	task.Version++
+	return nil
+}
+
+// rejectedUpdate 查询任务的当前状态，说明更新为何没有写入
+func rejectedUpdate(q taskExecer, task *ImageTask) error {
+	var status string
+	var version int64
+	err := q.QueryRow("SELECT status, version FROM image_tasks WHERE id = ?", task.ID).Scan(&status, &version)
+	if err == sql.ErrNoRows {
+		return ErrTaskNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load task: %w", err)
+	}
+	return &TransitionError{TaskID: task.ID, From: status, To: task.Status, Version: version, Stale: task.Version}
+}
+
+// updateTask 调用 updateTaskRow；被拒绝时缓存中的快照已过期，一并丢弃
+func (tm *TaskManager) updateTask(q taskExecer, task *ImageTask, set string, args ...interface{}) error {
+	err := updateTaskRow(q, task, set, args...)
+	var te *TransitionError
+	if errors.As(err, &te) {
+		tm.cache.remove(task.ID)
+	}
+	return err
+}
+
+// taskSnapshot 事务开始前的任务快照。updateTaskRow 在事务中就修改了 task.Version，
+// 事务没有提交时必须恢复，否则内存中的任务比数据库多一个版本，之后的更新都会冲突
+type taskSnapshot struct {
+	task  *ImageTask
+	saved *ImageTask
+}
+
+// snapshotTask 保存任务当前的内容，与 defer tx.Rollback() 一起 defer restore
+func snapshotTask(task *ImageTask) *taskSnapshot {
+	return &taskSnapshot{task: task, saved: task.Clone()}
+}
+
+// keep 事务已提交，保留对任务的修改
+func (s *taskSnapshot) keep() {
+	s.saved = nil
+}
+
+// restore 事务没有提交时把任务恢复为快照
+func (s *taskSnapshot) restore() {
+	if s.saved != nil {
+		*s.task = *s.saved
+	}
+}
+
+// Clone 返回任务的深拷贝
+func (t *ImageTask) Clone() *ImageTask {
+	c := *t
+	c.RunAt = cloneTime(t.RunAt)
+	c.StartedAt = cloneTime(t.StartedAt)
+	c.HeartbeatAt = cloneTime(t.HeartbeatAt)
+	c.LeaseExpiresAt = cloneTime(t.LeaseExpiresAt)
+	if t.Input != nil {
+		c.Input = append([]byte(nil), t.Input...)
+	}
+	if t.Output != nil {
+		c.Output = append([]byte(nil), t.Output...)
+	}
+	return &c
+}
+
+func cloneTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	v := *t
+	return &v
+}
+
+//
+// ======================
+// taskCache - 有界任务快照缓存
+// ======================
+//
+
+// taskCache 按 LRU 淘汰、按 TTL 过期的任务快照缓存，存取都复制任务，调用方拿不到缓存内部的指针
+type taskCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List // 最近使用的在前
+	entries  map[string]*list.Element
+	now      func() time.Time
+}
+
+type taskCacheEntry struct {
+	task    *ImageTask
+	expires time.Time
+}
+
+func newTaskCache(capacity int, ttl time.Duration) *taskCache {
+	c := &taskCache{
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+	c.setLimits(capacity, ttl)
+	return c
+}
+
+// setLimits 修改容量和 TTL，非正数使用默认值；超出新容量的快照立即淘汰
+func (c *taskCache) setLimits(capacity int, ttl time.Duration) {
+	if capacity <= 0 {
+		capacity = defaultTaskCacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultTaskCacheTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.capacity = capacity
+	c.ttl = ttl
+	c.evict()
+}
+
+// get 返回任务快照的副本，未缓存或已过期时返回 false
+func (c *taskCache) get(id string) (*ImageTask, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*taskCacheEntry)
+	if c.now().After(entry.expires) {
+		c.removeElement(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return entry.task.Clone(), true
+}
+
+// put 缓存任务的副本；已缓存的快照版本更新时保留已有快照，避免并发写入的旧结果覆盖新结果
+func (c *taskCache) put(task *ImageTask) {
+	snapshot := task.Clone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[task.ID]; ok {
+		entry := el.Value.(*taskCacheEntry)
+		if entry.task.Version <= snapshot.Version {
+			entry.task = snapshot
+		}
+		entry.expires = expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[task.ID] = c.order.PushFront(&taskCacheEntry{task: snapshot, expires: expires})
+	c.evict()
+}
+
+// update 在锁内修改已缓存的快照，用于不改变版本的字段（如心跳时间）
+func (c *taskCache) update(id string, fn func(task *ImageTask)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[id]; ok {
+		fn(el.Value.(*taskCacheEntry).task)
+	}
+}
+
+// remove 丢弃任务快照
+func (c *taskCache) remove(ids ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range ids {
+		if el, ok := c.entries[id]; ok {
+			c.removeElement(el)
+		}
+	}
+}
+
+// removeIf 丢弃满足条件的快照
+func (c *taskCache) removeIf(match func(task *ImageTask) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, el := range c.entries {
+		if match(el.Value.(*taskCacheEntry).task) {
+			c.removeElement(el)
+		}
+	}
+}
+
+// len 当前缓存的快照数
+func (c *taskCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// evict 淘汰最久未使用的快照直到不超过容量，调用方持有锁
+func (c *taskCache) evict() {
+	for c.order.Len() > c.capacity {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *taskCache) removeElement(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*taskCacheEntry).task.ID)
+}
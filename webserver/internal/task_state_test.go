@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateTaskRejectsIllegalTransition(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	if CanTransition(TaskDone, TaskRunning) || CanTransition(TaskFailed, TaskRunning) || !CanTransition(TaskQueued, TaskRunning) {
+		t.Fatal("unexpected transition table")
+	}
+
+	task, _ := tm.CreateJob(userID, "test.echo", json.RawMessage(`{}`), nil, TaskOptions{})
+	if err := tm.CompleteTask(task, json.RawMessage(`{"ok":true}`)); err != nil {
+		t.Fatalf("CompleteTask: %v", err)
+	}
+
+	done, _ := tm.GetTask(task.ID)
+	done.Status = TaskRunning
+	err := tm.UpdateTask(done)
+	var te *TransitionError
+	if !errors.Is(err, ErrIllegalTransition) || !errors.As(err, &te) || te.From != TaskDone {
+		t.Fatalf("expected DONE -> RUNNING to be rejected, got %v", err)
+	}
+	if err := tm.StartLease(done, time.Minute); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("expected a finished task not to be leased, got %v", err)
+	}
+
+	stored, _ := NewTaskManager(testDB).GetTask(task.ID)
+	if stored.Status != TaskDone || stored.Version != task.Version {
+		t.Fatalf("expected task to stay DONE at version %d, got %s at %d", task.Version, stored.Status, stored.Version)
+	}
+}
+
+func TestUpdateTaskRejectsStaleVersion(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "contended"}, TaskOptions{})
+	first, _ := tm.GetTask(task.ID)
+	second, _ := tm.GetTask(task.ID)
+
+	first.Status = TaskFailed
+	first.ErrorMsg = "backend down"
+	if err := tm.UpdateTask(first); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+
+	// second 读取于 first 写入之前，即使转换本身合法也不能覆盖
+	second.Status = TaskCancelled
+	if err := tm.UpdateTask(second); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("expected a stale snapshot to be rejected, got %v", err)
+	}
+
+	stored, _ := tm.GetTask(task.ID)
+	if stored.Status != TaskFailed || stored.Version != first.Version || stored.Version != task.Version+1 {
+		t.Fatalf("expected the first update to win, got %+v", stored)
+	}
+
+	// 快照是副本，修改不影响缓存
+	stored.Status = TaskDone
+	if again, _ := tm.GetTask(task.ID); again.Status != TaskFailed {
+		t.Fatalf("expected cached snapshot to be isolated, got %s", again.Status)
+	}
+}
+
+func TestFailedSaveRestoresTaskSnapshot(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	task, _ := tm.CreateTask(userID, TextToImageRequest{Prompt: "unlucky"}, TaskOptions{})
+	if err := tm.StartLease(task, time.Minute); err != nil {
+		t.Fatalf("StartLease: %v", err)
+	}
+	running := *task
+
+	// 任务行更新之后、提交之前失败：投递记录写不进去
+	if _, err := NewWebhookStore(testDB).CreateEndpoint(userID, "https://hooks.example.com/done", true); err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+	if _, err := testDB.Exec(`CREATE TRIGGER reject_deliveries BEFORE INSERT ON webhook_deliveries
+		BEGIN SELECT RAISE(ABORT, 'disk full'); END`); err != nil {
+		t.Fatalf("create trigger: %v", err)
+	}
+	if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("png"), MimeType: "image/png"}); err == nil {
+		t.Fatal("expected the save to fail")
+	}
+	if task.Version != running.Version || task.Status != TaskRunning || task.ImageID != 0 {
+		t.Fatalf("expected the task to be restored after rollback, got %s at version %d", task.Status, task.Version)
+	}
+
+	// 回退到 FAILED 不会因为版本超前而冲突
+	testDB.Exec(`DROP TRIGGER reject_deliveries`)
+	task.Status = TaskFailed
+	task.ErrorMsg = "failed to save result"
+	if err := tm.UpdateTask(task); err != nil {
+		t.Fatalf("expected the fallback to succeed, got %v", err)
+	}
+	if stored, _ := NewTaskManager(testDB).GetTask(task.ID); stored.Status != TaskFailed {
+		t.Fatalf("expected the task to be FAILED, got %s", stored.Status)
+	}
+}
+
+func TestTaskCacheEvictsAndExpires(t *testing.T) {
+	now := time.Now()
+	c := newTaskCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	for _, id := range []string{"a", "b"} {
+		c.put(&ImageTask{ID: id, Status: TaskQueued})
+	}
+	c.get("a") // a 变为最近使用
+	c.put(&ImageTask{ID: "c", Status: TaskQueued})
+	if c.len() != 2 {
+		t.Fatalf("expected cache to stay at 2 entries, got %d", c.len())
+	}
+	if _, ok := c.get("b"); ok {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+
+	// 旧版本不会覆盖新版本
+	c.put(&ImageTask{ID: "a", Status: TaskRunning, Version: 2})
+	c.put(&ImageTask{ID: "a", Status: TaskQueued, Version: 1})
+	if a, _ := c.get("a"); a.Status != TaskRunning {
+		t.Fatalf("expected the newer snapshot to be kept, got %s", a.Status)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected entry to expire after the TTL")
+	}
+	if c.len() != 1 {
+		t.Fatalf("expected the expired entry to be dropped, got %d entries", c.len())
+	}
+}
+
+func TestTaskManagerConcurrentLoad(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	tm.SetCacheLimits(8, time.Minute) // 小于任务数，读取时不断淘汰和重新加载
+	wp := NewWorkerPool(4, 100, nil, tm)
+	wp.RegisterHandler("test.echo", echoHandler{})
+	wp.Start()
+	defer wp.Stop()
+
+	const tasks = 40
+	var ids []string
+	for i := 0; i < tasks; i++ {
+		task, err := tm.CreateJob(userID, "test.echo", json.RawMessage(fmt.Sprintf(`{"n":%d}`, i)), nil, TaskOptions{})
+		if err != nil {
+			t.Fatalf("CreateJob: %v", err)
+		}
+		ids = append(ids, task.ID)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			seen := make(map[string]int64)
+			for i := r; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := ids[i%tasks]
+				task, err := tm.GetTask(id)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// 每个读取方看到的版本只增不减
+				if task.Version < seen[id] {
+					errs <- fmt.Errorf("task %s went back from version %d to %d", id, seen[id], task.Version)
+					return
+				}
+				seen[id] = task.Version
+				task.Status = "SCRIBBLED" // 快照归调用方所有，随意修改不影响其他读取方
+			}
+		}(r)
+	}
+
+	// 一部分任务在 worker 执行的同时被取消：只有一方能写入
+	for i, id := range ids {
+		task, _ := tm.GetTask(id)
+		if err := wp.Submit(task); err != nil {
+			t.Fatalf("Submit: %v", err)
+		}
+		if i%4 == 0 {
+			task.Status = TaskCancelled
+			if err := tm.UpdateTask(task); err != nil && !errors.Is(err, ErrVersionConflict) && !errors.Is(err, ErrIllegalTransition) {
+				t.Fatalf("UpdateTask: %v", err)
+			}
+		}
+	}
+
+	waitFor(t, "all tasks to finish", func() bool {
+		var pending int
+		testDB.QueryRow("SELECT COUNT(*) FROM image_tasks WHERE status IN (?, ?)", TaskQueued, TaskRunning).Scan(&pending)
+		return pending == 0
+	})
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for _, id := range ids {
+		cached, _ := tm.GetTask(id)
+		stored, _ := NewTaskManager(testDB).GetTask(id)
+		if cached.Status != stored.Status || cached.Version != stored.Version {
+			t.Fatalf("cache diverged from database for %s: %s@%d vs %s@%d", id, cached.Status, cached.Version, stored.Status, stored.Version)
+		}
+		if stored.Status != TaskDone && stored.Status != TaskCancelled {
+			t.Fatalf("unexpected final status %s for %s", stored.Status, id)
+		}
+	}
+}
@@ -2,9 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -15,21 +16,81 @@ import (
 // ======================
 
 const (
-	TaskQueued  = "QUEUED"
-	TaskRunning = "RUNNING"
-	TaskDone    = "DONE"
-	TaskFailed  = "FAILED"
+	TaskScheduled = "SCHEDULED" // 等待 run_at 到期，由调度器转为 QUEUED
+	TaskQueued    = "QUEUED"
+	TaskRunning   = "RUNNING"
+	TaskDone      = "DONE"
+	TaskFailed    = "FAILED"
+	TaskCancelled = "CANCELLED"
 )
 
+// ImageTask 异步任务。最初只用于文生图，现在由 Kind 区分任务类型：
+// image.generate 使用 Prompt 等生成参数列，其他类型的参数和结果分别在 Input / Output 中
 type ImageTask struct {
-	ID        string    `json:"task_id"`
-	UserID    int64     `json:"user_id"`
-	Prompt    string    `json:"prompt"`
-	Status    string    `json:"status"`
-	ResultURL string    `json:"result_url,omitempty"`
-	ErrorMsg  string    `json:"error,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID             string          `json:"task_id"`
+	UserID         int64           `json:"user_id"`
+	Kind           string          `json:"kind"`
+	Prompt         string          `json:"prompt"`
+	Model          string          `json:"model,omitempty"` // 指定的模型，为空时可以由任意实例生成
+	NegativePrompt string          `json:"negative_prompt,omitempty"`
+	Steps          int             `json:"steps,omitempty"`
+	Seed           int64           `json:"seed,omitempty"`
+	Width          int             `json:"width,omitempty"`
+	Height         int             `json:"height,omitempty"`
+	Status         string          `json:"status"`
+	ResultURL      string          `json:"result_url,omitempty"`
+	ImageID        int64           `json:"image_id,omitempty"`
+	ErrorMsg       string          `json:"error,omitempty"`
+	CallbackURL    string          `json:"callback_url,omitempty"`
+	Fingerprint    string          `json:"fingerprint,omitempty"`
+	CacheHit       bool            `json:"cache_hit,omitempty"`   // 结果来自已有图片，没有重新生成
+	AttachedTo     string          `json:"attached_to,omitempty"` // 跟随的相同参数任务，结果由该任务产生
+	RunAt          *time.Time      `json:"run_at,omitempty"`      // 计划执行时间，周期任务为下一次触发时间
+	Cron           string          `json:"cron,omitempty"`        // 周期任务的 cron 表达式
+	ScheduleID     string          `json:"schedule_id,omitempty"` // 产生该任务的周期任务
+	Attempts       int             `json:"attempts,omitempty"`    // worker 开始执行的次数
+	StartedAt      *time.Time      `json:"started_at,omitempty"`  // 本次执行的开始时间
+	HeartbeatAt    *time.Time      `json:"heartbeat_at,omitempty"`
+	LeaseExpiresAt *time.Time      `json:"lease_expires_at,omitempty"` // 本次执行的截止时间（含宽限）
+	WorkerID       string          `json:"worker_id,omitempty"`        // 持有租约的远程 worker，本进程执行时为空
+	Input          json.RawMessage `json:"input,omitempty"`            // 任务参数（JSON）
+	Output         json.RawMessage `json:"output,omitempty"`           // 非图片类任务的结果（JSON）
+	Version        int64           `json:"version"`                    // 每次状态更新加一，用于乐观并发控制
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// GenerationRequest 返回任务对应的后端生成请求
+func (t *ImageTask) GenerationRequest() TextToImageRequest {
+	return TextToImageRequest{
+		Prompt:         t.Prompt,
+		Model:          t.Model,
+		NegativePrompt: t.NegativePrompt,
+		Width:          t.Width,
+		Height:         t.Height,
+		Steps:          t.Steps,
+		Seed:           t.Seed,
+	}
+}
+
+// TaskOptions 任务的非生成参数
+type TaskOptions struct {
+	CallbackURL string    // 任务结束时回调的地址，为空则只通知用户注册的默认 webhook
+	RunAt       time.Time // 非零时任务以 SCHEDULED 状态创建，到期后才进入队列
+	Cron        string    // 非空时创建周期任务，RunAt 为空则取下一次触发时间（仅 image.generate）
+	ScheduleID  string    // 由周期任务产生时记录其 ID
+}
+
+// GenerationResult 一次成功生成的完整结果和来源信息
+type GenerationResult struct {
+	ImageData []byte
+	MimeType  string
+	Width     int
+	Height    int
+	Backend   string        // 生成图片的后端实例
+	Model     string        // 后端使用的模型
+	Seed      int64         // 后端实际使用的种子，任务未指定种子时写回任务和 prompts
+	Duration  time.Duration // 生成耗时
 }
 
 // ======================
@@ -38,86 +99,304 @@ type ImageTask struct {
 
 // TaskManager 管理任务的持久化和查询
 type TaskManager struct {
-	db    *sql.DB
-	mu    sync.RWMutex
-	cache map[string]*ImageTask
+	db     *sql.DB
+	cache  *taskCache // 任务快照，见 task_state.go
+	events *TaskEventBus
 }
 
 // NewTaskManager 创建新的 TaskManager
 func NewTaskManager(db *sql.DB) *TaskManager {
 	return &TaskManager{
-		db:    db,
-		cache: make(map[string]*ImageTask),
+		db:     db,
+		cache:  newTaskCache(defaultTaskCacheSize, defaultTaskCacheTTL),
+		events: NewTaskEventBus(defaultEventHistory),
+	}
+}
+
+// SetCacheLimits 设置任务快照缓存的条数上限和过期时间，非正数使用默认值
+func (tm *TaskManager) SetCacheLimits(size int, ttl time.Duration) {
+	tm.cache.setLimits(size, ttl)
+}
+
+// Events 返回任务事件总线，任务每次状态变化都会发布事件
+func (tm *TaskManager) Events() *TaskEventBus {
+	return tm.events
+}
+
+// taskColumns image_tasks 查询的统一列顺序，与 scanTask 对应
+const taskColumns = `id, user_id, kind, prompt, model, negative_prompt, steps, seed, width, height, status,
+	COALESCE(result_url, ''), COALESCE(image_id, 0), COALESCE(error_msg, ''), callback_url,
+	fingerprint, cache_hit, attached_to, run_at, cron_expr, schedule_id,
+	attempts, started_at, heartbeat_at, lease_expires_at, worker_id, input, output, version, created_at, updated_at`
+
+// rowScanner 兼容 *sql.Row 和 *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTask 按 taskColumns 的顺序读取一行任务
+func scanTask(row rowScanner) (*ImageTask, error) {
+	var task ImageTask
+	var runAt, startedAt, heartbeatAt, leaseExpiresAt sql.NullTime
+	var input, output string
+	err := row.Scan(
+		&task.ID, &task.UserID, &task.Kind, &task.Prompt, &task.Model, &task.NegativePrompt,
+		&task.Steps, &task.Seed, &task.Width, &task.Height, &task.Status,
+		&task.ResultURL, &task.ImageID, &task.ErrorMsg, &task.CallbackURL,
+		&task.Fingerprint, &task.CacheHit, &task.AttachedTo,
+		&runAt, &task.Cron, &task.ScheduleID,
+		&task.Attempts, &startedAt, &heartbeatAt, &leaseExpiresAt, &task.WorkerID, &input, &output,
+		&task.Version, &task.CreatedAt, &task.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	task.RunAt = nullTimePtr(runAt)
+	task.StartedAt = nullTimePtr(startedAt)
+	task.HeartbeatAt = nullTimePtr(heartbeatAt)
+	task.LeaseExpiresAt = nullTimePtr(leaseExpiresAt)
+	if input != "" {
+		task.Input = json.RawMessage(input)
 	}
+	if output != "" {
+		task.Output = json.RawMessage(output)
+	}
+	return &task, nil
 }
 
-// CreateTask 创建新任务
-func (tm *TaskManager) CreateTask(userID int64, prompt string) (*ImageTask, error) {
+// nullTimePtr 把可为空的时间列转换为指针，NULL 返回 nil
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// CreateTask 创建新任务，params 记录用户请求的全部生成参数；
+// opts 指定 RunAt 或 Cron 时任务以 SCHEDULED 状态创建，由 TaskScheduler 到期后入队
+func (tm *TaskManager) CreateTask(userID int64, params TextToImageRequest, opts TaskOptions) (*ImageTask, error) {
+	status := TaskQueued
+	var runAt *time.Time
+	if opts.Cron != "" {
+		schedule, err := ParseCron(opts.Cron)
+		if err != nil {
+			return nil, err
+		}
+		if opts.RunAt.IsZero() {
+			opts.RunAt = schedule.Next(time.Now())
+			if opts.RunAt.IsZero() {
+				return nil, fmt.Errorf("cron expression %q never fires", opts.Cron)
+			}
+		}
+	}
+	if !opts.RunAt.IsZero() {
+		status = TaskScheduled
+		runAt = &opts.RunAt
+	}
+
+	input, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode task input: %w", err)
+	}
+
 	task := &ImageTask{
-		ID:        uuid.New().String(),
-		UserID:    userID,
-		Prompt:    prompt,
-		Status:    TaskQueued,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		ID:             uuid.New().String(),
+		UserID:         userID,
+		Kind:           TaskKindImageGenerate,
+		Input:          input,
+		Prompt:         params.Prompt,
+		Model:          params.Model,
+		NegativePrompt: params.NegativePrompt,
+		Steps:          params.Steps,
+		Seed:           params.Seed,
+		Width:          params.Width,
+		Height:         params.Height,
+		CallbackURL:    opts.CallbackURL,
+		Fingerprint:    GenerationFingerprint(params),
+		RunAt:          runAt,
+		Cron:           opts.Cron,
+		ScheduleID:     opts.ScheduleID,
+		Status:         status,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
 	}
 
-	_, err := tm.db.Exec(`
-		INSERT INTO image_tasks (id, user_id, prompt, status, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, task.ID, task.UserID, task.Prompt, task.Status, task.CreatedAt, task.UpdatedAt)
+	_, err = tm.db.Exec(`
+		INSERT INTO image_tasks (id, user_id, kind, input, prompt, model, negative_prompt, steps, seed, width, height,
+			callback_url, fingerprint, run_at, cron_expr, schedule_id, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, task.ID, task.UserID, task.Kind, string(task.Input), task.Prompt, task.Model, task.NegativePrompt, task.Steps, task.Seed,
+		task.Width, task.Height, task.CallbackURL, task.Fingerprint, task.RunAt, task.Cron, task.ScheduleID,
+		task.Status, task.CreatedAt, task.UpdatedAt)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to create task: %w", err)
 	}
 
-	tm.mu.Lock()
-	tm.cache[task.ID] = task
-	tm.mu.Unlock()
+	tm.cache.put(task)
+	tm.publishStatus(task)
 
-	log.Printf("Created task %s for user %d: %s", task.ID, userID, prompt)
+	log.Printf("Created task %s for user %d: %s", task.ID, userID, task.Prompt)
 	return task, nil
 }
 
-// UpdateTask 更新任务状态
+// ErrCronNotSupported 只有 image.generate 任务可以按 cron 周期执行
+var ErrCronNotSupported = errors.New("cron schedules are only supported for image.generate tasks")
+
+// CreateJob 创建非文生图任务：input 为 JSON 参数，blob 非空时作为二进制输入（如上传的音频）一起保存
+func (tm *TaskManager) CreateJob(userID int64, kind string, input json.RawMessage, blob []byte, opts TaskOptions) (*ImageTask, error) {
+	if opts.Cron != "" {
+		return nil, ErrCronNotSupported
+	}
+
+	now := time.Now()
+	task := &ImageTask{
+		ID:          uuid.New().String(),
+		UserID:      userID,
+		Kind:        kind,
+		Input:       input,
+		CallbackURL: opts.CallbackURL,
+		Status:      TaskQueued,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if !opts.RunAt.IsZero() {
+		task.Status = TaskScheduled
+		task.RunAt = &opts.RunAt
+	}
+
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		INSERT INTO image_tasks (id, user_id, kind, input, prompt, callback_url, run_at, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, '', ?, ?, ?, ?, ?)
+	`, task.ID, task.UserID, task.Kind, string(task.Input), task.CallbackURL, task.RunAt,
+		task.Status, task.CreatedAt, task.UpdatedAt); err != nil {
+		return nil, fmt.Errorf("failed to create task: %w", err)
+	}
+	if blob != nil {
+		if _, err := tx.Exec(`INSERT INTO task_blobs (task_id, data, created_at) VALUES (?, ?, ?)`,
+			task.ID, blob, now); err != nil {
+			return nil, fmt.Errorf("failed to store task input: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create task: %w", err)
+	}
+
+	tm.storeAndPublish(task)
+
+	log.Printf("Created %s task %s for user %d", task.Kind, task.ID, userID)
+	return task, nil
+}
+
+// LoadTaskBlob 读取任务的二进制输入
+func (tm *TaskManager) LoadTaskBlob(taskID string) ([]byte, error) {
+	var data []byte
+	err := tm.db.QueryRow("SELECT data FROM task_blobs WHERE task_id = ?", taskID).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("task %s has no stored input", taskID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load task input: %w", err)
+	}
+	return data, nil
+}
+
+// CompleteTask 把任务标记为 DONE 并保存 JSON 结果，二进制输入不再需要，一并删除
+func (tm *TaskManager) CompleteTask(task *ImageTask, output json.RawMessage) error {
+	now := time.Now()
+
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+
+	task.Status = TaskDone
+	task.Output = output
+	task.ErrorMsg = ""
+	task.UpdatedAt = now
+	if err := tm.updateTask(tx, task, `output = ?, error_msg = '', updated_at = ?`, string(output), now); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM task_blobs WHERE task_id = ?", task.ID); err != nil {
+		return fmt.Errorf("failed to delete task input: %w", err)
+	}
+
+	if err := enqueueTaskWebhooks(tx, task); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to complete task: %w", err)
+	}
+	snapshot.keep()
+
+	tm.storeAndPublish(task)
+	return nil
+}
+
+// UpdateTask 更新任务状态；进入终态时在同一事务中写入 webhook 投递记录，
+// 跟随该任务的相同参数任务同步更新。task 读取之后已被修改时返回 ErrVersionConflict，
+// 状态表不允许这次转换时返回 ErrIllegalTransition
 func (tm *TaskManager) UpdateTask(task *ImageTask) error {
 	task.UpdatedAt = time.Now()
 
-	_, err := tm.db.Exec(`
-		UPDATE image_tasks 
-		SET status = ?, result_url = ?, error_msg = ?, updated_at = ?
-		WHERE id = ?
-	`, task.Status, task.ResultURL, task.ErrorMsg, task.UpdatedAt, task.ID)
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+
+	if err := tm.updateTask(tx, task, `result_url = ?, error_msg = ?, updated_at = ?`,
+		task.ResultURL, task.ErrorMsg, task.UpdatedAt); err != nil {
+		return err
+	}
+
+	if isTerminalStatus(task.Status) {
+		if err := enqueueTaskWebhooks(tx, task); err != nil {
+			return err
+		}
+	}
 
+	attached, err := syncAttachedTasks(tx, task)
 	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
 		return fmt.Errorf("failed to update task: %w", err)
 	}
+	snapshot.keep()
 
-	tm.mu.Lock()
-	tm.cache[task.ID] = task
-	tm.mu.Unlock()
+	tm.storeAndPublish(append([]*ImageTask{task}, attached...)...)
+	if task.Status == TaskRunning {
+		// 任务出队后，后面排队的任务位置都前移了一位
+		tm.publishQueuePositions()
+	}
 
 	return nil
 }
 
-// GetTask 获取任务
+// GetTask 获取任务的快照；返回的是副本，调用方修改后需通过 UpdateTask 等方法写回
 func (tm *TaskManager) GetTask(taskID string) (*ImageTask, error) {
-	tm.mu.RLock()
-	if task, ok := tm.cache[taskID]; ok {
-		tm.mu.RUnlock()
+	if task, ok := tm.cache.get(taskID); ok {
 		return task, nil
 	}
-	tm.mu.RUnlock()
 
-	var task ImageTask
-	err := tm.db.QueryRow(`
-		SELECT id, user_id, prompt, status, result_url, error_msg, created_at, updated_at
+	task, err := scanTask(tm.db.QueryRow(`
+		SELECT `+taskColumns+`
 		FROM image_tasks
 		WHERE id = ?
-	`, taskID).Scan(
-		&task.ID, &task.UserID, &task.Prompt, &task.Status,
-		&task.ResultURL, &task.ErrorMsg, &task.CreatedAt, &task.UpdatedAt,
-	)
+	`, taskID))
 
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("task not found")
@@ -126,11 +405,8 @@ func (tm *TaskManager) GetTask(taskID string) (*ImageTask, error) {
 		return nil, fmt.Errorf("failed to get task: %w", err)
 	}
 
-	tm.mu.Lock()
-	tm.cache[taskID] = &task
-	tm.mu.Unlock()
-
-	return &task, nil
+	tm.cache.put(task)
+	return task, nil
 }
 
 // GetUserTasks 获取用户的所有任务
@@ -140,7 +416,7 @@ func (tm *TaskManager) GetUserTasks(userID int64, limit int) ([]*ImageTask, erro
 	}
 
 	rows, err := tm.db.Query(`
-		SELECT id, user_id, prompt, status, result_url, error_msg, created_at, updated_at
+		SELECT `+taskColumns+`
 		FROM image_tasks
 		WHERE user_id = ?
 		ORDER BY created_at DESC
@@ -154,66 +430,198 @@ func (tm *TaskManager) GetUserTasks(userID int64, limit int) ([]*ImageTask, erro
 
 	var tasks []*ImageTask
 	for rows.Next() {
-		var task ImageTask
-		err := rows.Scan(
-			&task.ID, &task.UserID, &task.Prompt, &task.Status,
-			&task.ResultURL, &task.ErrorMsg, &task.CreatedAt, &task.UpdatedAt,
-		)
+		task, err := scanTask(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan task: %w", err)
 		}
-		tasks = append(tasks, &task)
+		tasks = append(tasks, task)
+	}
+
+	return tasks, rows.Err()
+}
+
+// QueuePosition 返回任务在队列中的位置（从 1 开始），任务不在排队状态或跟随其他任务时返回 0
+func (tm *TaskManager) QueuePosition(taskID string) (int, error) {
+	var position int
+	err := tm.db.QueryRow(`
+		SELECT COUNT(*)
+		FROM image_tasks
+		WHERE status = ? AND attached_to = ''
+			AND rowid <= (SELECT rowid FROM image_tasks WHERE id = ? AND status = ? AND attached_to = '')
+	`, TaskQueued, taskID, TaskQueued).Scan(&position)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get queue position: %w", err)
+	}
+	return position, nil
+}
+
+// storeAndPublish 把写入成功的任务快照存入缓存并依次发布任务状态事件
+func (tm *TaskManager) storeAndPublish(tasks ...*ImageTask) {
+	for _, task := range tasks {
+		tm.cache.put(task)
+		tm.publishStatus(task)
+	}
+}
+
+// publishStatus 发布任务状态事件，排队中的任务附带当前排队位置
+func (tm *TaskManager) publishStatus(task *ImageTask) {
+	event := TaskEvent{
+		Type:      TaskEventStatus,
+		TaskID:    task.ID,
+		Kind:      task.Kind,
+		UserID:    task.UserID,
+		Status:    task.Status,
+		ResultURL: task.ResultURL,
+		ErrorMsg:  task.ErrorMsg,
+		Time:      task.UpdatedAt,
+	}
+	if task.Status == TaskQueued {
+		if position, err := tm.QueuePosition(task.ID); err == nil {
+			event.QueuePosition = position
+		}
+	}
+	tm.events.Publish(event)
+}
+
+// publishQueuePositions 为所有排队中的任务发布最新排队位置（没有订阅者时跳过查询）
+func (tm *TaskManager) publishQueuePositions() {
+	if tm.events.SubscriberCount() == 0 {
+		return
 	}
 
-	return tasks, nil
+	rows, err := tm.db.Query(`
+		SELECT id, user_id FROM image_tasks
+		WHERE status = ? AND attached_to = ''
+		ORDER BY rowid
+	`, TaskQueued)
+	if err != nil {
+		log.Printf("Failed to load queued tasks: %v", err)
+		return
+	}
+	defer rows.Close()
+
+	position := 0
+	for rows.Next() {
+		var event TaskEvent
+		if err := rows.Scan(&event.TaskID, &event.UserID); err != nil {
+			log.Printf("Failed to scan queued task: %v", err)
+			return
+		}
+		position++
+		event.Type = TaskEventPosition
+		event.Status = TaskQueued
+		event.QueuePosition = position
+		tm.events.Publish(event)
+	}
 }
 
-// SaveImage 保存生成的图片到数据库
-func (tm *TaskManager) SaveImage(userID int64, prompt string, imageData []byte, mimeType string) (int64, error) {
+// SaveGenerationResult 在同一个事务中保存生成结果：
+// 写入 prompts（含完整生成参数）、写入 images（含后端、模型、耗时、MIME 类型），
+// 并把 image_tasks 标记为 DONE 且关联到生成的图片。任务未指定种子时记录后端实际使用的种子。
+// 任何一步失败都会整体回滚。
+func (tm *TaskManager) SaveGenerationResult(task *ImageTask, result GenerationResult) (int64, error) {
 	format := "jpeg"
-	if mimeType == "image/png" {
+	if result.MimeType == "image/png" {
 		format = "png"
+	} else if result.MimeType == "image/webp" {
+		format = "webp"
 	}
 
-	result, err := tm.db.Exec(`
-		INSERT INTO prompts (user_id, prompt_text, created_at)
-		VALUES (?, ?, ?)
-	`, userID, prompt, time.Now())
+	steps := task.Steps
+	if steps <= 0 {
+		steps = defaultInferenceSteps
+	}
 
+	tx, err := tm.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	snapshot := snapshotTask(task)
+	defer snapshot.restore()
+	if task.Seed == 0 {
+		task.Seed = result.Seed
+	}
+
+	now := time.Now()
+	res, err := tx.Exec(`
+		INSERT INTO prompts (user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, task.UserID, task.Prompt, task.NegativePrompt, steps, task.Seed, now)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create prompt: %w", err)
 	}
 
-	promptID, err := result.LastInsertId()
+	promptID, err := res.LastInsertId()
 	if err != nil {
 		return 0, fmt.Errorf("failed to get prompt id: %w", err)
 	}
 
-	result, err = tm.db.Exec(`
-		INSERT INTO images (user_id, prompt_id, image_data, image_format, created_at)
-		VALUES (?, ?, ?, ?, ?)
-	`, userID, promptID, imageData, format, time.Now())
-
+	res, err = tx.Exec(`
+		INSERT INTO images (user_id, prompt_id, image_data, image_format, width, height,
+			mime_type, backend_instance, model_name, duration_ms, fingerprint, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, task.UserID, promptID, result.ImageData, format, result.Width, result.Height,
+		result.MimeType, result.Backend, result.Model, result.Duration.Milliseconds(), task.Fingerprint, now)
 	if err != nil {
 		return 0, fmt.Errorf("failed to save image: %w", err)
 	}
 
-	imageID, err := result.LastInsertId()
+	imageID, err := res.LastInsertId()
 	if err != nil {
 		return 0, fmt.Errorf("failed to get image id: %w", err)
 	}
 
-	log.Printf("Saved image %d for user %d (prompt_id: %d)", imageID, userID, promptID)
+	resultURL := fmt.Sprintf("/api/images/%d", imageID)
+	output := imageTaskOutput(imageID, resultURL)
+	task.Status = TaskDone
+	task.ResultURL = resultURL
+	task.ImageID = imageID
+	task.Output = output
+	task.ErrorMsg = ""
+	task.UpdatedAt = now
+	if err := tm.updateTask(tx, task, `seed = ?, result_url = ?, image_id = ?, output = ?, error_msg = '', updated_at = ?`,
+		task.Seed, resultURL, imageID, string(output), now); err != nil {
+		return 0, err
+	}
+
+	if err := enqueueTaskWebhooks(tx, task); err != nil {
+		return 0, err
+	}
+
+	attached, err := syncAttachedTasks(tx, task)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit generation result: %w", err)
+	}
+	snapshot.keep()
+
+	tm.storeAndPublish(append([]*ImageTask{task}, attached...)...)
+
+	log.Printf("Saved image %d for user %d (prompt_id: %d, backend: %s, model: %s, %dms)",
+		imageID, task.UserID, promptID, result.Backend, result.Model, result.Duration.Milliseconds())
 	return imageID, nil
 }
 
+// imageTaskOutput image.generate 任务的 output，便于流水线后续步骤引用生成的图片
+func imageTaskOutput(imageID int64, resultURL string) json.RawMessage {
+	output, _ := json.Marshal(struct {
+		ImageID   int64  `json:"image_id"`
+		ResultURL string `json:"result_url"`
+	}{imageID, resultURL})
+	return output
+}
+
 // CleanupOldTasks 清理旧任务
 func (tm *TaskManager) CleanupOldTasks(olderThan time.Duration) error {
 	cutoff := time.Now().Add(-olderThan)
 	result, err := tm.db.Exec(`
 		DELETE FROM image_tasks
-		WHERE created_at < ? AND status IN (?, ?)
-	`, cutoff, TaskDone, TaskFailed)
+		WHERE created_at < ? AND status IN (?, ?, ?)
+	`, cutoff, TaskDone, TaskFailed, TaskCancelled)
 
 	if err != nil {
 		return fmt.Errorf("failed to cleanup old tasks: %w", err)
@@ -224,13 +632,33 @@ func (tm *TaskManager) CleanupOldTasks(olderThan time.Duration) error {
 		log.Printf("Cleaned up %d old tasks", rowsAffected)
 	}
 
-	tm.mu.Lock()
-	for id, task := range tm.cache {
-		if task.CreatedAt.Before(cutoff) {
-			delete(tm.cache, id)
-		}
+	// 未开启外键约束时审计记录和二进制输入不会级联删除
+	if _, err := tm.db.Exec(`
+		DELETE FROM task_audit_log WHERE task_id NOT IN (SELECT id FROM image_tasks)
+	`); err != nil {
+		return fmt.Errorf("failed to cleanup task audit log: %w", err)
+	}
+	if _, err := tm.db.Exec(`
+		DELETE FROM task_blobs WHERE task_id NOT IN (SELECT id FROM image_tasks)
+	`); err != nil {
+		return fmt.Errorf("failed to cleanup task inputs: %w", err)
 	}
-	tm.mu.Unlock()
+
+	// 已结束的流水线与任务一起过期
+	if _, err := tm.db.Exec(`
+		DELETE FROM pipelines WHERE created_at < ? AND status IN (?, ?)
+	`, cutoff, TaskDone, TaskFailed); err != nil {
+		return fmt.Errorf("failed to cleanup old pipelines: %w", err)
+	}
+	if _, err := tm.db.Exec(`
+		DELETE FROM pipeline_steps WHERE pipeline_id NOT IN (SELECT id FROM pipelines)
+	`); err != nil {
+		return fmt.Errorf("failed to cleanup pipeline steps: %w", err)
+	}
+
+	tm.cache.removeIf(func(task *ImageTask) bool {
+		return task.CreatedAt.Before(cutoff) && isTerminalStatus(task.Status)
+	})
 
 	return nil
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"webserver/testutil"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// setupTaskDB 创建带外键检查的测试数据库和一个测试用户
+func setupTaskDB(t *testing.T) (*sql.DB, int64) {
+	t.Helper()
+
+	testDB := testutil.SetupTestDB(t)
+	t.Cleanup(func() { testDB.Close() })
+
+	// PRAGMA 只对单个连接生效，固定为一个连接保证外键检查始终开启
+	testDB.SetMaxOpenConns(1)
+	if _, err := testDB.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		t.Fatalf("failed to enable foreign keys: %v", err)
+	}
+
+	res, err := testDB.Exec("INSERT INTO users (username, password) VALUES (?, ?)", "worker", "hash")
+	if err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+	userID, _ := res.LastInsertId()
+	return testDB, userID
+}
+
+func TestSaveGenerationResultRecordsProvenance(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{
+		Prompt:         "a red fox",
+		NegativePrompt: "blurry",
+		Steps:          30,
+		Seed:           42,
+		Width:          512,
+		Height:         768,
+	}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+
+	imageID, err := tm.SaveGenerationResult(task, GenerationResult{
+		ImageData: []byte("png-bytes"),
+		MimeType:  "image/png",
+		Width:     512,
+		Height:    768,
+		Backend:   "http://gpu-1:8000",
+		Model:     "qwen-image-gguf",
+		Duration:  1500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("SaveGenerationResult: %v", err)
+	}
+
+	var (
+		promptID                int64
+		format, mime, backend   string
+		model                   string
+		width, height, duration int64
+		promptText, negative    string
+		steps, seed             int64
+	)
+	err = testDB.QueryRow(`
+		SELECT prompt_id, image_format, mime_type, backend_instance, model_name, width, height, duration_ms
+		FROM images WHERE id = ?`, imageID).Scan(&promptID, &format, &mime, &backend, &model, &width, &height, &duration)
+	if err != nil {
+		t.Fatalf("failed to load image: %v", err)
+	}
+	if format != "png" || mime != "image/png" || backend != "http://gpu-1:8000" || model != "qwen-image-gguf" {
+		t.Fatalf("unexpected image provenance: %s %s %s %s", format, mime, backend, model)
+	}
+	if width != 512 || height != 768 || duration != 1500 {
+		t.Fatalf("unexpected image size/duration: %dx%d %dms", width, height, duration)
+	}
+
+	err = testDB.QueryRow(`
+		SELECT prompt_text, negative_prompt_text, inference_steps, seed
+		FROM prompts WHERE id = ?`, promptID).Scan(&promptText, &negative, &steps, &seed)
+	if err != nil {
+		t.Fatalf("failed to load prompt: %v", err)
+	}
+	if promptText != "a red fox" || negative != "blurry" || steps != 30 || seed != 42 {
+		t.Fatalf("unexpected prompt row: %q %q steps=%d seed=%d", promptText, negative, steps, seed)
+	}
+
+	tm.cache = newTaskCache(0, 0) // 强制从数据库读取
+	stored, err := tm.GetTask(task.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if stored.Status != TaskDone || stored.ImageID != imageID || stored.ResultURL == "" {
+		t.Fatalf("task not linked to image: %+v", stored)
+	}
+}
+
+func TestSaveGenerationResultRecordsBackendSeed(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a red fox"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	imageID, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("png-bytes"), MimeType: "image/png", Seed: 987654321})
+	if err != nil {
+		t.Fatalf("SaveGenerationResult: %v", err)
+	}
+
+	var seed int64
+	if err := testDB.QueryRow(`
+		SELECT p.seed FROM images i JOIN prompts p ON p.id = i.prompt_id WHERE i.id = ?`, imageID).Scan(&seed); err != nil {
+		t.Fatalf("failed to load prompt: %v", err)
+	}
+	tm.cache = newTaskCache(0, 0)
+	stored, err := tm.GetTask(task.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if seed != 987654321 || stored.Seed != 987654321 {
+		t.Fatalf("expected the backend seed to be recorded, got prompt=%d task=%d", seed, stored.Seed)
+	}
+}
+
+func TestSaveGenerationResultRollsBackOnFailure(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a cat"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+
+	// 不存在的用户会触发外键错误，整个事务应回滚
+	task.UserID = userID + 100
+	if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("x"), MimeType: "image/jpeg"}); err == nil {
+		t.Fatal("expected foreign key failure")
+	}
+
+	var images, prompts int
+	testDB.QueryRow("SELECT COUNT(*) FROM images").Scan(&images)
+	testDB.QueryRow("SELECT COUNT(*) FROM prompts").Scan(&prompts)
+	if images != 0 || prompts != 0 {
+		t.Fatalf("expected rollback, found %d images and %d prompts", images, prompts)
+	}
+
+	var status string
+	testDB.QueryRow("SELECT status FROM image_tasks WHERE id = ?", task.ID).Scan(&status)
+	if status != TaskQueued {
+		t.Fatalf("expected task to stay %s, got %s", TaskQueued, status)
+	}
+}
@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// ======================
+// Webhook 回调
+// ======================
+//
+
+const (
+	WebhookPending   = "PENDING"
+	WebhookDelivered = "DELIVERED"
+	WebhookFailed    = "FAILED"
+
+	WebhookEventTaskDone      = "task.done"
+	WebhookEventTaskFailed    = "task.failed"
+	WebhookEventTaskCancelled = "task.cancelled"
+
+	// 签名头：sha256=hex(HMAC-SHA256(secret, timestamp + "." + body))
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	WebhookTimestampHeader = "X-Webhook-Timestamp"
+	WebhookIDHeader        = "X-Webhook-Id"
+	WebhookEventHeader     = "X-Webhook-Event"
+)
+
+var (
+	ErrWebhookNotFound   = errors.New("webhook endpoint not found")
+	ErrInvalidWebhookURL = errors.New("webhook url must be an absolute http or https url")
+)
+
+// WebhookEndpoint 用户注册的回调地址
+type WebhookEndpoint struct {
+	ID        int64     `json:"id"`
+	UserID    int64     `json:"user_id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"` // 只在创建时返回
+	IsDefault bool      `json:"is_default"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookEvent 回调请求体
+type WebhookEvent struct {
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Task      ImageTask `json:"task"`
+}
+
+// WebhookDelivery 一次事件投递（outbox 中的一行）
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	EndpointID    int64            `json:"endpoint_id"`
+	TaskID        string           `json:"task_id"`
+	EventType     string           `json:"event_type"`
+	Status        string           `json:"status"`
+	Attempts      int              `json:"attempts"`
+	NextAttemptAt time.Time        `json:"next_attempt_at"`
+	LastError     string           `json:"last_error,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	AttemptLog    []WebhookAttempt `json:"attempt_log,omitempty"`
+}
+
+// WebhookAttempt 投递日志中的一次 HTTP 尝试
+type WebhookAttempt struct {
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SignWebhookPayload 计算回调签名，接收方用相同方法校验
+func SignWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature 常量时间校验回调签名
+func VerifyWebhookSignature(secret, timestamp string, body []byte, signature string) bool {
+	expected := SignWebhookPayload(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// validateWebhookURL 只允许绝对 http/https 地址
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidWebhookURL
+	}
+	return nil
+}
+
+// newWebhookSecret 生成 32 字节随机签名密钥
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate webhook secret: %w", err)
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}
+
+// enqueueTaskWebhooks 在任务进入终态的事务中写入投递记录：
+// 用户所有启用的默认 endpoint，以及任务指定的 callback_url 对应的 endpoint
+func enqueueTaskWebhooks(tx *sql.Tx, task *ImageTask) error {
+	eventType := WebhookEventTaskDone
+	switch task.Status {
+	case TaskFailed:
+		eventType = WebhookEventTaskFailed
+	case TaskCancelled:
+		eventType = WebhookEventTaskCancelled
+	}
+
+	rows, err := tx.Query(`
+		SELECT id FROM webhook_endpoints
+		WHERE user_id = ? AND enabled = 1 AND (is_default = 1 OR url = ?)
+	`, task.UserID, task.CallbackURL)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook endpoints: %w", err)
+	}
+	var endpointIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan webhook endpoint: %w", err)
+		}
+		endpointIDs = append(endpointIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load webhook endpoints: %w", err)
+	}
+	if len(endpointIDs) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(WebhookEvent{Type: eventType, CreatedAt: task.UpdatedAt, Task: *task})
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook event: %w", err)
+	}
+
+	now := time.Now()
+	for _, endpointID := range endpointIDs {
+		_, err := tx.Exec(`
+			INSERT INTO webhook_deliveries (endpoint_id, task_id, event_type, payload, status, next_attempt_at, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, endpointID, task.ID, eventType, string(payload), WebhookPending, now, now, now)
+		if err != nil {
+			return fmt.Errorf("failed to enqueue webhook delivery: %w", err)
+		}
+	}
+	return nil
+}
+
+//
+// ======================
+// WebhookStore - endpoint 和投递日志的持久化
+// ======================
+//
+
+// WebhookStore 管理 webhook endpoint 和投递记录
+type WebhookStore struct {
+	db *sql.DB
+}
+
+// NewWebhookStore 创建 WebhookStore
+func NewWebhookStore(db *sql.DB) *WebhookStore {
+	return &WebhookStore{db: db}
+}
+
+const webhookEndpointColumns = `id, user_id, url, is_default, enabled, created_at`
+
+func scanWebhookEndpoint(row rowScanner) (*WebhookEndpoint, error) {
+	var ep WebhookEndpoint
+	if err := row.Scan(&ep.ID, &ep.UserID, &ep.URL, &ep.IsDefault, &ep.Enabled, &ep.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &ep, nil
+}
+
+// CreateEndpoint 注册新的 endpoint，返回值包含签名密钥
+func (s *WebhookStore) CreateEndpoint(userID int64, rawURL string, isDefault bool) (*WebhookEndpoint, error) {
+	if err := validateWebhookURL(rawURL); err != nil {
+		return nil, err
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	ep := &WebhookEndpoint{
+		UserID:    userID,
+		URL:       rawURL,
+		Secret:    secret,
+		IsDefault: isDefault,
+		Enabled:   true,
+		CreatedAt: time.Now(),
+	}
+	res, err := s.db.Exec(`
+		INSERT INTO webhook_endpoints (user_id, url, secret, is_default, enabled, created_at)
+		VALUES (?, ?, ?, ?, 1, ?)
+	`, userID, rawURL, secret, isDefault, ep.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook endpoint: %w", err)
+	}
+	ep.ID, _ = res.LastInsertId()
+
+	log.Printf("Registered webhook endpoint %d for user %d: %s", ep.ID, userID, rawURL)
+	return ep, nil
+}
+
+// EnsureCallbackEndpoint 返回用户对应 URL 的 endpoint，不存在时注册为非默认 endpoint。
+// created 为 true 时返回值带有新生成的密钥。
+func (s *WebhookStore) EnsureCallbackEndpoint(userID int64, rawURL string) (ep *WebhookEndpoint, created bool, err error) {
+	ep, err = scanWebhookEndpoint(s.db.QueryRow(`
+		SELECT `+webhookEndpointColumns+` FROM webhook_endpoints WHERE user_id = ? AND url = ?
+	`, userID, rawURL))
+	if err == nil {
+		return ep, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, fmt.Errorf("failed to get webhook endpoint: %w", err)
+	}
+
+	ep, err = s.CreateEndpoint(userID, rawURL, false)
+	if err != nil {
+		return nil, false, err
+	}
+	return ep, true, nil
+}
+
+// ListEndpoints 列出用户的 endpoint（不含密钥）
+func (s *WebhookStore) ListEndpoints(userID int64) ([]*WebhookEndpoint, error) {
+	rows, err := s.db.Query(`
+		SELECT `+webhookEndpointColumns+` FROM webhook_endpoints WHERE user_id = ? ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook endpoints: %w", err)
+	}
+	defer rows.Close()
+
+	var endpoints []*WebhookEndpoint
+	for rows.Next() {
+		ep, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook endpoint: %w", err)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, rows.Err()
+}
+
+// GetEndpoint 获取用户的某个 endpoint
+func (s *WebhookStore) GetEndpoint(userID, id int64) (*WebhookEndpoint, error) {
+	ep, err := scanWebhookEndpoint(s.db.QueryRow(`
+		SELECT `+webhookEndpointColumns+` FROM webhook_endpoints WHERE id = ? AND user_id = ?
+	`, id, userID))
+	if err == sql.ErrNoRows {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get webhook endpoint: %w", err)
+	}
+	return ep, nil
+}
+
+// SetEndpointEnabled 启用或停用 endpoint，停用后不再产生新的投递
+func (s *WebhookStore) SetEndpointEnabled(userID, id int64, enabled bool) error {
+	res, err := s.db.Exec(`UPDATE webhook_endpoints SET enabled = ? WHERE id = ? AND user_id = ?`, enabled, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to update webhook endpoint: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// DeleteEndpoint 删除 endpoint 及其投递日志
+func (s *WebhookStore) DeleteEndpoint(userID, id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`DELETE FROM webhook_endpoints WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook endpoint: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrWebhookNotFound
+	}
+
+	// 不依赖连接上是否开启了外键级联
+	if _, err := tx.Exec(`
+		DELETE FROM webhook_delivery_attempts
+		WHERE delivery_id IN (SELECT id FROM webhook_deliveries WHERE endpoint_id = ?)
+	`, id); err != nil {
+		return fmt.Errorf("failed to delete webhook attempts: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM webhook_deliveries WHERE endpoint_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete webhook deliveries: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// ListDeliveries 返回 endpoint 最近的投递记录及每次尝试的日志
+func (s *WebhookStore) ListDeliveries(userID, endpointID int64, limit int) ([]*WebhookDelivery, error) {
+	if _, err := s.GetEndpoint(userID, endpointID); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+
+	rows, err := s.db.Query(`
+		SELECT id, endpoint_id, task_id, event_type, status, attempts, next_attempt_at, last_error, created_at, updated_at
+		FROM webhook_deliveries
+		WHERE endpoint_id = ?
+		ORDER BY id DESC
+		LIMIT ?
+	`, endpointID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+
+	var deliveries []*WebhookDelivery
+	byID := make(map[int64]*WebhookDelivery)
+	for rows.Next() {
+		var d WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.TaskID, &d.EventType, &d.Status, &d.Attempts,
+			&d.NextAttemptAt, &d.LastError, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan webhook delivery: %w", err)
+		}
+		deliveries = append(deliveries, &d)
+		byID[d.ID] = &d
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list webhook deliveries: %w", err)
+	}
+
+	attempts, err := s.db.Query(`
+		SELECT a.delivery_id, a.attempt, a.status_code, a.error, a.duration_ms, a.created_at
+		FROM webhook_delivery_attempts a
+		JOIN webhook_deliveries d ON d.id = a.delivery_id
+		WHERE d.endpoint_id = ?
+		ORDER BY a.delivery_id, a.attempt
+	`, endpointID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook attempts: %w", err)
+	}
+	defer attempts.Close()
+
+	for attempts.Next() {
+		var deliveryID int64
+		var a WebhookAttempt
+		if err := attempts.Scan(&deliveryID, &a.Attempt, &a.StatusCode, &a.Error, &a.DurationMS, &a.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook attempt: %w", err)
+		}
+		if d, ok := byID[deliveryID]; ok {
+			d.AttemptLog = append(d.AttemptLog, a)
+		}
+	}
+
+	return deliveries, attempts.Err()
+}
+
+//
+// ======================
+// WebhookDispatcher - 后台投递
+// ======================
+//
+
+// WebhookConfig 投递参数
+type WebhookConfig struct {
+	PollInterval time.Duration // 扫描 outbox 的间隔
+	Timeout      time.Duration // 单次请求超时
+	MaxAttempts  int           // 超过后标记为 FAILED
+	BaseBackoff  time.Duration // 第一次重试的等待时间，之后每次翻倍
+	MaxBackoff   time.Duration // 重试等待上限
+	BatchSize    int           // 每轮最多投递的数量
+}
+
+// DefaultWebhookConfig 默认投递参数：约 1 天内重试 10 次
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		PollInterval: 5 * time.Second,
+		Timeout:      10 * time.Second,
+		MaxAttempts:  10,
+		BaseBackoff:  30 * time.Second,
+		MaxBackoff:   6 * time.Hour,
+		BatchSize:    50,
+	}
+}
+
+// backoff 第 attempts 次失败后的等待时间
+func (c WebhookConfig) backoff(attempts int) time.Duration {
+	delay := c.BaseBackoff
+	for i := 1; i < attempts && delay < c.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+	return delay
+}
+
+// WebhookDispatcher 从 outbox 中取出到期的投递并发送
+type WebhookDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+	cfg    WebhookConfig
+	kick   chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewWebhookDispatcher 创建投递器，client 为 nil 时使用默认客户端
+func NewWebhookDispatcher(db *sql.DB, client *http.Client, cfg WebhookConfig) *WebhookDispatcher {
+	if client == nil {
+		client = &http.Client{Timeout: cfg.Timeout}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &WebhookDispatcher{
+		db:     db,
+		client: client,
+		cfg:    cfg,
+		kick:   make(chan struct{}, 1),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+// Start 启动后台投递循环，bus 不为 nil 时任务结束会立即唤醒投递
+func (d *WebhookDispatcher) Start(bus *TaskEventBus) {
+	d.wg.Add(1)
+	go d.loop()
+
+	if bus != nil {
+		sub := bus.Subscribe(EventFilter{}, 0)
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			defer sub.Cancel()
+			for {
+				select {
+				case <-d.ctx.Done():
+					return
+				case e := <-sub.Events:
+					if e.IsTerminal() {
+						d.Notify()
+					}
+				}
+			}
+		}()
+	}
+
+	log.Println("Webhook dispatcher started")
+}
+
+// Stop 停止投递，未完成的投递保留在 outbox 中，重启后继续
+func (d *WebhookDispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+	log.Println("Webhook dispatcher stopped")
+}
+
+// Notify 唤醒投递循环（非阻塞）
+func (d *WebhookDispatcher) Notify() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (d *WebhookDispatcher) loop() {
+	defer d.wg.Done()
+
+	ticker := time.NewTicker(d.cfg.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.DeliverDue()
+
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.kick:
+		}
+	}
+}
+
+// dueDelivery 一条待投递记录及其 endpoint 信息
+type dueDelivery struct {
+	id        int64
+	eventType string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+	enabled   bool
+}
+
+// DeliverDue 投递所有到期的记录，返回本轮尝试的数量
+func (d *WebhookDispatcher) DeliverDue() int {
+	rows, err := d.db.Query(`
+		SELECT w.id, w.event_type, w.payload, w.attempts, e.url, e.secret, e.enabled
+		FROM webhook_deliveries w
+		JOIN webhook_endpoints e ON e.id = w.endpoint_id
+		WHERE w.status = ? AND w.next_attempt_at <= ?
+		ORDER BY w.next_attempt_at
+		LIMIT ?
+	`, WebhookPending, time.Now(), d.cfg.BatchSize)
+	if err != nil {
+		log.Printf("Webhook dispatcher: failed to load deliveries: %v", err)
+		return 0
+	}
+
+	var due []dueDelivery
+	for rows.Next() {
+		var dd dueDelivery
+		var payload string
+		if err := rows.Scan(&dd.id, &dd.eventType, &payload, &dd.attempts, &dd.url, &dd.secret, &dd.enabled); err != nil {
+			log.Printf("Webhook dispatcher: failed to scan delivery: %v", err)
+			continue
+		}
+		dd.payload = []byte(payload)
+		due = append(due, dd)
+	}
+	rows.Close()
+
+	for _, dd := range due {
+		if d.ctx.Err() != nil {
+			break
+		}
+		d.deliver(dd)
+	}
+	return len(due)
+}
+
+// deliver 发送一次请求，记录尝试日志并更新 outbox 状态
+func (d *WebhookDispatcher) deliver(dd dueDelivery) {
+	attempt := dd.attempts + 1
+	start := time.Now()
+
+	var statusCode int
+	var deliverErr error
+	if !dd.enabled {
+		deliverErr = errors.New("endpoint disabled")
+	} else {
+		statusCode, deliverErr = d.send(dd)
+	}
+	duration := time.Since(start)
+
+	now := time.Now()
+	status := WebhookDelivered
+	lastError := ""
+	nextAttempt := now
+	if deliverErr != nil {
+		lastError = deliverErr.Error()
+		if attempt >= d.cfg.MaxAttempts || !dd.enabled {
+			status = WebhookFailed
+		} else {
+			status = WebhookPending
+			nextAttempt = now.Add(d.cfg.backoff(attempt))
+		}
+	}
+
+	if _, err := d.db.Exec(`
+		INSERT INTO webhook_delivery_attempts (delivery_id, attempt, status_code, error, duration_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, dd.id, attempt, statusCode, lastError, duration.Milliseconds(), now); err != nil {
+		log.Printf("Webhook dispatcher: failed to log attempt for delivery %d: %v", dd.id, err)
+	}
+
+	if _, err := d.db.Exec(`
+		UPDATE webhook_deliveries
+		SET status = ?, attempts = ?, next_attempt_at = ?, last_error = ?, updated_at = ?
+		WHERE id = ?
+	`, status, attempt, nextAttempt, lastError, now, dd.id); err != nil {
+		log.Printf("Webhook dispatcher: failed to update delivery %d: %v", dd.id, err)
+	}
+
+	if deliverErr != nil {
+		log.Printf("Webhook delivery %d attempt %d to %s failed (%s): %v", dd.id, attempt, dd.url, status, deliverErr)
+	}
+}
+
+// send 签名并 POST 事件，2xx 视为成功
+func (d *WebhookDispatcher) send(dd dueDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(d.ctx, d.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, dd.url, bytes.NewReader(dd.payload))
+	if err != nil {
+		return 0, fmt.Errorf("create request: %w", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "webserver-webhooks/1.0")
+	req.Header.Set(WebhookIDHeader, strconv.FormatInt(dd.id, 10))
+	req.Header.Set(WebhookEventHeader, dd.eventType)
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(dd.secret, timestamp, dd.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("execute request: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("receiver returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+//
+// ======================
+// Webhook 管理接口
+// ======================
+//
+
+// CreateWebhookRequest 注册 webhook 请求
+type CreateWebhookRequest struct {
+	URL       string `json:"url"`
+	IsDefault *bool  `json:"is_default,omitempty"` // 默认为 true：接收该用户所有任务的事件
+}
+
+// HandleWebhooks 处理 GET/POST /api/v1/webhooks
+//
+//	@Summary		List or register webhook endpoints
+//	@Description	GET lists the caller's webhook endpoints; POST registers a new endpoint and returns its signing secret once
+//	@Tags			webhooks
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			request	body		CreateWebhookRequest	false	"Endpoint to register (POST)"
+//	@Success		200		{array}		WebhookEndpoint
+//	@Success		201		{object}	WebhookEndpoint
+//	@Failure		400		{object}	map[string]string
+//	@Failure		401		{object}	map[string]string
+//	@Router			/api/v1/webhooks [get]
+//	@Router			/api/v1/webhooks [post]
+func (h *AsyncAPIHandlers) HandleWebhooks(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		endpoints, err := h.webhooks.ListEndpoints(userID)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to list webhooks")
+			return
+		}
+		writeJSON(w, http.StatusOK, endpoints)
+
+	case http.MethodPost:
+		var req CreateWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorResponse(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		isDefault := req.IsDefault == nil || *req.IsDefault
+
+		ep, err := h.webhooks.CreateEndpoint(userID, strings.TrimSpace(req.URL), isDefault)
+		if errors.Is(err, ErrInvalidWebhookURL) {
+			errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err != nil {
+			if strings.Contains(err.Error(), "UNIQUE") {
+				errorResponse(w, http.StatusConflict, "webhook url already registered")
+				return
+			}
+			errorResponse(w, http.StatusInternalServerError, "failed to create webhook")
+			return
+		}
+		writeJSON(w, http.StatusCreated, ep)
+
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// HandleWebhook 处理 PUT/DELETE /api/v1/webhooks/{id} 和 GET /api/v1/webhooks/{id}/deliveries
+//
+//	@Summary		Manage a webhook endpoint
+//	@Description	PUT enables or disables the endpoint, DELETE removes it, GET .../deliveries returns its delivery log
+//	@Tags			webhooks
+//	@Accept			json
+//	@Produce		json
+//	@Security		BearerAuth
+//	@Param			id		path		int	true	"Webhook endpoint ID"
+//	@Param			limit	query		int	false	"Maximum number of deliveries to return"	default(50)
+//	@Success		200		{array}		WebhookDelivery
+//	@Success		204		{object}	nil
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Router			/api/v1/webhooks/{id} [put]
+//	@Router			/api/v1/webhooks/{id} [delete]
+//	@Router			/api/v1/webhooks/{id}/deliveries [get]
+func (h *AsyncAPIHandlers) HandleWebhook(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(r.Header.Get("X-User-ID"), 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, "invalid user id")
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/webhooks/")
+	idStr, sub, _ := strings.Cut(rest, "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		errorResponse(w, http.StatusBadRequest, "invalid webhook id")
+		return
+	}
+
+	switch {
+	case sub == "deliveries" && r.Method == http.MethodGet:
+		limit := 50
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+			limit = l
+		}
+		deliveries, err := h.webhooks.ListDeliveries(userID, id, limit)
+		if errors.Is(err, ErrWebhookNotFound) {
+			errorResponse(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to list deliveries")
+			return
+		}
+		writeJSON(w, http.StatusOK, deliveries)
+
+	case sub == "" && r.Method == http.MethodPut:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			errorResponse(w, http.StatusBadRequest, "enabled is required")
+			return
+		}
+		if err := h.webhooks.SetEndpointEnabled(userID, id, *req.Enabled); err != nil {
+			if errors.Is(err, ErrWebhookNotFound) {
+				errorResponse(w, http.StatusNotFound, err.Error())
+				return
+			}
+			errorResponse(w, http.StatusInternalServerError, "failed to update webhook")
+			return
+		}
+		ep, err := h.webhooks.GetEndpoint(userID, id)
+		if err != nil {
+			errorResponse(w, http.StatusInternalServerError, "failed to get webhook")
+			return
+		}
+		writeJSON(w, http.StatusOK, ep)
+
+	case sub == "" && r.Method == http.MethodDelete:
+		if err := h.webhooks.DeleteEndpoint(userID, id); err != nil {
+			if errors.Is(err, ErrWebhookNotFound) {
+				errorResponse(w, http.StatusNotFound, err.Error())
+				return
+			}
+			errorResponse(w, http.StatusInternalServerError, "failed to delete webhook")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case sub != "" && sub != "deliveries":
+		errorResponse(w, http.StatusNotFound, "not found")
+
+	default:
+		errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
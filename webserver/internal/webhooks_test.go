@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver 记录收到的回调，前 failures 次返回 500
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.bodies = append(rcv.bodies, body)
+	rcv.headers = append(rcv.headers, r.Header.Clone())
+	if rcv.failures > 0 {
+		rcv.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func testWebhookConfig() WebhookConfig {
+	cfg := DefaultWebhookConfig()
+	cfg.BaseBackoff = 0 // 失败后立即到期，方便测试重试
+	cfg.MaxBackoff = 0
+	cfg.MaxAttempts = 3
+	return cfg
+}
+
+func TestWebhookDeliverySignedAndRetried(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	store := NewWebhookStore(testDB)
+
+	rcv := &webhookReceiver{failures: 1}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	ep, err := store.CreateEndpoint(userID, server.URL, true)
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a lake"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("x"), MimeType: "image/png"}); err != nil {
+		t.Fatalf("SaveGenerationResult: %v", err)
+	}
+
+	d := NewWebhookDispatcher(testDB, server.Client(), testWebhookConfig())
+	if n := d.DeliverDue(); n != 1 {
+		t.Fatalf("expected 1 delivery attempt, got %d", n)
+	}
+	if n := d.DeliverDue(); n != 1 {
+		t.Fatalf("expected retry after 500, got %d attempts", n)
+	}
+	if n := d.DeliverDue(); n != 0 {
+		t.Fatalf("expected nothing left to deliver, got %d", n)
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if len(rcv.bodies) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(rcv.bodies))
+	}
+	// 重试发送完全相同的内容
+	if string(rcv.bodies[0]) != string(rcv.bodies[1]) {
+		t.Fatal("retry payload differs from the first attempt")
+	}
+
+	h := rcv.headers[1]
+	if h.Get(WebhookEventHeader) != WebhookEventTaskDone {
+		t.Fatalf("unexpected event header %q", h.Get(WebhookEventHeader))
+	}
+	if !VerifyWebhookSignature(ep.Secret, h.Get(WebhookTimestampHeader), rcv.bodies[1], h.Get(WebhookSignatureHeader)) {
+		t.Fatal("signature does not verify with the endpoint secret")
+	}
+	if VerifyWebhookSignature("wrong", h.Get(WebhookTimestampHeader), rcv.bodies[1], h.Get(WebhookSignatureHeader)) {
+		t.Fatal("signature verified with the wrong secret")
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(rcv.bodies[1], &event); err != nil {
+		t.Fatalf("bad payload: %v", err)
+	}
+	if event.Task.ID != task.ID || event.Task.Status != TaskDone || event.Task.ResultURL == "" {
+		t.Fatalf("unexpected payload task: %+v", event.Task)
+	}
+
+	deliveries, err := store.ListDeliveries(userID, ep.ID, 10)
+	if err != nil {
+		t.Fatalf("ListDeliveries: %v", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != WebhookDelivered || deliveries[0].Attempts != 2 {
+		t.Fatalf("unexpected deliveries: %+v", deliveries)
+	}
+	attemptLog := deliveries[0].AttemptLog
+	if len(attemptLog) != 2 || attemptLog[0].StatusCode != http.StatusInternalServerError || attemptLog[1].StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected attempt log: %+v", attemptLog)
+	}
+}
+
+func TestWebhookDeliveryGivesUpAfterMaxAttempts(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	store := NewWebhookStore(testDB)
+
+	rcv := &webhookReceiver{failures: 100}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	ep, err := store.CreateEndpoint(userID, server.URL, true)
+	if err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a storm"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	task.Status = TaskFailed
+	task.ErrorMsg = "backend unavailable"
+	if err := tm.UpdateTask(task); err != nil {
+		t.Fatalf("UpdateTask: %v", err)
+	}
+
+	cfg := testWebhookConfig()
+	d := NewWebhookDispatcher(testDB, server.Client(), cfg)
+	for i := 0; i < cfg.MaxAttempts+2; i++ {
+		d.DeliverDue()
+	}
+
+	deliveries, err := store.ListDeliveries(userID, ep.ID, 10)
+	if err != nil {
+		t.Fatalf("ListDeliveries: %v", err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Status != WebhookFailed || deliveries[0].Attempts != cfg.MaxAttempts {
+		t.Fatalf("expected FAILED after %d attempts, got %+v", cfg.MaxAttempts, deliveries)
+	}
+	if deliveries[0].EventType != WebhookEventTaskFailed {
+		t.Fatalf("unexpected event type %q", deliveries[0].EventType)
+	}
+}
+
+func TestWebhookCallbackURLOnlyReceivesItsTask(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	store := NewWebhookStore(testDB)
+
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	ep, created, err := store.EnsureCallbackEndpoint(userID, server.URL)
+	if err != nil || !created || ep.Secret == "" {
+		t.Fatalf("EnsureCallbackEndpoint: created=%v err=%v", created, err)
+	}
+	again, created, err := store.EnsureCallbackEndpoint(userID, server.URL)
+	if err != nil || created || again.ID != ep.ID {
+		t.Fatalf("expected existing endpoint to be reused: created=%v err=%v", created, err)
+	}
+
+	withCallback, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "with"}, TaskOptions{CallbackURL: server.URL})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	without, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "without"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	for _, task := range []*ImageTask{withCallback, without} {
+		if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("x"), MimeType: "image/png"}); err != nil {
+			t.Fatalf("SaveGenerationResult: %v", err)
+		}
+	}
+
+	d := NewWebhookDispatcher(testDB, server.Client(), testWebhookConfig())
+	if n := d.DeliverDue(); n != 1 {
+		t.Fatalf("expected only the callback task to be delivered, got %d", n)
+	}
+
+	var event WebhookEvent
+	rcv.mu.Lock()
+	err = json.Unmarshal(rcv.bodies[0], &event)
+	rcv.mu.Unlock()
+	if err != nil || event.Task.ID != withCallback.ID || event.Task.CallbackURL != server.URL {
+		t.Fatalf("unexpected callback payload: %+v (%v)", event.Task, err)
+	}
+}
+
+func TestWebhookDispatcherWakesOnTerminalEvent(t *testing.T) {
+	testDB, userID := setupTaskDB(t)
+	tm := NewTaskManager(testDB)
+	store := NewWebhookStore(testDB)
+
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	if _, err := store.CreateEndpoint(userID, server.URL, true); err != nil {
+		t.Fatalf("CreateEndpoint: %v", err)
+	}
+
+	cfg := testWebhookConfig()
+	cfg.PollInterval = time.Hour // 只能靠事件唤醒
+	d := NewWebhookDispatcher(testDB, server.Client(), cfg)
+	d.Start(tm.Events())
+	defer d.Stop()
+
+	task, err := tm.CreateTask(userID, TextToImageRequest{Prompt: "a bird"}, TaskOptions{})
+	if err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if _, err := tm.SaveGenerationResult(task, GenerationResult{ImageData: []byte("x"), MimeType: "image/png"}); err != nil {
+		t.Fatalf("SaveGenerationResult: %v", err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		rcv.mu.Lock()
+		n := len(rcv.bodies)
+		rcv.mu.Unlock()
+		if n == 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("webhook was not delivered after the task finished")
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	for _, raw := range []string{"", "ftp://example.com/hook", "/relative", "http://"} {
+		if validateWebhookURL(raw) == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+	if err := validateWebhookURL("https://example.com/hook"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
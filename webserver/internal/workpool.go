@@ -1,46 +1,99 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"log"
+	"sort"
 	"sync"
 	"time"
 )
 
 // WorkerPool 工作池，管理多个 worker goroutine 处理任务
 type WorkerPool struct {
-	taskQueue    chan *ImageTask
-	workerCount  int
-	wg           sync.WaitGroup
-	ctx          context.Context
-	cancel       context.CancelFunc
-	imageClients []TextToImageProvider
-	balancer     *LoadBalancer
-	taskManager  *TaskManager
+	taskQueue   chan *ImageTask
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+	balancer    *ImageBalancer
+	speech      *SpeechBalancer // 语音识别后端，只用于计算可用容量
+	taskManager *TaskManager
+	durations   *DurationTracker
+	deadlines   DeadlinePolicy
+	registry    *TaskRegistry
+
+	mu          sync.Mutex
+	running     map[string]time.Time     // 正在执行的任务 → 开始时间
+	assignments map[int]*localAssignment // worker 编号 → 正在执行的任务
+	maxWait     time.Duration            // 准入上限，0 表示不限制
+	resume      chan struct{}            // 非 nil 表示已暂停，Resume 时关闭
+
+	// worker 数量调整，见 autoscale.go
+	scaling      ScalingPolicy
+	target       int              // 目标 worker 数
+	workers      map[int]struct{} // 存活的 worker 编号
+	nextWorkerID int
+	resized      chan struct{} // 目标数量减少时关闭并替换
+	nudge        chan struct{}
+	lowSince     time.Time // 需求开始低于目标的时间，用于延迟缩容
+	decisions    []ScalingDecision
+
+	remoteEnabled bool // 本进程无法执行的任务留在数据库中，由远程 worker 领取
 }
 
-// NewWorkerPool 创建新的 worker pool
+// NewWorkerPool 创建新的 worker pool，固定 workerCount 个 worker；SetScalingPolicy 可改为按负载自动调整
 func NewWorkerPool(workerCount int, queueSize int, imageClients []TextToImageProvider, taskManager *TaskManager) *WorkerPool {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &WorkerPool{
-		taskQueue:    make(chan *ImageTask, queueSize),
-		workerCount:  workerCount,
-		ctx:          ctx,
-		cancel:       cancel,
-		imageClients: imageClients,
-		balancer:     NewLoadBalancer(imageClients),
-		taskManager:  taskManager,
+	wp := &WorkerPool{
+		taskQueue:   make(chan *ImageTask, queueSize),
+		ctx:         ctx,
+		cancel:      cancel,
+		balancer:    NewLoadBalancer(imageClients),
+		taskManager: taskManager,
+		durations:   NewDurationTracker(durationWindow, defaultGenerationEstimate),
+		deadlines:   DefaultDeadlinePolicy(),
+		running:     make(map[string]time.Time),
+		assignments: make(map[int]*localAssignment),
+		maxWait:     defaultAdmissionMaxWait,
+		registry:    NewTaskRegistry(),
+		workers:     make(map[int]struct{}),
+		resized:     make(chan struct{}),
+		nudge:       make(chan struct{}, 1),
 	}
+	wp.SetScalingPolicy(ScalingPolicy{Min: workerCount, Max: workerCount})
+	wp.registry.Register(TaskKindImageGenerate, &imageGenerateHandler{wp: wp})
+	wp.registry.Register(TaskKindPromptTemplate, promptTemplateHandler{})
+	return wp
+}
+
+// RegisterHandler 注册任务类型的处理器，需在 Start 之前调用
+func (wp *WorkerPool) RegisterHandler(kind string, h TaskHandler) {
+	wp.registry.Register(kind, h)
+}
+
+// Handles 是否注册了 kind 的处理器
+func (wp *WorkerPool) Handles(kind string) bool {
+	_, ok := wp.registry.Lookup(kind)
+	return ok
 }
 
 // Start 启动 worker pool
 func (wp *WorkerPool) Start() {
-	log.Printf("Starting worker pool with %d workers", wp.workerCount)
-	for i := 0; i < wp.workerCount; i++ {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.scaling.dynamic() {
+		log.Printf("Starting worker pool with %d workers (scaling between %d and %d)", wp.target, wp.scaling.Min, wp.scaling.Max)
 		wp.wg.Add(1)
-		go wp.worker(i)
+		go wp.autoscale(wp.scaling.Interval)
+	} else {
+		log.Printf("Starting worker pool with %d workers", wp.target)
 	}
+	wp.spawnWorkers()
 }
 
 // Stop 停止 worker pool
@@ -49,103 +102,437 @@ func (wp *WorkerPool) Stop() {
 	wp.cancel()
 	close(wp.taskQueue)
 	wp.wg.Wait()
+	wp.balancer.Close()
 	log.Println("Worker pool stopped")
 }
 
-// Submit 提交任务到队列
+// Submit 提交任务到队列，队列已满时立即返回 ErrQueueFull。
+// 启用远程 worker 且本进程无法执行该类型（或没有实例提供任务指定的模型）时，任务保持 QUEUED 等待远程 worker 领取。
+// 入队的是任务副本，worker 执行期间修改的字段不会和调用方共享
 func (wp *WorkerPool) Submit(task *ImageTask) error {
+	if wp.remoteEnabled && (!wp.RunsLocally(task.Kind) || !wp.servesModelLocally(task)) {
+		return nil
+	}
 	select {
-	case wp.taskQueue <- task:
+	case wp.taskQueue <- task.Clone():
+		wp.nudgeScaler()
 		return nil
-	case <-time.After(5 * time.Second):
-		return fmt.Errorf("task queue is full, timeout after 5s")
+	default:
+		return ErrQueueFull
+	}
+}
+
+// EnableRemoteWorkers 允许远程 worker 领取任务，需在 Start 之前调用
+func (wp *WorkerPool) EnableRemoteWorkers() {
+	wp.remoteEnabled = true
+}
+
+// RunsLocally 本进程能否执行 kind 的任务
+func (wp *WorkerPool) RunsLocally(kind string) bool {
+	h, ok := wp.registry.Lookup(kind)
+	if !ok {
+		return false
+	}
+	if a, ok := h.(LocalAvailability); ok {
+		return a.Available()
+	}
+	return true
+}
+
+// servesModelLocally 本进程的文生图实例能否处理任务指定的模型，没有指定模型时为 true
+func (wp *WorkerPool) servesModelLocally(task *ImageTask) bool {
+	if task.Kind != TaskKindImageGenerate || task.Model == "" {
+		return true
+	}
+	return wp.balancer.CheckModel(task.GenerationRequest()) == nil
+}
+
+// TaskDeadline 返回任务的执行截止时间；没有注册处理器的类型使用截止时间上限
+func (wp *WorkerPool) TaskDeadline(task *ImageTask) time.Duration {
+	if h, ok := wp.registry.Lookup(task.Kind); ok {
+		return h.Deadline(task)
 	}
+	return wp.deadlines.Max
+}
+
+// SetSpeechBalancer 设置语音识别的负载均衡器，自动调整时其可用容量与文生图一起计入上限，需在 Start 之前调用
+func (wp *WorkerPool) SetSpeechBalancer(lb *SpeechBalancer) {
+	wp.speech = lb
+}
+
+// SetDeadlinePolicy 设置按生成参数计算任务截止时间的策略，需在 Start 之前调用
+func (wp *WorkerPool) SetDeadlinePolicy(p DeadlinePolicy) {
+	wp.deadlines = p
+}
+
+// SetAdmissionLimit 设置准入上限：预计等待超过 maxWait 时拒绝新任务，0 表示只在队列满时拒绝
+func (wp *WorkerPool) SetAdmissionLimit(maxWait time.Duration) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.maxWait = maxWait
+}
+
+// AdmissionLimit 返回当前准入上限
+func (wp *WorkerPool) AdmissionLimit() time.Duration {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.maxWait
+}
+
+// Durations 返回生成耗时统计
+func (wp *WorkerPool) Durations() *DurationTracker {
+	return wp.durations
 }
 
-// worker 处理任务的 goroutine
+// Admit 判断是否接受新任务；拒绝时返回 ErrQueueFull 或 ErrAdmissionRejected，以及建议的重试等待时间
+func (wp *WorkerPool) Admit() (time.Duration, error) {
+	now := time.Now()
+	if wp.GetQueueLength() >= wp.GetQueueCapacity() {
+		// 下一个 worker 空闲时队列才会腾出位置
+		return wp.EstimateQueued(1).StartAt.Sub(now), ErrQueueFull
+	}
+
+	maxWait := wp.AdmissionLimit()
+	if maxWait <= 0 {
+		return 0, nil
+	}
+	if wait := wp.PredictedWait(); wait > maxWait {
+		// 积压消化到上限以内所需的时间
+		return wait - maxWait, ErrAdmissionRejected
+	}
+	return 0, nil
+}
+
+// PredictedWait 新提交的任务预计要等待多久才开始执行
+func (wp *WorkerPool) PredictedWait() time.Duration {
+	now := time.Now()
+	wait := wp.estimateAt(now, wp.GetQueueLength()+1).StartAt.Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// EstimateQueued 预估排在第 position 位（从 1 开始）的任务的开始、结束时间
+func (wp *WorkerPool) EstimateQueued(position int) TaskEstimate {
+	return wp.estimateAt(time.Now(), position)
+}
+
+// EstimateRunning 预估正在执行的任务的结束时间，任务不在执行时返回 false
+func (wp *WorkerPool) EstimateRunning(taskID string) (TaskEstimate, bool) {
+	wp.mu.Lock()
+	started, ok := wp.running[taskID]
+	wp.mu.Unlock()
+	if !ok {
+		return TaskEstimate{}, false
+	}
+
+	finish := started.Add(wp.durations.Average())
+	if now := time.Now(); finish.Before(now) {
+		finish = now
+	}
+	return TaskEstimate{StartAt: started, FinishAt: finish}, true
+}
+
+// RunningCount 返回正在执行的任务数
+func (wp *WorkerPool) RunningCount() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return len(wp.running)
+}
+
+func (wp *WorkerPool) estimateAt(now time.Time, position int) TaskEstimate {
+	wp.mu.Lock()
+	running := make([]time.Time, 0, len(wp.running))
+	for _, started := range wp.running {
+		running = append(running, started)
+	}
+	wp.mu.Unlock()
+	sort.Slice(running, func(i, j int) bool { return running[i].Before(running[j]) })
+
+	return estimateQueue(now, wp.targetWorkers(), wp.durations.Average(), running, position)
+}
+
+func (wp *WorkerPool) markRunning(taskID string) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.running[taskID] = time.Now()
+}
+
+func (wp *WorkerPool) markFinished(taskID string) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	delete(wp.running, taskID)
+}
+
+// localAssignment 本进程 worker 正在执行的任务，cancel 用于管理员取消
+type localAssignment struct {
+	WorkerAssignment
+	cancel context.CancelFunc
+}
+
+func (wp *WorkerPool) assign(workerID int, task *ImageTask, cancel context.CancelFunc) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.assignments[workerID] = &localAssignment{
+		WorkerAssignment: WorkerAssignment{
+			TaskID:         task.ID,
+			Kind:           task.Kind,
+			UserID:         task.UserID,
+			Attempt:        task.Attempts,
+			StartedAt:      task.StartedAt,
+			LeaseExpiresAt: task.LeaseExpiresAt,
+		},
+		cancel: cancel,
+	}
+}
+
+func (wp *WorkerPool) unassign(workerID int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	delete(wp.assignments, workerID)
+}
+
+// LocalAssignments 返回本进程每个 worker（按编号）正在执行的任务，空闲的 worker 不在其中
+func (wp *WorkerPool) LocalAssignments() map[int]WorkerAssignment {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	out := make(map[int]WorkerAssignment, len(wp.assignments))
+	for id, a := range wp.assignments {
+		out[id] = a.WorkerAssignment
+	}
+	return out
+}
+
+// CancelRunning 中止本进程正在执行的任务，任务不在本进程执行时返回 false
+func (wp *WorkerPool) CancelRunning(taskID string) bool {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	for _, a := range wp.assignments {
+		if a.TaskID == taskID {
+			a.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// Pause 暂停从队列取任务，正在执行的任务不受影响；远程 worker 也不再领取任务
+func (wp *WorkerPool) Pause() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.resume == nil {
+		wp.resume = make(chan struct{})
+		log.Println("Worker pool paused")
+	}
+}
+
+// Resume 恢复从队列取任务
+func (wp *WorkerPool) Resume() {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.resume != nil {
+		close(wp.resume)
+		wp.resume = nil
+		log.Println("Worker pool resumed")
+	}
+}
+
+// Paused 是否已暂停
+func (wp *WorkerPool) Paused() bool {
+	return wp.pausedChan() != nil
+}
+
+// pausedChan 暂停时返回 Resume 时关闭的 channel，未暂停时返回 nil
+func (wp *WorkerPool) pausedChan() <-chan struct{} {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	return wp.resume
+}
+
+// waitResumed 暂停期间阻塞，pool 停止时返回 false
+func (wp *WorkerPool) waitResumed() bool {
+	for {
+		ch := wp.pausedChan()
+		if ch == nil {
+			return true
+		}
+		select {
+		case <-wp.ctx.Done():
+			return false
+		case <-ch:
+		}
+	}
+}
+
+// worker 处理任务的 goroutine；worker 数量多于目标时在两个任务之间退出
 func (wp *WorkerPool) worker(id int) {
 	defer wp.wg.Done()
+	defer wp.workerExited(id)
 	log.Printf("Worker %d started", id)
 
 	for {
+		resized := wp.resizedChan()
+		if wp.retire(id) {
+			log.Printf("Worker %d retired", id)
+			return
+		}
+		if !wp.waitResumed() {
+			log.Printf("Worker %d stopped", id)
+			return
+		}
+
 		select {
 		case <-wp.ctx.Done():
 			log.Printf("Worker %d stopped", id)
 			return
 
+		case <-resized:
+			continue
+
 		case task, ok := <-wp.taskQueue:
 			if !ok {
 				log.Printf("Worker %d: task queue closed", id)
 				return
 			}
 
+			// 等待期间被暂停的，任务保持 QUEUED 到恢复后再执行
+			if !wp.waitResumed() {
+				log.Printf("Worker %d stopped", id)
+				return
+			}
 			wp.processTask(id, task)
 		}
 	}
 }
 
-// processTask 处理单个任务
+// processTask 按任务类型查找处理器并执行单个任务
 func (wp *WorkerPool) processTask(workerID int, task *ImageTask) {
-	log.Printf("Worker %d processing task %s for user %d", workerID, task.ID, task.UserID)
+	log.Printf("Worker %d processing %s task %s for user %d", workerID, task.Kind, task.ID, task.UserID)
 
-	// 更新任务状态为运行中
-	task.Status = TaskRunning
-	task.UpdatedAt = time.Now()
-	if err := wp.taskManager.UpdateTask(task); err != nil {
-		log.Printf("Worker %d: failed to update task status: %v", workerID, err)
+	handler, ok := wp.registry.Lookup(task.Kind)
+	if !ok {
+		log.Printf("Worker %d: no handler for task kind %q", workerID, task.Kind)
+		task.Status = TaskFailed
+		task.ErrorMsg = fmt.Sprintf("%v: %s", ErrUnknownTaskKind, task.Kind)
+		if err := wp.taskManager.UpdateTask(task); err != nil {
+			log.Printf("Worker %d: failed to mark task %s as failed: %v", workerID, task.ID, err)
+		}
+		return
 	}
 
-	// 获取可用的图片生成客户端
-	client := wp.balancer.GetNext()
-	if client == nil {
-		log.Printf("Worker %d: no available image generation client", workerID)
-		task.Status = TaskFailed
-		task.ErrorMsg = "no available image generation service"
-		task.UpdatedAt = time.Now()
-		_ = wp.taskManager.UpdateTask(task)
+	// 获取租约，任务已被回收或取消时跳过
+	deadline := handler.Deadline(task)
+	if err := wp.taskManager.StartLease(task, deadline); err != nil {
+		log.Printf("Worker %d: skipping task %s: %v", workerID, task.ID, err)
 		return
 	}
+	attempt := task.Attempts
 
-	// 执行图片生成
-	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	wp.markRunning(task.ID)
+	defer wp.markFinished(task.ID)
+
+	stopHeartbeat := wp.startHeartbeat(task.ID, attempt)
+	defer stopHeartbeat()
+
+	// 执行任务，超过截止时间或被管理员取消后中止
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
 	defer cancel()
+	wp.assign(workerID, task, cancel)
+	defer wp.unassign(workerID)
 
 	startTime := time.Now()
-	resp, err := client.Generate(ctx, TextToImageRequest{
-		Prompt: task.Prompt,
-		Steps:  20,
-	})
+	result, err := handler.Run(ctx, task)
 	duration := time.Since(startTime)
 
+	// 已被回收器处理（重新排队或失败）的任务不再写入结果
+	if !wp.taskManager.LeaseHeld(task.ID, attempt) {
+		log.Printf("Worker %d: lease on task %s (attempt %d) lost after %.2fs, discarding result", workerID, task.ID, attempt, duration.Seconds())
+		return
+	}
+
 	if err != nil {
 		log.Printf("Worker %d: task %s failed after %.2fs: %v", workerID, task.ID, duration.Seconds(), err)
 		task.Status = TaskFailed
 		task.ErrorMsg = err.Error()
-		task.UpdatedAt = time.Now()
-		_ = wp.taskManager.UpdateTask(task)
+		if err := wp.taskManager.UpdateTask(task); err != nil {
+			log.Printf("Worker %d: failed to mark task %s as failed: %v", workerID, task.ID, err)
+		}
 		return
 	}
 
-	// 保存生成的图片到数据库
-	imageID, err := wp.taskManager.SaveImage(task.UserID, task.Prompt, resp.ImageData, resp.MimeType)
+	if result.Image != nil {
+		// 在一个事务中保存图片、提示词和任务结果
+		wp.durations.Observe(result.Image.Backend, result.Image.Duration)
+		_, err = wp.taskManager.SaveGenerationResult(task, *result.Image)
+	} else {
+		err = wp.taskManager.CompleteTask(task, result.Output)
+	}
 	if err != nil {
-		log.Printf("Worker %d: failed to save image: %v", workerID, err)
+		log.Printf("Worker %d: failed to save result of task %s: %v", workerID, task.ID, err)
 		task.Status = TaskFailed
-		task.ErrorMsg = fmt.Sprintf("failed to save image: %v", err)
-		task.UpdatedAt = time.Now()
-		_ = wp.taskManager.UpdateTask(task)
+		task.ErrorMsg = fmt.Sprintf("failed to save result: %v", err)
+		// 失败时任务已恢复为保存前的版本；这里也失败时由回收器在租约到期后处理
+		if err := wp.taskManager.UpdateTask(task); err != nil {
+			log.Printf("Worker %d: failed to mark task %s as failed: %v", workerID, task.ID, err)
+		}
 		return
 	}
 
-	// 更新任务状态为完成
-	task.Status = TaskDone
-	task.ResultURL = fmt.Sprintf("/api/images/%d", imageID)
-	task.UpdatedAt = time.Now()
-	if err := wp.taskManager.UpdateTask(task); err != nil {
-		log.Printf("Worker %d: failed to update task status: %v", workerID, err)
+	log.Printf("Worker %d: task %s completed in %.2fs", workerID, task.ID, duration.Seconds())
+}
+
+// startHeartbeat 在任务执行期间定期刷新心跳，返回停止函数
+func (wp *WorkerPool) startHeartbeat(taskID string, attempt int) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := wp.taskManager.Heartbeat(taskID, attempt); err != nil {
+					log.Printf("Heartbeat for task %s: %v", taskID, err)
+					if errors.Is(err, ErrLeaseLost) {
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// newGenerationResult 汇总后端响应和来源信息；图片尺寸优先取自图片本身，解码失败时使用请求尺寸
+func newGenerationResult(task *ImageTask, client TextToImageProvider, resp TextToImageResponse, duration time.Duration) GenerationResult {
+	result := GenerationResult{
+		ImageData: resp.ImageData,
+		MimeType:  resp.MimeType,
+		Seed:      resp.Seed,
+		Duration:  duration,
 	}
+	result.Width, result.Height = imageSize(resp.ImageData, task.Width, task.Height)
 
-	log.Printf("Worker %d: task %s completed in %.2fs", workerID, task.ID, duration.Seconds())
+	if info, ok := client.(ProviderInfo); ok {
+		result.Backend = info.InstanceName()
+		result.Model = info.ModelName()
+	}
+	// 同一后端可以提供多个模型（如 Automatic1111 的 checkpoint），按请求的模型记录
+	if task.Model != "" {
+		result.Model = task.Model
+	}
+
+	return result
+}
+
+// imageSize 从图片本身读取尺寸，解码失败时返回 width、height
+func imageSize(data []byte, width, height int) (int, int) {
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return cfg.Width, cfg.Height
+	}
+	return width, height
 }
 
 // GetQueueLength 获取队列长度
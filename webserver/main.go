@@ -96,10 +96,11 @@ type Image struct {
 type Prompt struct {
 	ID                 int64     `json:"id"`                   //	@Description	Prompts ID
 	UserID             int64     `json:"user_id"`              //	@Description	Prompts user ID
-	ImageID            int64     `json:"image_id"`             //	@Description	Prompts image ID
 	PromptText         string    `json:"prompt_text"`          //	@Description	Prompts text
 	NegativePromptText string    `json:"negative_prompt_text"` //	@Description	Prompts negative text
 	InferenceSteps     int64     `json:"inference_steps"`      //	@Description	Prompts inference step
+	Seed               int64     `json:"seed"`                 //	@Description	Prompts seed (0 = backend chooses)
+	ImageIDs           []int64   `json:"image_ids,omitempty"`  //	@Description	IDs of images generated from this prompt
 	CreatedAt          time.Time `json:"created_at"`           //	@Description	Prompts creation time
 }
 
@@ -392,10 +393,12 @@ func handleGetTodo(w http.ResponseWriter, r *http.Request) {
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Param			todo	body		Todo	true	"Todo object"
+//	@Param			Idempotency-Key	header		string	false	"Replays the original response when a retry reuses the key"
 //	@Success		201		{object}	Todo
 //	@Failure		400		{object}	map[string]string
 //	@Failure		401		{object}	map[string]string
 //	@Failure		500		{object}	map[string]string
+//	@Failure		422		{object}	map[string]string	"Idempotency-Key reused with a different body"
 //	@Router			/todos [post]
 func handleCreateTodo(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -910,9 +913,9 @@ func handleListImages(w http.ResponseWriter, r *http.Request) {
 			errorResponse(w, http.StatusBadRequest, "invalid user_id")
 			return
 		}
-		rows, err = db.Query("SELECT id, user_id, prompt_id, image_data, image_path, image_format, width, height, created_at FROM images WHERE user_id = ? LIMIT 10", userID)
+		rows, err = db.Query("SELECT id, user_id, prompt_id, image_data, COALESCE(image_path, ''), image_format, width, height, created_at FROM images WHERE user_id = ? LIMIT 10", userID)
 	} else {
-		rows, err = db.Query("SELECT id, user_id, prompt_id, image_data, image_path, image_format, width, height, created_at FROM images LIMIT 10")
+		rows, err = db.Query("SELECT id, user_id, prompt_id, image_data, COALESCE(image_path, ''), image_format, width, height, created_at FROM images LIMIT 10")
 	}
 
 	if err != nil {
@@ -971,7 +974,7 @@ func handleGetImage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var img Image
-	err = db.QueryRow("SELECT id, user_id, prompt_id, image_data, image_path, image_format, width, height, created_at FROM images WHERE id = ?", id).Scan(
+	err = db.QueryRow("SELECT id, user_id, prompt_id, image_data, COALESCE(image_path, ''), image_format, width, height, created_at FROM images WHERE id = ?", id).Scan(
 		&img.ID, &img.UserID, &img.PromptID, &img.ImageData, &img.ImagePath, &img.ImageFormat, &img.Width, &img.Height, &img.CreatedAt)
 
 	if err == sql.ErrNoRows {
@@ -995,9 +998,11 @@ func handleGetImage(w http.ResponseWriter, r *http.Request) {
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Param			image	body		Image	true	"Image object"
+//	@Param			Idempotency-Key	header		string	false	"Replays the original response when a retry reuses the key"
 //	@Success		201		{object}	Image
 //	@Failure		400		{object}	map[string]string
 //	@Failure		500		{object}	map[string]string
+//	@Failure		422		{object}	map[string]string	"Idempotency-Key reused with a different body"
 //	@Router			/images [post]
 func handleCreateImage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -1078,7 +1083,7 @@ func handleCreateImage(w http.ResponseWriter, r *http.Request) {
 	id, _ := result.LastInsertId()
 
 	var image Image
-	if err := db.QueryRow("SELECT id, user_id, prompt_id, image_data, image_path, image_format, width, height, created_at FROM images WHERE id = ?", id).Scan(
+	if err := db.QueryRow("SELECT id, user_id, prompt_id, image_data, COALESCE(image_path, ''), image_format, width, height, created_at FROM images WHERE id = ?", id).Scan(
 		&image.ID, &image.UserID, &image.PromptID, &image.ImageData, &image.ImagePath, &image.ImageFormat, &image.Width, &image.Height, &image.CreatedAt,
 	); err != nil {
 		errorLog.Printf("Failed to retrieve created image: %v", err)
@@ -1098,7 +1103,7 @@ func handleUpdateImage(w http.ResponseWriter, _ *http.Request) {
 // handleDeleteImage 处理 DELETE /images/{id}
 //
 //	@Summary		Delete an image
-//	@Description	Delete an existing image
+//	@Description	Delete an existing image; the prompt it was generated from is kept
 //	@Tags			images
 //	@Accept			json
 //	@Produce		json
@@ -1123,22 +1128,8 @@ func handleDeleteImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	//同时删除对应的prompts
-	result, err := db.Exec("DELETE FROM prompts WHERE id = (SELECT prompt_id FROM images WHERE id = ?)", id)
-	if err != nil {
-		errorLog.Printf("Database delete failed: %v", err)
-		errorResponse(w, http.StatusInternalServerError, "database delete failed")
-		return
-	}
-
-	_, err = result.RowsAffected()
-	if err != nil {
-		errorLog.Printf("Failed to get affected rows: %v", err)
-		errorResponse(w, http.StatusInternalServerError, "failed to get affected rows")
-		return
-	}
-
-	result, err = db.Exec("DELETE FROM images WHERE id = ?", id)
+	// prompt 可以拥有多张图片，删除图片时保留 prompt
+	result, err := db.Exec("DELETE FROM images WHERE id = ?", id)
 	if err != nil {
 		errorLog.Printf("Database delete failed: %v", err)
 		errorResponse(w, http.StatusInternalServerError, "database delete failed")
@@ -1194,9 +1185,9 @@ func handleListPrompts(w http.ResponseWriter, r *http.Request) {
 			errorResponse(w, http.StatusBadRequest, "invalid user_id")
 			return
 		}
-		rows, err = db.Query("SELECT id, user_id, image_id, prompt_text, negative_prompt_text, inference_steps, created_at FROM prompts WHERE user_id = ?", userID)
+		rows, err = db.Query("SELECT id, user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at FROM prompts WHERE user_id = ?", userID)
 	} else {
-		rows, err = db.Query("SELECT id, user_id, image_id, prompt_text, negative_prompt_text, inference_steps, created_at FROM prompts")
+		rows, err = db.Query("SELECT id, user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at FROM prompts")
 	}
 
 	if err != nil {
@@ -1209,7 +1200,7 @@ func handleListPrompts(w http.ResponseWriter, r *http.Request) {
 	var prompts []Prompt
 	for rows.Next() {
 		var p Prompt
-		if err := rows.Scan(&p.ID, &p.UserID, &p.ImageID, &p.PromptText, &p.NegativePromptText, &p.InferenceSteps, &p.CreatedAt); err != nil {
+		if err := rows.Scan(&p.ID, &p.UserID, &p.PromptText, &p.NegativePromptText, &p.InferenceSteps, &p.Seed, &p.CreatedAt); err != nil {
 			errorLog.Printf("Failed to scan row: %v", err)
 			errorResponse(w, http.StatusInternalServerError, "failed to scan row")
 			return
@@ -1255,8 +1246,8 @@ func handleGetPrompt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var p Prompt
-	err = db.QueryRow("SELECT id, user_id, image_id, prompt_text, negative_prompt_text, inference_steps, created_at FROM prompts WHERE id = ?", id).Scan(
-		&p.ID, &p.UserID, &p.ImageID, &p.PromptText, &p.NegativePromptText, &p.InferenceSteps, &p.CreatedAt)
+	err = db.QueryRow("SELECT id, user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at FROM prompts WHERE id = ?", id).Scan(
+		&p.ID, &p.UserID, &p.PromptText, &p.NegativePromptText, &p.InferenceSteps, &p.Seed, &p.CreatedAt)
 
 	if err == sql.ErrNoRows {
 		errorResponse(w, http.StatusNotFound, "prompt not found")
@@ -1267,10 +1258,36 @@ func handleGetPrompt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	p.ImageIDs, err = listPromptImageIDs(p.ID)
+	if err != nil {
+		errorLog.Printf("Database query failed: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "database query failed")
+		return
+	}
+
 	writeJSON(w, http.StatusOK, p)
 
 }
 
+// listPromptImageIDs 返回由某个 prompt 生成的所有图片 ID（一个 prompt 可以对应多张图片）
+func listPromptImageIDs(promptID int64) ([]int64, error) {
+	rows, err := db.Query("SELECT id FROM images WHERE prompt_id = ? ORDER BY id", promptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 // handleCreatePrompt 处理 POST /prompts
 //
 //	@Summary		Create a new prompt
@@ -1280,9 +1297,11 @@ func handleGetPrompt(w http.ResponseWriter, r *http.Request) {
 //	@Produce		json
 //	@Security		BearerAuth
 //	@Param			prompt	body		Prompt	true	"Prompt details"
+//	@Param			Idempotency-Key	header		string	false	"Replays the original response when a retry reuses the key"
 //	@Success		201		{object}	Prompt
 //	@Failure		400		{object}	map[string]string
 //	@Failure		500		{object}	map[string]string
+//	@Failure		422		{object}	map[string]string	"Idempotency-Key reused with a different body"
 //	@Router			/prompts [post]
 func handleCreatePrompt(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -1299,8 +1318,8 @@ func handleCreatePrompt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证必填字段
-	if p.UserID == 0 || p.ImageID == 0 || p.PromptText == "" {
-		errorResponse(w, http.StatusBadRequest, "user_id, image_id, and prompt_text are required")
+	if p.UserID == 0 || p.PromptText == "" {
+		errorResponse(w, http.StatusBadRequest, "user_id and prompt_text are required")
 		return
 	}
 
@@ -1319,8 +1338,8 @@ func handleCreatePrompt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	result, err := db.Exec(
-		"INSERT INTO prompts (user_id, image_id, prompt_text, negative_prompt_text, inference_steps) VALUES (?, ?, ?, ?, ?)",
-		p.UserID, p.ImageID, p.PromptText, p.NegativePromptText, p.InferenceSteps)
+		"INSERT INTO prompts (user_id, prompt_text, negative_prompt_text, inference_steps, seed) VALUES (?, ?, ?, ?, ?)",
+		p.UserID, p.PromptText, p.NegativePromptText, p.InferenceSteps, p.Seed)
 
 	if err != nil {
 		errorLog.Printf("Database insert failed: %v", err)
@@ -1331,8 +1350,8 @@ func handleCreatePrompt(w http.ResponseWriter, r *http.Request) {
 	id, _ := result.LastInsertId()
 
 	var prompt Prompt
-	err = db.QueryRow("SELECT id, user_id, image_id, prompt_text, negative_prompt_text, inference_steps, created_at FROM prompts WHERE id = ?", id).Scan(
-		&prompt.ID, &prompt.UserID, &prompt.ImageID, &prompt.PromptText, &prompt.NegativePromptText, &prompt.InferenceSteps, &prompt.CreatedAt)
+	err = db.QueryRow("SELECT id, user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at FROM prompts WHERE id = ?", id).Scan(
+		&prompt.ID, &prompt.UserID, &prompt.PromptText, &prompt.NegativePromptText, &prompt.InferenceSteps, &prompt.Seed, &prompt.CreatedAt)
 
 	if err != nil {
 		errorLog.Printf("Failed to retrieve created prompt: %v", err)
@@ -1381,8 +1400,8 @@ func handleUpdatePrompt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证必填字段
-	if p.UserID == 0 || p.ImageID == 0 || p.PromptText == "" {
-		errorResponse(w, http.StatusBadRequest, "user_id, image_id, and prompt_text are required")
+	if p.UserID == 0 || p.PromptText == "" {
+		errorResponse(w, http.StatusBadRequest, "user_id and prompt_text are required")
 		return
 	}
 
@@ -1400,8 +1419,8 @@ func handleUpdatePrompt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Exec("UPDATE prompts SET user_id = ?, image_id = ?, prompt_text = ?, negative_prompt_text = ?, inference_steps = ? WHERE id = ?",
-		p.UserID, p.ImageID, p.PromptText, p.NegativePromptText, p.InferenceSteps, id)
+	_, err = db.Exec("UPDATE prompts SET user_id = ?, prompt_text = ?, negative_prompt_text = ?, inference_steps = ?, seed = ? WHERE id = ?",
+		p.UserID, p.PromptText, p.NegativePromptText, p.InferenceSteps, p.Seed, id)
 
 	if err != nil {
 		errorLog.Printf("Database update failed: %v", err)
@@ -1410,8 +1429,8 @@ func handleUpdatePrompt(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var updatedPrompt Prompt
-	err = db.QueryRow("SELECT id, user_id, image_id, prompt_text, negative_prompt_text, inference_steps, created_at FROM prompts WHERE id = ?", id).Scan(
-		&updatedPrompt.ID, &updatedPrompt.UserID, &updatedPrompt.ImageID, &updatedPrompt.PromptText, &updatedPrompt.NegativePromptText, &updatedPrompt.InferenceSteps, &updatedPrompt.CreatedAt)
+	err = db.QueryRow("SELECT id, user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at FROM prompts WHERE id = ?", id).Scan(
+		&updatedPrompt.ID, &updatedPrompt.UserID, &updatedPrompt.PromptText, &updatedPrompt.NegativePromptText, &updatedPrompt.InferenceSteps, &updatedPrompt.Seed, &updatedPrompt.CreatedAt)
 
 	if err != nil {
 		errorLog.Printf("Failed to retrieve updated prompt: %v", err)
@@ -1425,7 +1444,7 @@ func handleUpdatePrompt(w http.ResponseWriter, r *http.Request) {
 // handleDeletePrompt 处理 DELETE /prompts/{id}
 //
 //	@Summary		Delete a prompt
-//	@Description	Delete an existing prompt
+//	@Description	Delete an existing prompt and every image generated from it
 //	@Tags			prompts
 //	@Accept			json
 //	@Produce		json
@@ -1450,7 +1469,16 @@ func handleDeletePrompt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := db.Exec("DELETE FROM prompts WHERE id = ?", id)
+	// 删除 prompt 时同时删除它拥有的所有图片（不依赖连接上是否开启了外键级联）
+	tx, err := db.Begin()
+	if err != nil {
+		errorLog.Printf("Failed to begin transaction: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "database delete failed")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM prompts WHERE id = ?", id)
 	if err != nil {
 		errorLog.Printf("Database delete failed: %v", err)
 		errorResponse(w, http.StatusInternalServerError, "database delete failed")
@@ -1469,6 +1497,18 @@ func handleDeletePrompt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := tx.Exec("DELETE FROM images WHERE prompt_id = ?", id); err != nil {
+		errorLog.Printf("Database delete failed: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "database delete failed")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		errorLog.Printf("Failed to commit delete: %v", err)
+		errorResponse(w, http.StatusInternalServerError, "database delete failed")
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -1603,7 +1643,7 @@ func main() {
 			case http.MethodGet:
 				handleListTodos(w, r)
 			case http.MethodPost:
-				handleCreateTodo(w, r)
+				idempotencyMiddleware(handleCreateTodo)(w, r)
 			default:
 				w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
 				errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -1677,7 +1717,7 @@ func main() {
 			case http.MethodGet:
 				handleListImages(w, r)
 			case http.MethodPost:
-				handleCreateImage(w, r)
+				idempotencyMiddleware(handleCreateImage)(w, r)
 			default:
 				w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
 				errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -1713,7 +1753,7 @@ func main() {
 			case http.MethodGet:
 				handleListPrompts(w, r)
 			case http.MethodPost:
-				handleCreatePrompt(w, r)
+				idempotencyMiddleware(handleCreatePrompt)(w, r)
 			default:
 				w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost)
 				errorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
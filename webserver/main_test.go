@@ -73,10 +73,10 @@ func bearerFor(t *testing.T, user User) string {
 	return "Bearer " + token
 }
 
-func insertPrompt(t *testing.T, userID int64, imageID int64, prompt string, negative_prompt_text string, inferencer_steps int64) int64 {
+func insertPrompt(t *testing.T, userID int64, prompt string, negative_prompt_text string, inferencer_steps int64) int64 {
 	t.Helper()
 
-	res, err := db.Exec("INSERT INTO prompts (user_id, image_id, prompt_text, negative_prompt_text, inference_steps) VALUES (?, ?, ?, ?, ?)", userID, imageID, prompt, negative_prompt_text, inferencer_steps)
+	res, err := db.Exec("INSERT INTO prompts (user_id, prompt_text, negative_prompt_text, inference_steps) VALUES (?, ?, ?, ?)", userID, prompt, negative_prompt_text, inferencer_steps)
 	if err != nil {
 		t.Fatalf("failed to insert prompt: %v", err)
 	}
@@ -312,13 +312,24 @@ func TestHandleDeleteTodo(t *testing.T) {
 	}
 }
 
+func insertImage(t *testing.T, userID int64, promptID int64) int64 {
+	t.Helper()
+
+	res, err := db.Exec("INSERT INTO images (user_id, prompt_id, image_data, image_format) VALUES (?, ?, ?, ?)", userID, promptID, []byte("img"), "png")
+	if err != nil {
+		t.Fatalf("failed to insert image: %v", err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
 func TestHandleListPrompts(t *testing.T) {
 	setupTestDB(t)
 	user := createTestUser(t, "hannah")
 
 	// Insert test prompts
-	insertPrompt(t, user.ID, 1, "Prompt 1", "negative prompt 1", 20)
-	insertPrompt(t, user.ID, 2, "Prompt 2", "negative prompt 2", 25)
+	insertPrompt(t, user.ID, "Prompt 1", "negative prompt 1", 20)
+	insertPrompt(t, user.ID, "Prompt 2", "negative prompt 2", 25)
 
 	req := httptest.NewRequest(http.MethodGet, "/prompts", nil)
 	req.Header.Set("Authorization", bearerFor(t, user))
@@ -349,3 +360,105 @@ func TestHandleListPrompts(t *testing.T) {
 	}
 
 }
+
+func TestHandleCreatePromptWithoutImage(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "ivan")
+
+	body := strings.NewReader(fmt.Sprintf(`{"user_id":%d,"prompt_text":"a lighthouse","inference_steps":20,"seed":7}`, user.ID))
+	req := httptest.NewRequest(http.MethodPost, "/prompts", body)
+	req.Header.Set("Authorization", bearerFor(t, user))
+	rr := httptest.NewRecorder()
+
+	authMiddleware(handleCreatePrompt)(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var prompt Prompt
+	if err := json.NewDecoder(rr.Body).Decode(&prompt); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if prompt.ID == 0 || prompt.Seed != 7 || len(prompt.ImageIDs) != 0 {
+		t.Fatalf("unexpected prompt: %+v", prompt)
+	}
+}
+
+func TestHandleGetPromptListsImages(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "judy")
+
+	promptID := insertPrompt(t, user.ID, "seed sweep", "", 20)
+	first := insertImage(t, user.ID, promptID)
+	second := insertImage(t, user.ID, promptID)
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/prompts/%d", promptID), nil)
+	req.Header.Set("Authorization", bearerFor(t, user))
+	rr := httptest.NewRecorder()
+
+	authMiddleware(handleGetPrompt)(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+
+	var prompt Prompt
+	if err := json.NewDecoder(rr.Body).Decode(&prompt); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(prompt.ImageIDs) != 2 || prompt.ImageIDs[0] != first || prompt.ImageIDs[1] != second {
+		t.Fatalf("expected image ids [%d %d], got %v", first, second, prompt.ImageIDs)
+	}
+}
+
+func TestHandleDeleteImageKeepsPrompt(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "kate")
+
+	promptID := insertPrompt(t, user.ID, "batch", "", 20)
+	imageID := insertImage(t, user.ID, promptID)
+	insertImage(t, user.ID, promptID)
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/images/%d", imageID), nil)
+	req.Header.Set("Authorization", bearerFor(t, user))
+	rr := httptest.NewRecorder()
+
+	authMiddleware(handleDeleteImage)(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", rr.Code)
+	}
+
+	var prompts, images int
+	db.QueryRow("SELECT COUNT(*) FROM prompts WHERE id = ?", promptID).Scan(&prompts)
+	db.QueryRow("SELECT COUNT(*) FROM images WHERE prompt_id = ?", promptID).Scan(&images)
+	if prompts != 1 || images != 1 {
+		t.Fatalf("expected prompt kept with 1 image, got %d prompts and %d images", prompts, images)
+	}
+}
+
+func TestHandleDeletePromptRemovesImages(t *testing.T) {
+	setupTestDB(t)
+	user := createTestUser(t, "leo")
+
+	promptID := insertPrompt(t, user.ID, "batch", "", 20)
+	insertImage(t, user.ID, promptID)
+	insertImage(t, user.ID, promptID)
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/prompts/%d", promptID), nil)
+	req.Header.Set("Authorization", bearerFor(t, user))
+	rr := httptest.NewRecorder()
+
+	authMiddleware(handleDeletePrompt)(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", rr.Code)
+	}
+
+	var images int
+	db.QueryRow("SELECT COUNT(*) FROM images WHERE prompt_id = ?", promptID).Scan(&images)
+	if images != 0 {
+		t.Fatalf("expected images to be deleted with prompt, found %d", images)
+	}
+}
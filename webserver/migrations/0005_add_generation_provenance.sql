@@ -0,0 +1,47 @@
+-- 0005_add_generation_provenance.sql
+-- Migration: Record full provenance for generated images
+-- Created: 2026-10-18
+-- Description: Async tasks now carry every generation parameter (negative prompt, steps, seed, size)
+--              and link to the image they produced. Prompts store the seed, images store the backend
+--              instance, model name, generation duration and MIME type returned by the backend.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+-- image_tasks: generation parameters requested by the user and the resulting image
+ALTER TABLE image_tasks ADD COLUMN negative_prompt TEXT NOT NULL DEFAULT '';  -- Negative prompt requested by the user
+ALTER TABLE image_tasks ADD COLUMN steps INTEGER NOT NULL DEFAULT 0;          -- Inference steps (0 = backend default)
+ALTER TABLE image_tasks ADD COLUMN seed INTEGER NOT NULL DEFAULT 0;           -- Random seed (0 = backend chooses)
+ALTER TABLE image_tasks ADD COLUMN width INTEGER NOT NULL DEFAULT 0;          -- Requested width in pixels (0 = backend default)
+ALTER TABLE image_tasks ADD COLUMN height INTEGER NOT NULL DEFAULT 0;         -- Requested height in pixels (0 = backend default)
+ALTER TABLE image_tasks ADD COLUMN image_id INTEGER REFERENCES images(id) ON DELETE SET NULL;  -- Image produced by this task
+
+-- prompts: seed used for the generation
+ALTER TABLE prompts ADD COLUMN seed INTEGER NOT NULL DEFAULT 0;               -- Random seed used by the backend
+
+-- images: where and how the image was generated
+ALTER TABLE images ADD COLUMN mime_type TEXT NOT NULL DEFAULT '';             -- MIME type returned by the backend (image/png, image/jpeg)
+ALTER TABLE images ADD COLUMN backend_instance TEXT NOT NULL DEFAULT '';      -- Backend instance that generated the image (base URL)
+ALTER TABLE images ADD COLUMN model_name TEXT NOT NULL DEFAULT '';            -- Model used by the backend
+ALTER TABLE images ADD COLUMN duration_ms INTEGER NOT NULL DEFAULT 0;         -- Generation wall time in milliseconds
+
+CREATE INDEX IF NOT EXISTS idx_image_tasks_image_id ON image_tasks(image_id);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+-- SQLite < 3.35 cannot drop columns; recreate the tables from 0003/0004 if a rollback is required
+
+-- DROP INDEX IF EXISTS idx_image_tasks_image_id;
+-- ALTER TABLE images DROP COLUMN duration_ms;
+-- ALTER TABLE images DROP COLUMN model_name;
+-- ALTER TABLE images DROP COLUMN backend_instance;
+-- ALTER TABLE images DROP COLUMN mime_type;
+-- ALTER TABLE prompts DROP COLUMN seed;
+-- ALTER TABLE image_tasks DROP COLUMN image_id;
+-- ALTER TABLE image_tasks DROP COLUMN height;
+-- ALTER TABLE image_tasks DROP COLUMN width;
+-- ALTER TABLE image_tasks DROP COLUMN seed;
+-- ALTER TABLE image_tasks DROP COLUMN steps;
+-- ALTER TABLE image_tasks DROP COLUMN negative_prompt;
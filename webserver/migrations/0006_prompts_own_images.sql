@@ -0,0 +1,88 @@
+-- 0006_prompts_own_images.sql
+-- Migration: Break the circular prompts <-> images reference
+-- Created: 2026-10-18
+-- Description: prompts.image_id (NOT NULL UNIQUE, FK to images) and images.prompt_id (NOT NULL, FK to prompts)
+--              made it impossible to insert either row first. A prompt now owns zero or more images
+--              (batches, seed sweeps, reruns); only images reference their prompt. Existing 1:1 links are
+--              carried over to images.prompt_id before prompts.image_id is dropped.
+--              Uses table recreation (SQLite standard pattern, see 0003).
+--              images.prompt_id references prompts ON DELETE CASCADE: with foreign keys enabled,
+--              DROP TABLE prompts would delete every image. The rebuild therefore runs with
+--              foreign_keys OFF and must not be wrapped in a transaction (the pragma is a no-op
+--              inside one). PRAGMA foreign_key_check must return no rows before the pragma is restored.
+
+-- ========================================
+-- UP: Apply the schema refactoring
+-- ========================================
+
+-- Step 0: Disable foreign keys so dropping prompts does not cascade to images
+PRAGMA foreign_keys = OFF;
+
+-- Step 1: Move existing links onto images.prompt_id (0003 filled it with a placeholder of 1)
+UPDATE images
+SET prompt_id = (SELECT p.id FROM prompts p WHERE p.image_id = images.id)
+WHERE EXISTS (SELECT 1 FROM prompts p WHERE p.image_id = images.id);
+
+-- Step 2: Create new prompts table without image_id
+CREATE TABLE IF NOT EXISTS prompts_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,  -- Unique prompt record identifier
+    user_id INTEGER NOT NULL,              -- Foreign key to users(id); prompt ownership for audit/filtering
+    prompt_text TEXT NOT NULL,             -- Positive prompt text used for image generation
+    negative_prompt_text TEXT DEFAULT '',  -- Negative prompt to exclude unwanted elements (empty string if not used)
+    inference_steps INTEGER NOT NULL,      -- Number of denoising steps in generation process (e.g., 20-50)
+    seed INTEGER NOT NULL DEFAULT 0,       -- Random seed used by the backend (0 = backend chooses)
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,  -- Prompt creation/generation timestamp
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE  -- Cascade delete when user is removed
+);
+
+-- Step 3: Copy existing prompts
+INSERT INTO prompts_new (id, user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at)
+SELECT id, user_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at
+FROM prompts;
+
+-- Step 4: Replace the old table
+DROP INDEX IF EXISTS idx_prompts_image_id;
+DROP INDEX IF EXISTS idx_prompts_user_id;
+DROP TABLE prompts;
+ALTER TABLE prompts_new RENAME TO prompts;
+
+-- Step 5: Recreate indexes
+CREATE INDEX IF NOT EXISTS idx_prompts_user_id ON prompts(user_id);
+
+-- Step 6: Verify every images.prompt_id still resolves, then re-enable foreign keys
+PRAGMA foreign_key_check;
+PRAGMA foreign_keys = ON;
+
+-- ========================================
+-- DOWN: Rollback the schema refactoring
+-- ========================================
+-- Note: a prompt with several images cannot be represented in the old 1:1 schema;
+-- the rollback keeps the most recent image of each prompt. Run it with foreign keys off as well.
+
+-- PRAGMA foreign_keys = OFF;
+--
+-- CREATE TABLE IF NOT EXISTS prompts_old (
+--     id INTEGER PRIMARY KEY AUTOINCREMENT,
+--     user_id INTEGER NOT NULL,
+--     image_id INTEGER NOT NULL UNIQUE,
+--     prompt_text TEXT NOT NULL,
+--     negative_prompt_text TEXT DEFAULT '',
+--     inference_steps INTEGER NOT NULL,
+--     seed INTEGER NOT NULL DEFAULT 0,
+--     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+--     FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+--     FOREIGN KEY (image_id) REFERENCES images(id) ON DELETE CASCADE
+-- );
+--
+-- INSERT INTO prompts_old (id, user_id, image_id, prompt_text, negative_prompt_text, inference_steps, seed, created_at)
+-- SELECT p.id, p.user_id, MAX(i.id), p.prompt_text, p.negative_prompt_text, p.inference_steps, p.seed, p.created_at
+-- FROM prompts p JOIN images i ON i.prompt_id = p.id
+-- GROUP BY p.id;
+--
+-- DROP TABLE prompts;
+-- ALTER TABLE prompts_old RENAME TO prompts;
+-- CREATE INDEX IF NOT EXISTS idx_prompts_user_id ON prompts(user_id);
+-- CREATE INDEX IF NOT EXISTS idx_prompts_image_id ON prompts(image_id);
+--
+-- PRAGMA foreign_key_check;
+-- PRAGMA foreign_keys = ON;
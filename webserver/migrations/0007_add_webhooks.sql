@@ -0,0 +1,72 @@
+-- 0007_add_webhooks.sql
+-- Migration: Signed webhook callbacks for finished async tasks
+-- Created: 2026-10-18
+-- Description: Users register webhook endpoints (each with its own HMAC secret); tasks may name a
+--              callback_url. When a task reaches DONE/FAILED a delivery row is written to the outbox in
+--              the same transaction, and a background dispatcher POSTs it with retries and backoff.
+--              Every attempt is kept in webhook_delivery_attempts as the per-endpoint delivery log.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+-- webhook_endpoints: receivers registered by users
+CREATE TABLE IF NOT EXISTS webhook_endpoints (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,  -- Unique endpoint identifier
+    user_id INTEGER NOT NULL,              -- Foreign key to users(id); endpoint ownership
+    url TEXT NOT NULL,                     -- Receiver URL (http/https)
+    secret TEXT NOT NULL,                  -- HMAC-SHA256 signing secret, generated by the server
+    is_default BOOLEAN NOT NULL DEFAULT 1, -- 1 = receives every task of the user; 0 = only tasks that name it as callback_url
+    enabled BOOLEAN NOT NULL DEFAULT 1,    -- Disabled endpoints receive no new deliveries
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,  -- Registration timestamp
+    UNIQUE (user_id, url),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- webhook_deliveries: transactional outbox, one row per (endpoint, event)
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,  -- Unique delivery identifier, sent as X-Webhook-Id
+    endpoint_id INTEGER NOT NULL,          -- Foreign key to webhook_endpoints(id)
+    task_id TEXT NOT NULL,                 -- Task that triggered the event
+    event_type TEXT NOT NULL,              -- task.done / task.failed
+    payload TEXT NOT NULL,                 -- JSON body, frozen at enqueue time so retries send identical bytes
+    status TEXT NOT NULL DEFAULT 'PENDING',  -- PENDING / DELIVERED / FAILED
+    attempts INTEGER NOT NULL DEFAULT 0,   -- Number of attempts made so far
+    next_attempt_at DATETIME NOT NULL,     -- Earliest time for the next attempt (backoff)
+    last_error TEXT NOT NULL DEFAULT '',   -- Error or response status of the last attempt
+    created_at DATETIME NOT NULL,          -- Enqueue timestamp
+    updated_at DATETIME NOT NULL,          -- Last state change
+    FOREIGN KEY (endpoint_id) REFERENCES webhook_endpoints(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint ON webhook_deliveries(endpoint_id, created_at DESC);
+
+-- webhook_delivery_attempts: delivery log, one row per HTTP attempt
+CREATE TABLE IF NOT EXISTS webhook_delivery_attempts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,  -- Unique attempt identifier
+    delivery_id INTEGER NOT NULL,          -- Foreign key to webhook_deliveries(id)
+    attempt INTEGER NOT NULL,              -- Attempt number, starting at 1
+    status_code INTEGER NOT NULL DEFAULT 0,  -- Receiver HTTP status (0 = no response)
+    error TEXT NOT NULL DEFAULT '',        -- Transport error or non-2xx description
+    duration_ms INTEGER NOT NULL DEFAULT 0,  -- Request wall time in milliseconds
+    created_at DATETIME NOT NULL,          -- Attempt timestamp
+    FOREIGN KEY (delivery_id) REFERENCES webhook_deliveries(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery ON webhook_delivery_attempts(delivery_id);
+
+-- image_tasks: optional per-task callback
+ALTER TABLE image_tasks ADD COLUMN callback_url TEXT NOT NULL DEFAULT '';  -- Receiver for this task only (registered as a non-default endpoint)
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- ALTER TABLE image_tasks DROP COLUMN callback_url;
+-- DROP INDEX IF EXISTS idx_webhook_attempts_delivery;
+-- DROP TABLE IF EXISTS webhook_delivery_attempts;
+-- DROP INDEX IF EXISTS idx_webhook_deliveries_endpoint;
+-- DROP INDEX IF EXISTS idx_webhook_deliveries_due;
+-- DROP TABLE IF EXISTS webhook_deliveries;
+-- DROP TABLE IF EXISTS webhook_endpoints;
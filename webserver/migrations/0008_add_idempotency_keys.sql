@@ -0,0 +1,33 @@
+-- 0008_add_idempotency_keys.sql
+-- Migration: Idempotency keys for resource-creating POST endpoints
+-- Created: 2026-10-18
+-- Description: Clients on flaky networks send an Idempotency-Key header with POST /api/v1/image/async,
+--              /todos, /images and /prompts. The first request stores the key with a fingerprint of the
+--              request and, once finished, the response. Retries within the window get the stored
+--              response replayed; reusing a key with a different request is rejected with 422.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    user_id INTEGER NOT NULL,              -- Foreign key to users(id); keys are scoped per user
+    idem_key TEXT NOT NULL,                -- Client supplied Idempotency-Key header
+    fingerprint TEXT NOT NULL,             -- SHA-256 of method, path and body of the first request
+    status_code INTEGER NOT NULL DEFAULT 0,  -- Stored response status (0 = first request still in flight)
+    content_type TEXT NOT NULL DEFAULT '', -- Stored response Content-Type
+    response_body BLOB,                    -- Stored response body
+    created_at DATETIME NOT NULL,          -- First request timestamp
+    expires_at DATETIME NOT NULL,          -- End of the replay window
+    PRIMARY KEY (user_id, idem_key),
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP INDEX IF EXISTS idx_idempotency_keys_expires_at;
+-- DROP TABLE IF EXISTS idempotency_keys;
@@ -0,0 +1,46 @@
+-- 0009_add_result_cache.sql
+-- Migration: Content-addressed result cache for image generation
+-- Created: 2026-10-18
+-- Description: Every task and generated image records a fingerprint of its generation parameters.
+--              A submission whose fingerprint matches a stored image completes immediately (cache_hit);
+--              one matching a task that is still queued or running is attached to it instead of being
+--              generated again. Users choose how the cache applies to them in result_cache_policies.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+-- image_tasks: fingerprint and how the task was satisfied
+ALTER TABLE image_tasks ADD COLUMN fingerprint TEXT NOT NULL DEFAULT '';   -- SHA-256 of the normalized generation parameters
+ALTER TABLE image_tasks ADD COLUMN cache_hit BOOLEAN NOT NULL DEFAULT 0;   -- 1 = result reused instead of generated
+ALTER TABLE image_tasks ADD COLUMN attached_to TEXT NOT NULL DEFAULT '';   -- Identical in-flight task this task follows ('' = generated itself)
+
+-- images: fingerprint of the parameters that produced the image
+ALTER TABLE images ADD COLUMN fingerprint TEXT NOT NULL DEFAULT '';        -- Same value as image_tasks.fingerprint ('' = unknown, never reused)
+
+CREATE INDEX IF NOT EXISTS idx_images_fingerprint ON images(fingerprint, user_id);
+CREATE INDEX IF NOT EXISTS idx_image_tasks_fingerprint ON image_tasks(fingerprint, status);
+CREATE INDEX IF NOT EXISTS idx_image_tasks_attached_to ON image_tasks(attached_to);
+
+-- result_cache_policies: per-user cache policy (no row = server default)
+CREATE TABLE IF NOT EXISTS result_cache_policies (
+    user_id INTEGER PRIMARY KEY,           -- Foreign key to users(id)
+    mode TEXT NOT NULL DEFAULT 'own',      -- off = always generate; own = reuse own results; shared = also reuse results of other shared users
+    include_unseeded BOOLEAN NOT NULL DEFAULT 0,  -- 1 = also reuse results for seed 0 (backend-chosen seed) requests
+    max_age_seconds INTEGER NOT NULL DEFAULT 0,   -- Only reuse images newer than this (0 = no limit)
+    updated_at DATETIME NOT NULL,          -- Last change
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP TABLE IF EXISTS result_cache_policies;
+-- DROP INDEX IF EXISTS idx_image_tasks_attached_to;
+-- DROP INDEX IF EXISTS idx_image_tasks_fingerprint;
+-- DROP INDEX IF EXISTS idx_images_fingerprint;
+-- ALTER TABLE images DROP COLUMN fingerprint;
+-- ALTER TABLE image_tasks DROP COLUMN attached_to;
+-- ALTER TABLE image_tasks DROP COLUMN cache_hit;
+-- ALTER TABLE image_tasks DROP COLUMN fingerprint;
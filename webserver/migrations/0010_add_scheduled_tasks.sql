@@ -0,0 +1,29 @@
+-- 0010_add_scheduled_tasks.sql
+-- Migration: Scheduled and recurring generation tasks
+-- Created: 2026-10-18
+-- Description: Tasks submitted with run_at or a cron expression are stored with status SCHEDULED.
+--              The scheduler moves a one-shot task to QUEUED once run_at has passed; a cron task stays
+--              SCHEDULED as a template and enqueues a copy (schedule_id = template id) at every firing,
+--              then advances run_at. Cancelled schedules move to CANCELLED. Everything lives in the
+--              database, so schedules survive restarts.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+ALTER TABLE image_tasks ADD COLUMN run_at DATETIME;                        -- Next time the task is due (NULL = run immediately)
+ALTER TABLE image_tasks ADD COLUMN cron_expr TEXT NOT NULL DEFAULT '';     -- 5-field cron expression for recurring schedules ('' = one-shot)
+ALTER TABLE image_tasks ADD COLUMN schedule_id TEXT NOT NULL DEFAULT '';   -- Recurring schedule that spawned this task ('' = none)
+
+CREATE INDEX IF NOT EXISTS idx_image_tasks_status_run_at ON image_tasks(status, run_at);
+CREATE INDEX IF NOT EXISTS idx_image_tasks_schedule_id ON image_tasks(schedule_id);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP INDEX IF EXISTS idx_image_tasks_schedule_id;
+-- DROP INDEX IF EXISTS idx_image_tasks_status_run_at;
+-- ALTER TABLE image_tasks DROP COLUMN schedule_id;
+-- ALTER TABLE image_tasks DROP COLUMN cron_expr;
+-- ALTER TABLE image_tasks DROP COLUMN run_at;
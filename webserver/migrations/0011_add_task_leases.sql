@@ -0,0 +1,44 @@
+-- 0011_add_task_leases.sql
+-- Migration: Execution leases, heartbeats and the task audit log
+-- Created: 2026-10-18
+-- Description: A worker takes a lease when it starts a task: attempts is incremented, started_at and
+--              heartbeat_at are set, and lease_expires_at is the per-task deadline (derived from steps
+--              and image size) plus a grace period. The worker refreshes heartbeat_at while it runs.
+--              A background reaper finds RUNNING tasks whose lease expired or whose heartbeat stopped
+--              (hung worker, crashed process) and requeues or fails them according to the retry policy.
+--              Every reaper action is recorded in task_audit_log.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+ALTER TABLE image_tasks ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;   -- Number of times a worker started the task
+ALTER TABLE image_tasks ADD COLUMN started_at DATETIME;                    -- Start of the current attempt
+ALTER TABLE image_tasks ADD COLUMN heartbeat_at DATETIME;                  -- Last heartbeat from the worker running the task
+ALTER TABLE image_tasks ADD COLUMN lease_expires_at DATETIME;              -- Deadline of the current attempt, including grace
+
+CREATE INDEX IF NOT EXISTS idx_image_tasks_status_lease ON image_tasks(status, lease_expires_at);
+
+CREATE TABLE IF NOT EXISTS task_audit_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    task_id TEXT NOT NULL,                         -- Task the action applies to
+    action TEXT NOT NULL,                          -- requeued, failed, recovered
+    detail TEXT NOT NULL DEFAULT '',               -- Human readable reason
+    attempt INTEGER NOT NULL DEFAULT 0,            -- Attempt the action refers to
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (task_id) REFERENCES image_tasks(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_task_audit_log_task_id ON task_audit_log(task_id);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP INDEX IF EXISTS idx_task_audit_log_task_id;
+-- DROP TABLE IF EXISTS task_audit_log;
+-- DROP INDEX IF EXISTS idx_image_tasks_status_lease;
+-- ALTER TABLE image_tasks DROP COLUMN lease_expires_at;
+-- ALTER TABLE image_tasks DROP COLUMN heartbeat_at;
+-- ALTER TABLE image_tasks DROP COLUMN started_at;
+-- ALTER TABLE image_tasks DROP COLUMN attempts;
@@ -0,0 +1,35 @@
+-- 0012_add_task_kinds.sql
+-- Migration: Typed tasks with JSON payloads
+-- Created: 2026-10-18
+-- Description: image_tasks becomes the generic task table. kind selects the registered handler
+--              (image.generate, speech.transcribe, ...), input holds the JSON parameters and output the
+--              JSON result of kinds that do not produce an image. Existing rows are image generations.
+--              Large binary inputs such as uploaded audio are stored once in task_blobs so retries can
+--              read them again; the blob is removed when the task completes.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+ALTER TABLE image_tasks ADD COLUMN kind TEXT NOT NULL DEFAULT 'image.generate';   -- Registered task kind
+ALTER TABLE image_tasks ADD COLUMN input TEXT NOT NULL DEFAULT '';                -- JSON input payload
+ALTER TABLE image_tasks ADD COLUMN output TEXT NOT NULL DEFAULT '';               -- JSON output payload ('' = none)
+
+CREATE INDEX IF NOT EXISTS idx_image_tasks_kind_status ON image_tasks(kind, status);
+
+CREATE TABLE IF NOT EXISTS task_blobs (
+    task_id TEXT PRIMARY KEY,                      -- Task that owns the binary input
+    data BLOB NOT NULL,                            -- Raw bytes (e.g. uploaded audio)
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (task_id) REFERENCES image_tasks(id) ON DELETE CASCADE
+);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP TABLE IF EXISTS task_blobs;
+-- DROP INDEX IF EXISTS idx_image_tasks_kind_status;
+-- ALTER TABLE image_tasks DROP COLUMN output;
+-- ALTER TABLE image_tasks DROP COLUMN input;
+-- ALTER TABLE image_tasks DROP COLUMN kind;
@@ -0,0 +1,50 @@
+-- 0013_add_pipelines.sql
+-- Migration: Multi-step task pipelines
+-- Created: 2026-10-18
+-- Description: A pipeline is a small DAG of typed tasks (e.g. speech.transcribe -> prompt.template ->
+--              image.generate). Each step becomes an image_tasks row once all of its dependencies are
+--              DONE; {{step.field}} placeholders in its input are filled from their outputs. A failed
+--              step skips its dependents and the pipeline reports one aggregate status. Uploaded audio
+--              is kept on the pipeline until it finishes so transcription steps can read it.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+CREATE TABLE IF NOT EXISTS pipelines (
+    id TEXT PRIMARY KEY,                           -- UUID
+    user_id INTEGER NOT NULL,                      -- Owner
+    status TEXT NOT NULL DEFAULT 'RUNNING',        -- RUNNING, DONE or FAILED
+    error_msg TEXT NOT NULL DEFAULT '',            -- First step failure
+    audio BLOB,                                    -- Uploaded audio for speech.transcribe steps (NULL once finished)
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_pipelines_user_created ON pipelines(user_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_pipelines_status ON pipelines(status);
+
+CREATE TABLE IF NOT EXISTS pipeline_steps (
+    pipeline_id TEXT NOT NULL,                     -- Owning pipeline
+    step_id TEXT NOT NULL,                         -- Step name, unique within the pipeline
+    position INTEGER NOT NULL,                     -- Topological order
+    kind TEXT NOT NULL,                            -- Task kind run by the step
+    depends_on TEXT NOT NULL DEFAULT '[]',         -- JSON array of step ids
+    input TEXT NOT NULL DEFAULT '',                -- JSON input template
+    task_id TEXT NOT NULL DEFAULT '',              -- Task created for the step ('' = not started)
+    status TEXT NOT NULL DEFAULT 'PENDING',        -- PENDING, SKIPPED or the task status
+    output TEXT NOT NULL DEFAULT '',               -- Copy of the task output once DONE
+    error_msg TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (pipeline_id, step_id),
+    FOREIGN KEY (pipeline_id) REFERENCES pipelines(id) ON DELETE CASCADE
+);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP TABLE IF EXISTS pipeline_steps;
+-- DROP INDEX IF EXISTS idx_pipelines_status;
+-- DROP INDEX IF EXISTS idx_pipelines_user_created;
+-- DROP TABLE IF EXISTS pipelines;
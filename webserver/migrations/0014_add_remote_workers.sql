@@ -0,0 +1,32 @@
+-- 0014_add_remote_workers.sql
+-- Migration: Remote pull-based workers
+-- Created: 2026-10-18
+-- Description: Workers on other machines (e.g. GPU hosts behind NAT) lease QUEUED tasks over HTTP instead
+--              of being pushed to. The lease uses the same attempts / heartbeat_at / lease_expires_at
+--              columns as in-process workers, so the reaper recovers tasks of workers that disappear.
+--              worker_id records which remote worker holds the current lease ('' = in-process worker).
+--              remote_workers keeps the last reported capabilities of each worker for monitoring.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+ALTER TABLE image_tasks ADD COLUMN worker_id TEXT NOT NULL DEFAULT '';   -- Remote worker holding the lease
+
+CREATE TABLE IF NOT EXISTS remote_workers (
+    id TEXT PRIMARY KEY,                           -- Worker-chosen identifier (X-Worker-ID)
+    capabilities TEXT NOT NULL DEFAULT '{}',       -- JSON: kinds, models, max_pixels, max_steps
+    version TEXT NOT NULL DEFAULT '',              -- Worker build reported in User-Agent
+    last_seen_at DATETIME NOT NULL,                -- Last lease, heartbeat or result
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_remote_workers_last_seen ON remote_workers(last_seen_at);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP INDEX IF EXISTS idx_remote_workers_last_seen;
+-- DROP TABLE IF EXISTS remote_workers;
+-- ALTER TABLE image_tasks DROP COLUMN worker_id;
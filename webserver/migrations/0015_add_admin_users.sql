@@ -0,0 +1,23 @@
+-- 0015_add_admin_users.sql
+-- Migration: Administrator flag for operators
+-- Created: 2026-10-18
+-- Description: Operators need to see and repair the task queue across users (list with filters, requeue,
+--              cancel, delete, pause / resume workers). Only users with is_admin = 1 may call the
+--              /api/v1/admin endpoints; grant it with
+--                  UPDATE users SET is_admin = 1 WHERE username = '<operator>';
+--              The created_at index backs the admin task listing's time range filter.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0;   -- 1 = may use the admin API
+
+CREATE INDEX IF NOT EXISTS idx_image_tasks_created_at ON image_tasks(created_at);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP INDEX IF EXISTS idx_image_tasks_created_at;
+-- ALTER TABLE users DROP COLUMN is_admin;
@@ -0,0 +1,22 @@
+-- 0016_add_task_versions.sql
+-- Migration: Optimistic versioning for image_tasks
+-- Created: 2026-10-18
+-- Description: Every status change of a task now goes through the transition table in
+--              internal/task_state.go and is written as
+--                  UPDATE image_tasks SET ..., version = version + 1
+--                  WHERE id = ? AND version = ? AND status IN (<allowed sources>)
+--              so a writer holding a stale snapshot (worker, reaper, scheduler, admin) is rejected
+--              instead of silently overwriting a newer state, and illegal transitions such as
+--              DONE -> RUNNING never reach the database.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+ALTER TABLE image_tasks ADD COLUMN version INTEGER NOT NULL DEFAULT 0;   -- bumped on every status update
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- ALTER TABLE image_tasks DROP COLUMN version;
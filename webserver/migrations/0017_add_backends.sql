@@ -0,0 +1,31 @@
+-- 0017_add_backends.sql
+-- Migration: Registry of image generation backends
+-- Created: 2026-10-18
+-- Description: Image backends used to come only from IMAGE_GEN_URL_1 at startup. They now live in the
+--              backends table and administrators add, drain, disable and remove them at runtime through
+--              /api/v1/admin/backends; the id is the stable instance ID used by the load balancer.
+--              On first start (empty table) the registry is seeded from IMAGE_GEN_URL_<n>.
+--              status: enabled = receives requests; drained = no new requests, in-flight ones finish;
+--              disabled = no requests and no health checks.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+CREATE TABLE IF NOT EXISTS backends (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,           -- Stable instance ID
+    url TEXT NOT NULL UNIQUE,                       -- Base URL of the backend service
+    type TEXT NOT NULL DEFAULT 'qwen-image-gguf',   -- Adapter used to talk to it
+    weight INTEGER NOT NULL DEFAULT 1,              -- Share of traffic under weighted-round-robin
+    capacity INTEGER NOT NULL DEFAULT 1,            -- Concurrent generation slots
+    tags TEXT NOT NULL DEFAULT '[]',                -- JSON array of free-form labels (e.g. gpu, region)
+    status TEXT NOT NULL DEFAULT 'enabled',         -- enabled / drained / disabled
+    created_at DATETIME NOT NULL,
+    updated_at DATETIME NOT NULL
+);
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- DROP TABLE IF EXISTS backends;
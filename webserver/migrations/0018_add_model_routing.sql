@@ -0,0 +1,23 @@
+-- 0018_add_model_routing.sql
+-- Migration: Model catalog and capability-based routing
+-- Created: 2026-10-18
+-- Description: Image tasks may name the model they must run on; the worker only hands such
+--              tasks to backend instances that serve the model and whose limits (max width,
+--              height, steps) and features cover the request. Each backend row can override the
+--              models its client declares with a JSON list of capabilities, e.g.
+--                  [{"name":"qwen-image","max_width":1024,"max_height":1024,"features":["seed"]}]
+--              An empty list keeps the models declared by the client.
+
+-- ========================================
+-- UP: Apply the schema
+-- ========================================
+
+ALTER TABLE image_tasks ADD COLUMN model TEXT NOT NULL DEFAULT '';   -- requested model, empty = any backend
+ALTER TABLE backends ADD COLUMN models TEXT NOT NULL DEFAULT '[]';   -- JSON []ModelCapability overriding the client
+
+-- ========================================
+-- DOWN: Rollback the schema
+-- ========================================
+
+-- ALTER TABLE backends DROP COLUMN models;
+-- ALTER TABLE image_tasks DROP COLUMN model;